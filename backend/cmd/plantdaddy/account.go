@@ -0,0 +1,482 @@
+package main
+
+// This file lets users take a copy of their data and delete their account
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// How often accounts past their grace period are looked for.
+const accountPurgeInterval = time.Hour
+
+var errNoPassword = errors.New("set a password with a reset link before deleting the account")
+var errNotScheduled = errors.New("account is not scheduled for deletion")
+
+// DB Query to get the account of a user.
+func getAccountDB(db *pgxpool.Pool, userID int64) (Account, error) {
+	var account Account
+	err := db.QueryRow(context.Background(), `SELECT id, username, email, email_verified, totp_enabled, password <> '',
+	COALESCE(time_zone, 'UTC'), delete_after FROM auth WHERE id = $1`, userID).Scan(&account.ID, &account.Username, &account.Email,
+		&account.EmailVerified, &account.TwoFactorEnabled, &account.HasPassword, &account.TimeZone, &account.DeleteAfter)
+	if err == pgx.ErrNoRows {
+		return Account{}, errUserNotFound
+	}
+	return account, err
+}
+
+// DB Query to schedule an account for deletion once the password has been checked.
+// Every session and api key is revoked straight away and the account can only read until it is restored,
+// the user can still sign in to restore it. Its devices stop sending data in the meantime.
+func scheduleAccountDeletion(db *pgxpool.Pool, userID int64, password string, grace time.Duration) (time.Time, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var hashed string
+	if err := tx.QueryRow(ctx, `SELECT password FROM auth WHERE id = $1 FOR UPDATE`, userID).Scan(&hashed); err != nil {
+		return time.Time{}, err
+	}
+	if hashed == "" {
+		return time.Time{}, errNoPassword
+	}
+	if !CheckPasswordHash(password, hashed) {
+		return time.Time{}, &FalseError{}
+	}
+
+	now := time.Now().UTC()
+	deleteAfter := now.Add(grace)
+	if _, err := tx.Exec(ctx, `UPDATE auth SET delete_after = $1 WHERE id = $2`, deleteAfter, userID); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE refresh_token SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`, now, userID); err != nil {
+		return time.Time{}, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE api_key SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`, now, userID); err != nil {
+		return time.Time{}, err
+	}
+	if err := bumpTokenVersion(ctx, tx, userID); err != nil {
+		return time.Time{}, err
+	}
+	return deleteAfter, tx.Commit(ctx)
+}
+
+// DB Query to cancel the deletion of an account during its grace period.
+func restoreAccount(db *pgxpool.Pool, userID int64) error {
+	tag, err := db.Exec(context.Background(), `UPDATE auth SET delete_after = NULL WHERE id = $1 AND delete_after IS NOT NULL`, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errNotScheduled
+	}
+	return nil
+}
+
+// DB Query to delete the accounts whose grace period is over and return their ids.
+// Deleting the auth row cascades through fk_user to devices, plant data and everything else the user owns.
+// Households the user was the only owner of are handed to another member, caretakers before viewers,
+// so they are not left without anyone to manage them. Households with nobody left in them are deleted.
+// The households of the deleted accounts are locked first, in order, so a member removed at the same time
+// cannot be the one they are handed to.
+func purgeDeletedAccounts(db *pgxpool.Pool, now time.Time) ([]int64, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `SELECT h.id FROM household h WHERE EXISTS (
+		SELECT 1 FROM household_member m INNER JOIN auth a ON a.id = m.user_id
+		WHERE m.household_id = h.id AND a.delete_after <= $1
+	) ORDER BY h.id FOR UPDATE`, now)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE household_member m SET role = 'owner' FROM (
+		SELECT DISTINCT ON (m.household_id) m.household_id, m.user_id
+		FROM household_member m INNER JOIN auth a ON a.id = m.user_id
+		WHERE (a.delete_after IS NULL OR a.delete_after > $1) AND EXISTS (
+			SELECT 1 FROM household_member o INNER JOIN auth d ON d.id = o.user_id
+			WHERE o.household_id = m.household_id AND o.role = 'owner' AND d.delete_after <= $1
+		) AND NOT EXISTS (
+			SELECT 1 FROM household_member o INNER JOIN auth k ON k.id = o.user_id
+			WHERE o.household_id = m.household_id AND o.role = 'owner' AND (k.delete_after IS NULL OR k.delete_after > $1)
+		)
+		ORDER BY m.household_id, m.role = 'caretaker' DESC, m.user_id
+	) heir WHERE m.household_id = heir.household_id AND m.user_id = heir.user_id`, now)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, `DELETE FROM household h WHERE EXISTS (
+		SELECT 1 FROM household_member m INNER JOIN auth a ON a.id = m.user_id
+		WHERE m.household_id = h.id AND a.delete_after <= $1
+	) AND NOT EXISTS (
+		SELECT 1 FROM household_member m INNER JOIN auth a ON a.id = m.user_id
+		WHERE m.household_id = h.id AND (a.delete_after IS NULL OR a.delete_after > $1)
+	)`, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// The probes of the deleted accounts can be claimed with the codes on their boxes again
+	_, err = tx.Exec(ctx, `UPDATE manufactured_device SET claimed_at = NULL WHERE device_id IN (
+		SELECT r.device_id FROM registered_devices r INNER JOIN auth a ON a.id = r.user_id WHERE a.delete_after <= $1
+	)`, now)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, `DELETE FROM auth WHERE delete_after <= $1 RETURNING id`, now)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit(ctx)
+}
+
+// This function deletes accounts past their grace period every accountPurgeInterval until the context is done.
+func runAccountPurge(ctx context.Context, db *pgxpool.Pool) {
+	ticker := time.NewTicker(accountPurgeInterval)
+	defer ticker.Stop()
+	for {
+		ids, err := purgeDeletedAccounts(db, time.Now().UTC())
+		if err != nil {
+			log.Printf("purging deleted accounts: %s", err)
+		}
+		for _, id := range ids {
+			log.Printf("deleted account %d", id)
+			if err := insertAuditEvent(db, AuditEvent{UserID: id, Action: auditAccountDelete}, 0, "", ""); err != nil {
+				log.Printf("audit %s: %s", auditAccountDelete, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// This function writes a file holding json to the export.
+func writeZipJSON(archive *zip.Writer, name string, v interface{}) error {
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// A json array written one element at a time, so it never has to fit in memory.
+type jsonArrayWriter struct {
+	w     io.Writer
+	count int
+}
+
+func (a *jsonArrayWriter) add(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	separator := ",\n  "
+	if a.count == 0 {
+		separator = "[\n  "
+	}
+	a.count++
+	if _, err := io.WriteString(a.w, separator); err != nil {
+		return err
+	}
+	_, err = a.w.Write(data)
+	return err
+}
+
+func (a *jsonArrayWriter) close() error {
+	end := "\n]\n"
+	if a.count == 0 {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(a.w, end)
+	return err
+}
+
+// The readings of the account export as a json array.
+type jsonArrayReadingWriter struct {
+	array *jsonArrayWriter
+}
+
+func (j jsonArrayReadingWriter) Write(row exportRow) error {
+	return j.array.add(row.exported(time.UTC))
+}
+
+func (j jsonArrayReadingWriter) Close() error {
+	return j.array.close()
+}
+
+// This function writes every reading of the devices the user owns to the export as csv and as json,
+// in UTC and the units probes measure in. Devices shared with the user are left out, their readings belong
+// to someone else. The rows are read once and streamed, the csv into the zip and the json into a temporary
+// file that follows it, since a zip is written one file at a time.
+func writeZipReadings(archive *zip.Writer, db *pgxpool.Pool, userID int64) error {
+	ctx := context.Background()
+	options := exportOptions{Format: "csv", Location: time.UTC, Units: readingUnits{Temperature: unitCelsius, Percent: unitPercent}}
+	var err error
+	if options.Metrics, err = getExtraMetrics(ctx, db); err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp("", "plant_data-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: "plant_data.csv", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(temp)
+	writers := []readingWriter{newReadingWriter(file, options), jsonArrayReadingWriter{&jsonArrayWriter{w: buffered}}}
+
+	rows, err := db.Query(ctx, `SELECT `+exportRowColumns+` FROM plant_data p
+	INNER JOIN registered_devices r ON r.device_id = p.device_id
+	WHERE r.user_id = $1 ORDER BY p.device_id, p.time, p.id`, userID)
+	if err != nil {
+		return err
+	}
+	_, err = eachExportRow(rows, options.Units, func(row exportRow) error {
+		for _, writer := range writers {
+			if err := writer.Write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, writer := range writers {
+		if err := writer.Close(); err != nil {
+			return err
+		}
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+
+	if _, err := temp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	file, err = archive.CreateHeader(&zip.FileHeader{Name: "plant_data.json", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, temp)
+	return err
+}
+
+// This function writes the audit log of the user to the export a page at a time.
+func writeZipAuditLog(archive *zip.Writer, db *pgxpool.Pool, userID int64) error {
+	file, err := archive.CreateHeader(&zip.FileHeader{Name: "audit_log.json", Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	entries := &jsonArrayWriter{w: file}
+	var before int64
+	for {
+		page, err := getAuditLogDB(db, userID, before, maxAuditLimit)
+		if err != nil {
+			return err
+		}
+		for _, entry := range page {
+			if err := entries.add(entry); err != nil {
+				return err
+			}
+		}
+		if len(page) < maxAuditLimit {
+			return entries.close()
+		}
+		before = page[len(page)-1].ID
+	}
+}
+
+// Everything we hold about a user apart from their readings and audit log, which are streamed.
+type accountExport struct {
+	profile AccountExport
+	devices []Device
+}
+
+// DB Query to get everything we hold about a user apart from their readings and audit log.
+func getAccountExport(db *pgxpool.Pool, userID int64) (accountExport, error) {
+	var export accountExport
+	account, err := getAccountDB(db, userID)
+	if err != nil {
+		return accountExport{}, err
+	}
+	export.profile.Account = account
+	if export.profile.Households, err = getHouseholdsDB(db, userID); err != nil {
+		return accountExport{}, err
+	}
+	if export.profile.Identities, err = getIdentitiesDB(db, userID); err != nil {
+		return accountExport{}, err
+	}
+	if export.profile.APIKeys, err = getAPIKeysDB(db, userID); err != nil {
+		return accountExport{}, err
+	}
+	if export.devices, err = getDevicesDB(db, userID); err != nil {
+		return accountExport{}, err
+	}
+	return export, nil
+}
+
+// This function writes the export of a user to w as a zip, followed by their audit log and readings.
+func writeAccountExport(w io.Writer, db *pgxpool.Pool, userID int64, export accountExport) error {
+	archive := zip.NewWriter(w)
+	if err := writeZipJSON(archive, "profile.json", export.profile); err != nil {
+		return err
+	}
+	if err := writeZipJSON(archive, "devices.json", export.devices); err != nil {
+		return err
+	}
+	if err := writeZipAuditLog(archive, db, userID); err != nil {
+		return err
+	}
+	if err := writeZipReadings(archive, db, userID); err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+// HTTP Call to get the account of the user or, with DELETE and the password, schedule it for deletion
+func (api *API) account(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	switch r.Method {
+	case "GET":
+		account, err := getAccountDB(api.db, currentUser(r).ID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(account)
+
+	case "DELETE":
+		var request DeleteAccount
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+
+		// The password is checked so a stolen access token cannot delete the account
+		user := currentUser(r)
+		keys := api.accountKeys(r, user.ID)
+		if !api.allowLoginAttempt(w, r, keys) {
+			return
+		}
+
+		deleteAfter, err := scheduleAccountDeletion(api.db, user.ID, request.Password, api.accountDeletionGrace)
+		var falseError *FalseError
+		switch {
+		case errors.As(err, &falseError):
+			unauthorized(w, err.Error())
+			return
+		case errors.Is(err, errNoPassword):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		api.recordLoginSuccess(r, keys)
+		api.audit(r, AuditEvent{Action: auditAccountDeletion, After: map[string]time.Time{"deleteAfter": deleteAfter}})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]time.Time{"deleteAfter": deleteAfter})
+	}
+}
+
+// HTTP Call to cancel the deletion of the account during its grace period
+func (api *API) restoreAccount(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		err := restoreAccount(api.db, currentUser(r).ID)
+		if errors.Is(err, errNotScheduled) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditAccountRestore})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HTTP Call to download a zip of everything we hold about the user
+func (api *API) exportAccount(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		// Large exports take longer than the server write timeout
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			log.Printf("%s", err)
+		}
+
+		user := currentUser(r)
+		export, err := getAccountExport(api.db, user.ID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="plantdaddy-%d.zip"`, user.ID))
+		w.Header().Set("Cache-Control", "no-store")
+
+		// Once the zip has started the status cannot be changed, so a failure can only be logged
+		if err := writeAccountExport(w, api.db, user.ID, export); err != nil {
+			log.Printf("export for user %d: %s", user.ID, err)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditAccountExport})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONArrayWriter(t *testing.T) {
+	tests := []struct {
+		values []interface{}
+		want   string
+	}{
+		{nil, "[]\n"},
+		{[]interface{}{1}, "[\n  1\n]\n"},
+		{[]interface{}{map[string]int{"a": 1}, "b"}, "[\n  {\"a\":1},\n  \"b\"\n]\n"},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		array := &jsonArrayWriter{w: &out}
+		for _, v := range test.values {
+			if err := array.add(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := array.close(); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != test.want {
+			t.Errorf("got %q, want %q", out.String(), test.want)
+		}
+		var decoded []interface{}
+		if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded) != len(test.values) {
+			t.Errorf("%q is not an array of %d: %v", out.String(), len(test.values), err)
+		}
+	}
+}
+
+// scheduleDeletion schedules the account of the user for deletion through the api.
+func scheduleDeletion(t *testing.T, api *API, user AuthUser, password string) {
+	t.Helper()
+	w := doJSON(t, asUser(api, user, api.account), "DELETE", "/api/account", DeleteAccount{Password: password}, nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestAccountPendingDeletionIsReadOnly(t *testing.T) {
+	api, _ := testAPI(t)
+	password := "correct horse battery"
+	user := AuthUser{Username: uniqueName(t, "leaving")}
+	user.ID = createUser(t, api, user.Username, password)
+	deviceID := createDevice(t, api, user.ID)
+
+	oldToken := bearerHeader(t, api, user)
+	scheduleDeletion(t, api, user, password)
+
+	read := api.authenticate(scopeAccount, api.account)
+	if w := doJSON(t, read, "GET", "/api/account", nil, oldToken); w.Code != http.StatusUnauthorized {
+		t.Errorf("a token from before the deletion got %d", w.Code)
+	}
+
+	// Signing in again gives a token that can read but not change anything
+	token := bearerHeader(t, api, user)
+	if w := doJSON(t, read, "GET", "/api/account", nil, token); w.Code != http.StatusOK {
+		t.Errorf("reading the account got %d", w.Code)
+	}
+	households := api.authenticate(scopeAccount, api.households)
+	if w := doJSON(t, households, "POST", "/api/households", NewHousehold{Name: "Home"}, token); w.Code != http.StatusForbidden {
+		t.Errorf("a change got %d, want %d", w.Code, http.StatusForbidden)
+	}
+	if _, err := getDeviceSecret(api.db, deviceID); err != errBadSignature {
+		t.Errorf("the device can still send data: %v", err)
+	}
+
+	restore := api.authenticatePendingDeletion(scopeAccount, api.restoreAccount)
+	if w := doJSON(t, restore, "POST", "/api/account/restore", nil, token); w.Code != http.StatusNoContent {
+		t.Fatalf("restore: %d %s", w.Code, w.Body)
+	}
+	if w := doJSON(t, households, "POST", "/api/households", NewHousehold{Name: "Home"}, token); w.Code != http.StatusCreated {
+		t.Errorf("a change after restoring got %d", w.Code)
+	}
+	if _, err := getDeviceSecret(api.db, deviceID); err != nil {
+		t.Errorf("the device cannot send data after restoring: %v", err)
+	}
+}
+
+func TestPurgeHandsOverHouseholds(t *testing.T) {
+	api, _ := testAPI(t)
+	users := map[string]AuthUser{}
+	for _, name := range []string{"owner", "caretaker", "viewer", "loner"} {
+		user := AuthUser{Username: uniqueName(t, name)}
+		user.ID = createUser(t, api, user.Username, "correct horse battery")
+		users[name] = user
+	}
+	shared := setUpHousehold(t, api, users["owner"], users["viewer"], roleViewer)
+	w := doJSON(t, asUser(api, users["owner"], api.inviteMember), "POST", "/api/households/invite",
+		NewInvitation{HouseholdID: shared, Username: users["caretaker"].Username, Role: roleCaretaker}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("invite: %d %s", w.Code, w.Body)
+	}
+	invitations, err := getInvitationsDB(api.db, users["caretaker"].ID)
+	if err != nil || len(invitations) != 1 {
+		t.Fatalf("got invitations %+v: %v", invitations, err)
+	}
+	if err := answerInvitation(api.db, users["caretaker"].ID, invitations[0].ID, true); err != nil {
+		t.Fatal(err)
+	}
+
+	w = doJSON(t, asUser(api, users["loner"], api.households), "POST", "/api/households", NewHousehold{Name: "Alone"}, nil)
+	var alone Household
+	if err := json.NewDecoder(w.Body).Decode(&alone); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the two accounts are past their grace period
+	now := time.Now().UTC()
+	_, err = api.db.Exec(context.Background(), `UPDATE auth SET delete_after = $1 WHERE id = ANY($2)`,
+		now.Add(-time.Minute), []int64{users["owner"].ID, users["loner"].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := purgeDeletedAccounts(api.db, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purged := map[int64]bool{}
+	for _, id := range ids {
+		purged[id] = true
+	}
+	if !purged[users["owner"].ID] || !purged[users["loner"].ID] || purged[users["caretaker"].ID] {
+		t.Errorf("purged %v", ids)
+	}
+
+	if role, err := householdRole(context.Background(), api.db, shared, users["caretaker"].ID); err != nil || role != roleOwner {
+		t.Errorf("the caretaker is %q of the shared household: %v", role, err)
+	}
+	if role, err := householdRole(context.Background(), api.db, shared, users["viewer"].ID); err != nil || role != roleViewer {
+		t.Errorf("the viewer is %q of the shared household: %v", role, err)
+	}
+	var exists bool
+	if err := api.db.QueryRow(context.Background(), `SELECT EXISTS(SELECT 1 FROM household WHERE id = $1)`, alone.ID).Scan(&exists); err != nil || exists {
+		t.Errorf("the empty household was kept: %v", err)
+	}
+}
+
+func TestAccountExport(t *testing.T) {
+	api, _ := testAPI(t)
+	owner := AuthUser{Username: uniqueName(t, "exporter")}
+	owner.ID = createUser(t, api, owner.Username, "correct horse battery")
+	friend := AuthUser{Username: uniqueName(t, "friend")}
+	friend.ID = createUser(t, api, friend.Username, "correct horse battery")
+
+	// The export holds the readings of the devices of the user, not those shared with them
+	householdID := setUpHousehold(t, api, friend, owner, roleViewer)
+	own := createDevice(t, api, owner.ID)
+	shared := createDevice(t, api, friend.ID)
+	if err := setDeviceHousehold(api.db, friend.ID, shared, &householdID); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, deviceID := range []string{own, shared} {
+		_, err := api.db.Exec(context.Background(), `INSERT INTO plant_data(device_id, temperature, humidity, soil_moisture, light, time)
+		VALUES ($1, 21.5, 40, 55, 300, $2)`, deviceID, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Old probes did not send a time
+	if _, err := api.db.Exec(context.Background(), `INSERT INTO plant_data(device_id, temperature) VALUES ($1, 20)`, own); err != nil {
+		t.Fatal(err)
+	}
+
+	w := doJSON(t, asUser(api, owner, api.exportAccount), "GET", "/api/account/export", nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("export: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name], _ = io.ReadAll(f)
+		f.Close()
+	}
+
+	var profile AccountExport
+	if err := json.Unmarshal(files["profile.json"], &profile); err != nil || profile.Username != owner.Username {
+		t.Errorf("got profile %s: %v", files["profile.json"], err)
+	}
+	var auditLog []AuditEntry
+	if err := json.Unmarshal(files["audit_log.json"], &auditLog); err != nil || len(auditLog) == 0 {
+		t.Errorf("got audit log %s: %v", files["audit_log.json"], err)
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(files["plant_data.csv"])).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Metrics other tests registered may follow the legacy columns
+	if len(records) != 3 || !strings.HasPrefix(strings.Join(records[0], ","), "deviceID,time,temperature,humidity,soilMoisture,light") {
+		t.Fatalf("got csv %q", records)
+	}
+	if record := records[1]; record[0] != own || record[1] != "2021-06-01T12:00:00Z" || record[2] != "21.5" {
+		t.Errorf("got csv row %q", record)
+	}
+	if record := records[2]; record[0] != own || record[1] != "" || record[2] != "20" {
+		t.Errorf("got csv row %q", record)
+	}
+
+	var readings []ExportedReading
+	if err := json.Unmarshal(files["plant_data.json"], &readings); err != nil {
+		t.Fatal(err)
+	}
+	if len(readings) != 2 || readings[0].DeviceID != own || readings[0].Time == nil || !readings[0].Time.Equal(at) ||
+		readings[1].DeviceID != own || readings[1].Time != nil {
+		t.Errorf("got readings %s", files["plant_data.json"])
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+// This file handles the personal api keys users make for their own scripts
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// What a token is allowed to do. Tokens from the app may do everything,
+// api keys only what they were made with.
+type scope string
+
+const (
+	scopeReadReadings  scope = "read-readings"
+	scopeManageDevices scope = "manage-devices"
+	scopeWriteNotes    scope = "write-notes"
+	// Managing the account itself, which is never given to api keys.
+	scopeAccount scope = "account"
+)
+
+// The scopes an api key may be made with.
+var apiKeyScopes = []scope{scopeReadReadings, scopeManageDevices, scopeWriteNotes}
+
+// Every api key starts with this so the middleware can tell it apart from an access token.
+const apiKeyPrefix = "pd_"
+
+var errInvalidAPIKey = errors.New("api key is invalid or has been revoked")
+var errKeyNotFound = errors.New("api key not found")
+
+// This function checks that every requested scope can be given to an api key.
+func validScopes(scopes []string) bool {
+	if len(scopes) == 0 {
+		return false
+	}
+	for _, requested := range scopes {
+		found := false
+		for _, allowed := range apiKeyScopes {
+			if scope(requested) == allowed {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// This function checks if the user may use a scope.
+func (user AuthUser) can(s scope) bool {
+	if user.APIKeyID == 0 {
+		return true
+	}
+	for _, granted := range user.Scopes {
+		if scope(granted) == s {
+			return true
+		}
+	}
+	return false
+}
+
+// DB Query to create an api key. The key is returned in full, only its hash is stored.
+func insertAPIKey(db *pgxpool.Pool, userID int64, request NewAPIKey) (APIKey, string, error) {
+	id, err := generateRandomBytes(4)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return APIKey{}, "", err
+	}
+
+	key := APIKey{
+		Name:      request.Name,
+		Prefix:    apiKeyPrefix + strings.ToLower(totpEncoding.EncodeToString(id)),
+		Scopes:    request.Scopes,
+		CreatedAt: time.Now().UTC(),
+	}
+	token := key.Prefix + "_" + secret
+
+	err = db.QueryRow(context.Background(), `INSERT INTO api_key(user_id, name, prefix, key_hash, scopes, created_at)
+	VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`, userID, key.Name, key.Prefix, hashToken(token), key.Scopes, key.CreatedAt).Scan(&key.ID)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	return key, token, nil
+}
+
+// DB Query to get the api keys of a user that have not been revoked.
+func getAPIKeysDB(db *pgxpool.Pool, userID int64) ([]APIKey, error) {
+	rows, err := db.Query(context.Background(), `SELECT id, name, prefix, scopes, created_at, last_used_at
+	FROM api_key WHERE user_id = $1 AND revoked_at IS NULL ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, &key.Scopes, &key.CreatedAt, &key.LastUsedAt); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// DB Query to revoke one of the api keys of a user.
+func revokeAPIKey(db *pgxpool.Pool, userID int64, keyID int64) error {
+	tag, err := db.Exec(context.Background(), `UPDATE api_key SET revoked_at = $1
+	WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`, time.Now().UTC(), keyID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errKeyNotFound
+	}
+	return nil
+}
+
+// DB Query to find the user an api key belongs to and record that it was used.
+// Keys of accounts scheduled for deletion do not work.
+func lookupAPIKey(db *pgxpool.Pool, token string) (AuthUser, error) {
+	var user AuthUser
+	row := db.QueryRow(context.Background(), `UPDATE api_key k SET last_used_at = $1
+	FROM auth a WHERE a.id = k.user_id AND k.key_hash = $2 AND k.revoked_at IS NULL AND a.delete_after IS NULL
+	RETURNING k.id, a.id, a.username, k.scopes`, time.Now().UTC(), hashToken(token))
+
+	err := row.Scan(&user.APIKeyID, &user.ID, &user.Username, &user.Scopes)
+	if err == pgx.ErrNoRows {
+		return AuthUser{}, errInvalidAPIKey
+	}
+	return user, err
+}
+
+// HTTP Call to list the api keys of the user or make a new one
+func (api *API) apiKeys(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	switch r.Method {
+	case "GET":
+		keys, err := getAPIKeysDB(api.db, currentUser(r).ID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(keys)
+
+	case "POST":
+		var request NewAPIKey
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+		if request.Name == "" {
+			http.Error(w, "Must provide name", http.StatusBadRequest)
+			return
+		}
+		if !validScopes(request.Scopes) {
+			http.Error(w, "scopes must be some of read-readings, manage-devices and write-notes", http.StatusBadRequest)
+			return
+		}
+
+		key, token, err := insertAPIKey(api.db, currentUser(r).ID, request)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditKeyCreate, After: key})
+		key.Key = token
+
+		// The key is only ever shown here
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(key)
+
+	case "DELETE":
+		keyID, err := strconv.ParseInt(r.URL.Query().Get("keyID"), 10, 64)
+		if err != nil {
+			http.Error(w, "Must provide keyID", http.StatusBadRequest)
+			return
+		}
+
+		err = revokeAPIKey(api.db, currentUser(r).ID, keyID)
+		if errors.Is(err, errKeyNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditKeyRevoke, Before: map[string]int64{"keyID": keyID}})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
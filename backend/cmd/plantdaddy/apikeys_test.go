@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestValidScopes(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		want   bool
+	}{
+		{[]string{"read-readings"}, true},
+		{[]string{"read-readings", "manage-devices", "write-notes"}, true},
+		{[]string{"account"}, false},
+		{[]string{"read-readings", "admin"}, false},
+		{[]string{}, false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		if got := validScopes(test.scopes); got != test.want {
+			t.Errorf("validScopes(%q) = %v, want %v", test.scopes, got, test.want)
+		}
+	}
+}
+
+func TestUserCan(t *testing.T) {
+	app := AuthUser{ID: 1}
+	key := AuthUser{ID: 1, APIKeyID: 2, Scopes: []string{"read-readings"}}
+	tests := []struct {
+		name  string
+		user  AuthUser
+		scope scope
+		want  bool
+	}{
+		{"app token reads", app, scopeReadReadings, true},
+		{"app token manages the account", app, scopeAccount, true},
+		{"key with the scope", key, scopeReadReadings, true},
+		{"key without the scope", key, scopeManageDevices, false},
+		{"key managing the account", key, scopeAccount, false},
+	}
+
+	for _, test := range tests {
+		if got := test.user.can(test.scope); got != test.want {
+			t.Errorf("%s: can(%s) = %v, want %v", test.name, test.scope, got, test.want)
+		}
+	}
+}
+
+func TestAuthenticateRequiresABearerToken(t *testing.T) {
+	api := &API{tokenSecret: []byte("test secret")}
+	handler := api.authenticate(scopeReadReadings, func(w http.ResponseWriter, r *http.Request) {
+		t.Error("the handler was called")
+	})
+
+	for _, header := range []string{"", "Basic abc", "Bearer not-a-token"} {
+		r := httptest.NewRequest("GET", "/api/devices", nil)
+		if header != "" {
+			r.Header.Set("Authorization", header)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+			t.Errorf("%q got %d with challenge %q", header, w.Code, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
+
+func TestAPIKeyLifecycle(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "scripter")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+
+	w := doJSON(t, asUser(api, user, api.apiKeys), "POST", "/api/keys", NewAPIKey{Name: "graphs", Scopes: []string{"read-readings"}}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", w.Code, w.Body)
+	}
+	var key APIKey
+	if err := json.NewDecoder(w.Body).Decode(&key); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key.Key, key.Prefix+"_") || !strings.HasPrefix(key.Prefix, apiKeyPrefix) {
+		t.Fatalf("got key %q with prefix %q", key.Key, key.Prefix)
+	}
+
+	call := func(s scope) int {
+		handler := api.authenticate(s, func(w http.ResponseWriter, r *http.Request) {
+			if got := currentUser(r); got.ID != user.ID || got.APIKeyID != key.ID {
+				t.Errorf("handler called as %+v", got)
+			}
+		})
+		r := httptest.NewRequest("GET", "/api/devices", nil)
+		r.Header.Set("Authorization", "Bearer "+key.Key)
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w.Code
+	}
+
+	if code := call(scopeReadReadings); code != http.StatusOK {
+		t.Errorf("a granted scope got %d", code)
+	}
+	if code := call(scopeManageDevices); code != http.StatusForbidden {
+		t.Errorf("a missing scope got %d", code)
+	}
+	if code := call(scopeAccount); code != http.StatusForbidden {
+		t.Errorf("the account scope got %d", code)
+	}
+
+	keys, err := getAPIKeysDB(api.db, user.ID)
+	if err != nil || len(keys) != 1 || keys[0].LastUsedAt == nil {
+		t.Errorf("got keys %+v: %v", keys, err)
+	}
+
+	w = doJSON(t, asUser(api, user, api.apiKeys), "DELETE", "/api/keys?keyID="+strconv.FormatInt(key.ID, 10), nil, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("revoke: %d %s", w.Code, w.Body)
+	}
+	if code := call(scopeReadReadings); code != http.StatusUnauthorized {
+		t.Errorf("a revoked key got %d", code)
+	}
+	w = doJSON(t, asUser(api, user, api.apiKeys), "DELETE", "/api/keys?keyID="+strconv.FormatInt(key.ID, 10), nil, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("revoking twice got %d", w.Code)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+// This file records who did what to an account or device, so destructive changes can be traced
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// The actions written to the audit log.
+const (
+	auditLogin           = "login"
+	auditLoginFailed     = "login.failed"
+	auditPasswordReset   = "password.reset"
+	auditLogOutAll       = "logout.all"
+	auditTOTPEnabled     = "2fa.enabled"
+	auditTOTPDisabled    = "2fa.disabled"
+	auditDeviceRegister  = "device.registered"
+	auditDeviceRename    = "device.renamed"
+	auditDeviceDelete    = "device.deleted"
+	auditDeviceSecret    = "device.secret.rotated"
+	auditDeviceShare     = "device.shared"
+	auditDeviceUnshare   = "device.unshared"
+	auditDeviceTransfer  = "device.transfer.offered"
+	auditDeviceAccepted  = "device.transfer.accepted"
+	auditDeviceClaim     = "device.claimed"
+	auditDeviceImport    = "device.readings.imported"
+	auditHouseholdCreate = "household.created"
+	auditMemberInvite    = "household.member.invited"
+	auditMemberJoin      = "household.member.joined"
+	auditMemberRemove    = "household.member.removed"
+	auditKeyCreate       = "apikey.created"
+	auditKeyRevoke       = "apikey.revoked"
+	auditIdentityLink    = "identity.linked"
+	auditIdentityUnlink  = "identity.unlinked"
+	auditAccountExport   = "account.exported"
+	auditAccountDeletion = "account.deletion.scheduled"
+	auditAccountRestore  = "account.restored"
+	auditAccountDelete   = "account.deleted"
+)
+
+const defaultAuditLimit = 50
+const maxAuditLimit = 200
+
+// Something that happened to an account or a device.
+type AuditEvent struct {
+	// The account the event belongs to. For device events this is the owner of the device.
+	// Zero when it is not known, such as a failed login for a username that does not exist.
+	UserID int64
+	// The user that did it. When zero it is taken from the request.
+	ActorID  int64
+	Action   string
+	DeviceID string
+	Before   interface{}
+	After    interface{}
+}
+
+// The parts of a device that are recorded when it is changed.
+type deviceState struct {
+	DeviceName  string `json:"deviceName"`
+	HouseholdID *int64 `json:"householdID,omitempty"`
+	Readings    int64  `json:"readings"`
+}
+
+// This function writes an event to the audit log.
+// A failure is logged but does not fail the request, the change has already been made.
+func (api *API) audit(r *http.Request, event AuditEvent) {
+	user := currentUser(r)
+	if event.ActorID == 0 {
+		event.ActorID = user.ID
+	}
+	if event.UserID == 0 && event.Action != auditLoginFailed {
+		event.UserID = event.ActorID
+	}
+
+	if err := insertAuditEvent(api.db, event, user.APIKeyID, api.clientIP(r), r.UserAgent()); err != nil {
+		log.Printf("audit %s: %s", event.Action, err)
+	}
+}
+
+// This function returns nil for a zero id so that it is stored as NULL.
+func nullID(id int64) *int64 {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+// This function returns nil for an empty string so that it is stored as NULL.
+func nullString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// DB Query to append an event to the audit log.
+func insertAuditEvent(db *pgxpool.Pool, event AuditEvent, apiKeyID int64, ip string, userAgent string) error {
+	_, err := db.Exec(context.Background(), `INSERT INTO audit_log(user_id, actor_id, api_key_id, action, device_id,
+	ip, user_agent, before, after, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		nullID(event.UserID), nullID(event.ActorID), nullID(apiKeyID), event.Action, nullString(event.DeviceID),
+		nullString(ip), nullString(userAgent), event.Before, event.After, time.Now().UTC())
+	return err
+}
+
+// DB Query to find the account a login was attempted against, or zero if there is none.
+func loginAccountID(db *pgxpool.Pool, username string) int64 {
+	var id int64
+	err := db.QueryRow(context.Background(), `SELECT id FROM auth
+	WHERE LOWER(username)=LOWER($1) OR (LOWER(email)=LOWER($1) AND email_verified)
+	ORDER BY LOWER(username)=LOWER($1) DESC LIMIT 1`, username).Scan(&id)
+	if err != nil && err != pgx.ErrNoRows {
+		log.Printf("%s", err)
+	}
+	return id
+}
+
+// DB Query to get the owner of a device and the state that is recorded when it changes.
+func getDeviceState(db *pgxpool.Pool, deviceID string) (int64, deviceState, error) {
+	var ownerID int64
+	var state deviceState
+	err := db.QueryRow(context.Background(), `SELECT r.user_id, r.device_name, r.household_id,
+	(SELECT COUNT(*) FROM plant_data p WHERE p.device_id = r.device_id)
+	FROM registered_devices r WHERE r.device_id = $1`, deviceID).Scan(&ownerID, &state.DeviceName, &state.HouseholdID, &state.Readings)
+	if err == pgx.ErrNoRows {
+		return 0, deviceState{}, errDeviceNotFound
+	}
+	return ownerID, state, err
+}
+
+// DB Query to get a page of the audit log of a user, newest first.
+// It holds the events of their account and devices and everything they did themselves.
+// The address and browser are only given for what the user did, not for what others did to their account or devices.
+func getAuditLogDB(db *pgxpool.Pool, userID int64, before int64, limit int) ([]AuditEntry, error) {
+	if before <= 0 {
+		before = 1<<63 - 1
+	}
+	rows, err := db.Query(context.Background(), `SELECT l.id, l.action, a.username, l.api_key_id, l.device_id,
+	CASE WHEN l.actor_id = $1 THEN l.ip END, CASE WHEN l.actor_id = $1 THEN l.user_agent END,
+	l.before, l.after, l.created_at
+	FROM audit_log l LEFT JOIN auth a ON a.id = l.actor_id
+	WHERE (l.user_id = $1 OR l.actor_id = $1) AND l.id < $2
+	ORDER BY l.id DESC LIMIT $3`, userID, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var before, after []byte
+		err := rows.Scan(&entry.ID, &entry.Action, &entry.Actor, &entry.APIKeyID, &entry.DeviceID,
+			&entry.IP, &entry.UserAgent, &before, &after, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		entry.Before = json.RawMessage(before)
+		entry.After = json.RawMessage(after)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// HTTP Call to page through the audit log of the user, pass the id of the last entry as before to get the next page
+func (api *API) getAuditLog(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		var before int64
+		if value := r.URL.Query().Get("before"); value != "" {
+			var err error
+			if before, err = strconv.ParseInt(value, 10, 64); err != nil {
+				http.Error(w, "before must be an entry id", http.StatusBadRequest)
+				return
+			}
+		}
+
+		limit := defaultAuditLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit <= 0 || limit > maxAuditLimit {
+				http.Error(w, "limit must be between 1 and "+strconv.Itoa(maxAuditLimit), http.StatusBadRequest)
+				return
+			}
+		}
+
+		entries, err := getAuditLogDB(api.db, currentUser(r).ID, before, limit)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}
+}
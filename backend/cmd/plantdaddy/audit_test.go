@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestNullValues(t *testing.T) {
+	if nullID(0) != nil {
+		t.Error("nullID(0) is not nil")
+	}
+	if id := nullID(7); id == nil || *id != 7 {
+		t.Errorf("nullID(7) = %v", id)
+	}
+	if nullString("") != nil {
+		t.Error(`nullString("") is not nil`)
+	}
+	if s := nullString("ip"); s == nil || *s != "ip" {
+		t.Errorf(`nullString("ip") = %v`, s)
+	}
+}
+
+func TestGetAuditLogRejectsBadPages(t *testing.T) {
+	api := &API{}
+	for _, query := range []string{"before=abc", "limit=0", "limit=-1", "limit=" + strconv.Itoa(maxAuditLimit+1), "limit=ten"} {
+		w := doJSON(t, asUser(api, AuthUser{ID: 1}, api.getAuditLog), "GET", "/api/audit-log?"+query, nil, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s got %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestAuditLogPages(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "audited")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+
+	r := httptest.NewRequest("POST", "/api/households", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("User-Agent", "audit test")
+	r = asUserRequest(r, user)
+	for i := 0; i < 3; i++ {
+		api.audit(r, AuditEvent{Action: auditHouseholdCreate, After: map[string]int{"n": i}})
+	}
+
+	var seen []AuditEntry
+	before := ""
+	for page := 0; page < 10; page++ {
+		w := doJSON(t, asUser(api, user, api.getAuditLog), "GET", "/api/audit-log?limit=2"+before, nil, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("page %d: %d %s", page, w.Code, w.Body)
+		}
+		var entries []AuditEntry
+		if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		seen = append(seen, entries...)
+		before = "&before=" + strconv.FormatInt(entries[len(entries)-1].ID, 10)
+	}
+
+	var created []AuditEntry
+	for _, entry := range seen {
+		if entry.Action == auditHouseholdCreate {
+			created = append(created, entry)
+		}
+	}
+	if len(created) != 3 {
+		t.Fatalf("got %d of the 3 events", len(created))
+	}
+	for i, entry := range created {
+		var after map[string]int
+		if err := json.Unmarshal(entry.After, &after); err != nil || after["n"] != 2-i {
+			t.Errorf("entry %d is %s, want newest first", i, entry.After)
+		}
+		if entry.Actor == nil || *entry.Actor != user.Username || entry.IP == nil || *entry.IP != "192.0.2.1" {
+			t.Errorf("entry %d was recorded as %+v", i, entry)
+		}
+	}
+}
+
+func TestAuditLogHidesWhereOthersActedFrom(t *testing.T) {
+	api, _ := testAPI(t)
+	owner := AuthUser{Username: uniqueName(t, "owner")}
+	owner.ID = createUser(t, api, owner.Username, "correct horse battery")
+	member := AuthUser{Username: uniqueName(t, "member")}
+	member.ID = createUser(t, api, member.Username, "correct horse battery")
+
+	// The member renames a device of the owner from their own phone
+	r := httptest.NewRequest("POST", "/api/rename-device", nil)
+	r.RemoteAddr = "192.0.2.7:1234"
+	r.Header.Set("User-Agent", "the member's phone")
+	api.audit(asUserRequest(r, member), AuditEvent{UserID: owner.ID, Action: auditDeviceRename})
+
+	tests := []struct {
+		name    string
+		user    AuthUser
+		visible bool
+	}{
+		{"owner", owner, false},
+		{"actor", member, true},
+	}
+	for _, test := range tests {
+		entries, err := getAuditLogDB(api.db, test.user.ID, 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Actor == nil || *entries[0].Actor != member.Username {
+			t.Fatalf("%s: got %+v", test.name, entries)
+		}
+		if visible := entries[0].IP != nil && entries[0].UserAgent != nil; visible != test.visible {
+			t.Errorf("%s: got address %v and browser %v", test.name, entries[0].IP, entries[0].UserAgent)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+// This file holds the middleware used to authenticate calls to the app api
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+type contextKey string
+
+const userContextKey contextKey = "user"
+
+var errDeletionPending = errors.New("account is scheduled for deletion, restore it to make changes")
+
+// The user that made the current request.
+type AuthUser struct {
+	ID       int64
+	Username string
+	// Set when the request was made with an api key rather than from the app.
+	APIKeyID int64
+	Scopes   []string
+	// The token version of the user when the access token was issued.
+	TokenVersion int64
+}
+
+// This function wraps a handler so that it can only be called with a valid access token
+// or an api key that has the scope.
+// The user the token was issued to is placed in the request context.
+// An account scheduled for deletion may only make GET requests until it is restored.
+func (api *API) authenticate(s scope, next http.HandlerFunc) http.HandlerFunc {
+	return api.authenticateUser(s, false, next)
+}
+
+// This function is authenticate for the calls an account scheduled for deletion may still make,
+// such as restoring it.
+func (api *API) authenticatePendingDeletion(s scope, next http.HandlerFunc) http.HandlerFunc {
+	return api.authenticateUser(s, true, next)
+}
+
+func (api *API) authenticateUser(s scope, allowPending bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			unauthorized(w, "Must provide a bearer token")
+			return
+		}
+
+		var user AuthUser
+		if strings.HasPrefix(token, apiKeyPrefix) {
+			var err error
+			user, err = lookupAPIKey(api.db, token)
+			if errors.Is(err, errInvalidAPIKey) {
+				unauthorized(w, err.Error())
+				return
+			} else if err != nil {
+				log.Printf("%s", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			claims, err := verifyAccessToken(api.tokenSecret, token, time.Now())
+			if err != nil {
+				log.Printf("%s", err)
+				unauthorized(w, err.Error())
+				return
+			}
+			user = AuthUser{ID: claims.UserID, Username: claims.Username, TokenVersion: claims.Version}
+
+			version, pending, err := getTokenState(r.Context(), api.db, user.ID)
+			if err == pgx.ErrNoRows || (err == nil && version != user.TokenVersion) {
+				unauthorized(w, errRevokedToken.Error())
+				return
+			} else if err != nil {
+				log.Printf("%s", err)
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				return
+			}
+			if pending && !allowPending && r.Method != "GET" {
+				http.Error(w, errDeletionPending.Error(), http.StatusForbidden)
+				return
+			}
+		}
+
+		if !user.can(s) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="plantdaddy", error="insufficient_scope", scope="`+string(s)+`"`)
+			http.Error(w, "api key does not have the "+string(s)+" scope", http.StatusForbidden)
+			return
+		}
+
+		next(w, r.WithContext(context.WithValue(r.Context(), userContextKey, user)))
+	}
+}
+
+// This function returns the authenticated user for the request.
+// It must only be called from handlers wrapped with authenticate.
+func currentUser(r *http.Request) AuthUser {
+	user, _ := r.Context().Value(userContextKey).(AuthUser)
+	return user
+}
+
+// This function returns the token from the Authorization header or an empty string.
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(header[7:])
+}
+
+// this function writes a 401 response with the challenge header set
+func unauthorized(w http.ResponseWriter, msg string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="plantdaddy"`)
+	http.Error(w, msg, http.StatusUnauthorized)
+}
+
+// DB Query to get the current token version of a user.
+func getTokenVersion(ctx context.Context, db *pgxpool.Pool, userID int64) (int64, error) {
+	var version int64
+	err := db.QueryRow(ctx, `SELECT token_version FROM auth WHERE id = $1`, userID).Scan(&version)
+	return version, err
+}
+
+// DB Query to get the current token version of a user and whether their account is scheduled for deletion.
+func getTokenState(ctx context.Context, db *pgxpool.Pool, userID int64) (int64, bool, error) {
+	var version int64
+	var pending bool
+	err := db.QueryRow(ctx, `SELECT token_version, delete_after IS NOT NULL FROM auth WHERE id = $1`, userID).Scan(&version, &pending)
+	return version, pending, err
+}
+
+// DB Query to make every access token already issued to a user stop working.
+// It is run in the same transaction that revokes their refresh tokens.
+func bumpTokenVersion(ctx context.Context, tx pgx.Tx, userID int64) error {
+	_, err := tx.Exec(ctx, `UPDATE auth SET token_version = token_version + 1 WHERE id = $1`, userID)
+	return err
+}
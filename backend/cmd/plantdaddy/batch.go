@@ -0,0 +1,243 @@
+package main
+
+// This file takes readings a probe held on to while it could not reach the server and sends all at once
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// The most readings a probe may send in one batch, a day of readings at one every ten minutes.
+const maxBatchReadings = 144
+
+// How long ago a reading in a batch may have been taken.
+const maxBatchReadingAge = 7 * 24 * time.Hour
+
+// What happened to each reading of a batch.
+const batchStored = "stored"
+const batchDuplicate = "duplicate"
+const batchRejected = "rejected"
+
+var errEmptyBatch = errors.New("the batch has no readings")
+var errBatchTooLarge = fmt.Errorf("a batch holds at most %d readings", maxBatchReadings)
+var errBatchTimestamp = errors.New("the batch must have the time it was sent")
+
+// This function returns how far the clock of the device is behind the server, from the time it says it sent
+// the batch. Clocks that are close enough are trusted, since the difference is mostly the time the request took.
+func batchClockOffset(sent time.Time, now time.Time) time.Duration {
+	offset := now.Sub(sent)
+	if offset <= deviceClockSkew && offset >= -deviceClockSkew {
+		return 0
+	}
+	return offset
+}
+
+// DB Query to store a batch of readings under one use of the session a device sent.
+// The time of each reading is moved by the offset of the device clock. Readings that are too old, were
+// taken after the batch was sent or are at a time the device already has a reading are not stored,
+// and the result says what happened to each of them. The offset changes between retries of a batch,
+// so a reading is also a duplicate when the device already sent one taken at the same time by its own clock. A reading with an idempotency key that was
+// stored before is reported as stored at the time it was stored then.
+func insertSessionBatch(batch SessionBatch, db *pgxpool.Pool, sessionTTL time.Duration) (BatchResult, error) {
+	if len(batch.Readings) == 0 {
+		return BatchResult{}, errEmptyBatch
+	}
+	if len(batch.Readings) > maxBatchReadings {
+		return BatchResult{}, errBatchTooLarge
+	}
+	if batch.Timestamp.IsZero() {
+		return BatchResult{}, errBatchTimestamp
+	}
+
+	now := time.Now().UTC()
+	offset := batchClockOffset(batch.Timestamp, now)
+	result := BatchResult{ClockOffset: offset.Seconds(), Results: make([]BatchReadingResult, len(batch.Readings))}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return BatchResult{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	sessionData := SessionData{SessionID: batch.SessionID, UsageCounter: batch.UsageCounter, DeviceID: batch.DeviceID}
+	result.Session, err = useSession(ctx, tx, sessionData, now, sessionTTL)
+	if err != nil {
+		return BatchResult{}, err
+	}
+
+	// Readings sent before with the same key get the result they had the first time
+	var keys []string
+	for _, data := range batch.Readings {
+		if data.IdempotencyKey != "" {
+			keys = append(keys, data.IdempotencyKey)
+		}
+	}
+	sent, err := getReadingKeys(ctx, tx, batch.DeviceID, keys)
+	if err != nil {
+		return BatchResult{}, err
+	}
+
+	// Every metric the batch uses is looked up once
+	metrics := make([]map[string]float64, len(batch.Readings))
+	for i, data := range batch.Readings {
+		metrics[i] = data.Metrics
+	}
+	registry, err := getMetricRegistry(ctx, tx, metrics...)
+	if err != nil {
+		return BatchResult{}, err
+	}
+
+	var readings []timedReading
+	replayed := map[int]bool{}
+	seenTimes := map[int64]bool{}
+	seenDeviceTimes := map[int64]bool{}
+	seenKeys := map[string]bool{}
+	for i, data := range batch.Readings {
+		item := &result.Results[i]
+		item.Index = i
+		item.Status = batchRejected
+
+		if t, ok := sent[data.IdempotencyKey]; ok {
+			item.Status = batchStored
+			item.Time = &t
+			replayed[i] = true
+			result.Stored++
+			continue
+		}
+
+		t := data.Timestamp.Add(offset).UTC().Truncate(time.Microsecond)
+		switch {
+		case data.Timestamp.IsZero():
+			item.Error = "timestamp is missing"
+			continue
+		case data.Timestamp.After(batch.Timestamp):
+			item.Error = "taken after the batch was sent"
+			continue
+		case now.Sub(t) > maxBatchReadingAge:
+			item.Error = fmt.Sprintf("older than %d days", int(maxBatchReadingAge.Hours()/24))
+			continue
+		case len(data.IdempotencyKey) > maxIdempotencyKey:
+			item.Error = errIdempotencyKey.Error()
+			continue
+		}
+		temperature := float64(data.Temperature)
+		humidity := float64(data.Humidity)
+		soilMoisture := data.SoilMoisture
+		light := data.Light
+		values := [4]*float64{&temperature, &humidity, &soilMoisture, &light}
+		if err := checkLegacyValues(values, registry); err != nil {
+			item.Error = err.Error()
+			continue
+		}
+		if err := checkMetrics(data.Metrics, registry); err != nil {
+			item.Error = err.Error()
+			continue
+		}
+
+		item.Time = &t
+		deviceTime := data.Timestamp.UTC().Truncate(time.Microsecond)
+		if seenTimes[t.UnixNano()] || seenDeviceTimes[deviceTime.UnixNano()] || (data.IdempotencyKey != "" && seenKeys[data.IdempotencyKey]) {
+			item.Status = batchDuplicate
+			continue
+		}
+		seenTimes[t.UnixNano()] = true
+		seenDeviceTimes[deviceTime.UnixNano()] = true
+		seenKeys[data.IdempotencyKey] = true
+		item.Status = batchStored
+		readings = append(readings, timedReading{Time: t, Values: values,
+			Key: data.IdempotencyKey, DeviceTime: deviceTime, Metrics: data.Metrics})
+	}
+
+	var inserted []time.Time
+	if len(readings) > 0 {
+		if inserted, err = insertReadings(ctx, tx, batch.DeviceID, readings); err != nil {
+			return BatchResult{}, err
+		}
+	}
+	// Readings the device already had are left out of the insert
+	stored := map[int64]bool{}
+	for _, t := range inserted {
+		stored[t.UnixNano()] = true
+	}
+	for i := range result.Results {
+		item := &result.Results[i]
+		if item.Status != batchStored || replayed[i] {
+			continue
+		}
+		if stored[item.Time.UnixNano()] {
+			result.Stored++
+		} else {
+			item.Status = batchDuplicate
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return BatchResult{}, err
+	}
+	return result, nil
+}
+
+// HTTP Call for a probe to send readings it took while it was offline, each with the time it was taken
+func (api *API) newSessionBatch(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var batch SessionBatch
+		if !api.decodeSignedDeviceRequest(w, r, &batch, func() string { return batch.DeviceID }) {
+			return
+		}
+
+		result, err := insertSessionBatch(batch, api.db, api.sessionTTL)
+		switch {
+		case errors.Is(err, errInvalidSession), errors.Is(err, errSessionExpired):
+			// The device has to log in again to get a new session
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, errBatchTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		case errors.Is(err, errEmptyBatch), errors.Is(err, errBatchTimestamp):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// DB Query to find which of the idempotency keys a device has already sent, and the time each reading was stored at.
+func getReadingKeys(ctx context.Context, tx pgx.Tx, deviceID string, keys []string) (map[string]time.Time, error) {
+	sent := map[string]time.Time{}
+	if len(keys) == 0 {
+		return sent, nil
+	}
+
+	rows, err := tx.Query(ctx, `SELECT idempotency_key, time FROM plant_data
+	WHERE device_id = $1 AND idempotency_key = ANY($2)`, deviceID, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var t time.Time
+		if err := rows.Scan(&key, &t); err != nil {
+			return nil, err
+		}
+		sent[key] = t
+	}
+	return sent, rows.Err()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestBatchClockOffset(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		sent time.Time
+		want time.Duration
+	}{
+		{"in sync", now, 0},
+		{"at the skew behind", now.Add(-deviceClockSkew), 0},
+		{"at the skew ahead", now.Add(deviceClockSkew), 0},
+		{"behind", now.Add(-deviceClockSkew - time.Second), deviceClockSkew + time.Second},
+		{"ahead", now.Add(deviceClockSkew + time.Second), -deviceClockSkew - time.Second},
+		{"never set", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), now.Sub(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC))},
+	}
+
+	for _, test := range tests {
+		if got := batchClockOffset(test.sent, now); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSessionBatch(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "batcher")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	deviceID := createDevice(t, api, user.ID)
+	session := startSession(t, api, deviceID)
+
+	// The clock of the device is an hour behind
+	deviceNow := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	readings := []Data{
+		{Timestamp: deviceNow.Add(-20 * time.Minute), Temperature: 20},
+		{Timestamp: deviceNow.Add(-10 * time.Minute), Temperature: 21, IdempotencyKey: "second"},
+		{Timestamp: deviceNow.Add(-10 * time.Minute), Temperature: 22},
+		{Timestamp: deviceNow.Add(time.Minute), Temperature: 23},
+		{Timestamp: deviceNow.Add(-8 * 24 * time.Hour), Temperature: 24},
+		{Temperature: 25},
+	}
+	batch := SessionBatch{SessionID: session.SessionID, UsageCounter: session.UsageCounter, Timestamp: deviceNow,
+		DeviceID: deviceID, Readings: readings}
+	result, err := insertSessionBatch(batch, api.db, api.sessionTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{batchStored, batchStored, batchDuplicate, batchRejected, batchRejected, batchRejected}
+	for i, item := range result.Results {
+		if item.Status != want[i] {
+			t.Errorf("reading %d: got %s %s, want %s", i, item.Status, item.Error, want[i])
+		}
+	}
+	if result.Stored != 2 || result.ClockOffset < 3590 || result.ClockOffset > 3610 || result.UsageCounter != session.UsageCounter-1 {
+		t.Errorf("got %d stored with a clock offset of %vs and counter %d", result.Stored, result.ClockOffset, result.UsageCounter)
+	}
+	corrected := readings[0].Timestamp.Add(time.Hour)
+	if first := result.Results[0].Time; first == nil || first.Sub(corrected) > 10*time.Second || corrected.Sub(*first) > 10*time.Second {
+		t.Errorf("the first reading was stored at %v, want about %s", first, corrected)
+	}
+
+	// The retry arrives later, so its clock offset and corrected times differ from the first attempt
+	batch.UsageCounter = result.UsageCounter
+	retry, err := insertSessionBatch(batch, api.db, api.sessionTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retry.Stored != 1 || retry.Results[0].Status != batchDuplicate || retry.Results[1].Status != batchStored ||
+		!retry.Results[1].Time.Equal(*result.Results[1].Time) {
+		t.Errorf("the retry got %+v", retry)
+	}
+
+	var count int
+	if err := api.db.QueryRow(context.Background(), `SELECT COUNT(*) FROM plant_data WHERE device_id = $1`, deviceID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("the device has %d readings, want 2", count)
+	}
+
+	tests := []struct {
+		name  string
+		batch SessionBatch
+		err   error
+	}{
+		{"empty", SessionBatch{DeviceID: deviceID, Timestamp: deviceNow}, errEmptyBatch},
+		{"too large", SessionBatch{DeviceID: deviceID, Timestamp: deviceNow, Readings: make([]Data, maxBatchReadings+1)}, errBatchTooLarge},
+		{"no timestamp", SessionBatch{DeviceID: deviceID, Readings: readings}, errBatchTimestamp},
+		{"used counter", batch, errInvalidSession},
+	}
+	for _, test := range tests {
+		if _, err := insertSessionBatch(test.batch, api.db, api.sessionTTL); err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
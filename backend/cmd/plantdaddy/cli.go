@@ -0,0 +1,100 @@
+package main
+
+// This file holds the admin commands that can be run instead of the server
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// This function runs the admin command named by the first argument and returns the exit code.
+func runCommand(args []string) int {
+	commands := map[string]func([]string) error{
+		"import-batch": importBatchCommand,
+		"export":       exportCommand,
+		"import":       importCommand,
+		"add-metric":   addMetricCommand,
+	}
+
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\nusage: plantdaddy [command]\n\ncommands:\n", args[0])
+		fmt.Fprintln(os.Stderr, "  import-batch  add a manufacturing batch and print its claim codes")
+		fmt.Fprintln(os.Stderr, "  export        write the readings of devices as csv, ndjson or parquet")
+		fmt.Fprintln(os.Stderr, "  import        add readings from a csv or ndjson file to the history of a device")
+		fmt.Fprintln(os.Stderr, "  add-metric    register a new metric that probes can send")
+		return 2
+	}
+
+	if err := command(args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+// This function opens the file named by path, or stdin when it is empty or "-".
+func openInput(path string) (io.ReadCloser, error) {
+	if path == "" || path == "-" {
+		return os.Stdin, nil
+	}
+	return os.Open(path)
+}
+
+// The import-batch command reads the device ids of a batch and prints the claim codes for the boxes.
+func importBatchCommand(args []string) error {
+	flags := flag.NewFlagSet("import-batch", flag.ContinueOnError)
+	batch := flags.String("batch", "", "name of the manufacturing batch")
+	output := flags.String("o", "", "file to write the claim codes to instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: plantdaddy import-batch -batch NAME [-o codes.csv] [devices.csv]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *batch == "" {
+		flags.Usage()
+		return fmt.Errorf("must provide -batch")
+	}
+
+	input, err := openInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	deviceIDs, err := readBatchFile(input)
+	if err != nil {
+		return err
+	}
+	if len(deviceIDs) == 0 {
+		return fmt.Errorf("no device ids found")
+	}
+
+	// The output is opened first since the codes cannot be shown again once they are stored
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	db := connectToDb(os.Getenv("CONNSTRING"))
+	defer db.Close()
+
+	devices, err := insertBatch(db, *batch, deviceIDs)
+	if err != nil {
+		return err
+	}
+
+	if err := writeBatchCSV(out, devices); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "added %d devices to batch %s\n", len(devices), *batch)
+	return nil
+}
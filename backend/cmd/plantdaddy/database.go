@@ -3,18 +3,34 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"log"
 	"time"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	
 	
 	_ "github.com/lib/pq"
 )
 
+var errUserExists = errors.New("username or email is already taken")
+
+// The postgres error code for a violated unique constraint.
+const uniqueViolation = "23505"
+
+var errInvalidSession = errors.New("session is invalid or its counter has already been used")
+var errSessionExpired = errors.New("session has expired")
+var errStaleReading = errors.New("reading timestamp is too old or in the future")
+
+// The longest idempotency key a device may send with a reading.
+const maxIdempotencyKey = 64
+
+var errIdempotencyKey = errors.New("idempotencyKey must be at most 64 characters")
+
 type FalseError struct {}
 
 func (e *FalseError) Error() string {
-	return "The passwords do not match."
+	return "The username or password is incorrect."
 }
 // Conenects to the database with a given string
 func connectToDb(connString string) *pgxpool.Pool {
@@ -36,16 +52,21 @@ func changeDeviceName(db *pgxpool.Pool, devName deviceName) error {
 	return nil
 }
 
-// DB Query to connect to database and and get the device data
-func getDeviceDB(db *pgxpool.Pool, deviceID string) (Device, error) {
+// DB Query to connect to database and and get the device data, with its time in loc
+func getDeviceDB(db *pgxpool.Pool, deviceID string, loc *time.Location) (Device, error) {
 
 	var device Device
 	device.DeviceID = deviceID
-	dataRow := db.QueryRow(context.Background(),`SELECT p.temperature, 
-		p.humidity, p.soil_moisture, p.light, p.time, r.device_name 
-		FROM plant_data p INNER JOIN registered_devices r
-		ON p.device_id = r.device_id
-		WHERE p.device_id=$1 ORDER BY time DESC LIMIT 1
+	nameRow := db.QueryRow(context.Background(), `SELECT device_name, time_zone FROM registered_devices WHERE device_id=$1`, deviceID)
+
+	if err := nameRow.Scan(&device.DeviceName, &device.TimeZone); err != nil {
+		log.Printf("%s", err)
+		return Device{}, err
+	}
+
+	dataRow := db.QueryRow(context.Background(),`SELECT temperature, 
+		humidity, soil_moisture, light, time FROM plant_data
+		WHERE device_id=$1 ORDER BY time DESC LIMIT 1
 		`, deviceID)
 	
 	err := dataRow.Scan(&device.DeviceData.Temperature,
@@ -53,92 +74,82 @@ func getDeviceDB(db *pgxpool.Pool, deviceID string) (Device, error) {
 		 &device.DeviceData.SoilMoisture,
 		&device.DeviceData.Light,
 		&device.DeviceData.Timestamp, 
-		&device.DeviceName,
 	)
 	
-	if err != nil {
+	// A device that has not sent any data yet is still returned.
+	if err != nil && err != pgx.ErrNoRows {
 		log.Printf("%s", err)
 		return Device{}, err
 	}
+	if !device.DeviceData.Timestamp.IsZero() {
+		device.DeviceData.Timestamp = device.DeviceData.Timestamp.In(loc)
+	}
 
 	return device, nil
 }
 
 // DB Query to connect to database and delete the device data.
+// The claim code printed on the box works again so the probe can be registered anew.
 func deleteDeviceDB(db *pgxpool.Pool, deviceID string) error {
-	_, err := db.Exec(context.Background(), "DELETE FROM registered_devices WHERE device_id=$1", deviceID)
-
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
 	if err != nil {
 		return err
 	}
-	return nil
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM registered_devices WHERE device_id=$1", deviceID); err != nil {
+		return err
+	}
+	if err := releaseManufacturingClaims(ctx, tx, []string{deviceID}); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
-// DB Query to connect to database and get the latest data.
-func getLatestDataDay(db *pgxpool.Pool, date string, deviceId string) (map[int]DeviceHourData, error) {
-	rows, err := db.Query(context.Background(), `
-	SELECT temperature, humidity, soil_moisture, light, (time::timestamp AT TIME ZONE 'GMT') FROM plant_data 
-	WHERE (time::timestamp AT TIME ZONE 'GMT')::date = $1 AND device_id = $2
-	`, date, deviceId)
-	dayMap := make(map[int]DeviceHourData)
+// DB Query to connect to database and get the data of a day in loc, averaged by the hour.
+// Hours with no data are left out of the map. On the day the clocks go back the repeated hour is merged.
+func getLatestDataDay(db *pgxpool.Pool, date string, deviceId string, loc *time.Location) (map[int]DeviceHourData, error) {
+	day, err := time.ParseInLocation("2006-01-02", date, loc)
+	if err != nil {
+		return nil, errInvalidPeriod
+	}
+
+	// The day may be 23 or 25 hours long
+	buckets, err := getReadingsDB(db, deviceId, day, day.AddDate(0, 0, 1), bucketSizes["1h"], loc)
 	if err != nil {
 		log.Printf("error %s", err)
 		return nil, err
 	}
 
-	defer rows.Close()
-
-	for rows.Next() {
-	var time time.Time
-	var deviceData DeviceHourData
-	deviceData.DeviceNumber = 1
-	errs := rows.Scan(&deviceData.Temperature, &deviceData.Humidity, &deviceData.SoilMoisture, &deviceData.Light, &time)
-
-	if errs != nil {
-		log.Printf("%s", errs)
-		return nil, errs
-	}
-	if val, ok := dayMap[time.Hour()]; ok {
-		val.Humidity += deviceData.Humidity
-		val.Temperature += deviceData.Temperature
-		val.SoilMoisture += deviceData.SoilMoisture
-		val.Light += deviceData.Light
-		val.DeviceNumber += 1
-		dayMap[time.Hour()] = val
-	} else {
-		deviceData.TimePeriod = time.Hour()
-		dayMap[time.Hour()] = deviceData
-	}
-	
-	}
-		// dayMap is a map[int]interface.
-		// loop over keys and values in the map.
-		for k, v := range dayMap {
-			v.Humidity /= float64(v.DeviceNumber)
-			v.Temperature /= float64(v.DeviceNumber)
-			v.Light /= float64(v.DeviceNumber)
-			v.SoilMoisture /= float64(v.DeviceNumber)
-			dayMap[k] = v
+	dayMap := make(map[int]DeviceHourData)
+	for _, bucket := range buckets {
+		hour := bucket.Start.Hour()
+		data := DeviceHourData{
+			TimePeriod:   hour,
+			Temperature:  bucket.Temperature.average(),
+			Humidity:     bucket.Humidity.average(),
+			SoilMoisture: bucket.SoilMoisture.average(),
+			Light:        bucket.Light.average(),
+			DeviceNumber: uint64(bucket.Count),
 		}
-
+		if val, ok := dayMap[hour]; ok {
+			data = val.merge(data)
+		}
+		dayMap[hour] = data
+	}
 	return dayMap, nil
 }
 
 // DB Query to connect to database and get all the latest devices associated with an ID 
-func getDevicesDB(db *pgxpool.Pool, username string) ([]Device, error) {
-
-	var id int64
-	row := db.QueryRow(context.Background(), `SELECT id from auth WHERE username = $1`, username)
-	
-	err := row.Scan(&id)
-	if err != nil {
-		return nil, err
-	}
+func getDevicesDB(db *pgxpool.Pool, id int64) ([]Device, error) {
 
-	
-	
-
-	rows, errs := db.Query(context.Background(),`SELECT device_name, device_id FROM registered_devices WHERE user_id = $1`, id)
+	// Devices shared through a household come back with the role the user has in it.
+	rows, errs := db.Query(context.Background(),`SELECT r.device_name, r.device_id,
+	CASE WHEN r.user_id = $1 THEN 'owner' ELSE m.role END
+	FROM registered_devices r LEFT JOIN household_member m
+	ON m.household_id = r.household_id AND m.user_id = $1
+	WHERE r.user_id = $1 OR m.user_id IS NOT NULL`, id)
 
 	if errs != nil {
 		return nil, errs
@@ -149,7 +160,7 @@ func getDevicesDB(db *pgxpool.Pool, username string) ([]Device, error) {
 	defer rows.Close()
 	for rows.Next() {
 		var device Device
-		err := rows.Scan(&device.DeviceName, &device.DeviceID)
+		err := rows.Scan(&device.DeviceName, &device.DeviceID, &device.Role)
 		if err != nil {
 			return nil, err
 		}
@@ -174,55 +185,68 @@ func getDevicesDB(db *pgxpool.Pool, username string) ([]Device, error) {
 }
 
 // DB Query to connect to database and and insert a new device.
-func insertDevice(newDevice *NewDevice, db *pgxpool.Pool) error{
+// The claim code from the box is used up and the secret the device must sign its requests with is returned.
+func insertDevice(newDevice *NewDevice, id int64, db *pgxpool.Pool) (string, error){
 	log.Printf("DEVICE: %s %s", newDevice.DeviceName, newDevice.DeviceID)
-	row:= db.QueryRow(context.Background(), "SELECT id FROM auth WHERE LOWER(username)=LOWER($1)", newDevice.Username)
 
-	var id int
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
 
-	err := row.Scan(&id)
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
 
-	switch {
-	case err == sql.ErrNoRows:
-		log.Printf("no user with id %d\n", id)
-		return err
-	case err != nil:
-		log.Printf("query error: %v\n", err)
-		return err
+	if err := useManufacturingClaim(ctx, tx, newDevice.DeviceID, newDevice.ClaimCode); err != nil {
+		return "", err
 	}
 	
-	_, errs := db.Exec(context.Background(),`INSERT INTO registered_devices(device_id, user_id, register_date, device_name)
-	VALUES($1, $2, $3, $4)
-	`, newDevice.DeviceID, id, time.Now().UTC(), newDevice.DeviceName)
+	_, errs := tx.Exec(ctx,`INSERT INTO registered_devices(device_id, user_id, register_date, device_name, device_secret)
+	VALUES($1, $2, $3, $4, $5)
+	`, newDevice.DeviceID, id, time.Now().UTC(), newDevice.DeviceName, secret)
 
 	if errs != nil {
 		log.Printf("%s", errs)
-		return errs
+		return "", errs
 	}
-	return nil
+	return secret, tx.Commit(ctx)
 }
 
-// DB Query to connect to database and log in as the device with a given username and password.
-func LogIn(db *pgxpool.Pool, user UserPass) error {
-	row := db.QueryRow(context.Background(), "SELECT password FROM auth WHERE LOWER(username)=LOWER($1) OR LOWER(email)=LOWER($1)", user.Username)
+// DB Query to connect to database and log in as the user with a given username or email and password.
+func LogIn(db *pgxpool.Pool, user UserPass) (AuthUser, error) {
+	// Signing in by email is only allowed once the email has been verified.
+	row := db.QueryRow(context.Background(), `SELECT id, username, password FROM auth
+	WHERE LOWER(username)=LOWER($1) OR (LOWER(email)=LOWER($1) AND email_verified)
+	ORDER BY LOWER(username)=LOWER($1) DESC LIMIT 1`, user.Username)
+	var authUser AuthUser
 	var password string
 
-	err := row.Scan(&password)
-	log.Printf("%s", db.Stat().AcquireDuration().String())
-	switch {
-		case err == sql.ErrNoRows:
-			return err
-		case err != nil:
-			return err
+	err := row.Scan(&authUser.ID, &authUser.Username, &password)
+	if err == pgx.ErrNoRows {
+		// Compare against a dummy hash so that unknown users take as long as known ones.
+		CheckPasswordHash(user.Password, dummyHash())
+		return AuthUser{}, &FalseError{}
+	} else if err != nil {
+		return AuthUser{}, err
+	}
+
+	// Accounts made by signing in with a provider have no password until one is set.
+	if password == "" {
+		CheckPasswordHash(user.Password, dummyHash())
+		return AuthUser{}, &FalseError{}
 	}
 
 	var checker = CheckPasswordHash(user.Password, password)
 	
 	if !checker {
-		return &FalseError{}
+		return AuthUser{}, &FalseError{}
 	}
 
-	return nil
+	return authUser, nil
 }
 
 
@@ -235,8 +259,8 @@ func getSession(db *pgxpool.Pool, login *Login) (Session, error) {
 		if errs != nil {
 			return Session{}, errs
 		}
-		_, err := db.Exec(context.Background(), `INSERT INTO session(session_id, usage_time, usage, device_id) VALUES ($1, $2, $3, $4) 
-		ON CONFLICT (device_id) DO UPDATE SET session_id=$1, usage_time=$2, usage=$3`, 
+		_, err := db.Exec(context.Background(), `INSERT INTO session(session_id, usage_time, usage, device_id, issued_at) VALUES ($1, $2, $3, $4, $2) 
+		ON CONFLICT (device_id) DO UPDATE SET session_id=$1, usage_time=$2, usage=$3, issued_at=$2`, 
 		hashedLogin.SessionID, hashedLogin.Timestamp, hashedLogin.UsageCounter, login.DeviceID)
 
 		if err != nil {
@@ -247,88 +271,187 @@ func getSession(db *pgxpool.Pool, login *Login) (Session, error) {
 }
 
 // DB Query to connect to database and create a new user that can be used to create devices.
-func insertNewUser(newUser UserPass , db *pgxpool.Pool) error {
+// The token for the email verification link is returned.
+func insertNewUser(newUser UserPass , db *pgxpool.Pool, verificationTTL time.Duration) (string, error) {
 	password, errs := HashPassword(newUser.Password)
 	
 	if errs != nil {
 		log.Printf("%s", errs)
-		return errs 
+		return "", errs 
 	}
-	_, err := db.Exec(context.Background(), `INSERT INTO auth(username, password, email) VALUES ($1, $2, $3)`, newUser.Username, password, newUser.Email)
 
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
 	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var id int64
+	row := tx.QueryRow(ctx, `INSERT INTO auth(username, password, email) VALUES ($1, $2, $3) RETURNING id`, newUser.Username, password, newUser.Email)
+
+	if err := row.Scan(&id); err != nil {
+		var pgErr interface{ SQLState() string }
+		if errors.As(err, &pgErr) && pgErr.SQLState() == uniqueViolation {
+			return "", errUserExists
+		}
 		log.Printf("%s", err)
-		return err
+		return "", err
 	}
-	return nil
+
+	token, err := insertEmailVerification(ctx, tx, id, newUser.Email, verificationTTL)
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit(ctx)
 }
 
 
-// DB Query that will create a take a given session and insert the plant data associated with it in the database.
-func insertSessionData(sessionData SessionData, db *pgxpool.Pool) (Session, error) {
-	
-	_, errs := db.Exec(context.Background(),`
-	INSERT INTO plant_data(device_id, time, temperature, humidity, soil_moisture, light)
-	VALUES ($1, $2, $3, $4, $5, $6)
-	`, sessionData.DeviceID, time.Now().UTC(), 
+// DB Query that will take a given session and insert the plant data associated with it in the database.
+// The session must be current and the usage counter is used up atomically so a payload can only ever be stored once.
+// A reading sent again with the same idempotency key is not stored twice. The first attempt already used up
+// the counter, so a retry sent with the same session and counter is given the response the first attempt got.
+func insertSessionData(sessionData SessionData, db *pgxpool.Pool, sessionTTL time.Duration) (Session, error) {
+	now := time.Now().UTC()
+	if err := checkReadingTime(sessionData.Timestamp, now); err != nil {
+		return Session{}, err
+	}
+	if len(sessionData.IdempotencyKey) > maxIdempotencyKey {
+		return Session{}, errIdempotencyKey
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	registry, err := getMetricRegistry(ctx, tx, sessionData.Metrics)
+	if err != nil {
+		return Session{}, err
+	}
+	temperature, humidity := float64(sessionData.Temperature), float64(sessionData.Humidity)
+	legacy := [4]*float64{&temperature, &humidity, &sessionData.SoilMoisture, &sessionData.Light}
+	if err := checkLegacyValues(legacy, registry); err != nil {
+		return Session{}, err
+	}
+	if err := checkMetrics(sessionData.Metrics, registry); err != nil {
+		return Session{}, err
+	}
+
+	// The reading is inserted first so a retry waits for the attempt it repeats and then finds its key
+	var id int64
+	err = tx.QueryRow(ctx, `
+	INSERT INTO plant_data(device_id, time, temperature, humidity, soil_moisture, light, idempotency_key, session_id, usage_counter)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) ON CONFLICT DO NOTHING RETURNING id
+	`, sessionData.DeviceID, now, 
 	sessionData.Temperature, 
 	sessionData.Humidity, 
 	sessionData.SoilMoisture, 
-	sessionData.Light)
-	if errs == sql.ErrNoRows {
-		return Session{
-			SessionID: "",
-			UsageCounter: 0,
-			Timestamp: time.Now(),
-		}, errs
+	sessionData.Light,
+	nullString(sessionData.IdempotencyKey),
+	sessionData.SessionID,
+	sessionData.UsageCounter).Scan(&id)
+	if err == pgx.ErrNoRows {
+		tx.Rollback(ctx)
+		return getRetriedSession(ctx, db, sessionData)
+	} else if err != nil {
+		log.Printf("%s", err)
+		return Session{}, err
+	}
+	if err := insertReadingMetrics(ctx, tx, []int64{id}, []map[string]float64{sessionData.Metrics}); err != nil {
+		return Session{}, err
 	}
 
-	
-	if errs != nil {
-		log.Printf("%s", errs)
-		return Session{
-			SessionID: "",
-			UsageCounter: 0,
-			Timestamp: time.Now(),
-		}, errs
+	session, err := useSession(ctx, tx, sessionData, now, sessionTTL)
+	if err != nil {
+		return Session{}, err
 	}
 
-	row := db.QueryRow(context.Background(),"SELECT session_id, usage, usage_time FROM session WHERE session_id=$1", sessionData.SessionID)
-	var session Session
+	// The response is kept with the reading for a retry of this request
+	if _, err := tx.Exec(ctx, `UPDATE plant_data SET response = $1 WHERE id = $2`, session, id); err != nil {
+		return Session{}, err
+	}
 
-	err := row.Scan(&session.SessionID, &session.UsageCounter, &session.Timestamp)
-	if err == sql.ErrNoRows || sessionData.UsageCounter == 0 || session.UsageCounter != sessionData.UsageCounter {
-		new_session, errs := hashBytes(nil, &sessionData)
+	if err := tx.Commit(ctx); err != nil {
+		return Session{}, err
+	}
+	return session, nil
+}
 
-		if errs != nil {
-			log.Printf("%s", errs)
-			return Session{}, errs
-		}
+// DB Query to get the response a device was given the first time it sent the reading with an idempotency key.
+// The retry must have been sent with the session and counter of the first attempt.
+func getRetriedSession(ctx context.Context, db *pgxpool.Pool, sessionData SessionData) (Session, error) {
+	var sessionID *string
+	var usageCounter *int
+	var response *Session
+	err := db.QueryRow(ctx, `SELECT session_id, usage_counter, response FROM plant_data WHERE device_id = $1 AND idempotency_key = $2`,
+	sessionData.DeviceID, sessionData.IdempotencyKey).Scan(&sessionID, &usageCounter, &response)
+	if err == pgx.ErrNoRows {
+		return Session{}, errInvalidSession
+	} else if err != nil {
+		return Session{}, err
+	}
 
-		_, err = db.Exec(context.Background(),"UPDATE session SET session_id=$1, usage_time=$2, usage=$3 WHERE device_id=$4", 
-		new_session.SessionID, new_session.Timestamp, new_session.UsageCounter, sessionData.DeviceID)
+	// Readings stored before responses were kept cannot be checked, the device logs in again
+	if response == nil || sessionID == nil || usageCounter == nil ||
+	*sessionID != sessionData.SessionID || *usageCounter != sessionData.UsageCounter {
+		return Session{}, errInvalidSession
+	}
+	return *response, nil
+}
 
-		if err != nil {
-			return Session{}, errs
-		}
+// This function checks a reading was taken within the allowed clock skew of now.
+func checkReadingTime(timestamp time.Time, now time.Time) error {
+	if timestamp.Before(now.Add(-deviceClockSkew)) || timestamp.After(now.Add(deviceClockSkew)) {
+		return errStaleReading
+	}
+	return nil
+}
+
+// This function checks if a session issued at the given time has outlived the ttl.
+// Sessions handed out before issued_at was recorded are treated as expired.
+func sessionExpired(issuedAt *time.Time, now time.Time, sessionTTL time.Duration) bool {
+	return issuedAt == nil || now.Sub(*issuedAt) > sessionTTL
+}
 
-		return new_session, nil
+// DB Query that uses up one request of the session a device sent, and returns the session to use next.
+// Only the request holding the current counter can decrement it, replays and
+// concurrent duplicates of a payload find no row to update.
+func useSession(ctx context.Context, tx pgx.Tx, sessionData SessionData, now time.Time, sessionTTL time.Duration) (Session, error) {
+	row := tx.QueryRow(ctx, `UPDATE session SET usage = usage - 1, usage_time = $1
+	WHERE device_id = $2 AND session_id = $3 AND usage = $4
+	RETURNING usage, issued_at`, now, sessionData.DeviceID, sessionData.SessionID, sessionData.UsageCounter)
+
+	var session Session
+	var issuedAt *time.Time
+	err := row.Scan(&session.UsageCounter, &issuedAt)
+	if err == pgx.ErrNoRows {
+		return Session{}, errInvalidSession
 	} else if err != nil {
-		log.Printf("%s", errs)
-		return Session{}, errs
-	} else {
-		newSession := Session{
-			SessionID: sessionData.SessionID,
-			UsageCounter: sessionData.UsageCounter - 1,
-			Timestamp: time.Now().UTC(),
+		return Session{}, err
+	}
+
+	if sessionExpired(issuedAt, now, sessionTTL) {
+		return Session{}, errSessionExpired
+	}
+
+	session.SessionID = sessionData.SessionID
+	session.Timestamp = now
+
+	// Once the counter has been used up the device is given a brand new session.
+	if session.UsageCounter <= 0 {
+		session, err = hashBytes(nil, &sessionData)
+		if err != nil {
+			return Session{}, err
 		}
 
-		_, err = db.Exec(context.Background(),"UPDATE session SET usage_time=$1, usage=$2 WHERE device_id=$3", 
-		newSession.Timestamp, newSession.UsageCounter, sessionData.DeviceID)
+		_, err = tx.Exec(ctx, "UPDATE session SET session_id=$1, usage_time=$2, usage=$3, issued_at=$2 WHERE device_id=$4", 
+		session.SessionID, session.Timestamp, session.UsageCounter, sessionData.DeviceID)
 		if err != nil {
 			return Session{}, err
 		}
-		return newSession, nil
 	}
-
+	return session, nil
 }
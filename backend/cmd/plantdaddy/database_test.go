@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestCheckReadingTime(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		timestamp time.Time
+		err       error
+	}{
+		{"now", now, nil},
+		{"at the skew behind", now.Add(-deviceClockSkew), nil},
+		{"at the skew ahead", now.Add(deviceClockSkew), nil},
+		{"too old", now.Add(-deviceClockSkew - time.Second), errStaleReading},
+		{"in the future", now.Add(deviceClockSkew + time.Second), errStaleReading},
+		{"missing", time.Time{}, errStaleReading},
+	}
+
+	for _, test := range tests {
+		if err := checkReadingTime(test.timestamp, now); err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestSessionExpired(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		t := now.Add(d)
+		return &t
+	}
+
+	tests := []struct {
+		name     string
+		issuedAt *time.Time
+		want     bool
+	}{
+		{"just issued", at(0), false},
+		{"at the ttl", at(-time.Hour), false},
+		{"past the ttl", at(-time.Hour - time.Second), true},
+		{"never recorded", nil, true},
+	}
+
+	for _, test := range tests {
+		if got := sessionExpired(test.issuedAt, now, time.Hour); got != test.want {
+			t.Errorf("%s: sessionExpired = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestHashBytesIssuesFreshSessions(t *testing.T) {
+	first, err := hashBytes(&Login{DeviceID: "probe-1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := hashBytes(nil, &SessionData{SessionID: first.SessionID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, session := range []Session{first, second} {
+		if len(session.SessionID) != 64 || session.UsageCounter != 10 || session.Timestamp.IsZero() {
+			t.Errorf("got session %+v", session)
+		}
+	}
+	if first.SessionID == second.SessionID {
+		t.Error("a rotated session has the same id")
+	}
+}
+
+func TestRetriedSessionData(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "prober")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	deviceID := createDevice(t, api, user.ID)
+	session := startSession(t, api, deviceID)
+
+	send := func(data SessionData) (Session, error) {
+		data.DeviceID = deviceID
+		data.Timestamp = time.Now().UTC()
+		data.Temperature = 21
+		return insertSessionData(data, api.db, api.sessionTTL)
+	}
+	first := SessionData{SessionID: session.SessionID, UsageCounter: session.UsageCounter, IdempotencyKey: uniqueName(t, "key-")}
+	response, err := send(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.SessionID != session.SessionID || response.UsageCounter != session.UsageCounter-1 {
+		t.Fatalf("got %+v", response)
+	}
+
+	// A retry gets exactly the response of the first attempt, even once the session has moved on
+	next := SessionData{SessionID: session.SessionID, UsageCounter: response.UsageCounter}
+	if _, err := send(next); err != nil {
+		t.Fatal(err)
+	}
+	retried, err := send(first)
+	if err != nil || retried.SessionID != response.SessionID || retried.UsageCounter != response.UsageCounter ||
+		!retried.Timestamp.Equal(response.Timestamp) {
+		t.Errorf("the retry got %+v %v, want %+v", retried, err, response)
+	}
+
+	tests := []struct {
+		name string
+		data SessionData
+	}{
+		{"another counter", SessionData{SessionID: session.SessionID, UsageCounter: first.UsageCounter - 5, IdempotencyKey: first.IdempotencyKey}},
+		{"another session", SessionData{SessionID: "not the session", UsageCounter: first.UsageCounter, IdempotencyKey: first.IdempotencyKey}},
+		{"a used counter without a key", first},
+	}
+	tests[2].data.IdempotencyKey = ""
+	for _, test := range tests {
+		if got, err := send(test.data); err != errInvalidSession {
+			t.Errorf("%s: got %+v %v, want %v", test.name, got, err, errInvalidSession)
+		}
+	}
+
+	var count int
+	if err := api.db.QueryRow(context.Background(), `SELECT COUNT(*) FROM plant_data WHERE device_id = $1`, deviceID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("the device has %d readings, want 2", count)
+	}
+}
+
+func TestRetryAfterTheSessionIsReplaced(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "prober")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	deviceID := createDevice(t, api, user.ID)
+	session := startSession(t, api, deviceID)
+	if _, err := api.db.Exec(context.Background(), `UPDATE session SET usage = 1 WHERE device_id = $1`, deviceID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Using up the last of the counter hands out a brand new session, which the retry is given again
+	data := SessionData{SessionID: session.SessionID, UsageCounter: 1, DeviceID: deviceID, Timestamp: time.Now().UTC(),
+		IdempotencyKey: uniqueName(t, "key-")}
+	response, err := insertSessionData(data, api.db, api.sessionTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.SessionID == session.SessionID || response.UsageCounter != 10 {
+		t.Fatalf("got %+v", response)
+	}
+	retried, err := insertSessionData(data, api.db, api.sessionTTL)
+	if err != nil || retried.SessionID != response.SessionID || retried.UsageCounter != response.UsageCounter {
+		t.Errorf("the retry got %+v %v, want %+v", retried, err, response)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+// This file is used for authenticating the requests sent by the probes
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// The header the probe puts the hex encoded HMAC-SHA256 of the request body in.
+const deviceSignatureHeader = "X-Signature"
+
+// How far the clock of a probe may drift from ours when it logs in.
+const deviceClockSkew = 5 * time.Minute
+
+var errBadSignature = errors.New("request signature is invalid")
+var errStaleRequest = errors.New("request is stale or its nonce has already been used")
+
+// This function signs a request body with the secret of a device.
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DB Query to get the secret a device was provisioned with.
+// Devices of accounts scheduled for deletion are treated as having none so they stop sending data.
+func getDeviceSecret(db *pgxpool.Pool, deviceID string) (string, error) {
+	row := db.QueryRow(context.Background(), `SELECT r.device_secret FROM registered_devices r
+	INNER JOIN auth a ON a.id = r.user_id
+	WHERE r.device_id = $1 AND r.device_secret IS NOT NULL AND a.delete_after IS NULL`, deviceID)
+
+	var secret string
+	err := row.Scan(&secret)
+	if err == pgx.ErrNoRows {
+		return "", errBadSignature
+	}
+	return secret, err
+}
+
+// DB Query to give a device a new secret. The old secret and session stop working straight away.
+func rotateDeviceSecret(db *pgxpool.Pool, deviceID string) (string, error) {
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE registered_devices SET device_secret = $1 WHERE device_id = $2`, secret, deviceID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM session WHERE device_id = $1`, deviceID); err != nil {
+		return "", err
+	}
+	return secret, tx.Commit(ctx)
+}
+
+// This function checks the signature of a request body against the secret stored for the device.
+func verifyDeviceSignature(db *pgxpool.Pool, deviceID string, body []byte, signature string) error {
+	if deviceID == "" || signature == "" {
+		return errBadSignature
+	}
+
+	secret, err := getDeviceSecret(db, deviceID)
+	if err != nil {
+		return err
+	}
+
+	if !validSignature(secret, body, signature) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// This function checks a hex encoded signature of a body in constant time.
+func validSignature(secret string, body []byte, signature string) bool {
+	expected := signBody(secret, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// DB Query to check that a signed request carrying a timestamp and nonce is recent and has not been seen before.
+func useDeviceNonce(db *pgxpool.Pool, login Login) error {
+	if err := checkRequestTime(login, time.Now()); err != nil {
+		return err
+	}
+	signedAt := time.Unix(login.Timestamp, 0).UTC()
+
+	ctx := context.Background()
+	// Nonces only have to be kept for as long as their timestamp would be accepted
+	if _, err := db.Exec(ctx, `DELETE FROM device_nonce WHERE expires_at < $1`, time.Now().UTC()); err != nil {
+		return err
+	}
+	tag, err := db.Exec(ctx, `INSERT INTO device_nonce(device_id, nonce, expires_at) VALUES ($1, $2, $3)
+	ON CONFLICT DO NOTHING`, login.DeviceID, login.Nonce, signedAt.Add(deviceClockSkew))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errStaleRequest
+	}
+	return nil
+}
+
+// This function checks a signed request has a nonce and was signed within the allowed clock skew of now.
+func checkRequestTime(login Login, now time.Time) error {
+	signedAt := time.Unix(login.Timestamp, 0)
+	if login.Nonce == "" || now.Sub(signedAt) > deviceClockSkew || signedAt.Sub(now) > deviceClockSkew {
+		return errStaleRequest
+	}
+	return nil
+}
+
+// This function reads a signed json request from a probe into v.
+// The value must be decoded before the signature can be checked since it holds the device id,
+// so nothing in v may be trusted unless true is returned.
+func (api *API) decodeSignedDeviceRequest(w http.ResponseWriter, r *http.Request, v interface{}, deviceID func() string) bool {
+	if r.Header.Get("Content-Type") != "application/json" {
+		msg := "Content-type header is not application/json"
+		http.Error(w, msg, http.StatusUnsupportedMediaType)
+		return false
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		jsonDecoder(err, w)
+		return false
+	}
+
+	if err := decodeStrict(body, v); jsonDecoder(err, w) != nil {
+		return false
+	}
+
+	err = verifyDeviceSignature(api.db, deviceID(), body, r.Header.Get(deviceSignatureHeader))
+	if errors.Is(err, errBadSignature) {
+		log.Printf("rejected request from device %q: %s", deviceID(), err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	} else if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// This function decodes json that may not contain any unknown fields.
+func decodeStrict(body []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// HTTP Call to give a device a new secret, used when provisioning a probe again
+func (api *API) newDeviceSecret(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		deviceID := r.URL.Query().Get("deviceID")
+		if !api.allowDevice(w, r, deviceID, manageDevice) {
+			return
+		}
+
+		secret, err := rotateDeviceSecret(api.db, deviceID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, "Error creating device secret", http.StatusInternalServerError)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditDeviceSecret, DeviceID: deviceID})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(DeviceCredentials{DeviceID: deviceID, DeviceSecret: secret})
+	}
+}
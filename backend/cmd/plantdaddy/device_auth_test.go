@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignBody(t *testing.T) {
+	// Test case 2 of RFC 4231.
+	got := signBody("Jefe", []byte("what do ya want for nothing?"))
+	want := "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if got != want {
+		t.Errorf("signBody = %s, want %s", got, want)
+	}
+}
+
+func TestValidSignature(t *testing.T) {
+	body := []byte(`{"deviceID":"probe-1","timestamp":1600000000,"nonce":"abc"}`)
+	signature := signBody("secret", body)
+
+	tests := []struct {
+		name      string
+		secret    string
+		body      []byte
+		signature string
+		want      bool
+	}{
+		{"valid", "secret", body, signature, true},
+		{"other secret", "other", body, signature, false},
+		{"changed body", "secret", []byte(`{"deviceID":"probe-2","timestamp":1600000000,"nonce":"abc"}`), signature, false},
+		{"upper case hex", "secret", body, strings.ToUpper(signature), false},
+		{"truncated", "secret", body, signature[:32], false},
+		{"empty", "secret", body, "", false},
+	}
+
+	for _, test := range tests {
+		if got := validSignature(test.secret, test.body, test.signature); got != test.want {
+			t.Errorf("%s: validSignature = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckRequestTime(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tests := []struct {
+		name  string
+		login Login
+		err   error
+	}{
+		{"now", Login{Timestamp: now.Unix(), Nonce: "a"}, nil},
+		{"a little behind", Login{Timestamp: now.Add(-deviceClockSkew).Unix(), Nonce: "a"}, nil},
+		{"a little ahead", Login{Timestamp: now.Add(deviceClockSkew).Unix(), Nonce: "a"}, nil},
+		{"too old", Login{Timestamp: now.Add(-deviceClockSkew - time.Second).Unix(), Nonce: "a"}, errStaleRequest},
+		{"too far ahead", Login{Timestamp: now.Add(deviceClockSkew + time.Second).Unix(), Nonce: "a"}, errStaleRequest},
+		{"no nonce", Login{Timestamp: now.Unix()}, errStaleRequest},
+		{"no timestamp", Login{Nonce: "a"}, errStaleRequest},
+	}
+
+	for _, test := range tests {
+		if err := checkRequestTime(test.login, now); err != test.err {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		}
+	}
+}
+
+func TestDecodeSignedDeviceRequestRejectsBadBodies(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"not json", "text/plain", `{"deviceID":"probe-1"}`, http.StatusUnsupportedMediaType},
+		{"bad json", "application/json", `{"deviceID":`, http.StatusBadRequest},
+		{"unknown field", "application/json", `{"deviceID":"probe-1","admin":true}`, http.StatusBadRequest},
+	}
+
+	// None of these get far enough to look up the secret of the device.
+	api := &API{}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/login", strings.NewReader(test.body))
+			r.Header.Set("Content-Type", test.contentType)
+			w := httptest.NewRecorder()
+
+			var login Login
+			if api.decodeSignedDeviceRequest(w, r, &login, func() string { return login.DeviceID }) {
+				t.Fatal("the request was accepted")
+			}
+			if w.Code != test.status {
+				t.Errorf("got status %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
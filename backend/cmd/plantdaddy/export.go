@@ -0,0 +1,502 @@
+package main
+
+// This file exports the readings of devices as csv, json lines or parquet for notebooks and spreadsheets
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// The formats readings can be exported as, and their content types.
+var exportFormats = map[string]string{
+	"csv":     "text/csv",
+	"ndjson":  "application/x-ndjson",
+	"parquet": "application/vnd.apache.parquet",
+}
+
+// The columns every export starts with, in order. The metrics beyond the legacy four follow them.
+var exportColumns = []string{"deviceID", "time", "temperature", "humidity", "soilMoisture", "light"}
+
+const unitCelsius = "celsius"
+const unitFahrenheit = "fahrenheit"
+const unitKelvin = "kelvin"
+const unitPercent = "percent"
+const unitFraction = "fraction"
+
+// What to export and how.
+type exportOptions struct {
+	DeviceIDs []string
+	// Either end of the range may be zero to leave it open.
+	From   time.Time
+	To     time.Time
+	Format string
+	// The time zone the times of the csv and json lines are written in.
+	// Parquet times are always stored in UTC.
+	Location *time.Location
+	Units    readingUnits
+	// The metrics beyond the legacy four, written as a column each after the legacy ones.
+	Metrics []Metric
+}
+
+// The units readings are written or read in.
+type readingUnits struct {
+	// The unit of the temperature, probes measure celsius.
+	Temperature string
+	// The unit of the humidity, soil moisture and light, which probes measure as percentages.
+	Percent string
+}
+
+// A reading as it is exported, with the units already converted.
+type exportRow struct {
+	DeviceID string
+	// Zero for the readings of old probes that did not send a time.
+	Time time.Time
+	// Temperature, humidity, soil moisture and light, nil when the device did not send one.
+	Values [4]*float64
+	// The other metrics the device sent, by name.
+	Metrics map[string]float64
+}
+
+// This function parses the temperatureUnit and percentUnit parameters, which default to the units probes measure in.
+func parseReadingUnits(query url.Values) (readingUnits, error) {
+	units := readingUnits{Temperature: query.Get("temperatureUnit"), Percent: query.Get("percentUnit")}
+	switch units.Temperature {
+	case "":
+		units.Temperature = unitCelsius
+	case unitCelsius, unitFahrenheit, unitKelvin:
+	default:
+		return readingUnits{}, errors.New("temperatureUnit must be celsius, fahrenheit or kelvin")
+	}
+	switch units.Percent {
+	case "":
+		units.Percent = unitPercent
+	case unitPercent, unitFraction:
+	default:
+		return readingUnits{}, errors.New("percentUnit must be percent or fraction")
+	}
+	return units, nil
+}
+
+// This function converts temperature, humidity, soil moisture and light from the units they are stored in.
+func (u readingUnits) fromStored(values [4]*float64) [4]*float64 {
+	return u.scale(values, false)
+}
+
+// This function converts temperature, humidity, soil moisture and light to the units they are stored in.
+func (u readingUnits) toStored(values [4]*float64) [4]*float64 {
+	return u.scale(values, true)
+}
+
+// This function converts from the stored units, or back to them when inverse is set.
+func (u readingUnits) scale(values [4]*float64, inverse bool) [4]*float64 {
+	if t := values[0]; t != nil {
+		var c float64
+		switch {
+		case u.Temperature == unitFahrenheit && inverse:
+			c = (*t - 32) * 5 / 9
+		case u.Temperature == unitFahrenheit:
+			c = *t*9/5 + 32
+		case u.Temperature == unitKelvin && inverse:
+			c = *t - 273.15
+		case u.Temperature == unitKelvin:
+			c = *t + 273.15
+		default:
+			c = *t
+		}
+		values[0] = &c
+	}
+	if u.Percent == unitFraction {
+		for i := 1; i < len(values); i++ {
+			if values[i] != nil {
+				v := *values[i] / 100
+				if inverse {
+					v = *values[i] * 100
+				}
+				values[i] = &v
+			}
+		}
+	}
+	return values
+}
+
+// This function parses the deviceID, from, to, format, timeZone, temperatureUnit and percentUnit
+// parameters of an export. The time zone defaults to loc, which also applies to dates without a time.
+func parseExportQuery(query url.Values, loc *time.Location) (exportOptions, error) {
+	units, err := parseReadingUnits(query)
+	if err != nil {
+		return exportOptions{}, err
+	}
+	options := exportOptions{Format: query.Get("format"), Location: loc, Units: units}
+
+	seen := map[string]bool{}
+	for _, value := range query["deviceID"] {
+		for _, deviceID := range strings.Split(value, ",") {
+			if deviceID = strings.TrimSpace(deviceID); deviceID != "" && !seen[deviceID] {
+				seen[deviceID] = true
+				options.DeviceIDs = append(options.DeviceIDs, deviceID)
+			}
+		}
+	}
+	if len(options.DeviceIDs) == 0 {
+		return exportOptions{}, errors.New("must provide at least one deviceID")
+	}
+
+	if options.Format == "" {
+		options.Format = "csv"
+	}
+	if _, ok := exportFormats[options.Format]; !ok {
+		return exportOptions{}, errors.New("format must be csv, ndjson or parquet")
+	}
+
+	if name := query.Get("timeZone"); name != "" {
+		if options.Location, err = loadTimeZone(name); err != nil {
+			return exportOptions{}, errInvalidTimeZone
+		}
+	}
+
+	if value := query.Get("from"); value != "" {
+		if options.From, err = parseTimeIn(value, options.Location); err != nil {
+			return exportOptions{}, errors.New("from must be a time such as 2021-06-01T00:00:00Z or a date")
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if options.To, err = parseTimeIn(value, options.Location); err != nil {
+			return exportOptions{}, errors.New("to must be a time such as 2021-06-02T00:00:00Z or a date")
+		}
+	}
+	if !options.From.IsZero() && !options.To.IsZero() && !options.From.Before(options.To) {
+		return exportOptions{}, errInvalidRange
+	}
+	return options, nil
+}
+
+// This function returns the columns of the export in order.
+func (options exportOptions) columns() []string {
+	columns := append([]string{}, exportColumns...)
+	for _, m := range options.Metrics {
+		columns = append(columns, m.Name)
+	}
+	return columns
+}
+
+// This function returns the values of the metrics beyond the legacy four in the order of their columns.
+func (options exportOptions) metricValues(row exportRow) []*float64 {
+	values := make([]*float64, len(options.Metrics))
+	for i, m := range options.Metrics {
+		if value, ok := row.Metrics[m.Name]; ok {
+			values[i] = &value
+		}
+	}
+	return values
+}
+
+// This function returns the reading as it is written to json, with its time in loc.
+func (row exportRow) exported(loc *time.Location) ExportedReading {
+	reading := ExportedReading{
+		DeviceID:     row.DeviceID,
+		Temperature:  row.Values[0],
+		Humidity:     row.Values[1],
+		SoilMoisture: row.Values[2],
+		Light:        row.Values[3],
+		Metrics:      row.Metrics,
+	}
+	if !row.Time.IsZero() {
+		t := row.Time.In(loc)
+		reading.Time = &t
+	}
+	return reading
+}
+
+// Something that writes exported readings in a format.
+type readingWriter interface {
+	Write(row exportRow) error
+	// Close writes anything held back, it does not close the underlying writer.
+	Close() error
+}
+
+// This function returns a writer for the format of the export.
+func newReadingWriter(w io.Writer, options exportOptions) readingWriter {
+	switch options.Format {
+	case "ndjson":
+		return &ndjsonReadingWriter{encoder: json.NewEncoder(w), loc: options.Location}
+	case "parquet":
+		names := options.columns()
+		columns := []parquetColumn{
+			{Name: names[0], Type: parquetByteArray, UTF8: true},
+			{Name: names[1], Type: parquetInt64, Timestamp: true},
+		}
+		for _, name := range names[2:] {
+			columns = append(columns, parquetColumn{Name: name, Type: parquetDouble, Optional: true})
+		}
+		metadata := [][2]string{
+			{"timeZone", options.Location.String()},
+			{"temperatureUnit", options.Units.Temperature},
+			{"percentUnit", options.Units.Percent},
+		}
+		return parquetReadingWriter{newParquetWriter(w, columns, metadata), options}
+	default:
+		return &csvReadingWriter{writer: csv.NewWriter(w), options: options}
+	}
+}
+
+type csvReadingWriter struct {
+	writer  *csv.Writer
+	options exportOptions
+	header  bool
+}
+
+func (c *csvReadingWriter) Write(row exportRow) error {
+	if !c.header {
+		c.header = true
+		if err := c.writer.Write(c.options.columns()); err != nil {
+			return err
+		}
+	}
+
+	record := []string{row.DeviceID, ""}
+	if !row.Time.IsZero() {
+		record[1] = row.Time.In(c.options.Location).Format(time.RFC3339)
+	}
+	for _, value := range append(row.Values[:], c.options.metricValues(row)...) {
+		if value != nil {
+			record = append(record, strconv.FormatFloat(*value, 'f', -1, 64))
+		} else {
+			record = append(record, "")
+		}
+	}
+	return c.writer.Write(record)
+}
+
+func (c *csvReadingWriter) Close() error {
+	if !c.header {
+		c.header = true
+		c.writer.Write(c.options.columns())
+	}
+	c.writer.Flush()
+	return c.writer.Error()
+}
+
+type ndjsonReadingWriter struct {
+	encoder *json.Encoder
+	loc     *time.Location
+}
+
+func (n *ndjsonReadingWriter) Write(row exportRow) error {
+	return n.encoder.Encode(row.exported(n.loc))
+}
+
+func (n *ndjsonReadingWriter) Close() error {
+	return nil
+}
+
+type parquetReadingWriter struct {
+	writer  *parquetWriter
+	options exportOptions
+}
+
+func (p parquetReadingWriter) Write(row exportRow) error {
+	values := []interface{}{row.DeviceID, row.Time.UnixNano() / int64(time.Microsecond),
+		row.Values[0], row.Values[1], row.Values[2], row.Values[3]}
+	for _, value := range p.options.metricValues(row) {
+		values = append(values, value)
+	}
+	return p.writer.Write(values)
+}
+
+func (p parquetReadingWriter) Close() error {
+	return p.writer.Close()
+}
+
+// The columns of plant_data p that eachExportRow scans, the metrics beyond the legacy four last.
+const exportRowColumns = `p.device_id, p.time, p.temperature, p.humidity, p.soil_moisture, p.light,
+	(SELECT jsonb_object_agg(m.name, v.value) FROM plant_data_metric v INNER JOIN metric m ON m.id = v.metric_id
+	WHERE v.plant_data_id = p.id)`
+
+// This function scans rows selecting exportRowColumns, converting them from the stored units and calling fn for each.
+// It returns the number of rows fn took.
+func eachExportRow(rows pgx.Rows, units readingUnits, fn func(exportRow) error) (int64, error) {
+	defer rows.Close()
+	var count int64
+	for rows.Next() {
+		var row exportRow
+		var t *time.Time
+		v := &row.Values
+		if err := rows.Scan(&row.DeviceID, &t, &v[0], &v[1], &v[2], &v[3], &row.Metrics); err != nil {
+			return count, err
+		}
+		if t != nil {
+			row.Time = *t
+		}
+		row.Values = units.fromStored(row.Values)
+		if err := fn(row); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, rows.Err()
+}
+
+// DB Query to stream the readings of the devices in the export to w, by device and then oldest first.
+// Rows are written as they are read so the export never has to fit in memory.
+// Readings without a time cannot be placed in a range and are left out. Every metric beyond the legacy four
+// gets a column. It returns the number of readings written.
+func writeReadingsExport(ctx context.Context, db *pgxpool.Pool, w io.Writer, options exportOptions) (int64, error) {
+	var err error
+	if options.Metrics, err = getExtraMetrics(ctx, db); err != nil {
+		return 0, err
+	}
+
+	where := []string{"p.device_id = ANY($1)", "p.time IS NOT NULL"}
+	args := []interface{}{options.DeviceIDs}
+	if !options.From.IsZero() {
+		args = append(args, options.From.UTC())
+		where = append(where, "p.time >= $"+strconv.Itoa(len(args)))
+	}
+	if !options.To.IsZero() {
+		args = append(args, options.To.UTC())
+		where = append(where, "p.time < $"+strconv.Itoa(len(args)))
+	}
+
+	rows, err := db.Query(ctx, `SELECT `+exportRowColumns+` FROM plant_data p
+	WHERE `+strings.Join(where, " AND ")+` ORDER BY p.device_id, p.time, p.id`, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	writer := newReadingWriter(w, options)
+	count, err := eachExportRow(rows, options.Units, writer.Write)
+	if err != nil {
+		return count, err
+	}
+	return count, writer.Close()
+}
+
+// HTTP Call to download the readings of one or more devices, pass deviceID once per device or as a comma separated list
+func (api *API) exportReadings(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		// A single device is exported in its own time zone, several in the time zone of the user
+		query := r.URL.Query()
+		zoneDevice := ""
+		if ids := query["deviceID"]; len(ids) == 1 && !strings.Contains(ids[0], ",") {
+			zoneDevice = ids[0]
+		}
+		loc, err := deviceLocation(api.db, currentUser(r).ID, zoneDevice)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		options, err := parseExportQuery(query, loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, deviceID := range options.DeviceIDs {
+			if !api.allowDevice(w, r, deviceID, readDevice) {
+				return
+			}
+		}
+
+		// Large exports take longer than the server write timeout
+		if err := http.NewResponseController(w).SetWriteDeadline(time.Time{}); err != nil {
+			log.Printf("%s", err)
+		}
+
+		w.Header().Set("Content-Type", exportFormats[options.Format])
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="plantdaddy-readings.%s"`, options.Format))
+		w.Header().Set("Cache-Control", "no-store")
+
+		// Once the export has started the status cannot be changed, so a failure can only be logged
+		if _, err := writeReadingsExport(r.Context(), api.db, w, options); err != nil {
+			log.Printf("readings export for user %d: %s", currentUser(r).ID, err)
+		}
+	}
+}
+
+// A flag that can be given more than once.
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// The export command writes the readings of any devices to a file or stdout.
+func exportCommand(args []string) error {
+	var devices stringsFlag
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.Var(&devices, "device", "device to export, may be given more than once or as a comma separated list")
+	from := flags.String("from", "", "export readings from this time or date")
+	to := flags.String("to", "", "export readings before this time or date")
+	format := flags.String("format", "csv", "csv, ndjson or parquet")
+	timeZone := flags.String("tz", "UTC", "time zone of the times written and of dates without a time")
+	temperatureUnit := flags.String("temperature-unit", unitCelsius, "celsius, fahrenheit or kelvin")
+	percentUnit := flags.String("percent-unit", unitPercent, "percent or fraction")
+	output := flags.String("o", "", "file to write to instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: plantdaddy export -device ID [-device ID...] [-from DATE] [-to DATE] [-format csv] [-o FILE]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	options, err := parseExportQuery(url.Values{
+		"deviceID":        devices,
+		"from":            {*from},
+		"to":              {*to},
+		"format":          {*format},
+		"timeZone":        {*timeZone},
+		"temperatureUnit": {*temperatureUnit},
+		"percentUnit":     {*percentUnit},
+	}, time.UTC)
+	if err != nil {
+		flags.Usage()
+		return err
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+
+	db := connectToDb(os.Getenv("CONNSTRING"))
+	defer db.Close()
+
+	buffered := bufio.NewWriter(out)
+	count, err := writeReadingsExport(context.Background(), db, buffered, options)
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported %d readings from %d devices\n", count, len(options.DeviceIDs))
+	return nil
+}
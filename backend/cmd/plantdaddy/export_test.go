@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseReadingUnits(t *testing.T) {
+	tests := []struct {
+		query string
+		want  readingUnits
+		err   bool
+	}{
+		{"", readingUnits{Temperature: unitCelsius, Percent: unitPercent}, false},
+		{"temperatureUnit=fahrenheit&percentUnit=fraction", readingUnits{Temperature: unitFahrenheit, Percent: unitFraction}, false},
+		{"temperatureUnit=kelvin", readingUnits{Temperature: unitKelvin, Percent: unitPercent}, false},
+		{"temperatureUnit=rankine", readingUnits{}, true},
+		{"percentUnit=permille", readingUnits{}, true},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		units, err := parseReadingUnits(query)
+		if (err != nil) != test.err || units != test.want {
+			t.Errorf("%q: got %+v %v", test.query, units, err)
+		}
+	}
+}
+
+func TestReadingUnitsScale(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	tests := []struct {
+		units  readingUnits
+		stored [4]*float64
+		want   [4]*float64
+	}{
+		{readingUnits{unitCelsius, unitPercent}, [4]*float64{value(20), value(40), value(55), value(80)},
+			[4]*float64{value(20), value(40), value(55), value(80)}},
+		{readingUnits{unitFahrenheit, unitPercent}, [4]*float64{value(100), nil, nil, nil},
+			[4]*float64{value(212), nil, nil, nil}},
+		{readingUnits{unitKelvin, unitFraction}, [4]*float64{value(-273.15), value(50), nil, value(100)},
+			[4]*float64{value(0), value(0.5), nil, value(1)}},
+		{readingUnits{unitCelsius, unitFraction}, [4]*float64{nil, nil, nil, nil},
+			[4]*float64{nil, nil, nil, nil}},
+	}
+
+	for _, test := range tests {
+		got := test.units.fromStored(test.stored)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%+v: got %v, want %v", test.units, floats(got), floats(test.want))
+		}
+		if back := test.units.toStored(got); !reflect.DeepEqual(back, test.stored) {
+			t.Errorf("%+v: came back as %v, want %v", test.units, floats(back), floats(test.stored))
+		}
+	}
+}
+
+// floats returns the values pointed to so they can be printed.
+func floats(values [4]*float64) []string {
+	var out []string
+	for _, v := range values {
+		if v == nil {
+			out = append(out, "nil")
+		} else {
+			out = append(out, strconv.FormatFloat(*v, 'f', -1, 64))
+		}
+	}
+	return out
+}
+
+func TestParseExportQuery(t *testing.T) {
+	vancouver, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  exportOptions
+		err   bool
+	}{
+		{"defaults", "deviceID=a", exportOptions{DeviceIDs: []string{"a"}, Format: "csv", Location: vancouver,
+			Units: readingUnits{unitCelsius, unitPercent}}, false},
+		{"several devices", "deviceID=a,+b&deviceID=c&deviceID=a&format=parquet", exportOptions{DeviceIDs: []string{"a", "b", "c"},
+			Format: "parquet", Location: vancouver, Units: readingUnits{unitCelsius, unitPercent}}, false},
+		{"range in another zone", "deviceID=a&format=ndjson&timeZone=UTC&from=2021-06-01&to=2021-06-02", exportOptions{
+			DeviceIDs: []string{"a"}, Format: "ndjson", Location: time.UTC, Units: readingUnits{unitCelsius, unitPercent},
+			From: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC)}, false},
+		{"no device", "format=csv", exportOptions{}, true},
+		{"empty devices", "deviceID=,", exportOptions{}, true},
+		{"unknown format", "deviceID=a&format=xlsx", exportOptions{}, true},
+		{"unknown zone", "deviceID=a&timeZone=Local", exportOptions{}, true},
+		{"bad from", "deviceID=a&from=today", exportOptions{}, true},
+		{"backwards", "deviceID=a&from=2021-06-02&to=2021-06-01", exportOptions{}, true},
+		{"bad unit", "deviceID=a&temperatureUnit=rankine", exportOptions{}, true},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		options, err := parseExportQuery(query, vancouver)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		} else if !test.err && (!reflect.DeepEqual(options.DeviceIDs, test.want.DeviceIDs) || options.Format != test.want.Format ||
+			options.Location != test.want.Location || options.Units != test.want.Units ||
+			!options.From.Equal(test.want.From) || !options.To.Equal(test.want.To)) {
+			t.Errorf("%s: got %+v, want %+v", test.name, options, test.want)
+		}
+	}
+}
+
+func TestReadingWriters(t *testing.T) {
+	vancouver, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	temperature, light := 21.5, 300.0
+	rows := []exportRow{
+		{DeviceID: "a", Time: time.Date(2021, 6, 1, 19, 0, 0, 0, time.UTC), Values: [4]*float64{&temperature, nil, nil, &light},
+			Metrics: map[string]float64{"ph": 6.5}},
+		{DeviceID: "b", Time: time.Date(2021, 6, 1, 20, 0, 0, 0, time.UTC), Metrics: map[string]float64{"ec": 1.2}},
+	}
+	metrics := []Metric{{Name: "ph"}, {Name: "ec"}}
+	tests := []struct {
+		format  string
+		metrics []Metric
+		rows    []exportRow
+		want    string
+	}{
+		{"csv", nil, rows, "deviceID,time,temperature,humidity,soilMoisture,light\n" +
+			"a,2021-06-01T12:00:00-07:00,21.5,,,300\n" +
+			"b,2021-06-01T13:00:00-07:00,,,,\n"},
+		{"csv", nil, nil, "deviceID,time,temperature,humidity,soilMoisture,light\n"},
+		{"csv", metrics, rows, "deviceID,time,temperature,humidity,soilMoisture,light,ph,ec\n" +
+			"a,2021-06-01T12:00:00-07:00,21.5,,,300,6.5,\n" +
+			"b,2021-06-01T13:00:00-07:00,,,,,,1.2\n"},
+		{"csv", metrics, nil, "deviceID,time,temperature,humidity,soilMoisture,light,ph,ec\n"},
+		{"ndjson", nil, rows, `{"deviceID":"a","time":"2021-06-01T12:00:00-07:00","temperature":21.5,"humidity":null,"soilMoisture":null,"light":300,"metrics":{"ph":6.5}}` + "\n" +
+			`{"deviceID":"b","time":"2021-06-01T13:00:00-07:00","temperature":null,"humidity":null,"soilMoisture":null,"light":null,"metrics":{"ec":1.2}}` + "\n"},
+		{"ndjson", nil, []exportRow{{DeviceID: "c", Time: time.Date(2021, 6, 1, 20, 0, 0, 0, time.UTC)}},
+			`{"deviceID":"c","time":"2021-06-01T13:00:00-07:00","temperature":null,"humidity":null,"soilMoisture":null,"light":null}` + "\n"},
+		{"ndjson", nil, nil, ""},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writer := newReadingWriter(&buf, exportOptions{Format: test.format, Location: vancouver, Metrics: test.metrics})
+		for _, row := range test.rows {
+			if err := writer.Write(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.want {
+			t.Errorf("%s of %d rows: got\n%s\nwant\n%s", test.format, len(test.rows), buf.String(), test.want)
+		}
+	}
+}
+
+func TestParquetReadingWriter(t *testing.T) {
+	temperature := 21.5
+	var buf bytes.Buffer
+	options := exportOptions{Format: "parquet", Location: time.UTC, Units: readingUnits{unitFahrenheit, unitFraction}}
+	options.Metrics = []Metric{{Name: "ph"}, {Name: "ec"}}
+	writer := newReadingWriter(&buf, options)
+	row := exportRow{DeviceID: "a", Time: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), Values: [4]*float64{&temperature},
+		Metrics: map[string]float64{"ec": 1.2}}
+	if err := writer.Write(row); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := readParquet(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the legacy values are converted to the units asked for
+	want := [][]interface{}{{"a", row.Time.UnixNano() / int64(time.Microsecond), 21.5, nil, nil, nil, nil, 1.2}}
+	if !reflect.DeepEqual(file.Columns, options.columns()) || len(file.Columns) != len(exportColumns)+2 || !reflect.DeepEqual(file.Rows, want) ||
+		file.Metadata["temperatureUnit"] != unitFahrenheit || file.Metadata["percentUnit"] != unitFraction {
+		t.Errorf("got %+v", file)
+	}
+}
+
+func TestExportReadings(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "exporter")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	first := createDevice(t, api, user.ID)
+	second := createDevice(t, api, user.ID)
+	stranger := AuthUser{Username: uniqueName(t, "stranger")}
+	stranger.ID = createUser(t, api, stranger.Username, "correct horse battery")
+	theirs := createDevice(t, api, stranger.ID)
+
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	addReading(t, api, first, at, 20)
+	addReading(t, api, first, at.Add(time.Hour), 25)
+	addReading(t, api, second, at.Add(30*time.Minute), 30)
+	addReading(t, api, first, at.AddDate(0, 0, 1), 100)
+
+	w := doJSON(t, asUser(api, user, api.exportReadings), "GET",
+		"/api/readings/export?deviceID="+second+","+first+"&timeZone=UTC&from=2021-06-01&to=2021-06-02&temperatureUnit=fahrenheit", nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" ||
+		!strings.Contains(w.Header().Get("Content-Disposition"), "plantdaddy-readings.csv") {
+		t.Fatalf("export: %d %v", w.Code, w.Header())
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Readings are by device then oldest first
+	want := [][]string{{first, "2021-06-01T12:00:00Z", "68"}, {first, "2021-06-01T13:00:00Z", "77"}, {second, "2021-06-01T12:30:00Z", "86"}}
+	if second < first {
+		want = append(want[2:], want[:2]...)
+	}
+	if len(records) != len(want)+1 {
+		t.Fatalf("got %d records: %v", len(records), records)
+	}
+	for i, record := range records[1:] {
+		if !reflect.DeepEqual(record[:3], want[i]) || record[3] != "40" {
+			t.Errorf("record %d: got %v, want %v", i, record, want[i])
+		}
+	}
+
+	w = doJSON(t, asUser(api, user, api.exportReadings), "GET", "/api/readings/export?deviceID="+first+","+theirs, nil, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("exporting the device of someone else got %d", w.Code)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
+	"sync"
 	"time"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -25,6 +26,19 @@ func HashPassword(password string) (string, error) {
     return string(bytes), err
 }
 
+var dummyHashOnce sync.Once
+var dummyHashValue string
+
+// This function returns a bcrypt hash of a random password, used to keep failed logins for unknown users slow.
+// It is only worked out the first time a login fails so starting the server and commands stays fast.
+func dummyHash() string {
+	dummyHashOnce.Do(func() {
+		b, _ := generateRandomBytes(16)
+		dummyHashValue, _ = HashPassword(hex.EncodeToString(b))
+	})
+	return dummyHashValue
+}
+
 func CheckPasswordHash(password, hash string) bool {
     err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
     return err == nil
@@ -32,7 +46,20 @@ func CheckPasswordHash(password, hash string) bool {
 
 
 
+// This function creates a random token that is handed to a client and only ever stored hashed.
+func newOpaqueToken() (string, error) {
+	b, err := generateRandomBytes(32)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
 
+// This function hashes a token so that it can be stored and looked up in the database.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
 
 // This function hashes the login provided from the struct and 
 //returns the result or the error and a message.
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testAPI returns an API backed by the database in TEST_CONNSTRING, which must have been loaded
+// from db/db.sql. Tests that need a database are skipped when it is not set.
+// Every test makes its own users and devices so tests can share the database.
+func testAPI(t *testing.T) (*API, *MemoryMailer) {
+	t.Helper()
+	connString := os.Getenv("TEST_CONNSTRING")
+	if connString == "" {
+		t.Skip("TEST_CONNSTRING is not set")
+	}
+
+	db, err := pgxpool.Connect(context.Background(), connString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+
+	mailer := &MemoryMailer{}
+	api := &API{
+		db:                   db,
+		tokenSecret:          []byte("a test secret that is long enough to sign with"),
+		accessTokenTTL:       15 * time.Minute,
+		refreshTokenTTL:      time.Hour,
+		sessionTTL:           time.Hour,
+		passwordResetTTL:     time.Hour,
+		emailVerificationTTL: time.Hour,
+		accountDeletionGrace: time.Hour,
+		mailer:               mailer,
+		appURL:               "plantdaddy://app",
+	}
+	api.loginLimiter = NewMemoryLoginLimiter()
+	return api, mailer
+}
+
+// uniqueName returns a name that no other test run uses.
+func uniqueName(t *testing.T, prefix string) string {
+	t.Helper()
+	b, err := generateRandomBytes(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefix + hex.EncodeToString(b)
+}
+
+// createUser signs up a user through the api and returns their id.
+func createUser(t *testing.T, api *API, username string, password string) int64 {
+	t.Helper()
+	w := doJSON(t, api.newUser, "POST", "/api/new-user", UserPass{Username: username, Password: password, Email: username + "@example.com"}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("signing up %s: %d %s", username, w.Code, w.Body)
+	}
+
+	var id int64
+	if err := api.db.QueryRow(context.Background(), `SELECT id FROM auth WHERE username = $1`, username).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// asUser returns the handler wrapped so that it is called as the user.
+func asUser(api *API, user AuthUser, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handler(w, asUserRequest(r, user))
+	}
+}
+
+// doJSON calls a handler with the value encoded as json, or no body if it is nil.
+func doJSON(t *testing.T, handler http.HandlerFunc, method string, target string, v interface{}, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	if v != nil {
+		if err := json.NewEncoder(&body).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r := httptest.NewRequest(method, target, &body)
+	r.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+var mailTokenPattern = regexp.MustCompile(`token=([0-9a-f]+)`)
+
+// waitForMail waits for an email to be sent to the address and returns the token in the link it holds.
+func waitForMail(t *testing.T, mailer *MemoryMailer, to string, subject string) string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, mail := range mailer.Sent() {
+			if mail.To == to && strings.Contains(mail.Subject, subject) {
+				match := mailTokenPattern.FindStringSubmatch(mail.Body)
+				if match == nil {
+					t.Fatalf("mail to %s has no link: %s", to, mail.Body)
+				}
+				return match[1]
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %q mail was sent to %s", subject, to)
+	return ""
+}
+
+// createDevice registers a device to the user straight in the database and returns its id.
+func createDevice(t *testing.T, api *API, userID int64) string {
+	t.Helper()
+	deviceID := uniqueName(t, "device-")
+	_, err := api.db.Exec(context.Background(), `INSERT INTO registered_devices(device_id, register_date, user_id, device_name, device_secret)
+	VALUES ($1, $2, $3, $4, $5)`, deviceID, time.Now().UTC(), userID, "Fern", "a device secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return deviceID
+}
+
+// asUserRequest returns the request made as the user.
+func asUserRequest(r *http.Request, user AuthUser) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userContextKey, user))
+}
+
+// bearerHeader returns an Authorization header holding a fresh access token for the user.
+func bearerHeader(t *testing.T, api *API, user AuthUser) http.Header {
+	t.Helper()
+	version, err := getTokenVersion(context.Background(), api.db, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.TokenVersion = version
+	token, err := newAccessToken(api.tokenSecret, user, api.accessTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return http.Header{"Authorization": {"Bearer " + token.AccessToken}}
+}
+
+// addReading stores a reading of the device straight in the database.
+func addReading(t *testing.T, api *API, deviceID string, at time.Time, temperature float64) {
+	t.Helper()
+	_, err := api.db.Exec(context.Background(), `INSERT INTO plant_data(device_id, temperature, humidity, soil_moisture, light, time)
+	VALUES ($1, $2, 40, 55, 300, $3)`, deviceID, temperature, at.UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startSession gives the device a fresh session straight in the database and returns it.
+func startSession(t *testing.T, api *API, deviceID string) Session {
+	t.Helper()
+	session := Session{SessionID: uniqueName(t, "session-"), UsageCounter: 100, Timestamp: time.Now().UTC()}
+	_, err := api.db.Exec(context.Background(), `INSERT INTO session(session_id, usage_time, usage, device_id, issued_at) VALUES ($1, $2, $3, $4, $2)
+	ON CONFLICT (device_id) DO UPDATE SET session_id = $1, usage_time = $2, usage = $3, issued_at = $2`,
+		session.SessionID, session.Timestamp, session.UsageCounter, deviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return session
+}
@@ -0,0 +1,317 @@
+package main
+
+// This file pages through the raw readings of a device, for the history view of the app and for syncing
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const defaultReadingsLimit = 100
+const maxReadingsLimit = 1000
+
+var errInvalidCursor = errors.New("cursor is not valid, pass the nextCursor of the previous page")
+
+// The metrics a reading can be asked for, and the column each is stored in.
+// Columns are only ever taken from this map.
+var readingMetrics = map[string]string{
+	"temperature":  "temperature",
+	"humidity":     "humidity",
+	"soilMoisture": "soil_moisture",
+	"light":        "light",
+}
+
+// The metrics returned when none are asked for, in the order they are selected.
+var allReadingMetrics = []string{"temperature", "humidity", "soilMoisture", "light"}
+
+// The position of a reading in the order of a device's history.
+// The id breaks ties between readings sent at the same time.
+type readingCursor struct {
+	Time time.Time
+	ID   int64
+}
+
+// This function encodes a cursor so it can be handed to the client and passed back unchanged.
+func (c readingCursor) String() string {
+	value := strconv.FormatInt(c.Time.UnixNano(), 10) + "." + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(value))
+}
+
+// This function decodes a cursor made by String.
+func parseReadingCursor(value string) (readingCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return readingCursor{}, errInvalidCursor
+	}
+	parts := strings.Split(string(raw), ".")
+	if len(parts) != 2 {
+		return readingCursor{}, errInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return readingCursor{}, errInvalidCursor
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return readingCursor{}, errInvalidCursor
+	}
+	return readingCursor{Time: time.Unix(0, nanos).UTC(), ID: id}, nil
+}
+
+// The parameters of a page of raw readings.
+type readingsPage struct {
+	From    time.Time
+	To      time.Time
+	Metrics []string
+	// The ids of the asked for metrics that are not legacy ones, filled in from the registry.
+	MetricIDs map[string]int64
+	// Newest first unless true.
+	Ascending bool
+	After     *readingCursor
+	Limit     int
+}
+
+// This function parses the from, to, metrics, order, cursor and limit parameters of a page of raw readings.
+// The range is optional at both ends and dates without a time are midnight in loc.
+func parseReadingsPage(r *http.Request, loc *time.Location) (readingsPage, error) {
+	query := r.URL.Query()
+	page := readingsPage{Metrics: allReadingMetrics, Limit: defaultReadingsLimit}
+
+	var err error
+	if value := query.Get("from"); value != "" {
+		if page.From, err = parseTimeIn(value, loc); err != nil {
+			return readingsPage{}, errors.New("from must be a time such as 2021-06-01T00:00:00Z or a date")
+		}
+	}
+	if value := query.Get("to"); value != "" {
+		if page.To, err = parseTimeIn(value, loc); err != nil {
+			return readingsPage{}, errors.New("to must be a time such as 2021-06-02T00:00:00Z or a date")
+		}
+	}
+	if !page.From.IsZero() && !page.To.IsZero() && !page.From.Before(page.To) {
+		return readingsPage{}, errInvalidRange
+	}
+
+	if value := query.Get("metrics"); value != "" {
+		page.Metrics = nil
+		seen := map[string]bool{}
+		for _, metric := range strings.Split(value, ",") {
+			metric = strings.TrimSpace(metric)
+			if !metricNamePattern.MatchString(metric) {
+				return readingsPage{}, errors.New("metrics must be a list of metric names such as temperature,humidity")
+			}
+			if !seen[metric] {
+				seen[metric] = true
+				page.Metrics = append(page.Metrics, metric)
+			}
+		}
+	}
+
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		page.Ascending = true
+	default:
+		return readingsPage{}, errors.New("order must be asc or desc")
+	}
+
+	if value := query.Get("cursor"); value != "" {
+		cursor, err := parseReadingCursor(value)
+		if err != nil {
+			return readingsPage{}, err
+		}
+		page.After = &cursor
+	}
+
+	if value := query.Get("limit"); value != "" {
+		if page.Limit, err = strconv.Atoi(value); err != nil || page.Limit <= 0 || page.Limit > maxReadingsLimit {
+			return readingsPage{}, errors.New("limit must be between 1 and " + strconv.Itoa(maxReadingsLimit))
+		}
+	}
+	return page, nil
+}
+
+// DB Query to get a page of the raw readings of a device, and the cursor of the next page if there is one.
+// Readings without a time cannot be placed in the history and are left out.
+func getRawReadingsDB(db *pgxpool.Pool, deviceID string, page readingsPage, loc *time.Location) ([]RawReading, *readingCursor, error) {
+	where := []string{"device_id = $1", "time IS NOT NULL"}
+	args := []interface{}{deviceID}
+	if !page.From.IsZero() {
+		args = append(args, page.From.UTC())
+		where = append(where, "time >= $"+strconv.Itoa(len(args)))
+	}
+	if !page.To.IsZero() {
+		args = append(args, page.To.UTC())
+		where = append(where, "time < $"+strconv.Itoa(len(args)))
+	}
+	order := "DESC"
+	compare := "<"
+	if page.Ascending {
+		order = "ASC"
+		compare = ">"
+	}
+	if page.After != nil {
+		args = append(args, page.After.Time, page.After.ID)
+		where = append(where, "(time, id) "+compare+" ($"+strconv.Itoa(len(args)-1)+", $"+strconv.Itoa(len(args))+")")
+	}
+
+	// Legacy metrics have their own column, the others are looked up by the id of their metric
+	columns := make([]string, len(page.Metrics))
+	for i, metric := range page.Metrics {
+		if column, ok := readingMetrics[metric]; ok {
+			columns[i] = column
+		} else {
+			args = append(args, page.MetricIDs[metric])
+			columns[i] = "(SELECT value FROM plant_data_metric WHERE plant_data_id = plant_data.id AND metric_id = $" + strconv.Itoa(len(args)) + ")"
+		}
+	}
+	selected := ""
+	if len(columns) > 0 {
+		selected = ", " + strings.Join(columns, ", ")
+	}
+
+	// One more than the page is read to tell if there is a next page.
+	args = append(args, page.Limit+1)
+
+	rows, err := db.Query(context.Background(), `SELECT id, time`+selected+` FROM plant_data
+	WHERE `+strings.Join(where, " AND ")+`
+	ORDER BY time `+order+`, id `+order+` LIMIT $`+strconv.Itoa(len(args)), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	readings := []RawReading{}
+	for rows.Next() {
+		var reading RawReading
+		values := make([]*float64, len(page.Metrics))
+		dest := []interface{}{&reading.ID, &reading.Time}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, nil, err
+		}
+		reading.Metrics = make(map[string]*float64, len(page.Metrics))
+		for i, metric := range page.Metrics {
+			reading.Metrics[metric] = values[i]
+		}
+		readings = append(readings, reading)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	var next *readingCursor
+	if len(readings) > page.Limit {
+		readings = readings[:page.Limit]
+		last := readings[len(readings)-1]
+		next = &readingCursor{Time: last.Time, ID: last.ID}
+	}
+	for i := range readings {
+		readings[i].Time = readings[i].Time.In(loc)
+	}
+	return readings, next, nil
+}
+
+// HTTP Call for the resources of a single device, such as /api/devices/{id}/readings
+func (api *API) deviceResource(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/devices/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch parts[1] {
+	case "readings":
+		api.getRawReadings(w, r, parts[0])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// HTTP Call to page through the raw readings of a device, pass the nextCursor of a page to get the one after it
+func (api *API) getRawReadings(w http.ResponseWriter, r *http.Request, deviceID string) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		if !api.allowDevice(w, r, deviceID, readDevice) {
+			return
+		}
+
+		loc, err := deviceLocation(api.db, currentUser(r).ID, deviceID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		page, err := parseReadingsPage(r, loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := api.resolveMetrics(r.Context(), &page); err != nil {
+			if errors.Is(err, errInvalidMetric) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		readings, next, err := getRawReadingsDB(api.db, deviceID, page, loc)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		result := RawReadings{DeviceID: deviceID, TimeZone: loc.String(), Order: "desc", Readings: readings}
+		if page.Ascending {
+			result.Order = "asc"
+		}
+		if next != nil {
+			result.NextCursor = next.String()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// This function finds the metrics of a page that are not legacy ones in the registry.
+func (api *API) resolveMetrics(ctx context.Context, page *readingsPage) error {
+	var names []string
+	for _, metric := range page.Metrics {
+		if _, ok := readingMetrics[metric]; !ok {
+			names = append(names, metric)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	metrics, err := getMetricsDB(ctx, api.db, names)
+	if err != nil {
+		return err
+	}
+	page.MetricIDs = make(map[string]int64, len(metrics))
+	for _, m := range metrics {
+		page.MetricIDs[m.Name] = m.ID
+	}
+	for _, name := range names {
+		if _, ok := page.MetricIDs[name]; !ok {
+			return fmt.Errorf("%w: %s is not a registered metric", errInvalidMetric, name)
+		}
+	}
+	return nil
+}
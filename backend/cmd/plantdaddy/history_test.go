@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadingCursor(t *testing.T) {
+	cursors := []readingCursor{
+		{Time: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), ID: 1},
+		{Time: time.Date(2021, 6, 1, 12, 0, 0, 123456000, time.UTC), ID: 9007199254740993},
+		{Time: time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), ID: 0},
+	}
+	for _, cursor := range cursors {
+		got, err := parseReadingCursor(cursor.String())
+		if err != nil || !got.Time.Equal(cursor.Time) || got.ID != cursor.ID {
+			t.Errorf("%+v came back as %+v %v", cursor, got, err)
+		}
+	}
+
+	encode := func(s string) string { return base64.RawURLEncoding.EncodeToString([]byte(s)) }
+	invalid := []string{
+		"",
+		"not base64!",
+		encode("1622548800000000000"),
+		encode("1622548800000000000.1.2"),
+		encode("noon.1"),
+		encode("1622548800000000000.one"),
+	}
+	for _, value := range invalid {
+		if _, err := parseReadingCursor(value); err != errInvalidCursor {
+			t.Errorf("%q: got error %v, want %v", value, err, errInvalidCursor)
+		}
+	}
+}
+
+func TestParseReadingsPage(t *testing.T) {
+	cursor := readingCursor{Time: time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), ID: 7}
+	tests := []struct {
+		name  string
+		query string
+		want  readingsPage
+		err   bool
+	}{
+		{"defaults", "", readingsPage{Metrics: allReadingMetrics, Limit: defaultReadingsLimit}, false},
+		{"range", "from=2021-06-01&to=2021-06-02T00:00:00Z", readingsPage{
+			From: time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), To: time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC),
+			Metrics: allReadingMetrics, Limit: defaultReadingsLimit}, false},
+		{"metrics", "metrics=light,+humidity,light,co2", readingsPage{
+			Metrics: []string{"light", "humidity", "co2"}, Limit: defaultReadingsLimit}, false},
+		{"ascending", "order=asc&limit=5&cursor=" + cursor.String(), readingsPage{
+			Metrics: allReadingMetrics, Ascending: true, After: &cursor, Limit: 5}, false},
+		{"descending", "order=desc&limit=1000", readingsPage{Metrics: allReadingMetrics, Limit: maxReadingsLimit}, false},
+		{"empty range", "from=2021-06-01&to=2021-06-01", readingsPage{}, true},
+		{"bad from", "from=yesterday", readingsPage{}, true},
+		{"bad to", "to=tomorrow", readingsPage{}, true},
+		{"bad metric", "metrics=temperature,%3Bdrop+table", readingsPage{}, true},
+		{"empty metric", "metrics=temperature,", readingsPage{}, true},
+		{"bad order", "order=newest", readingsPage{}, true},
+		{"bad cursor", "cursor=abc", readingsPage{}, true},
+		{"zero limit", "limit=0", readingsPage{}, true},
+		{"limit too high", "limit=1001", readingsPage{}, true},
+		{"limit not a number", "limit=ten", readingsPage{}, true},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/devices/probe/readings?"+test.query, nil)
+		page, err := parseReadingsPage(r, time.UTC)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		} else if !reflect.DeepEqual(page, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, page, test.want)
+		}
+	}
+}
+
+func TestRawReadingsPages(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "reader")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	deviceID := createDevice(t, api, user.ID)
+
+	// Two readings share a time so the id has to break the tie
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, offset := range []time.Duration{0, time.Minute, time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		addReading(t, api, deviceID, at.Add(offset), float64(i))
+	}
+
+	readAll := func(query string) []float64 {
+		t.Helper()
+		var temperatures []float64
+		cursor := ""
+		for pages := 0; pages < 10; pages++ {
+			w := doJSON(t, asUser(api, user, api.deviceResource), "GET",
+				"/api/devices/"+deviceID+"/readings?limit=2&"+query+"&cursor="+cursor, nil, nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: %d %s", query, w.Code, w.Body)
+			}
+			var page RawReadings
+			if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+				t.Fatal(err)
+			}
+			if len(page.Readings) > 2 {
+				t.Fatalf("%s: got %d readings on a page", query, len(page.Readings))
+			}
+			for _, reading := range page.Readings {
+				if len(reading.Metrics) != 1 || reading.Metrics["temperature"] == nil {
+					t.Fatalf("%s: got metrics %v", query, reading.Metrics)
+				}
+				temperatures = append(temperatures, *reading.Metrics["temperature"])
+			}
+			if page.NextCursor == "" {
+				return temperatures
+			}
+			cursor = page.NextCursor
+		}
+		t.Fatalf("%s: the pages never ended", query)
+		return nil
+	}
+
+	tests := []struct {
+		query string
+		want  []float64
+	}{
+		{"order=asc&metrics=temperature", []float64{0, 1, 2, 3, 4}},
+		{"metrics=temperature", []float64{4, 3, 2, 1, 0}},
+		{"order=asc&metrics=temperature&from=2021-06-01T12:01:00Z&to=2021-06-01T12:03:00Z", []float64{1, 2, 3}},
+	}
+	for _, test := range tests {
+		if got := readAll(test.query); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.query, got, test.want)
+		}
+	}
+
+	w := doJSON(t, asUser(api, user, api.deviceResource), "GET", "/api/devices/"+deviceID+"/readings?metrics=notAMetric", nil, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("an unknown metric got %d", w.Code)
+	}
+	w = doJSON(t, asUser(api, user, api.deviceResource), "GET", "/api/devices/"+deviceID+"/history", nil, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("an unknown resource got %d", w.Code)
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+// This file handles households, the groups of users that look after the same devices
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// How long an invitation can be accepted for.
+const invitationTTL = 7 * 24 * time.Hour
+
+var errHouseholdNotFound = errors.New("household not found")
+var errUserNotFound = errors.New("user not found")
+var errInvitationNotFound = errors.New("invitation not found or has expired")
+var errAlreadyMember = errors.New("user is already a member of the household")
+var errLastOwner = errors.New("a household must keep at least one owner")
+
+// This function checks that a role is one a member can be given.
+func validRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// DB Query to find the role a user has in a household.
+func householdRole(ctx context.Context, q pgxQuerier, householdID int64, userID int64) (string, error) {
+	var role string
+	err := q.QueryRow(ctx, `SELECT role FROM household_member WHERE household_id = $1 AND user_id = $2`,
+		householdID, userID).Scan(&role)
+	if err == pgx.ErrNoRows {
+		return "", errHouseholdNotFound
+	}
+	return role, err
+}
+
+// The query methods shared by the pool and transactions.
+type pgxQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// DB Query to create a household with the user as its owner.
+func insertHousehold(db *pgxpool.Pool, userID int64, name string) (Household, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return Household{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	household := Household{Name: name, Role: roleOwner}
+	err = tx.QueryRow(ctx, `INSERT INTO household(name, created_by, created_at) VALUES ($1, $2, $3) RETURNING id`,
+		name, userID, time.Now().UTC()).Scan(&household.ID)
+	if err != nil {
+		return Household{}, err
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO household_member(household_id, user_id, role) VALUES ($1, $2, $3)`,
+		household.ID, userID, roleOwner)
+	if err != nil {
+		return Household{}, err
+	}
+	return household, tx.Commit(ctx)
+}
+
+// DB Query to get every household the user belongs to along with its members.
+func getHouseholdsDB(db *pgxpool.Pool, userID int64) ([]Household, error) {
+	rows, err := db.Query(context.Background(), `SELECT h.id, h.name, m.role FROM household h
+	INNER JOIN household_member m ON m.household_id = h.id
+	WHERE m.user_id = $1 ORDER BY h.name`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	households := []Household{}
+	for rows.Next() {
+		var household Household
+		if err := rows.Scan(&household.ID, &household.Name, &household.Role); err != nil {
+			return nil, err
+		}
+		households = append(households, household)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range households {
+		members, err := db.Query(context.Background(), `SELECT a.id, a.username, m.role FROM household_member m
+		INNER JOIN auth a ON a.id = m.user_id
+		WHERE m.household_id = $1 ORDER BY a.username`, households[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		households[i].Members = []HouseholdMember{}
+		for members.Next() {
+			var member HouseholdMember
+			if err := members.Scan(&member.UserID, &member.Username, &member.Role); err != nil {
+				members.Close()
+				return nil, err
+			}
+			households[i].Members = append(households[i].Members, member)
+		}
+		members.Close()
+		if err := members.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return households, nil
+}
+
+// DB Query to invite a user to a household. Only owners of the household may invite.
+// The email of the invited user is returned so they can be told about it.
+func insertInvitation(db *pgxpool.Pool, userID int64, invite NewInvitation) (string, error) {
+	ctx := context.Background()
+	role, err := householdRole(ctx, db, invite.HouseholdID, userID)
+	if err != nil {
+		return "", err
+	}
+	if role != roleOwner {
+		return "", errForbidden
+	}
+
+	var inviteeID int64
+	var email *string
+	err = db.QueryRow(ctx, `SELECT id, CASE WHEN email_verified THEN email END FROM auth WHERE LOWER(username) = LOWER($1)`,
+		invite.Username).Scan(&inviteeID, &email)
+	if err == pgx.ErrNoRows {
+		return "", errUserNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	if _, err := householdRole(ctx, db, invite.HouseholdID, inviteeID); err == nil {
+		return "", errAlreadyMember
+	} else if !errors.Is(err, errHouseholdNotFound) {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	// Inviting someone again replaces the invitation they have not answered yet
+	_, err = db.Exec(ctx, `INSERT INTO household_invitation(household_id, user_id, role, invited_by, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (household_id, user_id) WHERE accepted_at IS NULL AND declined_at IS NULL
+	DO UPDATE SET role = EXCLUDED.role, invited_by = EXCLUDED.invited_by, created_at = EXCLUDED.created_at,
+	expires_at = EXCLUDED.expires_at`, invite.HouseholdID, inviteeID, invite.Role, userID, now, now.Add(invitationTTL))
+	if err != nil {
+		return "", err
+	}
+
+	if email == nil {
+		return "", nil
+	}
+	return *email, nil
+}
+
+// DB Query to get the invitations the user has not answered yet.
+func getInvitationsDB(db *pgxpool.Pool, userID int64) ([]Invitation, error) {
+	rows, err := db.Query(context.Background(), `SELECT i.id, h.id, h.name, i.role, COALESCE(a.username, ''), i.expires_at
+	FROM household_invitation i
+	INNER JOIN household h ON h.id = i.household_id
+	LEFT JOIN auth a ON a.id = i.invited_by
+	WHERE i.user_id = $1 AND i.accepted_at IS NULL AND i.declined_at IS NULL AND i.expires_at > $2
+	ORDER BY i.created_at`, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []Invitation{}
+	for rows.Next() {
+		var invitation Invitation
+		err := rows.Scan(&invitation.ID, &invitation.HouseholdID, &invitation.HouseholdName,
+			&invitation.Role, &invitation.InvitedBy, &invitation.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, invitation)
+	}
+	return invitations, rows.Err()
+}
+
+// DB Query to accept or decline an invitation sent to the user.
+func answerInvitation(db *pgxpool.Pool, userID int64, invitationID int64, accept bool) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+	var householdID int64
+	var role string
+	err = tx.QueryRow(ctx, `SELECT household_id, role FROM household_invitation
+	WHERE id = $1 AND user_id = $2 AND accepted_at IS NULL AND declined_at IS NULL AND expires_at > $3
+	FOR UPDATE`, invitationID, userID, now).Scan(&householdID, &role)
+	if err == pgx.ErrNoRows {
+		return errInvitationNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if !accept {
+		if _, err := tx.Exec(ctx, `UPDATE household_invitation SET declined_at = $1 WHERE id = $2`, now, invitationID); err != nil {
+			return err
+		}
+		return tx.Commit(ctx)
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE household_invitation SET accepted_at = $1 WHERE id = $2`, now, invitationID); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO household_member(household_id, user_id, role) VALUES ($1, $2, $3)
+	ON CONFLICT (household_id, user_id) DO NOTHING`, householdID, userID, role)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DB Query to lock a household inside of a transaction, so changes to its owners are made one at a time.
+func lockHousehold(ctx context.Context, tx pgx.Tx, householdID int64) error {
+	var id int64
+	err := tx.QueryRow(ctx, `SELECT id FROM household WHERE id = $1 FOR UPDATE`, householdID).Scan(&id)
+	if err == pgx.ErrNoRows {
+		return errHouseholdNotFound
+	}
+	return err
+}
+
+// DB Query to remove a member from a household. Owners may remove anyone, everyone else may only leave.
+// The household is locked before the owners are counted, so two owners removing each other at once
+// cannot leave it without one.
+func removeMember(db *pgxpool.Pool, userID int64, householdID int64, memberID int64) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := lockHousehold(ctx, tx, householdID); err != nil {
+		return err
+	}
+	role, err := householdRole(ctx, tx, householdID, userID)
+	if err != nil {
+		return err
+	}
+	if memberID != userID && role != roleOwner {
+		return errForbidden
+	}
+
+	memberRole, err := householdRole(ctx, tx, householdID, memberID)
+	if err != nil {
+		return err
+	}
+	if memberRole == roleOwner {
+		var owners int
+		err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM household_member WHERE household_id = $1 AND role = $2`,
+			householdID, roleOwner).Scan(&owners)
+		if err != nil {
+			return err
+		}
+		if owners <= 1 {
+			return errLastOwner
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `DELETE FROM household_member WHERE household_id = $1 AND user_id = $2`, householdID, memberID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DB Query to share a device with a household, or stop sharing it when householdID is nil.
+// The user must be an owner of the household the device is being shared with.
+func setDeviceHousehold(db *pgxpool.Pool, userID int64, deviceID string, householdID *int64) error {
+	ctx := context.Background()
+	if householdID != nil {
+		role, err := householdRole(ctx, db, *householdID, userID)
+		if err != nil {
+			return err
+		}
+		if role != roleOwner {
+			return errForbidden
+		}
+	}
+
+	_, err := db.Exec(ctx, `UPDATE registered_devices SET household_id = $1 WHERE device_id = $2`, householdID, deviceID)
+	return err
+}
+
+// this function writes the error from a household query
+func householdError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errHouseholdNotFound), errors.Is(err, errUserNotFound), errors.Is(err, errInvitationNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errAlreadyMember), errors.Is(err, errLastOwner):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// HTTP Call to list the households of the user or create a new one
+func (api *API) households(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	switch r.Method {
+	case "GET":
+		households, err := getHouseholdsDB(api.db, currentUser(r).ID)
+		if err != nil {
+			householdError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(households)
+
+	case "POST":
+		var request NewHousehold
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+		if request.Name == "" {
+			http.Error(w, "Must provide name", http.StatusBadRequest)
+			return
+		}
+
+		household, err := insertHousehold(api.db, currentUser(r).ID, request.Name)
+		if err != nil {
+			householdError(w, err)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditHouseholdCreate, After: household})
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(household)
+	}
+}
+
+// HTTP Call to invite another user into a household with a role
+func (api *API) inviteMember(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var request NewInvitation
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+		if !validRole(request.Role) {
+			http.Error(w, "role must be viewer, caretaker or owner", http.StatusBadRequest)
+			return
+		}
+
+		email, err := insertInvitation(api.db, currentUser(r).ID, request)
+		if err != nil {
+			householdError(w, err)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditMemberInvite, After: request})
+
+		if email != "" {
+			sendMailAsync(api.mailer, Mail{
+				To:      email,
+				Subject: "You have been invited to a Plant Daddy household",
+				Body: fmt.Sprintf("%s has invited you to help look after their plants as a %s.\n\n"+
+					"Open the Plant Daddy app to accept the invitation, it expires in %s.\n",
+					currentUser(r).Username, request.Role, invitationTTL),
+			})
+		}
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// HTTP Call to list the invitations waiting for the user
+func (api *API) getInvitations(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		invitations, err := getInvitationsDB(api.db, currentUser(r).ID)
+		if err != nil {
+			householdError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(invitations)
+	}
+}
+
+// This function returns a handler that accepts or declines an invitation
+func (api *API) answerInvitation(accept bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method == "POST" {
+			var request InvitationAnswer
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			err := decoder.Decode(&request)
+
+			if jsonDecoder(err, w) != nil {
+				return
+			}
+
+			if err := answerInvitation(api.db, currentUser(r).ID, request.InvitationID, accept); err != nil {
+				householdError(w, err)
+				return
+			}
+			if accept {
+				api.audit(r, AuditEvent{Action: auditMemberJoin, After: request})
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}
+}
+
+// HTTP Call to remove a member from a household, or leave it
+func (api *API) removeMember(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "DELETE" {
+		householdID, err := strconv.ParseInt(r.URL.Query().Get("householdID"), 10, 64)
+		if err != nil {
+			http.Error(w, "Must provide householdID", http.StatusBadRequest)
+			return
+		}
+		userID, err := strconv.ParseInt(r.URL.Query().Get("userID"), 10, 64)
+		if err != nil {
+			http.Error(w, "Must provide userID", http.StatusBadRequest)
+			return
+		}
+
+		if err := removeMember(api.db, currentUser(r).ID, householdID, userID); err != nil {
+			householdError(w, err)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditMemberRemove, Before: map[string]int64{"householdID": householdID, "userID": userID}})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HTTP Call to share a device with a household or, with DELETE, stop sharing it
+func (api *API) shareDevice(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	switch r.Method {
+	case "POST":
+		var request ShareDevice
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+		if !api.allowDevice(w, r, request.DeviceID, manageDevice) {
+			return
+		}
+		ownerID, before, err := getDeviceState(api.db, request.DeviceID)
+		if err != nil {
+			householdError(w, err)
+			return
+		}
+
+		if err := setDeviceHousehold(api.db, currentUser(r).ID, request.DeviceID, &request.HouseholdID); err != nil {
+			householdError(w, err)
+			return
+		}
+		api.audit(r, AuditEvent{UserID: ownerID, Action: auditDeviceShare, DeviceID: request.DeviceID,
+			Before: map[string]*int64{"householdID": before.HouseholdID},
+			After:  map[string]*int64{"householdID": &request.HouseholdID}})
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		deviceID := r.URL.Query().Get("deviceID")
+		if !api.allowDevice(w, r, deviceID, manageDevice) {
+			return
+		}
+		ownerID, before, err := getDeviceState(api.db, deviceID)
+		if err != nil {
+			householdError(w, err)
+			return
+		}
+
+		if err := setDeviceHousehold(api.db, currentUser(r).ID, deviceID, nil); err != nil {
+			householdError(w, err)
+			return
+		}
+		api.audit(r, AuditEvent{UserID: ownerID, Action: auditDeviceUnshare, DeviceID: deviceID,
+			Before: map[string]*int64{"householdID": before.HouseholdID}})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// setUpHousehold creates a household of the owner with the member in it as the role.
+func setUpHousehold(t *testing.T, api *API, owner AuthUser, member AuthUser, role string) int64 {
+	t.Helper()
+	w := doJSON(t, asUser(api, owner, api.households), "POST", "/api/households", NewHousehold{Name: "Home"}, nil)
+	var household Household
+	if err := json.NewDecoder(w.Body).Decode(&household); err != nil || w.Code != http.StatusCreated {
+		t.Fatalf("creating a household: %d %v", w.Code, err)
+	}
+
+	w = doJSON(t, asUser(api, owner, api.inviteMember), "POST", "/api/households/invite",
+		NewInvitation{HouseholdID: household.ID, Username: member.Username, Role: role}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("invite: %d %s", w.Code, w.Body)
+	}
+	invitations, err := getInvitationsDB(api.db, member.ID)
+	if err != nil || len(invitations) != 1 {
+		t.Fatalf("got invitations %+v: %v", invitations, err)
+	}
+	w = doJSON(t, asUser(api, member, api.answerInvitation(true)), "POST", "/api/households/accept",
+		InvitationAnswer{InvitationID: invitations[0].ID}, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("accept: %d %s", w.Code, w.Body)
+	}
+	return household.ID
+}
+
+func TestOnlyTheRegistrantManagesADevice(t *testing.T) {
+	api, _ := testAPI(t)
+	registrant := AuthUser{Username: uniqueName(t, "registrant")}
+	registrant.ID = createUser(t, api, registrant.Username, "correct horse battery")
+	coOwner := AuthUser{Username: uniqueName(t, "coowner")}
+	coOwner.ID = createUser(t, api, coOwner.Username, "correct horse battery")
+
+	householdID := setUpHousehold(t, api, registrant, coOwner, roleOwner)
+	deviceID := createDevice(t, api, registrant.ID)
+	w := doJSON(t, asUser(api, registrant, api.shareDevice), "POST", "/api/households/devices",
+		ShareDevice{DeviceID: deviceID, HouseholdID: householdID}, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("share: %d %s", w.Code, w.Body)
+	}
+
+	for _, action := range []deviceAction{readDevice, careDevice} {
+		if err := authorizeDevice(api.db, coOwner.ID, deviceID, action); err != nil {
+			t.Errorf("a household owner cannot take action %d: %v", action, err)
+		}
+	}
+	if err := authorizeDevice(api.db, coOwner.ID, deviceID, manageDevice); err != errForbidden {
+		t.Errorf("a household owner managing the device got %v, want %v", err, errForbidden)
+	}
+	if err := authorizeDevice(api.db, registrant.ID, deviceID, manageDevice); err != nil {
+		t.Errorf("the registrant cannot manage the device: %v", err)
+	}
+
+	requests := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		target  string
+		body    interface{}
+	}{
+		{"delete", api.deleteDevice, "DELETE", "/api/delete-device?deviceID=" + deviceID, nil},
+		{"rotate secret", api.newDeviceSecret, "POST", "/api/device-secret?deviceID=" + deviceID, nil},
+		{"unshare", api.shareDevice, "DELETE", "/api/households/devices?deviceID=" + deviceID, nil},
+		{"transfer", api.transferDevice, "POST", "/api/devices/transfer", NewTransfer{DeviceID: deviceID, Username: coOwner.Username}},
+	}
+	for _, request := range requests {
+		w := doJSON(t, asUser(api, coOwner, request.handler), request.method, request.target, request.body, nil)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s by a household owner got %d, want %d", request.name, w.Code, http.StatusForbidden)
+		}
+	}
+	if _, _, err := getDeviceState(api.db, deviceID); err != nil {
+		t.Errorf("the device is gone: %v", err)
+	}
+}
+
+func TestPendingInvitations(t *testing.T) {
+	api, _ := testAPI(t)
+	owner := AuthUser{Username: uniqueName(t, "owner")}
+	owner.ID = createUser(t, api, owner.Username, "correct horse battery")
+	invitee := AuthUser{Username: uniqueName(t, "invitee")}
+	invitee.ID = createUser(t, api, invitee.Username, "correct horse battery")
+
+	w := doJSON(t, asUser(api, owner, api.households), "POST", "/api/households", NewHousehold{Name: "Home"}, nil)
+	var household Household
+	if err := json.NewDecoder(w.Body).Decode(&household); err != nil {
+		t.Fatal(err)
+	}
+
+	// Inviting twice leaves one invitation with the latest role
+	for _, role := range []string{roleViewer, roleCaretaker} {
+		w := doJSON(t, asUser(api, owner, api.inviteMember), "POST", "/api/households/invite",
+			NewInvitation{HouseholdID: household.ID, Username: invitee.Username, Role: role}, nil)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("invite as %s: %d %s", role, w.Code, w.Body)
+		}
+	}
+	invitations, err := getInvitationsDB(api.db, invitee.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invitations) != 1 || invitations[0].Role != roleCaretaker || invitations[0].InvitedBy != owner.Username {
+		t.Fatalf("got invitations %+v", invitations)
+	}
+
+	// An invitation is still listed once the account that sent it is gone
+	if _, err := api.db.Exec(context.Background(), `UPDATE household_invitation SET invited_by = NULL WHERE id = $1`, invitations[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	invitations, err = getInvitationsDB(api.db, invitee.ID)
+	if err != nil || len(invitations) != 1 || invitations[0].InvitedBy != "" {
+		t.Errorf("got invitations %+v: %v", invitations, err)
+	}
+}
+
+func TestOwnersRemovingEachOther(t *testing.T) {
+	api, _ := testAPI(t)
+	first := AuthUser{Username: uniqueName(t, "owner")}
+	first.ID = createUser(t, api, first.Username, "correct horse battery")
+	second := AuthUser{Username: uniqueName(t, "owner")}
+	second.ID = createUser(t, api, second.Username, "correct horse battery")
+	householdID := setUpHousehold(t, api, first, second, roleOwner)
+
+	// Both see two owners, but only one of them can go
+	errs := make(chan error, 2)
+	for _, pair := range [][2]AuthUser{{first, second}, {second, first}} {
+		go func(remover AuthUser, member AuthUser) {
+			errs <- removeMember(api.db, remover.ID, householdID, member.ID)
+		}(pair[0], pair[1])
+	}
+	removed := 0
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err == nil {
+			removed++
+		}
+	}
+
+	var owners int
+	err := api.db.QueryRow(context.Background(), `SELECT COUNT(*) FROM household_member WHERE household_id = $1 AND role = $2`,
+		householdID, roleOwner).Scan(&owners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || owners != 1 {
+		t.Errorf("%d removals went through, leaving %d owners", removed, owners)
+	}
+}
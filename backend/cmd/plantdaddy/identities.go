@@ -0,0 +1,584 @@
+package main
+
+// This file handles signing in with an OpenID Connect provider and the identities linked to an account
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// How long the user has to sign in at the provider.
+const oidcLoginTTL = 10 * time.Minute
+
+// How long the app has to trade the code from the callback for tokens.
+const oidcExchangeTTL = 2 * time.Minute
+
+// The cookie that ties the callback to the browser that started the sign in, it holds the hash of the state.
+const oidcStateCookie = "oidc_state"
+
+// The purpose of the token that lets a browser start linking an identity to an account.
+const oidcLinkPurpose = "oidc-link"
+
+var errUnknownProvider = errors.New("unknown sign in provider")
+var errInvalidOIDCState = errors.New("sign in has expired, please try again")
+var errIdentityLinked = errors.New("this identity is linked to another account")
+var errIdentityEmailTaken = errors.New("an account with this email already exists, sign in with your password and link the identity from settings")
+var errIdentityNotFound = errors.New("identity not found")
+var errLastSignInMethod = errors.New("set a password or link another identity before removing this one")
+var errInvalidCodeChallenge = errors.New("code_challenge must be the S256 challenge of a PKCE verifier")
+
+// An S256 PKCE challenge, the unpadded base64url of a sha256 digest.
+var codeChallengePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// Characters that are kept when making a username from the provider's claims.
+var usernameCleaner = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// A sign in that has been started at a provider.
+type oidcLogin struct {
+	ID         int64
+	Provider   string
+	Nonce      string
+	Verifier   string
+	LinkUserID *int64
+	// The claims of the id token, once the provider has sent the user back.
+	Claims IDTokenClaims
+}
+
+// DB Query to start a sign in, or the linking of an identity when linkUserID is set.
+// The app challenge is the PKCE challenge of the app, which must show its verifier to trade the code
+// from the callback. The state, nonce and PKCE verifier sent to the provider are returned.
+func insertOIDCLogin(db *pgxpool.Pool, provider string, linkUserID *int64, appChallenge string) (string, string, string, error) {
+	var values [3]string
+	for i := range values {
+		token, err := newOpaqueToken()
+		if err != nil {
+			return "", "", "", err
+		}
+		values[i] = token
+	}
+	state, nonce, verifier := values[0], values[1], values[2]
+
+	now := time.Now().UTC()
+	_, err := db.Exec(context.Background(), `INSERT INTO oidc_login(state_hash, provider, nonce, code_verifier, link_user_id, app_challenge, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, hashToken(state), provider, nonce, verifier, linkUserID, appChallenge, now, now.Add(oidcLoginTTL))
+	if err != nil {
+		return "", "", "", err
+	}
+	return state, nonce, verifier, nil
+}
+
+// DB Query to use up the state the provider sent back so the callback can only be followed once.
+func useOIDCLogin(db *pgxpool.Pool, state string) (oidcLogin, error) {
+	now := time.Now().UTC()
+	var login oidcLogin
+	err := db.QueryRow(context.Background(), `UPDATE oidc_login SET used_at = $1
+	WHERE state_hash = $2 AND used_at IS NULL AND expires_at > $1
+	RETURNING id, provider, nonce, code_verifier, link_user_id`, now, hashToken(state)).
+		Scan(&login.ID, &login.Provider, &login.Nonce, &login.Verifier, &login.LinkUserID)
+	if err == pgx.ErrNoRows {
+		return oidcLogin{}, errInvalidOIDCState
+	}
+	return login, err
+}
+
+// DB Query to keep the claims the provider vouched for and create the one time code the app trades for them.
+func insertOIDCExchange(db *pgxpool.Pool, loginID int64, claims IDTokenClaims) (string, error) {
+	code, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = db.Exec(context.Background(), `UPDATE oidc_login SET claims = $1, exchange_hash = $2, exchange_expires_at = $3
+	WHERE id = $4`, claims, hashToken(code), time.Now().UTC().Add(oidcExchangeTTL), loginID)
+	if err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// DB Query to use up the code from the callback once the app has shown the verifier of the challenge
+// it started the sign in with, and return the sign in with the claims of the provider.
+func useOIDCExchange(db *pgxpool.Pool, code string, verifier string) (oidcLogin, error) {
+	now := time.Now().UTC()
+	var login oidcLogin
+	err := db.QueryRow(context.Background(), `UPDATE oidc_login SET exchanged_at = $1
+	WHERE exchange_hash = $2 AND app_challenge = $3 AND exchanged_at IS NULL AND exchange_expires_at > $1
+	RETURNING id, provider, link_user_id, claims`, now, hashToken(code), pkceChallenge(verifier)).
+		Scan(&login.ID, &login.Provider, &login.LinkUserID, &login.Claims)
+	if err == pgx.ErrNoRows {
+		return oidcLogin{}, errInvalidOIDCState
+	}
+	return login, err
+}
+
+// This function makes a username from the claims of a new identity.
+func usernameFromClaims(claims IDTokenClaims) string {
+	base := claims.PreferredUsername
+	if base == "" && claims.Email != "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = strings.Trim(usernameCleaner.ReplaceAllString(strings.ToLower(base), ""), ".-_")
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	if base == "" {
+		base = "gardener"
+	}
+	return base
+}
+
+// DB Query to find or create the account for an identity from a provider.
+// An identity that is not known yet is linked to linkUserID when it is set, otherwise a new account is made
+// with no password. The account is never matched by email since the provider may not own the address.
+func signInIdentity(db *pgxpool.Pool, provider *OIDCProvider, claims IDTokenClaims, linkUserID *int64) (AuthUser, bool, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return AuthUser{}, false, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+	var email *string
+	if claims.Email != "" {
+		email = &claims.Email
+	}
+
+	var user AuthUser
+	err = tx.QueryRow(ctx, `SELECT a.id, a.username FROM external_identity e INNER JOIN auth a ON a.id = e.user_id
+	WHERE e.issuer = $1 AND e.subject = $2 FOR UPDATE OF e`, provider.Issuer, claims.Subject).Scan(&user.ID, &user.Username)
+	if err == nil {
+		if linkUserID != nil && *linkUserID != user.ID {
+			return AuthUser{}, false, errIdentityLinked
+		}
+		_, err := tx.Exec(ctx, `UPDATE external_identity SET email = $1, last_login_at = $2 WHERE issuer = $3 AND subject = $4`,
+			email, now, provider.Issuer, claims.Subject)
+		if err != nil {
+			return AuthUser{}, false, err
+		}
+		return user, false, tx.Commit(ctx)
+	} else if err != pgx.ErrNoRows {
+		return AuthUser{}, false, err
+	}
+
+	created := false
+	if linkUserID != nil {
+		err := tx.QueryRow(ctx, `SELECT id, username FROM auth WHERE id = $1`, *linkUserID).Scan(&user.ID, &user.Username)
+		if err == pgx.ErrNoRows {
+			return AuthUser{}, false, errUserNotFound
+		} else if err != nil {
+			return AuthUser{}, false, err
+		}
+	} else {
+		user, err = insertIdentityUser(ctx, tx, claims)
+		if err != nil {
+			return AuthUser{}, false, err
+		}
+		created = true
+	}
+
+	_, err = tx.Exec(ctx, `INSERT INTO external_identity(user_id, provider, issuer, subject, email, created_at, last_login_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $6)`, user.ID, provider.Name, provider.Issuer, claims.Subject, email, now)
+	if err != nil {
+		return AuthUser{}, false, err
+	}
+	return user, created, tx.Commit(ctx)
+}
+
+// DB Query to create the account for a new identity inside of a transaction.
+// The email is only copied over if the provider has verified it.
+func insertIdentityUser(ctx context.Context, tx pgx.Tx, claims IDTokenClaims) (AuthUser, error) {
+	var email *string
+	if claims.Email != "" && bool(claims.EmailVerified) {
+		var taken bool
+		err := tx.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM auth WHERE LOWER(email) = LOWER($1))`, claims.Email).Scan(&taken)
+		if err != nil {
+			return AuthUser{}, err
+		}
+		if taken {
+			return AuthUser{}, errIdentityEmailTaken
+		}
+		email = &claims.Email
+	}
+
+	base := usernameFromClaims(claims)
+	for attempt := 0; attempt < 5; attempt++ {
+		username := base
+		if attempt > 0 {
+			suffix, err := generateRandomBytes(2)
+			if err != nil {
+				return AuthUser{}, err
+			}
+			username = fmt.Sprintf("%s%d", base, int(suffix[0])<<8|int(suffix[1]))
+		}
+
+		// An empty password can never be matched, the user can set one with a reset link
+		user := AuthUser{Username: username}
+		err := tx.QueryRow(ctx, `INSERT INTO auth(username, password, email, email_verified) VALUES ($1, '', $2, $3)
+		ON CONFLICT DO NOTHING RETURNING id`, username, email, email != nil).Scan(&user.ID)
+		if err == nil {
+			return user, nil
+		} else if err != pgx.ErrNoRows {
+			return AuthUser{}, err
+		}
+	}
+	return AuthUser{}, errUserExists
+}
+
+// DB Query to get the identities linked to a user.
+func getIdentitiesDB(db *pgxpool.Pool, userID int64) ([]Identity, error) {
+	rows, err := db.Query(context.Background(), `SELECT id, provider, email, created_at, last_login_at
+	FROM external_identity WHERE user_id = $1 ORDER BY created_at`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var identity Identity
+		if err := rows.Scan(&identity.ID, &identity.Provider, &identity.Email, &identity.CreatedAt, &identity.LastLoginAt); err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// DB Query to unlink an identity from a user.
+// The last way of signing in to an account cannot be removed.
+func unlinkIdentity(db *pgxpool.Pool, userID int64, identityID int64) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var hasPassword bool
+	var identities int
+	err = tx.QueryRow(ctx, `SELECT a.password <> '', (SELECT COUNT(*) FROM external_identity e WHERE e.user_id = a.id)
+	FROM auth a WHERE a.id = $1 FOR UPDATE`, userID).Scan(&hasPassword, &identities)
+	if err != nil {
+		return err
+	}
+	if !hasPassword && identities <= 1 {
+		return errLastSignInMethod
+	}
+
+	tag, err := tx.Exec(ctx, `DELETE FROM external_identity WHERE id = $1 AND user_id = $2`, identityID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errIdentityNotFound
+	}
+	return tx.Commit(ctx)
+}
+
+// This function sends the browser back to the app after a sign in at a provider.
+func (api *API) oidcRedirect(w http.ResponseWriter, r *http.Request, values url.Values) {
+	http.Redirect(w, r, strings.TrimRight(api.appURL, "/")+"/oidc?"+values.Encode(), http.StatusFound)
+}
+
+// This function starts a sign in at the provider, ties it to the browser with a cookie and sends the browser
+// to the provider.
+func (api *API) startOIDCLogin(w http.ResponseWriter, r *http.Request, name string, linkUserID *int64, appChallenge string) {
+	provider, ok := api.oidcProviders[name]
+	if !ok {
+		http.Error(w, errUnknownProvider.Error(), http.StatusNotFound)
+		return
+	}
+
+	state, nonce, verifier, err := insertOIDCLogin(api.db, provider.Name, linkUserID, appChallenge)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	authorizationURL, err := provider.authorizationURL(r.Context(), api.oidcRedirectURL, state, nonce, verifier)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+
+	// Lax rather than strict, since the provider sends the browser back from another site
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    hashToken(state),
+		Path:     "/api/oidc/",
+		MaxAge:   int(oidcLoginTTL.Seconds()),
+		Secure:   strings.HasPrefix(api.oidcRedirectURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authorizationURL, http.StatusFound)
+}
+
+// This function checks the state sent back by the provider is the one the cookie of the browser was set for.
+func oidcStateMatches(r *http.Request, state string) bool {
+	cookie, err := r.Cookie(oidcStateCookie)
+	if err != nil || state == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(hashToken(state))) == 1
+}
+
+// HTTP Call to list the providers users can sign in with
+func (api *API) getOIDCProviders(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		names := make([]string, 0, len(api.oidcProviders))
+		for name := range api.oidcProviders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		json.NewEncoder(w).Encode(names)
+	}
+}
+
+// HTTP Call the app opens in a browser to sign in with a provider, it redirects to the provider.
+// The app sends the S256 challenge of a PKCE verifier only it knows, and the link token from /api/oidc/link
+// when it is linking an identity to the account.
+func (api *API) startOIDC(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		query := r.URL.Query()
+		appChallenge := query.Get("code_challenge")
+		if !codeChallengePattern.MatchString(appChallenge) || query.Get("code_challenge_method") != "S256" {
+			http.Error(w, errInvalidCodeChallenge.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var linkUserID *int64
+		if link := query.Get("link"); link != "" {
+			claims, err := verifyPurposeToken(api.tokenSecret, link, oidcLinkPurpose, time.Now())
+			if err != nil {
+				unauthorized(w, err.Error())
+				return
+			}
+			linkUserID = &claims.UserID
+		}
+		api.startOIDCLogin(w, r, query.Get("provider"), linkUserID, appChallenge)
+	}
+}
+
+// HTTP Call to start linking a provider to the authenticated user, it returns the url to open in a browser.
+// The link only finishes once the app that started it trades the code from the callback with its verifier.
+func (api *API) linkOIDC(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var request OIDCStart
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+		if _, ok := api.oidcProviders[request.Provider]; !ok {
+			http.Error(w, errUnknownProvider.Error(), http.StatusNotFound)
+			return
+		}
+		if !codeChallengePattern.MatchString(request.CodeChallenge) {
+			http.Error(w, errInvalidCodeChallenge.Error(), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now().UTC()
+		user := currentUser(r)
+		link, err := signAccessToken(api.tokenSecret, AccessClaims{
+			UserID:    user.ID,
+			Username:  user.Username,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(oidcLoginTTL).Unix(),
+			Purpose:   oidcLinkPurpose,
+		})
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		// The browser starts the sign in itself so the cookie is set in the browser that comes back
+		start, err := url.Parse(api.oidcRedirectURL)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		start = start.ResolveReference(&url.URL{Path: "start", RawQuery: url.Values{
+			"provider":              {request.Provider},
+			"code_challenge":        {request.CodeChallenge},
+			"code_challenge_method": {"S256"},
+			"link":                  {link},
+		}.Encode()})
+		json.NewEncoder(w).Encode(OIDCAuthorization{URL: start.String()})
+	}
+}
+
+// HTTP Call the provider redirects back to. The browser is sent on to the app with a one time code,
+// or with an error if the sign in did not work.
+func (api *API) oidcCallback(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		query := r.URL.Query()
+
+		// A sign in started in another browser is refused before its state is used up
+		if !oidcStateMatches(r, query.Get("state")) {
+			api.oidcRedirect(w, r, url.Values{"error": {errInvalidOIDCState.Error()}})
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/api/oidc/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+
+		login, err := useOIDCLogin(api.db, query.Get("state"))
+		if err != nil {
+			if !errors.Is(err, errInvalidOIDCState) {
+				log.Printf("%s", err)
+			}
+			api.oidcRedirect(w, r, url.Values{"error": {errInvalidOIDCState.Error()}})
+			return
+		}
+
+		// The user cancelled or the provider refused
+		if providerError := query.Get("error"); providerError != "" {
+			api.oidcRedirect(w, r, url.Values{"error": {providerError}})
+			return
+		}
+
+		provider, ok := api.oidcProviders[login.Provider]
+		if !ok {
+			api.oidcRedirect(w, r, url.Values{"error": {errUnknownProvider.Error()}})
+			return
+		}
+
+		claims, err := provider.exchange(r.Context(), api.oidcRedirectURL, query.Get("code"), login.Verifier, login.Nonce)
+		if err != nil {
+			log.Printf("%s", err)
+			api.oidcRedirect(w, r, url.Values{"error": {"sign in with " + provider.Name + " failed"}})
+			return
+		}
+
+		// Nothing is signed in to or linked until the app shows its verifier
+		code, err := insertOIDCExchange(api.db, login.ID, claims)
+		if err != nil {
+			log.Printf("%s", err)
+			api.oidcRedirect(w, r, url.Values{"error": {http.StatusText(http.StatusInternalServerError)}})
+			return
+		}
+		api.oidcRedirect(w, r, url.Values{"code": {code}})
+	}
+}
+
+// HTTP Call for the app to trade the code it was sent after signing in at a provider, along with the
+// PKCE verifier it started the sign in with. A sign in gets tokens, a link is finished with no content.
+func (api *API) oidcToken(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var request OIDCExchange
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+		if request.Code == "" || request.CodeVerifier == "" {
+			http.Error(w, "Must provide code and codeVerifier", http.StatusBadRequest)
+			return
+		}
+
+		login, err := useOIDCExchange(api.db, request.Code, request.CodeVerifier)
+		if errors.Is(err, errInvalidOIDCState) {
+			unauthorized(w, err.Error())
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		provider, ok := api.oidcProviders[login.Provider]
+		if !ok {
+			http.Error(w, errUnknownProvider.Error(), http.StatusNotFound)
+			return
+		}
+
+		user, created, err := signInIdentity(api.db, provider, login.Claims, login.LinkUserID)
+		switch {
+		case errors.Is(err, errIdentityLinked), errors.Is(err, errIdentityEmailTaken):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, errUserNotFound):
+			unauthorized(w, err.Error())
+			return
+		case err != nil:
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if login.LinkUserID != nil {
+			api.audit(r, AuditEvent{ActorID: user.ID, Action: auditIdentityLink, After: map[string]string{"provider": provider.Name}})
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if created {
+			api.audit(r, AuditEvent{ActorID: user.ID, Action: auditIdentityLink,
+				After: map[string]string{"provider": provider.Name, "username": user.Username}})
+		}
+
+		// The provider stands in for the password, two factor authentication still applies
+		api.completeLogin(w, r, user, "oidc")
+	}
+}
+
+// HTTP Call to list the identities linked to the user or, with DELETE, unlink one
+func (api *API) identities(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	switch r.Method {
+	case "GET":
+		identities, err := getIdentitiesDB(api.db, currentUser(r).ID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(identities)
+
+	case "DELETE":
+		identityID, err := strconv.ParseInt(r.URL.Query().Get("identityID"), 10, 64)
+		if err != nil {
+			http.Error(w, "Must provide identityID", http.StatusBadRequest)
+			return
+		}
+
+		err = unlinkIdentity(api.db, currentUser(r).ID, identityID)
+		switch {
+		case errors.Is(err, errIdentityNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, errLastSignInMethod):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditIdentityUnlink, Before: map[string]int64{"identityID": identityID}})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+// This file imports readings from other loggers and from probes that were offline into the history of a device
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// The largest file that can be uploaded to the import endpoint.
+const maxImportSize = 32 << 20
+
+// The readings inserted by a single statement.
+const importChunkSize = 500
+
+// The row errors listed in the result of an import, the rest are only counted.
+const maxImportErrors = 100
+
+// The longest line of a json lines import.
+const maxImportLine = 1 << 20
+
+// How far ahead of the server clock an imported reading may be, to allow for loggers with a fast clock.
+const importClockSkew = 5 * time.Minute
+
+// An error with the file as a whole rather than one of its rows.
+type importFileError struct {
+	message string
+}
+
+func (e importFileError) Error() string {
+	return e.message
+}
+
+var errImportNoTime = importFileError{"the file must have a time column"}
+
+// The names columns are recognised by when no mapping is given, after lower casing and removing
+// spaces, dashes and underscores.
+var importColumnNames = map[string]string{
+	"time":         "time",
+	"timestamp":    "time",
+	"datetime":     "time",
+	"date":         "time",
+	"temperature":  "temperature",
+	"temp":         "temperature",
+	"humidity":     "humidity",
+	"rh":           "humidity",
+	"soilmoisture": "soilMoisture",
+	"moisture":     "soilMoisture",
+	"light":        "light",
+}
+
+// The earliest time a number is read as, so an epoch in a unit that was not recognised is not stored decades ago.
+var importEarliestTime = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// The units of Unix epochs by their size, since loggers write seconds, milliseconds or microseconds.
+var importEpochUnits = []struct {
+	below float64
+	unit  time.Duration
+}{{1e11, time.Second}, {1e14, time.Millisecond}, {1e17, time.Microsecond}}
+
+// The layouts of times without an offset, which are taken as local time in the time zone of the import.
+var importTimeLayouts = []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04"}
+
+// What to import and how.
+type importOptions struct {
+	DeviceID string
+	// csv or ndjson.
+	Format string
+	// The time zone of times without an offset.
+	Location *time.Location
+	Units    readingUnits
+	// Columns of the file mapped to time or a metric, for names that are not recognised.
+	Columns map[string]string
+	// Check the file and count what would be imported without storing anything.
+	DryRun bool
+}
+
+// A row of an import before it is checked, by column name.
+type importRecord struct {
+	Line   int
+	Fields map[string]string
+	// Set when the row could not be read at all.
+	Err error
+}
+
+// A reading with the time it was taken, in the units readings are stored in.
+type timedReading struct {
+	Time   time.Time
+	Values [4]*float64
+	// The idempotency key the device sent with it, if any.
+	Key string
+	// The time by the clock of the device that sent it, before the clock was corrected.
+	// A device sends the same time when it retries, so it is zero for imported readings.
+	DeviceTime time.Time
+	// Metrics beyond the legacy four, checked against the registry.
+	Metrics map[string]float64
+}
+
+// This function parses the deviceID, format, timeZone, temperatureUnit, percentUnit, columns and dryRun
+// parameters of an import. The format defaults to the content type and the time zone to loc.
+func parseImportQuery(query url.Values, contentType string, loc *time.Location) (importOptions, error) {
+	units, err := parseReadingUnits(query)
+	if err != nil {
+		return importOptions{}, err
+	}
+	options := importOptions{
+		DeviceID: query.Get("deviceID"),
+		Format:   query.Get("format"),
+		Location: loc,
+		Units:    units,
+		Columns:  map[string]string{},
+		DryRun:   query.Get("dryRun") == "true",
+	}
+	if options.DeviceID == "" {
+		return importOptions{}, errors.New("must provide a deviceID")
+	}
+
+	if options.Format == "" {
+		options.Format = "csv"
+		if strings.HasPrefix(contentType, "application/x-ndjson") || strings.HasPrefix(contentType, "application/jsonl") {
+			options.Format = "ndjson"
+		}
+	}
+	if options.Format != "csv" && options.Format != "ndjson" {
+		return importOptions{}, errors.New("format must be csv or ndjson")
+	}
+
+	if name := query.Get("timeZone"); name != "" {
+		if options.Location, err = loadTimeZone(name); err != nil {
+			return importOptions{}, errInvalidTimeZone
+		}
+	}
+
+	// Mappings are given as field=column, such as temperature=Temp (C),time=Logged At
+	if value := query.Get("columns"); value != "" {
+		for _, pair := range strings.Split(value, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			field := strings.TrimSpace(parts[0])
+			if _, ok := readingMetrics[field]; len(parts) != 2 || (!ok && field != "time") {
+				return importOptions{}, errors.New("columns must be a list of field=column where field is time, temperature, humidity, soilMoisture or light")
+			}
+			options.Columns[strings.TrimSpace(parts[1])] = field
+		}
+	}
+	return options, nil
+}
+
+// This function returns the field a column holds, or an empty string when it is not imported.
+func (options importOptions) field(column string) string {
+	if field, ok := options.Columns[column]; ok {
+		return field
+	}
+	name := strings.NewReplacer(" ", "", "-", "", "_", "").Replace(strings.ToLower(strings.TrimSpace(column)))
+	return importColumnNames[name]
+}
+
+// This function reads the rows of a csv file with a header line and sends them to records.
+// It returns an error when the file cannot be imported at all.
+func readImportCSV(r io.Reader, options importOptions, records func(importRecord) error) ([]string, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	var parseErr *csv.ParseError
+	if err == io.EOF {
+		return nil, errImportNoTime
+	} else if errors.As(err, &parseErr) {
+		return nil, importFileError{"the header " + parseErr.Err.Error()}
+	} else if err != nil {
+		return nil, err
+	}
+
+	fields := make([]string, len(header))
+	var ignored []string
+	seen := map[string]bool{}
+	for i, column := range header {
+		fields[i] = options.field(column)
+		if fields[i] == "" {
+			ignored = append(ignored, column)
+			continue
+		}
+		if seen[fields[i]] {
+			return nil, importFileError{fmt.Sprintf("more than one column holds %s", fields[i])}
+		}
+		seen[fields[i]] = true
+	}
+	if !seen["time"] {
+		return nil, errImportNoTime
+	}
+
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return ignored, nil
+		}
+		if errors.As(err, &parseErr) {
+			if err := records(importRecord{Line: parseErr.Line, Err: parseErr.Err}); err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		record := importRecord{Line: line, Fields: map[string]string{}}
+		if len(row) != len(header) {
+			record.Err = fmt.Errorf("has %d columns but the header has %d", len(row), len(header))
+		}
+		for i, value := range row {
+			if i < len(fields) && fields[i] != "" {
+				record.Fields[fields[i]] = value
+			}
+		}
+		if err := records(record); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// This function reads the objects of a json lines file and sends them to records.
+// It returns an error when the file cannot be imported at all.
+func readImportNDJSON(r io.Reader, options importOptions, records func(importRecord) error) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+
+	var ignored []string
+	ignoredSeen := map[string]bool{}
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var object map[string]interface{}
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+		record := importRecord{Line: line, Fields: map[string]string{}}
+		if err := decoder.Decode(&object); err != nil {
+			record.Err = errors.New("is not a json object")
+		}
+
+		for key, value := range object {
+			field := options.field(key)
+			if field == "" {
+				if !ignoredSeen[key] {
+					ignoredSeen[key] = true
+					ignored = append(ignored, key)
+				}
+				continue
+			}
+			if _, ok := record.Fields[field]; ok {
+				record.Err = fmt.Errorf("has more than one value for %s", field)
+			}
+			switch v := value.(type) {
+			case nil:
+				record.Fields[field] = ""
+			case string:
+				record.Fields[field] = v
+			case json.Number:
+				record.Fields[field] = v.String()
+			default:
+				record.Err = fmt.Errorf("%s must be a number or a string", key)
+			}
+		}
+		if err := records(record); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		return nil, importFileError{fmt.Sprintf("line %d is longer than %d bytes", line+1, maxImportLine)}
+	} else if err != nil {
+		return nil, err
+	}
+	return ignored, nil
+}
+
+// This function parses the time of an import row.
+// It accepts RFC 3339, a date and time without an offset in the time zone of the import, or a Unix epoch
+// in seconds, milliseconds or microseconds after 2000.
+func parseImportTime(value string, loc *time.Location) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, errors.New("time is missing")
+	}
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range importTimeLayouts {
+		if t, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		for _, epoch := range importEpochUnits {
+			if !(math.Abs(number) < epoch.below) {
+				continue
+			}
+			// Checked as a float so a number too large for a time cannot overflow into one
+			if nanoseconds := number * float64(epoch.unit); nanoseconds < float64(importEarliestTime.UnixNano()) || nanoseconds >= math.MaxInt64 {
+				break
+			}
+			whole, fraction := math.Modf(number)
+			return time.Unix(0, int64(whole)*int64(epoch.unit)+int64(math.Round(fraction*float64(epoch.unit)))), nil
+		}
+		return time.Time{}, fmt.Errorf("time %q is not a Unix time after 2000 in seconds, milliseconds or microseconds", value)
+	}
+	return time.Time{}, fmt.Errorf("time %q is not a time such as 2021-06-01T12:00:00Z", value)
+}
+
+// This function checks a row against the ranges in the registry and converts it into a reading
+// in the units readings are stored in.
+func (options importOptions) reading(record importRecord, registry map[string]Metric, now time.Time) (timedReading, error) {
+	if record.Err != nil {
+		return timedReading{}, record.Err
+	}
+
+	t, err := parseImportTime(record.Fields["time"], options.Location)
+	if err != nil {
+		return timedReading{}, err
+	}
+	if t.After(now.Add(importClockSkew)) {
+		return timedReading{}, errors.New("time is in the future")
+	}
+
+	var values [4]*float64
+	found := false
+	for i, field := range allReadingMetrics {
+		value := strings.TrimSpace(record.Fields[field])
+		if value == "" {
+			continue
+		}
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsNaN(number) {
+			return timedReading{}, fmt.Errorf("%s %q is not a number", field, value)
+		}
+		values[i] = &number
+		found = true
+	}
+	if !found {
+		return timedReading{}, errors.New("has no readings")
+	}
+
+	values = options.Units.toStored(values)
+	if err := checkLegacyValues(values, registry); err != nil {
+		return timedReading{}, err
+	}
+	return timedReading{Time: t.UTC().Truncate(time.Microsecond), Values: values}, nil
+}
+
+// DB Query to insert readings into the history of a device, leaving out any at a time the device already has a reading,
+// taken at a time by its own clock it has already sent or with an idempotency key it has already sent.
+// It returns the times of the readings that were inserted.
+func insertReadings(ctx context.Context, tx pgx.Tx, deviceID string, readings []timedReading) ([]time.Time, error) {
+	times := make([]time.Time, len(readings))
+	keys := make([]*string, len(readings))
+	deviceTimes := make([]*time.Time, len(readings))
+	var values [4][]*float64
+	for i := range values {
+		values[i] = make([]*float64, len(readings))
+	}
+	for i, reading := range readings {
+		times[i] = reading.Time
+		keys[i] = nullString(reading.Key)
+		if !reading.DeviceTime.IsZero() {
+			deviceTimes[i] = &readings[i].DeviceTime
+		}
+		for j := range values {
+			values[j][i] = reading.Values[j]
+		}
+	}
+
+	// The first reading at each time is kept, and the position of each reading that was inserted is
+	// returned with it so its other metrics go with the right row
+	rows, err := tx.Query(ctx, `WITH i AS (
+		SELECT * FROM unnest($2::timestamp[], $3::float8[], $4::float8[], $5::float8[], $6::float8[], $7::text[], $8::timestamp[])
+		WITH ORDINALITY AS i(time, temperature, humidity, soil_moisture, light, idempotency_key, device_time, n)
+	), picked AS (
+		SELECT DISTINCT ON (i.time) i.* FROM i
+		WHERE NOT EXISTS (SELECT 1 FROM plant_data p WHERE p.device_id = $1 AND (p.time = i.time OR p.device_time = i.device_time))
+		ORDER BY i.time, i.n
+	), inserted AS (
+		INSERT INTO plant_data(device_id, time, temperature, humidity, soil_moisture, light, idempotency_key, device_time)
+		SELECT $1, time, temperature, humidity, soil_moisture, light, idempotency_key, device_time FROM picked ORDER BY n
+		ON CONFLICT DO NOTHING RETURNING id, time
+	)
+	SELECT inserted.id, inserted.time, picked.n FROM inserted INNER JOIN picked ON picked.time = inserted.time
+	ORDER BY picked.n`, deviceID, times, values[0], values[1], values[2], values[3], keys, deviceTimes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var inserted []time.Time
+	var ids []int64
+	var metrics []map[string]float64
+	for rows.Next() {
+		var id, n int64
+		var t time.Time
+		if err := rows.Scan(&id, &t, &n); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		inserted = append(inserted, t)
+		metrics = append(metrics, readings[n-1].Metrics)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if err := insertReadingMetrics(ctx, tx, ids, metrics); err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+// DB Query to import a file of readings into the history of a device.
+// Rows that cannot be imported are reported and skipped, and readings at a time the device already
+// has one are counted as duplicates. Everything is stored in one transaction, and nothing is stored
+// for a dry run. Imports into the same device wait for each other so duplicates are always caught.
+func importReadings(ctx context.Context, db *pgxpool.Pool, r io.Reader, options importOptions) (ImportResult, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return ImportResult{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked string
+	err = tx.QueryRow(ctx, `SELECT device_id FROM registered_devices WHERE device_id = $1 FOR NO KEY UPDATE`, options.DeviceID).Scan(&locked)
+	if err == pgx.ErrNoRows {
+		return ImportResult{}, errDeviceNotFound
+	} else if err != nil {
+		return ImportResult{}, err
+	}
+
+	registry, err := getMetricRegistry(ctx, tx)
+	if err != nil {
+		return ImportResult{}, err
+	}
+
+	result := ImportResult{DryRun: options.DryRun, Errors: []ImportError{}}
+	now := time.Now()
+	var chunk []timedReading
+	var valid int64
+	flush := func() error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		inserted, err := insertReadings(ctx, tx, options.DeviceID, chunk)
+		result.Imported += int64(len(inserted))
+		chunk = chunk[:0]
+		return err
+	}
+
+	records := func(record importRecord) error {
+		result.Rows++
+		reading, err := options.reading(record, registry, now)
+		if err != nil {
+			result.Failed++
+			if len(result.Errors) < maxImportErrors {
+				result.Errors = append(result.Errors, ImportError{Line: record.Line, Error: err.Error()})
+			}
+			return nil
+		}
+		valid++
+		chunk = append(chunk, reading)
+		if len(chunk) >= importChunkSize {
+			return flush()
+		}
+		return nil
+	}
+
+	if options.Format == "ndjson" {
+		result.IgnoredColumns, err = readImportNDJSON(r, options, records)
+	} else {
+		result.IgnoredColumns, err = readImportCSV(r, options, records)
+	}
+	if err != nil {
+		return ImportResult{}, err
+	}
+	if err := flush(); err != nil {
+		return ImportResult{}, err
+	}
+	result.Duplicates = valid - result.Imported
+
+	if options.DryRun {
+		return result, nil
+	}
+	return result, tx.Commit(ctx)
+}
+
+// HTTP Call to import a csv or json lines file of readings into the history of a device
+func (api *API) importReadings(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		deviceID := r.URL.Query().Get("deviceID")
+		if !api.allowDevice(w, r, deviceID, careDevice) {
+			return
+		}
+
+		loc, err := deviceLocation(api.db, currentUser(r).ID, deviceID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		options, err := parseImportQuery(r.URL.Query(), r.Header.Get("Content-Type"), loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// Months of readings take longer to upload than the server read timeout
+		if err := http.NewResponseController(w).SetReadDeadline(time.Time{}); err != nil {
+			log.Printf("%s", err)
+		}
+
+		body := http.MaxBytesReader(w, r.Body, maxImportSize)
+		result, err := importReadings(r.Context(), api.db, body, options)
+		var tooLarge *http.MaxBytesError
+		var fileErr importFileError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("the file is larger than %d MB, split it into smaller files", maxImportSize>>20), http.StatusRequestEntityTooLarge)
+			return
+		} else if errors.As(err, &fileErr) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if !result.DryRun && result.Imported > 0 {
+			ownerID, _, err := getDeviceState(api.db, deviceID)
+			if err != nil {
+				log.Printf("%s", err)
+			}
+			api.audit(r, AuditEvent{UserID: ownerID, Action: auditDeviceImport, DeviceID: deviceID,
+				After: map[string]int64{"imported": result.Imported, "duplicates": result.Duplicates, "failed": result.Failed}})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+// The import command reads a file of readings into the history of any device.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	device := flags.String("device", "", "device to import the readings into")
+	format := flags.String("format", "", "csv or ndjson, taken from the file extension when not given")
+	timeZone := flags.String("tz", "UTC", "time zone of times without an offset")
+	temperatureUnit := flags.String("temperature-unit", unitCelsius, "celsius, fahrenheit or kelvin")
+	percentUnit := flags.String("percent-unit", unitPercent, "percent or fraction")
+	columns := flags.String("columns", "", "columns to map, such as temperature=Temp (C),time=Logged At")
+	dryRun := flags.Bool("dry-run", false, "check the file without storing anything")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: plantdaddy import -device ID [-format csv] [-tz ZONE] [-dry-run] [readings.csv]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *format == "" && (strings.HasSuffix(flags.Arg(0), ".ndjson") || strings.HasSuffix(flags.Arg(0), ".jsonl")) {
+		*format = "ndjson"
+	}
+	query := url.Values{
+		"deviceID":        {*device},
+		"format":          {*format},
+		"timeZone":        {*timeZone},
+		"temperatureUnit": {*temperatureUnit},
+		"percentUnit":     {*percentUnit},
+		"columns":         {*columns},
+		"dryRun":          {strconv.FormatBool(*dryRun)},
+	}
+	options, err := parseImportQuery(query, "", time.UTC)
+	if err != nil {
+		flags.Usage()
+		return err
+	}
+
+	input, err := openInput(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	db := connectToDb(os.Getenv("CONNSTRING"))
+	defer db.Close()
+
+	result, err := importReadings(context.Background(), db, bufio.NewReader(input), options)
+	if err != nil {
+		return err
+	}
+
+	for _, rowErr := range result.Errors {
+		fmt.Fprintf(os.Stderr, "line %d: %s\n", rowErr.Line, rowErr.Error)
+	}
+	if hidden := result.Failed - int64(len(result.Errors)); hidden > 0 {
+		fmt.Fprintf(os.Stderr, "and %d more rows that could not be imported\n", hidden)
+	}
+	if len(result.IgnoredColumns) > 0 {
+		fmt.Fprintf(os.Stderr, "ignored columns: %s\n", strings.Join(result.IgnoredColumns, ", "))
+	}
+	verb := "imported"
+	if result.DryRun {
+		verb = "would import"
+	}
+	fmt.Fprintf(os.Stderr, "%s %d of %d rows into %s, %d duplicates, %d failed\n",
+		verb, result.Imported, result.Rows, options.DeviceID, result.Duplicates, result.Failed)
+	return nil
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseImportTime(t *testing.T) {
+	vancouver, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value string
+		want  time.Time
+		err   bool
+	}{
+		{"2021-06-01T12:00:00Z", time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), false},
+		{"2021-06-01T12:00:00.25+02:00", time.Date(2021, 6, 1, 10, 0, 0, 250000000, time.UTC), false},
+		{"2021-06-01 12:00:00", time.Date(2021, 6, 1, 19, 0, 0, 0, time.UTC), false},
+		{"2021-06-01T12:00:30", time.Date(2021, 6, 1, 19, 0, 30, 0, time.UTC), false},
+		{" 2021-06-01 12:00 ", time.Date(2021, 6, 1, 19, 0, 0, 0, time.UTC), false},
+		{"2021-01-01T12:00", time.Date(2021, 1, 1, 20, 0, 0, 0, time.UTC), false},
+		{"1622548800", time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), false},
+		{"1622548800.5", time.Date(2021, 6, 1, 12, 0, 0, 500000000, time.UTC), false},
+		{"1622548800000", time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), false},
+		{"1622548800250", time.Date(2021, 6, 1, 12, 0, 0, 250000000, time.UTC), false},
+		{"1622548800000000", time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), false},
+		{"946684800", time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), false},
+		{"946684799", time.Time{}, true},
+		{"1622548800000000000", time.Time{}, true},
+		{"99999999999", time.Time{}, true},
+		{"NaN", time.Time{}, true},
+		{"Inf", time.Time{}, true},
+		{"", time.Time{}, true},
+		{"0", time.Time{}, true},
+		{"-5", time.Time{}, true},
+		{"yesterday", time.Time{}, true},
+		{"01/06/2021", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseImportTime(test.value, vancouver)
+		if (err != nil) != test.err || !got.Equal(test.want) {
+			t.Errorf("%q: got %s %v", test.value, got, err)
+		}
+	}
+}
+
+func TestParseImportQuery(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		contentType string
+		format      string
+		columns     map[string]string
+		err         bool
+	}{
+		{"defaults", "deviceID=a", "", "csv", map[string]string{}, false},
+		{"format from the content type", "deviceID=a", "application/x-ndjson; charset=utf-8", "ndjson", map[string]string{}, false},
+		{"format given", "deviceID=a&format=csv", "application/jsonl", "csv", map[string]string{}, false},
+		{"columns", "deviceID=a&columns=temperature=Temp+(C),+time+=Logged+At", "", "csv",
+			map[string]string{"Temp (C)": "temperature", "Logged At": "time"}, false},
+		{"no device", "format=csv", "", "", nil, true},
+		{"unknown format", "deviceID=a&format=xlsx", "", "", nil, true},
+		{"unknown zone", "deviceID=a&timeZone=Nowhere", "", "", nil, true},
+		{"unknown field", "deviceID=a&columns=pressure=hPa", "", "", nil, true},
+		{"column without a field", "deviceID=a&columns=Temp", "", "", nil, true},
+		{"bad unit", "deviceID=a&percentUnit=permille", "", "", nil, true},
+	}
+
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		options, err := parseImportQuery(query, test.contentType, time.UTC)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		} else if !test.err && (options.Format != test.format || !reflect.DeepEqual(options.Columns, test.columns)) {
+			t.Errorf("%s: got %+v", test.name, options)
+		}
+	}
+}
+
+func TestImportField(t *testing.T) {
+	options := importOptions{Columns: map[string]string{"Probe 1": "temperature"}}
+	tests := []struct {
+		column string
+		want   string
+	}{
+		{"time", "time"},
+		{"Timestamp", "time"},
+		{" Date-Time ", "time"},
+		{"Soil_Moisture", "soilMoisture"},
+		{"RH", "humidity"},
+		{"Probe 1", "temperature"},
+		{"Probe 2", ""},
+		{"battery", ""},
+	}
+
+	for _, test := range tests {
+		if got := options.field(test.column); got != test.want {
+			t.Errorf("field(%q) = %q, want %q", test.column, got, test.want)
+		}
+	}
+}
+
+// readRecords reads an import file the way importReadings does and returns its records.
+func readRecords(format string, input string, options importOptions) ([]importRecord, []string, error) {
+	var records []importRecord
+	collect := func(record importRecord) error {
+		records = append(records, record)
+		return nil
+	}
+	var ignored []string
+	var err error
+	if format == "ndjson" {
+		ignored, err = readImportNDJSON(strings.NewReader(input), options, collect)
+	} else {
+		ignored, err = readImportCSV(strings.NewReader(input), options, collect)
+	}
+	return records, ignored, err
+}
+
+func TestReadImportCSV(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		records []importRecord
+		ignored []string
+		err     error
+	}{
+		{"recognised columns", "Time,Temp,Battery\n2021-06-01T12:00:00Z,21.5,90\n\n2021-06-01T12:10:00Z,,89\n",
+			[]importRecord{
+				{Line: 2, Fields: map[string]string{"time": "2021-06-01T12:00:00Z", "temperature": "21.5"}},
+				{Line: 4, Fields: map[string]string{"time": "2021-06-01T12:10:00Z", "temperature": ""}},
+			}, []string{"Battery"}, nil},
+		{"short row", "time,light\n2021-06-01T12:00:00Z\n",
+			[]importRecord{{Line: 2, Fields: map[string]string{"time": "2021-06-01T12:00:00Z"},
+				Err: errors.New("has 1 columns but the header has 2")}}, nil, nil},
+		{"no time column", "temperature,light\n21.5,300\n", nil, nil, errImportNoTime},
+		{"empty file", "", nil, nil, errImportNoTime},
+		{"repeated field", "time,temp,temperature\n", nil, nil, importFileError{"more than one column holds temperature"}},
+	}
+
+	for _, test := range tests {
+		records, ignored, err := readRecords("csv", test.input, importOptions{})
+		if !reflect.DeepEqual(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(records, test.records) || !reflect.DeepEqual(ignored, test.ignored) {
+			t.Errorf("%s: got %+v ignoring %v", test.name, records, ignored)
+		}
+	}
+
+	// A row that cannot be parsed is reported on its own line and the rest are still read
+	records, _, err := readRecords("csv", "time,light\n\"2021-06-01T12:00:00Z,1\n", importOptions{})
+	if err != nil || len(records) != 1 || records[0].Err == nil {
+		t.Errorf("a broken quote got %+v %v", records, err)
+	}
+}
+
+func TestReadImportNDJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		records []importRecord
+		ignored []string
+		err     bool
+	}{
+		{"values", `{"time": "2021-06-01T12:00:00Z", "temperature": 21.50, "light": null, "battery": 90}` + "\n\n" +
+			`{"time": 1622548800, "humidity": "40"}`,
+			[]importRecord{
+				{Line: 1, Fields: map[string]string{"time": "2021-06-01T12:00:00Z", "temperature": "21.50", "light": ""}},
+				{Line: 3, Fields: map[string]string{"time": "1622548800", "humidity": "40"}},
+			}, []string{"battery"}, false},
+		{"not an object", "[1, 2]\n",
+			[]importRecord{{Line: 1, Fields: map[string]string{}, Err: errors.New("is not a json object")}}, nil, false},
+		{"nested value", `{"time": "2021-06-01T12:00:00Z", "light": {"lux": 300}}`,
+			[]importRecord{{Line: 1, Fields: map[string]string{"time": "2021-06-01T12:00:00Z"},
+				Err: errors.New("light must be a number or a string")}}, nil, false},
+		{"line too long", `{"time": "` + strings.Repeat("1", maxImportLine) + `"}`, nil, nil, true},
+	}
+
+	for _, test := range tests {
+		records, ignored, err := readRecords("ndjson", test.input, importOptions{})
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(records, test.records) || !reflect.DeepEqual(ignored, test.ignored) {
+			t.Errorf("%s: got %+v ignoring %v", test.name, records, ignored)
+		}
+	}
+
+	// Which of the two values comes first depends on the order of the map, so only the error is checked
+	records, _, err := readRecords("ndjson", `{"temp": 20, "temperature": 20}`, importOptions{})
+	if err != nil || len(records) != 1 || records[0].Err == nil {
+		t.Errorf("two names for a field got %+v %v", records, err)
+	}
+}
+
+func TestImportReading(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	value := func(v float64) *float64 { return &v }
+	celsius := importOptions{Location: time.UTC, Units: readingUnits{unitCelsius, unitPercent}}
+	fahrenheit := importOptions{Location: time.UTC, Units: readingUnits{unitFahrenheit, unitFraction}}
+	tests := []struct {
+		name    string
+		options importOptions
+		fields  map[string]string
+		want    [4]*float64
+		err     bool
+	}{
+		{"every value", celsius, map[string]string{"time": "2021-06-01T11:00:00Z", "temperature": "21.5", "humidity": "40",
+			"soilMoisture": " 55 ", "light": "100"}, [4]*float64{value(21.5), value(40), value(55), value(100)}, false},
+		{"converted", fahrenheit, map[string]string{"time": "2021-06-01T11:00:00Z", "temperature": "212", "humidity": "0.5"},
+			[4]*float64{value(100), value(50), nil, nil}, false},
+		{"within the clock skew", celsius, map[string]string{"time": "2021-06-01T12:04:00Z", "light": "0"},
+			[4]*float64{nil, nil, nil, value(0)}, false},
+		{"in the future", celsius, map[string]string{"time": "2021-06-01T12:06:00Z", "light": "0"}, [4]*float64{}, true},
+		{"no time", celsius, map[string]string{"light": "0"}, [4]*float64{}, true},
+		{"no readings", celsius, map[string]string{"time": "2021-06-01T11:00:00Z", "light": ""}, [4]*float64{}, true},
+		{"not a number", celsius, map[string]string{"time": "2021-06-01T11:00:00Z", "light": "bright"}, [4]*float64{}, true},
+		{"NaN", celsius, map[string]string{"time": "2021-06-01T11:00:00Z", "light": "NaN"}, [4]*float64{}, true},
+		{"too hot", celsius, map[string]string{"time": "2021-06-01T11:00:00Z", "temperature": "101"}, [4]*float64{}, true},
+		{"too cold", fahrenheit, map[string]string{"time": "2021-06-01T11:00:00Z", "temperature": "-60"}, [4]*float64{}, true},
+		{"over a hundred percent", fahrenheit, map[string]string{"time": "2021-06-01T11:00:00Z", "humidity": "1.5"}, [4]*float64{}, true},
+		{"below zero percent", celsius, map[string]string{"time": "2021-06-01T11:00:00Z", "soilMoisture": "-1"}, [4]*float64{}, true},
+	}
+
+	for _, test := range tests {
+		reading, err := test.options.reading(importRecord{Line: 2, Fields: test.fields}, legacyRegistry(), now)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		} else if !test.err && !reflect.DeepEqual(reading.Values, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, floats(reading.Values), floats(test.want))
+		}
+	}
+
+	failed := importRecord{Line: 2, Err: errors.New("is not a json object")}
+	if _, err := celsius.reading(failed, legacyRegistry(), now); err != failed.Err {
+		t.Errorf("a row that could not be read got %v", err)
+	}
+}
+
+// importFile posts a file to the import endpoint as the user and returns the response.
+func importFile(t *testing.T, api *API, user AuthUser, query string, contentType string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/api/readings/import?"+query, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	api.importReadings(w, asUserRequest(r, user))
+	return w
+}
+
+func TestImportReadings(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "importer")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	deviceID := createDevice(t, api, user.ID)
+	addReading(t, api, deviceID, time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), 20)
+
+	file := "time,temperature,humidity,notes\n" +
+		"2021-06-01T12:00:00Z,21,40,already there\n" +
+		"2021-06-01T12:10:00Z,22,41,\n" +
+		"2021-06-01T12:10:00Z,23,42,twice in the file\n" +
+		"2021-06-01T12:20:00Z,hot,42,\n" +
+		"2021-06-01 05:30:00,24,43,local time\n"
+	tests := []struct {
+		name  string
+		query string
+		want  ImportResult
+	}{
+		{"dry run", "dryRun=true&timeZone=America/Vancouver", ImportResult{DryRun: true, Rows: 5, Imported: 2, Duplicates: 2, Failed: 1}},
+		{"import", "timeZone=America/Vancouver", ImportResult{Rows: 5, Imported: 2, Duplicates: 2, Failed: 1}},
+		{"again", "timeZone=America/Vancouver", ImportResult{Rows: 5, Imported: 0, Duplicates: 4, Failed: 1}},
+	}
+	for _, test := range tests {
+		w := importFile(t, api, user, "deviceID="+deviceID+"&"+test.query, "text/csv", file)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", test.name, w.Code, w.Body)
+		}
+		var result ImportResult
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		if result.DryRun != test.want.DryRun || result.Rows != test.want.Rows || result.Imported != test.want.Imported ||
+			result.Duplicates != test.want.Duplicates || result.Failed != test.want.Failed {
+			t.Errorf("%s: got %+v, want %+v", test.name, result, test.want)
+		}
+		if len(result.Errors) != 1 || result.Errors[0].Line != 5 || !reflect.DeepEqual(result.IgnoredColumns, []string{"notes"}) {
+			t.Errorf("%s: got errors %+v ignoring %v", test.name, result.Errors, result.IgnoredColumns)
+		}
+	}
+
+	// The first of two readings at the same time is kept, and local times are stored in UTC
+	page, err := parseReadingsPage(httptest.NewRequest("GET", "/?order=asc&metrics=temperature", nil), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readings, _, err := getRawReadingsDB(api.db, deviceID, page, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, reading := range readings {
+		got = append(got, reading.Time.Format("15:04")+"="+strconv.FormatFloat(*reading.Metrics["temperature"], 'f', -1, 64))
+	}
+	if want := []string{"12:00=20", "12:10=22", "12:30=24"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got readings %v, want %v", got, want)
+	}
+
+	rejected := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"no time column", "temperature\n21\n", http.StatusBadRequest},
+		{"too large", "time,temperature\n" + strings.Repeat("2021-06-01T12:00:00Z,21\n", maxImportSize/24+1), http.StatusRequestEntityTooLarge},
+	}
+	for _, test := range rejected {
+		if w := importFile(t, api, user, "deviceID="+deviceID, "text/csv", test.body); w.Code != test.code {
+			t.Errorf("%s: got %d %s", test.name, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+// This file holds the mailers used to send emails to users
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"sync"
+	"time"
+)
+
+// A plain text email.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends emails to users. Implementations must be safe to call from many goroutines.
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+// Sends emails through an SMTP relay.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// This function creates a mailer for the relay at addr (host:port).
+// If username is empty the relay is used without authentication.
+func NewSMTPMailer(addr, username, password, from string) *SMTPMailer {
+	var auth smtp.Auth
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &SMTPMailer{addr: addr, from: from, auth: auth}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mail.Subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(mail.Body)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(m.addr, m.auth, m.from, []string{mail.To}, msg.Bytes())
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Keeps emails in memory instead of sending them, used for development and tests.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func (m *MemoryMailer) Send(ctx context.Context, mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, mail)
+	log.Printf("mail to %s: %s", mail.To, mail.Subject)
+	return nil
+}
+
+// This function returns a copy of every email sent so far.
+func (m *MemoryMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mail(nil), m.sent...)
+}
+
+// This function creates the mailer configured in the environment.
+// Without SMTP_ADDR emails are only logged.
+func mailerFromEnv() Mailer {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		log.Println("SMTP_ADDR is not set, emails will not be sent")
+		return &MemoryMailer{}
+	}
+	return NewSMTPMailer(addr, os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), os.Getenv("MAIL_FROM"))
+}
+
+// This function sends an email in the background so the caller does not wait on the relay,
+// which would also reveal whether an account exists.
+func sendMailAsync(mailer Mailer, mail Mail) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := mailer.Send(ctx, mail); err != nil {
+			log.Printf("error sending mail to %s: %s", mail.To, err)
+		}
+	}()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+func TestMemoryMailer(t *testing.T) {
+	mailer := &MemoryMailer{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mailer.Send(context.Background(), Mail{To: "fern@example.com", Subject: "Hello"})
+		}()
+	}
+	wg.Wait()
+
+	sent := mailer.Sent()
+	if len(sent) != 10 {
+		t.Fatalf("got %d mails, want 10", len(sent))
+	}
+	// The copy can be changed without changing what the mailer holds
+	sent[0].To = "someone@example.com"
+	if mailer.Sent()[0].To != "fern@example.com" {
+		t.Error("Sent returned the mails the mailer holds")
+	}
+}
+
+func TestAppLink(t *testing.T) {
+	tests := []struct {
+		appURL string
+		want   string
+	}{
+		{"plantdaddy://app", "plantdaddy://app/reset-password?token=a+b%2F"},
+		{"https://plantdaddy.example/", "https://plantdaddy.example/reset-password?token=a+b%2F"},
+	}
+
+	for _, test := range tests {
+		api := &API{appURL: test.appURL}
+		if got := api.appLink("reset-password", "a b/"); got != test.want {
+			t.Errorf("appLink with %s = %s, want %s", test.appURL, got, test.want)
+		}
+	}
+}
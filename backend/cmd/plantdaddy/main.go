@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -18,6 +19,23 @@ import (
 // Requires initial server request config for login
 type API struct {
 	db * pgxpool.Pool
+	tokenSecret []byte
+	accessTokenTTL time.Duration
+	refreshTokenTTL time.Duration
+	sessionTTL time.Duration
+	passwordResetTTL time.Duration
+	emailVerificationTTL time.Duration
+	mailer Mailer
+	loginLimiter LoginLimiter
+	// Set when running behind a proxy that sets X-Forwarded-For
+	trustProxy bool
+	// Links sent to users by email open this url
+	appURL string
+	oidcProviders map[string]*OIDCProvider
+	// Where providers send the user back to, the full url of /api/oidc/callback
+	oidcRedirectURL string
+	// How long a deleted account can still be restored
+	accountDeletionGrace time.Duration
 }
 
 
@@ -30,21 +48,95 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	logger := log.New(os.Stdout, "http: ", log.Flags())
 
 	
-	api := &API{db: connectToDb(os.Getenv("CONNSTRING"))}
+	tokenSecret := os.Getenv("TOKEN_SECRET")
+	if len(tokenSecret) < 32 {
+		log.Fatal("TOKEN_SECRET must be set to at least 32 characters")
+	}
+
+	api := &API{
+		db: connectToDb(os.Getenv("CONNSTRING")),
+		tokenSecret: []byte(tokenSecret),
+		accessTokenTTL: durationEnv("ACCESS_TOKEN_TTL", 15 * time.Minute),
+		refreshTokenTTL: durationEnv("REFRESH_TOKEN_TTL", 30 * 24 * time.Hour),
+		sessionTTL: durationEnv("SESSION_TTL", 24 * time.Hour),
+		passwordResetTTL: durationEnv("PASSWORD_RESET_TTL", time.Hour),
+		emailVerificationTTL: durationEnv("EMAIL_VERIFICATION_TTL", 48 * time.Hour),
+		accountDeletionGrace: durationEnv("ACCOUNT_DELETION_GRACE", 30 * 24 * time.Hour),
+		mailer: mailerFromEnv(),
+		appURL: stringEnv("APP_URL", "plantdaddy://app"),
+	}
 	defer api.db.Close()
+	api.loginLimiter = loginLimiterFromEnv(api.db)
+	api.trustProxy = os.Getenv("TRUST_PROXY") == "true"
+	api.oidcProviders = oidcProvidersFromEnv()
+	api.oidcRedirectURL = os.Getenv("OIDC_REDIRECT_URL")
+	if len(api.oidcProviders) > 0 && api.oidcRedirectURL == "" {
+		log.Fatal("OIDC_REDIRECT_URL must be set when OIDC_PROVIDERS is")
+	}
+	go runAccountPurge(context.Background(), api.db)
+	go runLoginAttemptCleanup(context.Background(), api.loginLimiter)
 	http.HandleFunc("/auth-device", api.logIn)
-	http.HandleFunc("/api/new-device", api.newDevice)
+	http.HandleFunc("/api/new-device", api.authenticate(scopeManageDevices, api.newDevice))
 	http.HandleFunc("/api/login", api.logInApp)
+	http.HandleFunc("/api/login/2fa", api.logInSecondFactor)
+	http.HandleFunc("/api/token/refresh", api.refreshToken)
+	http.HandleFunc("/api/logout", api.logOut)
+	http.HandleFunc("/api/logout-all", api.authenticatePendingDeletion(scopeAccount, api.logOutAll))
+	http.HandleFunc("/api/password/forgot", api.forgotPassword)
+	http.HandleFunc("/api/password/reset", api.resetPassword)
+	http.HandleFunc("/api/email/verify", api.verifyEmail)
+	http.HandleFunc("/api/email/resend", api.authenticate(scopeAccount, api.resendVerification))
+	http.HandleFunc("/api/2fa/enroll", api.authenticate(scopeAccount, api.enrollTOTP))
+	http.HandleFunc("/api/2fa/confirm", api.authenticate(scopeAccount, api.confirmTOTP))
+	http.HandleFunc("/api/2fa/disable", api.authenticate(scopeAccount, api.disableTOTP))
 	http.HandleFunc("/new-data",api.newSessionData)
+	http.HandleFunc("/new-data/batch", api.newSessionBatch)
 	http.HandleFunc("/api/new-user", api.newUser)
-	http.HandleFunc("/api/devices", api.getDevices)
-	http.HandleFunc("/api/get-daily-data", api.getDailyData)
-	http.HandleFunc("/api/get-device", api.getDevice)
-	http.HandleFunc("/api/device-name", api.changeDeviceName)
-	http.HandleFunc("/api/delete-device", api.deleteDevice)
+	http.HandleFunc("/api/devices", api.authenticate(scopeReadReadings, api.getDevices))
+	http.HandleFunc("/api/get-daily-data", api.authenticate(scopeReadReadings, api.getDailyData))
+	http.HandleFunc("/api/get-device", api.authenticate(scopeReadReadings, api.getDevice))
+	http.HandleFunc("/api/readings", api.authenticate(scopeReadReadings, api.getReadings))
+	http.HandleFunc("/api/v2/daily-data", api.authenticate(scopeReadReadings, api.getDailyDataV2))
+	http.HandleFunc("/api/readings/export", api.authenticate(scopeReadReadings, api.exportReadings))
+	http.HandleFunc("/api/readings/import", api.authenticate(scopeManageDevices, api.importReadings))
+	http.HandleFunc("/api/metrics", api.authenticate(scopeReadReadings, api.getMetrics))
+	http.HandleFunc("/api/device-name", api.authenticate(scopeManageDevices, api.changeDeviceName))
+	http.HandleFunc("/api/delete-device", api.authenticate(scopeManageDevices, api.deleteDevice))
+	http.HandleFunc("/api/device-secret", api.authenticate(scopeManageDevices, api.newDeviceSecret))
+	http.HandleFunc("/api/device-time-zone", api.authenticate(scopeManageDevices, api.changeDeviceTimeZone))
+	http.HandleFunc("/api/households", api.authenticate(scopeAccount, api.households))
+	http.HandleFunc("/api/households/invite", api.authenticate(scopeAccount, api.inviteMember))
+	http.HandleFunc("/api/households/invitations", api.authenticate(scopeAccount, api.getInvitations))
+	http.HandleFunc("/api/households/accept", api.authenticate(scopeAccount, api.answerInvitation(true)))
+	http.HandleFunc("/api/households/decline", api.authenticate(scopeAccount, api.answerInvitation(false)))
+	http.HandleFunc("/api/households/members", api.authenticate(scopeAccount, api.removeMember))
+	http.HandleFunc("/api/households/devices", api.authenticate(scopeAccount, api.shareDevice))
+	http.HandleFunc("/api/devices/transfer", api.authenticate(scopeAccount, api.transferDevice))
+	http.HandleFunc("/api/devices/transfers", api.authenticate(scopeAccount, api.getTransfers))
+	http.HandleFunc("/api/devices/transfer/accept", api.authenticate(scopeAccount, api.answerTransfer(true)))
+	http.HandleFunc("/api/devices/transfer/decline", api.authenticate(scopeAccount, api.answerTransfer(false)))
+	http.HandleFunc("/api/devices/claim", api.authenticate(scopeManageDevices, api.claimDevice))
+	http.HandleFunc("/api/devices/", api.authenticate(scopeReadReadings, api.deviceResource))
+	http.HandleFunc("/reset-device", api.resetDevice)
+	http.HandleFunc("/api/keys", api.authenticate(scopeAccount, api.apiKeys))
+	http.HandleFunc("/api/audit", api.authenticate(scopeAccount, api.getAuditLog))
+	http.HandleFunc("/api/oidc/providers", api.getOIDCProviders)
+	http.HandleFunc("/api/oidc/start", api.startOIDC)
+	http.HandleFunc("/api/oidc/callback", api.oidcCallback)
+	http.HandleFunc("/api/oidc/token", api.oidcToken)
+	http.HandleFunc("/api/oidc/link", api.authenticate(scopeAccount, api.linkOIDC))
+	http.HandleFunc("/api/oidc/identities", api.authenticate(scopeAccount, api.identities))
+	http.HandleFunc("/api/account", api.authenticate(scopeAccount, api.account))
+	http.HandleFunc("/api/account/restore", api.authenticatePendingDeletion(scopeAccount, api.restoreAccount))
+	http.HandleFunc("/api/account/export", api.authenticate(scopeAccount, api.exportAccount))
+	http.HandleFunc("/api/account/time-zone", api.authenticate(scopeAccount, api.changeTimeZone))
 	log.Println("Listening for requests at http://localhost:8000/")
 	server := &http.Server{
 		ReadTimeout: 5 * time.Second,
@@ -56,6 +148,28 @@ func main() {
 	log.Fatal(server.ListenAndServe())
 }
 
+// This function reads a value from the environment or returns the default.
+func stringEnv(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// This function reads a duration such as "15m" from the environment or returns the default.
+func durationEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Fatalf("%s must be a positive duration: %q", name, value)
+	}
+	return duration
+}
+
 // HTTP Call to get the device associated with a given user.
 func (api *API) getDevice(w http.ResponseWriter, r *http.Request){
 	defer r.Body.Close()
@@ -64,22 +178,59 @@ func (api *API) getDevice(w http.ResponseWriter, r *http.Request){
 		log.Printf("New Request %s", r.URL.String())
 		deviceID := r.URL.Query().Get("deviceID")
 
-		device, err := getDeviceDB(api.db, deviceID)
+		if !api.allowDevice(w, r, deviceID, readDevice) {
+			return
+		}
+
+		loc, err := deviceLocation(api.db, currentUser(r).ID, deviceID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		device, err := getDeviceDB(api.db, deviceID, loc)
 
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		device.Role, err = deviceRole(api.db, currentUser(r).ID, deviceID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 		json.NewEncoder(w).Encode(device)
 	}
 }
 
+// HTTP Call to delete a device and all of the data it has collected
 func (api * API) deleteDevice(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	
 	if r.Method == "DELETE" {
 		deviceID := r.URL.Query().Get("deviceID")
 
-		deleteDeviceDB(api.db, deviceID)
+		if !api.allowDevice(w, r, deviceID, manageDevice) {
+			return
+		}
+
+		// What is about to be lost is recorded since the data cannot be brought back
+		ownerID, before, err := getDeviceState(api.db, deviceID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, "Error deleting device", http.StatusInternalServerError)
+			return
+		}
+
+		if err := deleteDeviceDB(api.db, deviceID); err != nil {
+			log.Printf("%s", err)
+			http.Error(w, "Error deleting device", http.StatusInternalServerError)
+			return
+		}
+		api.audit(r, AuditEvent{UserID: ownerID, Action: auditDeviceDelete, DeviceID: deviceID, Before: before})
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
@@ -97,37 +248,47 @@ func (api * API) changeDeviceName(w http.ResponseWriter, r *http.Request){
 			return
 		}
 
+		if !api.allowDevice(w, r, name.DeviceID, careDevice) {
+			return
+		}
+
+		ownerID, before, err := getDeviceState(api.db, name.DeviceID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, "Error updating device name", http.StatusInternalServerError)
+			return
+		}
+
 		// We dont return anything from this funtion unless there is an error that is written to the w stream
 		errs := changeDeviceName(api.db, name)
 
 		if errs != nil {
 			http.Error(w, "Error updating device name", http.StatusInternalServerError)
+			return
 		}
+		api.audit(r, AuditEvent{UserID: ownerID, Action: auditDeviceRename, DeviceID: name.DeviceID,
+			Before: map[string]string{"deviceName": before.DeviceName},
+			After:  map[string]string{"deviceName": name.DeviceName}})
 
 	}
 }	
 
 
-// HTTP Call to query for all devices associated with a user
+// HTTP Call to query for all devices associated with the authenticated user
 func (api * API) getDevices(w http.ResponseWriter, r *http.Request){
 	defer r.Body.Close()
 	if r.Method == "GET" {
 		log.Printf("New request: %s", r.URL)
 		
-		username := r.URL.Query().Get("username")
-		if username != "" {
-			devices, err := getDevicesDB(api.db, username)
+		devices, err := getDevicesDB(api.db, currentUser(r).ID)
 
-			if err != nil {
-				log.Printf("%s", err)
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-			}
-			jsonEncoder := json.NewEncoder(w)
-			jsonEncoder.Encode(devices)
-			
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
-
-		
+		jsonEncoder := json.NewEncoder(w)
+		jsonEncoder.Encode(devices)
 	}
 }
 
@@ -144,7 +305,7 @@ func (api * API) newDevice(w http.ResponseWriter, r *http.Request) {
 	if r.Header.Get("Content-Type") != "application/json" {
 			msg := "Content-type header is not application/json"
 			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			
+			return
 		}
 
 		
@@ -158,43 +319,61 @@ func (api * API) newDevice(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-	 	insertDevice(&newDevice, api.db)
+		// Claim codes are short so guesses are throttled like passwords
+		keys := api.claimKeys(r, currentUser(r).ID, newDevice.DeviceID)
+		if !api.allowLoginAttempt(w, r, keys) {
+			return
+		}
+
+		secret, err := insertDevice(&newDevice, currentUser(r).ID, api.db)
+		if errors.Is(err, errInvalidClaimCode) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Error registering device", http.StatusInternalServerError)
+			return
+		}
+		api.recordLoginSuccess(r, keys)
+		api.audit(r, AuditEvent{Action: auditDeviceRegister, DeviceID: newDevice.DeviceID,
+			After: map[string]string{"deviceName": newDevice.DeviceName}})
+
+		// The secret is only ever shown here, the app hands it to the probe over bluetooth.
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(DeviceCredentials{DeviceID: newDevice.DeviceID, DeviceSecret: secret})
 
 		
 	}
 }
 
-// HTTP call to login as the device if there is no session data available
+// HTTP call to login as the device if there is no session data available.
+// The body must be signed with the device secret and carry the current time and a fresh nonce.
 func (api * API) logIn(w http.ResponseWriter, r *http.Request) {
 	var login Login;
 	defer r.Body.Close()
 	if r.Method == "POST" {
 		log.Printf("New Request %s", r.URL)
-		// Check if the content type is correct
-		if r.Header.Get("Content-Type") != "application/json" {
-			msg := "Content-type header is not application/json"
-			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			
-		}
-
-		// Decoder our data into json.
-		decoder := json.NewDecoder(r.Body)
 
-		
-		// Do not allow certain fields that are not approved 
-		decoder.DisallowUnknownFields()
-		err := decoder.Decode(&login)
+		if !api.decodeSignedDeviceRequest(w, r, &login, func() string { return login.DeviceID }) {
+			return
+		}
 
-		if jsonDecoder(err, w) != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			log.Printf("%s", err.Error())
+		if err := useDeviceNonce(api.db, login); errors.Is(err, errStaleRequest) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
 		}
+
 		// From this struct we must now return a bit id to the device. 
 		session, err := getSession(api.db, &login)
 
 		if err != nil {
 			log.Printf("%s", err.Error())
-			w.Write([]byte(err.Error()))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
 		}
 	
 	w.Header().Set("Content-Type", "application/json")
@@ -216,15 +395,32 @@ func (api * API) getDailyData(w http.ResponseWriter, r *http.Request){
 		
 		if deviceID == "" {
 			http.Error(w, "Must provide deviceID", http.StatusBadRequest)
+			return
 		} 
 		if timePeriod == "" {
 			http.Error(w, "Must provide timePeriod", http.StatusBadRequest)
+			return
 		}
-		
-		mapper, err := getLatestDataDay(api.db, timePeriod, deviceID)
 
+		if !api.allowDevice(w, r, deviceID, readDevice) {
+			return
+		}
+		
+		loc, err := deviceLocation(api.db, currentUser(r).ID, deviceID)
 		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		mapper, err := getLatestDataDay(api.db, timePeriod, deviceID, loc)
+
+		if errors.Is(err, errInvalidPeriod) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
 			http.Error(w, "Error getting latest data day", http.StatusBadGateway)
+			return
 		}
 
 
@@ -237,7 +433,7 @@ func (api * API) getDailyData(w http.ResponseWriter, r *http.Request){
 }
 
 
-// HTTP Call to login as a user on the ios/android app
+// HTTP Call to login as a user on the ios/android app and receive an access and refresh token
 func (api * API) logInApp(w http.ResponseWriter, r *http.Request) {
 	log.Printf("New request %s", r.URL)
 	defer r.Body.Close()
@@ -245,7 +441,7 @@ func (api * API) logInApp(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Content-Type") != "application/json" {
 			msg := "Content-type header is not application/json"
 			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			log.Printf("NOT CONTENT TYPE")
+			return
 		}
 		
 		decoder := json.NewDecoder(r.Body)
@@ -257,32 +453,43 @@ func (api * API) logInApp(w http.ResponseWriter, r *http.Request) {
 
 		if jsonDecoder(err, w) != nil {
 			log.Printf("JSON ERROR %s", err)
-			
+			return
 		}
 		
-		errs := LogIn(api.db, login)
-		if errs != nil {
+		// Locked out callers are turned away before the password is hashed
+		keys := api.loginKeys(r, login.Username)
+		if !api.allowLoginAttempt(w, r, keys) {
+			return
+		}
+		
+		user, errs := LogIn(api.db, login)
+		var falseError *FalseError
+		if errors.As(errs, &falseError) {
+			api.audit(r, AuditEvent{UserID: loginAccountID(api.db, login.Username), Action: auditLoginFailed,
+				After: map[string]string{"username": login.Username, "factor": "password"}})
+			unauthorized(w, errs.Error())
+			return
+		} else if errs != nil {
 			log.Printf("%s",errs.Error())
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(errs.Error()))
-			
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-
-		defer r.Body.Close()
+		api.recordLoginSuccess(r, keys)
+		api.completeLogin(w, r, user, "password")
 	}
 
 }
-// HTTP Call to add a new user to the database
+// HTTP Call to add a new user to the database and email them a verification link
 func (api * API) newUser(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
 		if r.Method == "POST" {
 	log.Printf("New Request %s", r.URL)
 
 	if r.Header.Get("Content-Type") != "application/json" {
 			msg := "Content-type header is not application/json"
 			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			
+			return
 		}
 
 		var newUser UserPass;
@@ -294,57 +501,64 @@ func (api * API) newUser(w http.ResponseWriter, r *http.Request) {
 
 		if jsonDecoder(err, w) != nil {
 			log.Printf("JSON ERROR %s", err)
-			
+			return
 		}
 
-		w.Header().Set("Content-Type", "application/json")
+		email, err := parseEmail(newUser.Email)
+		if err != nil {
+			http.Error(w, "Must provide a valid email", http.StatusBadRequest)
+			return
+		}
+		newUser.Email = email
+		if len(newUser.Password) < minPasswordLength {
+			http.Error(w, errWeakPassword.Error(), http.StatusBadRequest)
+			return
+		}
 
-		// Check if out counter has reached zero and return new session
-		var errs = insertNewUser(newUser, api.db)
+		token, errs := insertNewUser(newUser, api.db, api.emailVerificationTTL)
 
-		if errs != nil {
-			w.Write([]byte(err.Error()))
-			
-			
-			
-		} else {
-			w.WriteHeader(http.StatusOK)
+		if errors.Is(errs, errUserExists) {
+			http.Error(w, errs.Error(), http.StatusConflict)
+			return
+		} else if errs != nil {
+			http.Error(w, "Error creating user", http.StatusInternalServerError)
+			return
 		}
+
+		api.sendVerificationEmail(newUser.Email, token)
+		w.WriteHeader(http.StatusOK)
 		
 	}
 }
-// HTTP Call to add new session data to the database
+// HTTP Call to add new session data to the database.
+// The body must be signed with the device secret.
 func (api * API) newSessionData(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 	if r.Method == "POST" {
 	log.Printf("New Request %s", r.URL)
 
-
-	if r.Header.Get("Content-Type") != "application/json" {
-			msg := "Content-type header is not application/json"
-			http.Error(w, msg, http.StatusUnsupportedMediaType)
-			
-		}
-
 		var session SessionData;
-		decoder := json.NewDecoder(r.Body)
-		
-		// Do not allow certain fields that are not approved 
-		decoder.DisallowUnknownFields()
-		err := decoder.Decode(&session)
+		if !api.decodeSignedDeviceRequest(w, r, &session, func() string { return session.DeviceID }) {
+			return
+		}
 
-		if jsonDecoder(err, w) != nil {
+		// Check if out counter has reached zero and return new session
+		newSession, err := insertSessionData(session, api.db, api.sessionTTL)
+		switch {
+		case errors.Is(err, errInvalidSession), errors.Is(err, errSessionExpired):
+			// The device has to log in again to get a new session
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		case errors.Is(err, errStaleReading), errors.Is(err, errIdempotencyKey), errors.Is(err, errInvalidMetric):
 			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		
-		// Check if out counter has reached zero and return new session
-		log.Printf("ABOUT TO INSERT")
-		var newSession, _  = insertSessionData(session, api.db)
-		log.Printf("FINISHED INSERT DATA")
-		
-
 		json.NewEncoder(w).Encode(newSession)
 		
 		
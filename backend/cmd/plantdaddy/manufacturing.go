@@ -0,0 +1,130 @@
+package main
+
+// This file handles the claim codes printed on the box of every probe we make
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var errDuplicateDevice = errors.New("device is already in a batch")
+
+// A probe from a manufacturing batch and the code to claim it with.
+type ManufacturedDevice struct {
+	DeviceID  string
+	ClaimCode string
+}
+
+// This function builds the payload for the QR code printed next to the claim code.
+func claimPayload(deviceID string, code string) string {
+	values := url.Values{}
+	values.Set("deviceID", deviceID)
+	values.Set("code", code)
+	return "plantdaddy://claim?" + values.Encode()
+}
+
+// This function reads device ids from a batch file, one per line or as the first column of a csv.
+// A header row naming the column deviceID is skipped.
+func readBatchFile(r io.Reader) ([]string, error) {
+	reader := csv.NewReader(bufio.NewReader(r))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	seen := make(map[string]bool)
+	var deviceIDs []string
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		deviceID := strings.TrimSpace(record[0])
+		if deviceID == "" || (line == 1 && strings.EqualFold(deviceID, "deviceID")) {
+			continue
+		}
+		if seen[deviceID] {
+			return nil, fmt.Errorf("line %d: %s: %w", line, deviceID, errDuplicateDevice)
+		}
+		seen[deviceID] = true
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+	return deviceIDs, nil
+}
+
+// DB Query to add a manufacturing batch and create a claim code for each device in it.
+// Nothing is stored if any device is already known.
+func insertBatch(db *pgxpool.Pool, batch string, deviceIDs []string) ([]ManufacturedDevice, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+	devices := make([]ManufacturedDevice, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		code, err := newClaimCode()
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = tx.Exec(ctx, `INSERT INTO manufactured_device(device_id, batch, manufactured_at, claim_code_hash)
+		VALUES ($1, $2, $3, $4)`, deviceID, batch, now, hashToken(normalizeClaimCode(code)))
+		if err != nil {
+			var pgErr interface{ SQLState() string }
+			if errors.As(err, &pgErr) && pgErr.SQLState() == uniqueViolation {
+				return nil, fmt.Errorf("%s: %w", deviceID, errDuplicateDevice)
+			}
+			return nil, err
+		}
+		devices = append(devices, ManufacturedDevice{DeviceID: deviceID, ClaimCode: code})
+	}
+	return devices, tx.Commit(ctx)
+}
+
+// DB Query to use up the claim code of a manufactured device inside of a transaction.
+func useManufacturingClaim(ctx context.Context, tx pgx.Tx, deviceID string, code string) error {
+	tag, err := tx.Exec(ctx, `UPDATE manufactured_device SET claimed_at = $1
+	WHERE device_id = $2 AND claim_code_hash = $3 AND claimed_at IS NULL`,
+		time.Now().UTC(), deviceID, hashToken(normalizeClaimCode(code)))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errInvalidClaimCode
+	}
+	return nil
+}
+
+// DB Query to let the claim codes of deleted devices be used again inside of a transaction.
+func releaseManufacturingClaims(ctx context.Context, tx pgx.Tx, deviceIDs []string) error {
+	_, err := tx.Exec(ctx, `UPDATE manufactured_device SET claimed_at = NULL WHERE device_id = ANY($1)`, deviceIDs)
+	return err
+}
+
+// This function writes the claim codes of a batch as csv so they can be printed on the boxes.
+func writeBatchCSV(w io.Writer, devices []ManufacturedDevice) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"deviceID", "claimCode", "qrPayload"}); err != nil {
+		return err
+	}
+	for _, device := range devices {
+		if err := writer.Write([]string{device.DeviceID, device.ClaimCode, claimPayload(device.DeviceID, device.ClaimCode)}); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
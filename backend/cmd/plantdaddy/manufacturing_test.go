@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadBatchFile(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+		err   error
+	}{
+		{"one per line", "probe-1\nprobe-2\n", []string{"probe-1", "probe-2"}, nil},
+		{"csv with a header", "deviceID,colour\nprobe-1,green\nprobe-2,white\n", []string{"probe-1", "probe-2"}, nil},
+		{"blank lines and spaces", "probe-1\n\n  probe-2  \n", []string{"probe-1", "probe-2"}, nil},
+		{"duplicate", "probe-1\nprobe-1\n", nil, errDuplicateDevice},
+		{"empty", "", nil, nil},
+	}
+
+	for _, test := range tests {
+		got, err := readBatchFile(strings.NewReader(test.input))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestWriteBatchCSV(t *testing.T) {
+	var out bytes.Buffer
+	devices := []ManufacturedDevice{{DeviceID: "probe 1", ClaimCode: "ABCD-EFGH"}}
+	if err := writeBatchCSV(&out, devices); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || lines[0] != "deviceID,claimCode,qrPayload" {
+		t.Fatalf("got csv %q", out.String())
+	}
+	payload, err := url.Parse(strings.Split(lines[1], ",")[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Scheme != "plantdaddy" || payload.Query().Get("deviceID") != "probe 1" || payload.Query().Get("code") != "ABCD-EFGH" {
+		t.Errorf("got payload %s", payload)
+	}
+}
+
+// A deleted probe can be registered again with the code on its box.
+func TestDeleteThenReclaimDevice(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "grower")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+
+	deviceID := uniqueName(t, "probe-")
+	devices, err := insertBatch(api.db, uniqueName(t, "batch-"), []string{deviceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim := NewDevice{DeviceID: deviceID, DeviceName: "Basil", ClaimCode: devices[0].ClaimCode}
+
+	w := doJSON(t, asUser(api, user, api.newDevice), "POST", "/api/new-device", claim, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+	w = doJSON(t, asUser(api, user, api.newDevice), "POST", "/api/new-device", claim, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("a used code got %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = doJSON(t, asUser(api, user, api.deleteDevice), "DELETE", "/api/delete-device?deviceID="+url.QueryEscape(deviceID), nil, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: %d %s", w.Code, w.Body)
+	}
+	w = doJSON(t, asUser(api, user, api.newDevice), "POST", "/api/new-device", claim, nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("registering a deleted probe again got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestNewDeviceRequiresJSON(t *testing.T) {
+	// The request is turned down before the limiter or the database is used.
+	api := &API{}
+	header := http.Header{"Content-Type": {"text/plain"}}
+	w := doJSON(t, api.newDevice, "POST", "/api/new-device", NewDevice{DeviceID: "probe-1", ClaimCode: "code"}, header)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnsupportedMediaType)
+	}
+}
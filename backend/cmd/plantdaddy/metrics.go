@@ -0,0 +1,261 @@
+package main
+
+// This file keeps the registry of what probes can measure, so new sensors only need a row in the metric table
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+)
+
+// The types a metric can have.
+const metricFloat = "float"
+const metricInteger = "integer"
+
+// Metric names are used as json keys next to the legacy ones, such as soilMoisture2 or co2.
+var metricNamePattern = regexp.MustCompile(`^[a-z][a-zA-Z0-9]{0,31}$`)
+
+var errInvalidMetric = errors.New("invalid metric")
+var errMetricExists = errors.New("a metric with that name already exists")
+
+// Something that can run a query, a pool or a transaction.
+type queryer interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+}
+
+// DB Query to get the registered metrics with the names given, or every metric when names is nil.
+func getMetricsDB(ctx context.Context, q queryer, names []string) ([]Metric, error) {
+	rows, err := q.Query(ctx, `SELECT id, name, unit, value_type, min_value, max_value, COALESCE(description, ''),
+	legacy_column IS NOT NULL FROM metric WHERE $1::text[] IS NULL OR name = ANY($1) ORDER BY id`, names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	metrics := []Metric{}
+	for rows.Next() {
+		var m Metric
+		if err := rows.Scan(&m.ID, &m.Name, &m.Unit, &m.Type, &m.Min, &m.Max, &m.Description, &m.Legacy); err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics, rows.Err()
+}
+
+// DB Query to get the legacy metrics and the registered metrics a set of readings use, by name.
+func getMetricRegistry(ctx context.Context, q queryer, readings ...map[string]float64) (map[string]Metric, error) {
+	registry := map[string]Metric{}
+	seen := map[string]bool{}
+	names := append([]string{}, allReadingMetrics...)
+	for _, name := range names {
+		seen[name] = true
+	}
+	for _, values := range readings {
+		for name := range values {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	metrics, err := getMetricsDB(ctx, q, names)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range metrics {
+		registry[m.Name] = m
+	}
+	return registry, nil
+}
+
+// This function checks a value is of the type of the metric and within its range.
+func (m Metric) check(value float64) error {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("%w: %s must be a number", errInvalidMetric, m.Name)
+	}
+	if m.Type == metricInteger && value != math.Trunc(value) {
+		return fmt.Errorf("%w: %s must be a whole number", errInvalidMetric, m.Name)
+	}
+	if (m.Min != nil && value < *m.Min) || (m.Max != nil && value > *m.Max) {
+		return fmt.Errorf("%w: %s %g%s is out of range", errInvalidMetric, m.Name, value, m.Unit)
+	}
+	return nil
+}
+
+// This function checks the metrics sent with a reading beyond the legacy four against the registry.
+func checkMetrics(values map[string]float64, registry map[string]Metric) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		m, ok := registry[name]
+		if !ok {
+			return fmt.Errorf("%w: %s is not a registered metric", errInvalidMetric, name)
+		}
+		if m.Legacy {
+			return fmt.Errorf("%w: %s is sent in its own field", errInvalidMetric, name)
+		}
+		if err := m.check(values[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// This function checks temperature, humidity, soil moisture and light against the ranges of their legacy metrics.
+func checkLegacyValues(values [4]*float64, registry map[string]Metric) error {
+	for i, name := range allReadingMetrics {
+		if values[i] == nil {
+			continue
+		}
+		m, ok := registry[name]
+		if !ok {
+			return fmt.Errorf("%w: %s is not a registered metric", errInvalidMetric, name)
+		}
+		if err := m.check(*values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DB Query to get the metrics beyond the legacy four, which exports write after the legacy ones.
+func getExtraMetrics(ctx context.Context, q queryer) ([]Metric, error) {
+	metrics, err := getMetricsDB(ctx, q, nil)
+	if err != nil {
+		return nil, err
+	}
+	extra := []Metric{}
+	for _, m := range metrics {
+		if !m.Legacy {
+			extra = append(extra, m)
+		}
+	}
+	return extra, nil
+}
+
+// DB Query to store the metrics beyond the legacy four of readings that were just inserted.
+// Every metric must have been checked against the registry.
+func insertReadingMetrics(ctx context.Context, tx pgx.Tx, ids []int64, metrics []map[string]float64) error {
+	var readingIDs []int64
+	var names []string
+	var values []float64
+	for i, reading := range metrics {
+		for name, value := range reading {
+			readingIDs = append(readingIDs, ids[i])
+			names = append(names, name)
+			values = append(values, value)
+		}
+	}
+	if len(readingIDs) == 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(ctx, `INSERT INTO plant_data_metric(plant_data_id, metric_id, value)
+	SELECT v.plant_data_id, m.id, v.value FROM unnest($1::bigint[], $2::text[], $3::float8[])
+	AS v(plant_data_id, name, value) INNER JOIN metric m ON m.name = v.name`, readingIDs, names, values)
+	return err
+}
+
+// DB Query to add a metric to the registry.
+func insertMetric(db queryer, m Metric) error {
+	_, err := db.Exec(context.Background(), `INSERT INTO metric(name, unit, value_type, min_value, max_value, description)
+	VALUES ($1, $2, $3, $4, $5, $6)`, m.Name, m.Unit, m.Type, m.Min, m.Max, nullString(m.Description))
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) && pgErr.SQLState() == uniqueViolation {
+		return errMetricExists
+	}
+	return err
+}
+
+// HTTP Call to list the metrics probes can send
+func (api *API) getMetrics(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		metrics, err := getMetricsDB(r.Context(), api.db, nil)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(metrics)
+	}
+}
+
+// A flag holding a number that may be left unset.
+type optionalFloat struct {
+	value *float64
+}
+
+func (f *optionalFloat) String() string {
+	if f.value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f.value, 'g', -1, 64)
+}
+
+func (f *optionalFloat) Set(value string) error {
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	f.value = &number
+	return nil
+}
+
+// The add-metric command registers a new metric that probes can send.
+func addMetricCommand(args []string) error {
+	var min, max optionalFloat
+	flags := flag.NewFlagSet("add-metric", flag.ContinueOnError)
+	name := flags.String("name", "", "name probes send the metric as, such as ph or soilMoisture2")
+	unit := flags.String("unit", "", "unit of the values, such as pH or µS/cm")
+	valueType := flags.String("type", metricFloat, "float or integer")
+	description := flags.String("description", "", "what the metric measures")
+	flags.Var(&min, "min", "lowest valid value")
+	flags.Var(&max, "max", "highest valid value")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: plantdaddy add-metric -name NAME [-unit UNIT] [-type float] [-min N] [-max N] [-description TEXT]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if !metricNamePattern.MatchString(*name) {
+		flags.Usage()
+		return fmt.Errorf("name must start with a lower case letter and hold at most 32 letters and digits")
+	}
+	if *valueType != metricFloat && *valueType != metricInteger {
+		return fmt.Errorf("type must be float or integer")
+	}
+	if min.value != nil && max.value != nil && *min.value > *max.value {
+		return fmt.Errorf("min must not be more than max")
+	}
+
+	db := connectToDb(os.Getenv("CONNSTRING"))
+	defer db.Close()
+
+	m := Metric{Name: *name, Unit: *unit, Type: *valueType, Min: min.value, Max: max.value, Description: *description}
+	if err := insertMetric(db, m); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "added metric %s\n", m.Name)
+	return nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// legacyRegistry returns the registry of the legacy metrics as db.sql seeds it.
+func legacyRegistry() map[string]Metric {
+	value := func(v float64) *float64 { return &v }
+	return map[string]Metric{
+		"temperature":  {Name: "temperature", Unit: "°C", Type: metricFloat, Min: value(-50), Max: value(100), Legacy: true},
+		"humidity":     {Name: "humidity", Unit: "%", Type: metricFloat, Min: value(0), Max: value(100), Legacy: true},
+		"soilMoisture": {Name: "soilMoisture", Unit: "%", Type: metricFloat, Min: value(0), Max: value(100), Legacy: true},
+		"light":        {Name: "light", Unit: "%", Type: metricFloat, Min: value(0), Max: value(100), Legacy: true},
+	}
+}
+
+func TestMetricCheck(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	ph := Metric{Name: "ph", Unit: "pH", Type: metricFloat, Min: value(0), Max: value(14)}
+	count := Metric{Name: "leaves", Type: metricInteger, Min: value(0)}
+	unbounded := Metric{Name: "ec", Type: metricFloat}
+	tests := []struct {
+		name   string
+		metric Metric
+		value  float64
+		err    bool
+	}{
+		{"within the range", ph, 6.5, false},
+		{"at the min", ph, 0, false},
+		{"at the max", ph, 14, false},
+		{"below the min", ph, -0.1, true},
+		{"above the max", ph, 14.1, true},
+		{"NaN", ph, math.NaN(), true},
+		{"infinite", unbounded, math.Inf(1), true},
+		{"negative infinite", unbounded, math.Inf(-1), true},
+		{"no bounds", unbounded, -1e9, false},
+		{"whole number", count, 12, false},
+		{"fraction of an integer", count, 12.5, true},
+		{"only a min", count, 1e9, false},
+		{"below only a min", count, -1, true},
+	}
+
+	for _, test := range tests {
+		err := test.metric.check(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if err != nil && !errors.Is(err, errInvalidMetric) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, errInvalidMetric)
+		}
+	}
+}
+
+func TestCheckMetrics(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	registry := legacyRegistry()
+	registry["ph"] = Metric{Name: "ph", Unit: "pH", Type: metricFloat, Min: value(0), Max: value(14)}
+	tests := []struct {
+		name   string
+		values map[string]float64
+		err    bool
+	}{
+		{"none", nil, false},
+		{"registered", map[string]float64{"ph": 7}, false},
+		{"not registered", map[string]float64{"co2": 400}, true},
+		{"a legacy metric", map[string]float64{"temperature": 21}, true},
+		{"out of range", map[string]float64{"ph": 15}, true},
+		{"one of many out of range", map[string]float64{"ph": 7, "co2": 400}, true},
+	}
+
+	for _, test := range tests {
+		err := checkMetrics(test.values, registry)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if err != nil && !errors.Is(err, errInvalidMetric) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, errInvalidMetric)
+		}
+	}
+}
+
+func TestCheckLegacyValues(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name     string
+		values   [4]*float64
+		registry map[string]Metric
+		err      bool
+	}{
+		{"every value", [4]*float64{value(21.5), value(40), value(55), value(100)}, legacyRegistry(), false},
+		{"none", [4]*float64{}, legacyRegistry(), false},
+		{"at the bounds", [4]*float64{value(-50), value(0), value(100), value(0)}, legacyRegistry(), false},
+		{"too hot", [4]*float64{value(100.5), nil, nil, nil}, legacyRegistry(), true},
+		{"too cold", [4]*float64{value(-51), nil, nil, nil}, legacyRegistry(), true},
+		{"over a hundred percent", [4]*float64{nil, value(101), nil, nil}, legacyRegistry(), true},
+		{"below zero percent", [4]*float64{nil, nil, value(-1), nil}, legacyRegistry(), true},
+		{"NaN", [4]*float64{nil, nil, nil, value(math.NaN())}, legacyRegistry(), true},
+		{"not in the registry", [4]*float64{value(21), nil, nil, nil}, map[string]Metric{}, true},
+		{"missing value not in the registry", [4]*float64{}, map[string]Metric{}, false},
+	}
+
+	for _, test := range tests {
+		if err := checkLegacyValues(test.values, test.registry); (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+	}
+
+	// The ranges come from the registry, so a wider range lets the value through
+	wider := legacyRegistry()
+	wider["temperature"] = Metric{Name: "temperature", Type: metricFloat, Legacy: true}
+	if err := checkLegacyValues([4]*float64{value(150), nil, nil, nil}, wider); err != nil {
+		t.Errorf("a temperature without bounds got %v", err)
+	}
+}
+
+func TestInsertMetric(t *testing.T) {
+	api, _ := testAPI(t)
+	name := uniqueName(t, "ph")
+	if err := insertMetric(api.db, Metric{Name: name, Unit: "pH", Type: metricFloat}); err != nil {
+		t.Fatal(err)
+	}
+	if err := insertMetric(api.db, Metric{Name: name, Type: metricFloat}); err != errMetricExists {
+		t.Errorf("a second metric with the name got %v, want %v", err, errMetricExists)
+	}
+
+	extra, err := getExtraMetrics(context.Background(), api.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, m := range extra {
+		if m.Legacy {
+			t.Errorf("%s is a legacy metric", m.Name)
+		}
+		found = found || m.Name == name
+	}
+	if !found {
+		t.Errorf("%s is not among the extra metrics %+v", name, extra)
+	}
+}
+
+func TestBatchMetricsFollowTheirReading(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "measurer")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	deviceID := createDevice(t, api, user.ID)
+	session := startSession(t, api, deviceID)
+	name := uniqueName(t, "ph")
+	if err := insertMetric(api.db, Metric{Name: name, Unit: "pH", Type: metricFloat}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The device already has the second reading, so the metrics of the others must not shift onto the wrong rows
+	now := time.Now().UTC().Truncate(time.Second)
+	addReading(t, api, deviceID, now.Add(-20*time.Minute), 20)
+	readings := []Data{
+		{Timestamp: now.Add(-30 * time.Minute), Temperature: 19, Metrics: map[string]float64{name: 6}},
+		{Timestamp: now.Add(-20 * time.Minute), Temperature: 20, Metrics: map[string]float64{name: 7}},
+		{Timestamp: now.Add(-10 * time.Minute), Temperature: 21, Metrics: map[string]float64{name: 8}},
+	}
+	batch := SessionBatch{SessionID: session.SessionID, UsageCounter: session.UsageCounter, Timestamp: now,
+		DeviceID: deviceID, Readings: readings}
+	result, err := insertSessionBatch(batch, api.db, api.sessionTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stored != 2 {
+		t.Fatalf("got %+v", result)
+	}
+
+	rows, err := api.db.Query(context.Background(), `SELECT p.temperature, v.value FROM plant_data p
+	INNER JOIN plant_data_metric v ON v.plant_data_id = p.id INNER JOIN metric m ON m.id = v.metric_id
+	WHERE p.device_id = $1 AND m.name = $2`, deviceID, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	got := map[float64]float64{}
+	for rows.Next() {
+		var temperature, value float64
+		if err := rows.Scan(&temperature, &value); err != nil {
+			t.Fatal(err)
+		}
+		got[temperature] = value
+	}
+	if len(got) != 2 || got[19] != 6 || got[21] != 8 {
+		t.Errorf("got metrics by temperature %v", got)
+	}
+}
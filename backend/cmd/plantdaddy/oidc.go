@@ -0,0 +1,430 @@
+package main
+
+// This file talks to the OpenID Connect providers users can sign in with
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How long the id token clock may be off from ours.
+const oidcClockSkew = 2 * time.Minute
+
+// How often the signing keys may be fetched again when a token names a key we do not know.
+const jwksRefreshInterval = time.Minute
+
+var errInvalidIDToken = errors.New("id token is invalid")
+
+// An identity provider configured with OIDC_PROVIDERS.
+type OIDCProvider struct {
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+
+	client *http.Client
+
+	mu          sync.Mutex
+	discovery   *oidcDiscovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// The parts of the provider's /.well-known/openid-configuration we use.
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// The claims we read from an id token.
+type IDTokenClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	ExpiresAt         int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	EmailVerified     oidcBool     `json:"email_verified"`
+	PreferredUsername string       `json:"preferred_username"`
+	Name              string       `json:"name"`
+}
+
+// The aud claim may be a single string or a list.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = oidcAudience{single}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+// Some providers send email_verified as the string "true".
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	default:
+		*b = false
+	}
+	return nil
+}
+
+// This function reads the providers from the environment.
+// OIDC_PROVIDERS is a comma separated list of names, and each name NAME has
+// OIDC_NAME_ISSUER, OIDC_NAME_CLIENT_ID and optionally OIDC_NAME_CLIENT_SECRET and OIDC_NAME_SCOPES.
+func oidcProvidersFromEnv() map[string]*OIDCProvider {
+	providers := make(map[string]*OIDCProvider)
+	for _, name := range strings.Split(os.Getenv("OIDC_PROVIDERS"), ",") {
+		name = strings.TrimSpace(strings.ToLower(name))
+		if name == "" {
+			continue
+		}
+
+		prefix := "OIDC_" + strings.ToUpper(strings.Replace(name, "-", "_", -1)) + "_"
+		provider := &OIDCProvider{
+			Name:         name,
+			Issuer:       strings.TrimRight(os.Getenv(prefix+"ISSUER"), "/"),
+			ClientID:     os.Getenv(prefix + "CLIENT_ID"),
+			ClientSecret: os.Getenv(prefix + "CLIENT_SECRET"),
+			Scopes:       strings.Fields(stringEnv(prefix+"SCOPES", "openid email profile")),
+			client:       &http.Client{Timeout: 10 * time.Second},
+		}
+		if provider.Issuer == "" || provider.ClientID == "" {
+			log.Fatalf("%sISSUER and %sCLIENT_ID must be set for the %s provider", prefix, prefix, name)
+		}
+		providers[name] = provider
+	}
+	return providers
+}
+
+// This function fetches the provider configuration the first time it is needed.
+func (p *OIDCProvider) configuration(ctx context.Context) (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := p.getJSON(ctx, p.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(discovery.Issuer, "/") != p.Issuer {
+		return nil, fmt.Errorf("%s: discovery issuer %q does not match %q", p.Name, discovery.Issuer, p.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, fmt.Errorf("%s: discovery document is missing endpoints", p.Name)
+	}
+	p.discovery = &discovery
+	return p.discovery, nil
+}
+
+// This function makes a GET request and decodes the json it returns.
+func (p *OIDCProvider) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: GET %s returned %s", p.Name, u, res.Status)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(v)
+}
+
+// This function builds the url the user is sent to to sign in.
+func (p *OIDCProvider) authorizationURL(ctx context.Context, redirectURL string, state string, nonce string, verifier string) (string, error) {
+	discovery, err := p.configuration(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", p.ClientID)
+	values.Set("redirect_uri", redirectURL)
+	values.Set("scope", strings.Join(p.Scopes, " "))
+	values.Set("state", state)
+	values.Set("nonce", nonce)
+	values.Set("code_challenge", pkceChallenge(verifier))
+	values.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + values.Encode(), nil
+}
+
+// This function returns the S256 code challenge for a PKCE verifier.
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// This function trades the code from the callback for tokens and returns the verified id token claims.
+func (p *OIDCProvider) exchange(ctx context.Context, redirectURL string, code string, verifier string, nonce string) (IDTokenClaims, error) {
+	discovery, err := p.configuration(ctx)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", redirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", p.ClientID)
+
+	req, err := http.NewRequest("POST", discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return IDTokenClaims{}, fmt.Errorf("%s: token endpoint returned %s: %s", p.Name, res.Status, body)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return IDTokenClaims{}, err
+	}
+	if tokens.IDToken == "" {
+		return IDTokenClaims{}, fmt.Errorf("%s: token response has no id_token", p.Name)
+	}
+	return p.verifyIDToken(ctx, tokens.IDToken, nonce, time.Now())
+}
+
+// This function checks the signature and claims of an id token.
+func (p *OIDCProvider) verifyIDToken(ctx context.Context, token string, nonce string, now time.Time) (IDTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return IDTokenClaims{}, errInvalidIDToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return IDTokenClaims{}, errInvalidIDToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return IDTokenClaims{}, errInvalidIDToken
+	}
+
+	key, err := p.signingKey(ctx, header.KeyID)
+	if err != nil {
+		return IDTokenClaims{}, err
+	}
+	if err := verifyJWS(header.Algorithm, key, parts[0]+"."+parts[1], signature); err != nil {
+		return IDTokenClaims{}, err
+	}
+
+	var claims IDTokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return IDTokenClaims{}, errInvalidIDToken
+	}
+
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.Issuer:
+		return IDTokenClaims{}, fmt.Errorf("%w: wrong issuer", errInvalidIDToken)
+	case !claims.Audience.contains(p.ClientID):
+		return IDTokenClaims{}, fmt.Errorf("%w: wrong audience", errInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.ClientID:
+		return IDTokenClaims{}, fmt.Errorf("%w: wrong authorized party", errInvalidIDToken)
+	case now.Add(-oidcClockSkew).Unix() >= claims.ExpiresAt:
+		return IDTokenClaims{}, fmt.Errorf("%w: expired", errInvalidIDToken)
+	case claims.IssuedAt > now.Add(oidcClockSkew).Unix():
+		return IDTokenClaims{}, fmt.Errorf("%w: issued in the future", errInvalidIDToken)
+	case claims.Nonce != nonce:
+		return IDTokenClaims{}, fmt.Errorf("%w: wrong nonce", errInvalidIDToken)
+	case claims.Subject == "":
+		return IDTokenClaims{}, fmt.Errorf("%w: no subject", errInvalidIDToken)
+	}
+	return claims, nil
+}
+
+// This function checks if the audience names the client.
+func (a oidcAudience) contains(clientID string) bool {
+	for _, audience := range a {
+		if audience == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// This function decodes one base64url segment of a token as json.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// This function checks a RS256 or ES256 signature over the signed part of a token.
+// Other algorithms, including none and the HMAC ones, are refused.
+func verifyJWS(algorithm string, key crypto.PublicKey, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	switch algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: key does not match algorithm", errInvalidIDToken)
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return fmt.Errorf("%w: bad signature", errInvalidIDToken)
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return fmt.Errorf("%w: key does not match algorithm", errInvalidIDToken)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return fmt.Errorf("%w: bad signature", errInvalidIDToken)
+		}
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %q", errInvalidIDToken, algorithm)
+	}
+	return nil
+}
+
+// This function returns the provider key with the id, fetching the key set again if it is not known.
+func (p *OIDCProvider) signingKey(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	discovery, err := p.configuration(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[keyID]; ok {
+		return key, nil
+	}
+	// Providers rotate their keys so an unknown id is a reason to look again, but not too often
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidIDToken, keyID)
+	}
+
+	keys, err := p.fetchKeys(ctx, discovery.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	p.keysFetched = time.Now()
+
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", errInvalidIDToken, keyID)
+	}
+	return key, nil
+}
+
+// This function fetches and parses the provider's json web key set.
+// Keys that are not for signing or that we cannot use are skipped.
+func (p *OIDCProvider) fetchKeys(ctx context.Context, jwksURI string) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+			Curve   string `json:"crv"`
+			X       string `json:"x"`
+			Y       string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := p.getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		switch jwk.KeyType {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+			if errN != nil || errE != nil || len(e) > 4 {
+				continue
+			}
+			keys[jwk.KeyID] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if jwk.Curve != "P-256" || errX != nil || errY != nil {
+				continue
+			}
+			key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !key.Curve.IsOnCurve(key.X, key.Y) {
+				continue
+			}
+			keys[jwk.KeyID] = key
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,553 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeIdP is an OpenID Connect provider that signs in whoever the test asks it to.
+type fakeIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]fakeGrant
+}
+
+// What the provider hands out for an authorization code.
+type fakeGrant struct {
+	claims    IDTokenClaims
+	challenge string
+}
+
+const fakeClientID = "plantdaddy-test"
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	t.Helper()
+	key := mustRSAKey(t)
+	idp := &fakeIdP{key: key, codes: map[string]fakeGrant{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                idp.server.URL,
+			AuthorizationEndpoint: idp.server.URL + "/authorize",
+			TokenEndpoint:         idp.server.URL + "/token",
+			JWKSURI:               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		idp.mu.Lock()
+		grant, ok := idp.codes[r.PostFormValue("code")]
+		delete(idp.codes, r.PostFormValue("code"))
+		idp.mu.Unlock()
+		if !ok || r.PostFormValue("client_id") != fakeClientID || pkceChallenge(r.PostFormValue("code_verifier")) != grant.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, "RS256", "test", grant.claims)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// This function returns a provider that trusts the fake.
+func (idp *fakeIdP) provider() *OIDCProvider {
+	return &OIDCProvider{Name: "fake", Issuer: idp.server.URL, ClientID: fakeClientID, Scopes: []string{"openid"}, client: idp.server.Client()}
+}
+
+// This function returns claims for the subject that verify against the provider.
+func (idp *fakeIdP) claims(subject string, nonce string) IDTokenClaims {
+	now := time.Now()
+	return IDTokenClaims{
+		Issuer:    idp.server.URL,
+		Subject:   subject,
+		Audience:  oidcAudience{fakeClientID},
+		ExpiresAt: now.Add(time.Hour).Unix(),
+		IssuedAt:  now.Unix(),
+		Nonce:     nonce,
+	}
+}
+
+// This function signs the claims as an id token.
+func (idp *fakeIdP) sign(t *testing.T, algorithm string, keyID string, claims IDTokenClaims) string {
+	t.Helper()
+	signed := unsignedToken(t, algorithm, keyID, claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// This function plays the user signing in at the provider. It reads the authorization url the
+// server sent them to and returns the state and code the provider sends back to the callback.
+// When the claims have no nonce the one from the url is used.
+func (idp *fakeIdP) authorize(t *testing.T, authorizationURL string, claims IDTokenClaims) (string, string) {
+	t.Helper()
+	u, err := url.Parse(authorizationURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("client_id") != fakeClientID || query.Get("code_challenge_method") != "S256" {
+		t.Fatalf("got authorization url %s", authorizationURL)
+	}
+	if claims.Nonce == "" {
+		claims.Nonce = query.Get("nonce")
+	}
+
+	code := uniqueName(t, "code")
+	idp.mu.Lock()
+	idp.codes[code] = fakeGrant{claims: claims, challenge: query.Get("code_challenge")}
+	idp.mu.Unlock()
+	return query.Get("state"), code
+}
+
+// oidcTestAPI returns an API that can sign in with the fake provider.
+func oidcTestAPI(t *testing.T) (*API, *fakeIdP) {
+	api, _ := testAPI(t)
+	idp := newFakeIdP(t)
+	api.oidcProviders = map[string]*OIDCProvider{"fake": idp.provider()}
+	api.oidcRedirectURL = "https://plantdaddy.test/api/oidc/callback"
+	return api, idp
+}
+
+// oidcFlow is a sign in the app started in a browser, with the verifier the app keeps and the cookie
+// the browser was given.
+type oidcFlow struct {
+	authorizationURL string
+	verifier         string
+	cookie           *http.Cookie
+}
+
+// newAppVerifier returns a PKCE verifier for the app to start a sign in with.
+func newAppVerifier(t *testing.T) string {
+	t.Helper()
+	verifier, err := newOpaqueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return verifier
+}
+
+// openStart opens the start url in the browser and returns the sign in it started.
+func openStart(t *testing.T, api *API, target string, verifier string) oidcFlow {
+	t.Helper()
+	w := doJSON(t, api.startOIDC, "GET", target, nil, nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("start: %d %s", w.Code, w.Body)
+	}
+	flow := oidcFlow{authorizationURL: w.Header().Get("Location"), verifier: verifier}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == oidcStateCookie {
+			flow.cookie = cookie
+		}
+	}
+	if flow.cookie == nil || !flow.cookie.HttpOnly || flow.cookie.SameSite != http.SameSiteLaxMode || !flow.cookie.Secure {
+		t.Fatalf("start set the cookie %+v", flow.cookie)
+	}
+	return flow
+}
+
+// callback follows the redirect back from the provider in the browser of the flow and returns where the app is sent.
+func callback(t *testing.T, api *API, flow oidcFlow, state string, code string) url.Values {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/api/oidc/callback?"+url.Values{"state": {state}, "code": {code}}.Encode(), nil)
+	if flow.cookie != nil {
+		r.AddCookie(&http.Cookie{Name: flow.cookie.Name, Value: flow.cookie.Value})
+	}
+	w := httptest.NewRecorder()
+	api.oidcCallback(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("callback: %d %s", w.Code, w.Body)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Scheme != "plantdaddy" || location.Path != "/oidc" {
+		t.Fatalf("callback sent the app to %s", location)
+	}
+	return location.Query()
+}
+
+// exchangeCode trades the code the app was sent with the verifier of the flow.
+func exchangeCode(t *testing.T, api *API, flow oidcFlow, values url.Values) *httptest.ResponseRecorder {
+	t.Helper()
+	if values.Get("code") == "" {
+		t.Fatalf("sign in failed: %v", values)
+	}
+	return doJSON(t, api.oidcToken, "POST", "/api/oidc/token", OIDCExchange{Code: values.Get("code"), CodeVerifier: flow.verifier}, nil)
+}
+
+// startSignIn starts a sign in with the fake provider.
+func startSignIn(t *testing.T, api *API) oidcFlow {
+	t.Helper()
+	verifier := newAppVerifier(t)
+	query := url.Values{"provider": {"fake"}, "code_challenge": {pkceChallenge(verifier)}, "code_challenge_method": {"S256"}}
+	return openStart(t, api, "/api/oidc/start?"+query.Encode(), verifier)
+}
+
+// startLink starts linking the fake provider to the user and opens the url it returns in the browser.
+func startLink(t *testing.T, api *API, user AuthUser) oidcFlow {
+	t.Helper()
+	verifier := newAppVerifier(t)
+	w := doJSON(t, asUser(api, user, api.linkOIDC), "POST", "/api/oidc/link", OIDCStart{Provider: "fake", CodeChallenge: pkceChallenge(verifier)}, nil)
+	var authorization OIDCAuthorization
+	if err := json.NewDecoder(w.Body).Decode(&authorization); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("link: %d %v", w.Code, err)
+	}
+	start, err := url.Parse(authorization.URL)
+	if err != nil || start.Host != "plantdaddy.test" || start.Path != "/api/oidc/start" {
+		t.Fatalf("link returned %s: %v", authorization.URL, err)
+	}
+	return openStart(t, api, start.RequestURI(), verifier)
+}
+
+// signInWith follows a flow through the provider and the callback and trades the code for tokens.
+func signInWith(t *testing.T, api *API, idp *fakeIdP, flow oidcFlow, claims IDTokenClaims) *httptest.ResponseRecorder {
+	t.Helper()
+	state, code := idp.authorize(t, flow.authorizationURL, claims)
+	return exchangeCode(t, api, flow, callback(t, api, flow, state, code))
+}
+
+func TestPKCEChallenge(t *testing.T) {
+	// The example from RFC 7636 appendix B
+	if got := pkceChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"); got != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("got challenge %s", got)
+	}
+}
+
+func TestIDTokenClaimsDecoding(t *testing.T) {
+	tests := []struct {
+		payload  string
+		audience oidcAudience
+		verified bool
+	}{
+		{`{"aud":"app","email_verified":true}`, oidcAudience{"app"}, true},
+		{`{"aud":["app","other"],"email_verified":"true"}`, oidcAudience{"app", "other"}, true},
+		{`{"aud":"app","email_verified":"false"}`, oidcAudience{"app"}, false},
+		{`{"aud":"app"}`, oidcAudience{"app"}, false},
+	}
+
+	for _, test := range tests {
+		var claims IDTokenClaims
+		if err := json.Unmarshal([]byte(test.payload), &claims); err != nil {
+			t.Errorf("%s: %v", test.payload, err)
+			continue
+		}
+		if len(claims.Audience) != len(test.audience) || claims.Audience[0] != test.audience[0] || bool(claims.EmailVerified) != test.verified {
+			t.Errorf("%s: got audience %q verified %v", test.payload, claims.Audience, claims.EmailVerified)
+		}
+	}
+}
+
+func TestUsernameFromClaims(t *testing.T) {
+	tests := []struct {
+		claims IDTokenClaims
+		want   string
+	}{
+		{IDTokenClaims{PreferredUsername: "Fern.Lover"}, "fern.lover"},
+		{IDTokenClaims{Email: "basil@example.com"}, "basil"},
+		{IDTokenClaims{PreferredUsername: "--Mint Leaf!--"}, "mintleaf"},
+		{IDTokenClaims{PreferredUsername: "ÄÖÜ"}, "gardener"},
+		{IDTokenClaims{}, "gardener"},
+		{IDTokenClaims{PreferredUsername: "a123456789b123456789c123456789d123456789e123"}, "a123456789b123456789c123456789d123456789"},
+	}
+
+	for _, test := range tests {
+		if got := usernameFromClaims(test.claims); got != test.want {
+			t.Errorf("usernameFromClaims(%+v) = %q, want %q", test.claims, got, test.want)
+		}
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	idp := newFakeIdP(t)
+	provider := idp.provider()
+	now := time.Now()
+	valid := idp.claims("subject", "nonce")
+
+	modified := func(change func(*IDTokenClaims)) IDTokenClaims {
+		claims := valid
+		change(&claims)
+		return claims
+	}
+	otherKey := &fakeIdP{key: mustRSAKey(t)}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", idp.sign(t, "RS256", "test", valid), true},
+		{"wrong nonce", idp.sign(t, "RS256", "test", modified(func(c *IDTokenClaims) { c.Nonce = "other" })), false},
+		{"wrong issuer", idp.sign(t, "RS256", "test", modified(func(c *IDTokenClaims) { c.Issuer = "https://evil.test" })), false},
+		{"wrong audience", idp.sign(t, "RS256", "test", modified(func(c *IDTokenClaims) { c.Audience = oidcAudience{"other"} })), false},
+		{"several audiences without azp", idp.sign(t, "RS256", "test", modified(func(c *IDTokenClaims) { c.Audience = oidcAudience{fakeClientID, "other"} })), false},
+		{"several audiences with azp", idp.sign(t, "RS256", "test", modified(func(c *IDTokenClaims) {
+			c.Audience = oidcAudience{fakeClientID, "other"}
+			c.AuthorizedParty = fakeClientID
+		})), true},
+		{"expired", idp.sign(t, "RS256", "test", modified(func(c *IDTokenClaims) { c.ExpiresAt = now.Add(-time.Hour).Unix() })), false},
+		{"issued in the future", idp.sign(t, "RS256", "test", modified(func(c *IDTokenClaims) { c.IssuedAt = now.Add(time.Hour).Unix() })), false},
+		{"no subject", idp.sign(t, "RS256", "test", modified(func(c *IDTokenClaims) { c.Subject = "" })), false},
+		{"signed by another key", otherKey.sign(t, "RS256", "test", valid), false},
+		{"unknown key", idp.sign(t, "RS256", "other", valid), false},
+		{"algorithm none", unsignedToken(t, "none", "test", valid) + ".", false},
+		{"HMAC algorithm", idp.sign(t, "HS256", "test", valid), false},
+		{"EC algorithm with an RSA key", idp.sign(t, "ES256", "test", valid), false},
+		{"not a token", "abc", false},
+	}
+
+	for _, test := range tests {
+		_, err := provider.verifyIDToken(context.Background(), test.token, "nonce", now)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if err != nil && !errors.Is(err, errInvalidIDToken) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, errInvalidIDToken)
+		}
+	}
+}
+
+func TestOIDCSignIn(t *testing.T) {
+	api, idp := oidcTestAPI(t)
+	subject := uniqueName(t, "subject")
+	claims := idp.claims(subject, "")
+	claims.PreferredUsername = uniqueName(t, "oidc")
+
+	flow := startSignIn(t, api)
+	state, code := idp.authorize(t, flow.authorizationURL, claims)
+	values := callback(t, api, flow, state, code)
+
+	// Another app that was handed the code cannot trade it without the verifier
+	w := doJSON(t, api.oidcToken, "POST", "/api/oidc/token", OIDCExchange{Code: values.Get("code"), CodeVerifier: newAppVerifier(t)}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a wrong verifier got %d", w.Code)
+	}
+	w = doJSON(t, api.oidcToken, "POST", "/api/oidc/token", OIDCExchange{Code: values.Get("code")}, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("no verifier got %d", w.Code)
+	}
+
+	w = exchangeCode(t, api, flow, values)
+	var token AccessToken
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil || w.Code != http.StatusOK || token.RefreshToken == "" {
+		t.Fatalf("token: %d %v", w.Code, err)
+	}
+	first, err := verifyAccessToken(api.tokenSecret, token.AccessToken, time.Now())
+	if err != nil || first.Username != claims.PreferredUsername {
+		t.Fatalf("got claims %+v: %v", first, err)
+	}
+
+	// The code from the callback can only be traded once
+	if w := exchangeCode(t, api, flow, values); w.Code != http.StatusUnauthorized {
+		t.Errorf("a used code got %d", w.Code)
+	}
+
+	// Signing in again with the same identity finds the same account
+	w = signInWith(t, api, idp, startSignIn(t, api), claims)
+	token = AccessToken{}
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil {
+		t.Fatal(err)
+	}
+	if again, err := verifyAccessToken(api.tokenSecret, token.AccessToken, time.Now()); err != nil || again.UserID != first.UserID {
+		t.Errorf("signing in again got %+v: %v", again, err)
+	}
+}
+
+func TestStartOIDCNeedsAnAppChallenge(t *testing.T) {
+	api, _ := oidcTestAPI(t)
+	challenge := pkceChallenge("a verifier the app keeps")
+	tests := []struct {
+		name  string
+		query url.Values
+		code  int
+	}{
+		{"no challenge", url.Values{"provider": {"fake"}}, http.StatusBadRequest},
+		{"plain challenge", url.Values{"provider": {"fake"}, "code_challenge": {challenge}, "code_challenge_method": {"plain"}}, http.StatusBadRequest},
+		{"short challenge", url.Values{"provider": {"fake"}, "code_challenge": {"abc"}, "code_challenge_method": {"S256"}}, http.StatusBadRequest},
+		{"unknown provider", url.Values{"provider": {"other"}, "code_challenge": {challenge}, "code_challenge_method": {"S256"}}, http.StatusNotFound},
+		{"forged link", url.Values{"provider": {"fake"}, "code_challenge": {challenge}, "code_challenge_method": {"S256"}, "link": {"not a token"}},
+			http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		w := doJSON(t, api.startOIDC, "GET", "/api/oidc/start?"+test.query.Encode(), nil, nil)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.code)
+		}
+	}
+}
+
+func TestOIDCCallbackChecksStateAndNonce(t *testing.T) {
+	api, idp := oidcTestAPI(t)
+	claims := idp.claims(uniqueName(t, "subject"), "")
+
+	flow := startSignIn(t, api)
+	state, code := idp.authorize(t, flow.authorizationURL, claims)
+	if values := callback(t, api, flow, "not the state", code); values.Get("error") != errInvalidOIDCState.Error() {
+		t.Errorf("an unknown state got %v", values)
+	}
+
+	// A browser that did not start the sign in is turned away, without using up the state
+	if values := callback(t, api, oidcFlow{}, state, code); values.Get("error") != errInvalidOIDCState.Error() {
+		t.Errorf("a callback without the cookie got %v", values)
+	}
+	other := startSignIn(t, api)
+	if values := callback(t, api, other, state, code); values.Get("error") != errInvalidOIDCState.Error() {
+		t.Errorf("a callback with the cookie of another sign in got %v", values)
+	}
+
+	if values := callback(t, api, flow, state, code); values.Get("code") == "" {
+		t.Fatalf("sign in failed: %s", values.Get("error"))
+	}
+	// The state is used up by the first callback
+	_, code = idp.authorize(t, flow.authorizationURL, claims)
+	if values := callback(t, api, flow, state, code); values.Get("error") != errInvalidOIDCState.Error() {
+		t.Errorf("a used state got %v", values)
+	}
+
+	// A token minted for another sign in is refused
+	claims.Nonce = "another sign in"
+	flow = startSignIn(t, api)
+	state, code = idp.authorize(t, flow.authorizationURL, claims)
+	if values := callback(t, api, flow, state, code); values.Get("code") != "" || values.Get("error") == "" {
+		t.Errorf("a wrong nonce got %v", values)
+	}
+}
+
+func TestOIDCLinkAndUnlink(t *testing.T) {
+	api, idp := oidcTestAPI(t)
+	user := AuthUser{Username: uniqueName(t, "linker")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	subject := uniqueName(t, "subject")
+
+	if w := signInWith(t, api, idp, startLink(t, api, user), idp.claims(subject, "")); w.Code != http.StatusNoContent {
+		t.Fatalf("link: %d %s", w.Code, w.Body)
+	}
+	identities, err := getIdentitiesDB(api.db, user.ID)
+	if err != nil || len(identities) != 1 || identities[0].Provider != "fake" {
+		t.Fatalf("got identities %+v: %v", identities, err)
+	}
+
+	// The identity cannot be linked to a second account
+	other := AuthUser{Username: uniqueName(t, "other")}
+	other.ID = createUser(t, api, other.Username, "correct horse battery")
+	if w := signInWith(t, api, idp, startLink(t, api, other), idp.claims(subject, "")); w.Code != http.StatusConflict {
+		t.Errorf("linking to a second account got %d %s", w.Code, w.Body)
+	}
+
+	// The user still has a password so the identity can go
+	w := doJSON(t, asUser(api, user, api.identities), "DELETE", "/api/oidc/identities?identityID="+strconv.FormatInt(identities[0].ID, 10), nil, nil)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("unlink: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestOIDCLinkSentToSomeoneElse(t *testing.T) {
+	api, idp := oidcTestAPI(t)
+	attacker := AuthUser{Username: uniqueName(t, "attacker")}
+	attacker.ID = createUser(t, api, attacker.Username, "correct horse battery")
+	victim := idp.claims(uniqueName(t, "subject"), "")
+
+	// The provider url of a link started by the attacker does nothing in a browser without its cookie
+	flow := startLink(t, api, attacker)
+	state, code := idp.authorize(t, flow.authorizationURL, victim)
+	if values := callback(t, api, oidcFlow{}, state, code); values.Get("error") != errInvalidOIDCState.Error() {
+		t.Errorf("the link in another browser got %v", values)
+	}
+
+	// Once the victim's browser started it, their app still cannot finish it without the attacker's verifier
+	values := callback(t, api, flow, state, code)
+	if w := exchangeCode(t, api, oidcFlow{verifier: newAppVerifier(t)}, values); w.Code != http.StatusUnauthorized {
+		t.Errorf("finishing the link with another verifier got %d", w.Code)
+	}
+	if identities, err := getIdentitiesDB(api.db, attacker.ID); err != nil || len(identities) != 0 {
+		t.Errorf("the attacker has identities %+v: %v", identities, err)
+	}
+}
+
+func TestOIDCUnlinkLastSignInMethod(t *testing.T) {
+	api, idp := oidcTestAPI(t)
+	claims := idp.claims(uniqueName(t, "subject"), "")
+	claims.PreferredUsername = uniqueName(t, "nopassword")
+
+	w := signInWith(t, api, idp, startSignIn(t, api), claims)
+	var token AccessToken
+	if err := json.NewDecoder(w.Body).Decode(&token); err != nil {
+		t.Fatalf("sign in: %d %v", w.Code, err)
+	}
+	access, err := verifyAccessToken(api.tokenSecret, token.AccessToken, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := AuthUser{ID: access.UserID, Username: access.Username}
+	identities, err := getIdentitiesDB(api.db, user.ID)
+	if err != nil || len(identities) != 1 {
+		t.Fatalf("got identities %+v: %v", identities, err)
+	}
+
+	unlink := func(id int64) int {
+		w := doJSON(t, asUser(api, user, api.identities), "DELETE", "/api/oidc/identities?identityID="+strconv.FormatInt(id, 10), nil, nil)
+		return w.Code
+	}
+	if code := unlink(identities[0].ID); code != http.StatusConflict {
+		t.Errorf("unlinking the only way to sign in got %d, want %d", code, http.StatusConflict)
+	}
+
+	// Once a second identity is linked the first can go
+	if w := signInWith(t, api, idp, startLink(t, api, user), idp.claims(uniqueName(t, "subject"), "")); w.Code != http.StatusNoContent {
+		t.Fatalf("link: %d %s", w.Code, w.Body)
+	}
+	if code := unlink(identities[0].ID); code != http.StatusNoContent {
+		t.Errorf("unlinking with another identity left got %d", code)
+	}
+}
+
+// unsignedToken returns the header and payload of an id token.
+func unsignedToken(t *testing.T, algorithm string, keyID string, claims IDTokenClaims) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": algorithm, "kid": keyID, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+}
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
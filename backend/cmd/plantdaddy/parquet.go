@@ -0,0 +1,431 @@
+package main
+
+// This file writes readings as Apache Parquet, the columnar format notebooks and data tools read fastest.
+// Only what the export needs is implemented: flat schemas of required strings and timestamps and
+// optional doubles, written uncompressed with plain encoding.
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const parquetMagic = "PAR1"
+
+// The rows held in memory before they are written out as a row group.
+const parquetRowGroupSize = 65536
+
+// Parquet physical types.
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// Parquet repetition types.
+const (
+	parquetRequired = 0
+	parquetOptional = 1
+)
+
+// Parquet encodings.
+const (
+	parquetPlain = 0
+	parquetRLE   = 3
+)
+
+// Parquet converted types, written for readers that do not know logical types.
+const (
+	parquetUTF8            = 0
+	parquetTimestampMicros = 10
+)
+
+// A column of a parquet file.
+type parquetColumn struct {
+	Name     string
+	Type     int32
+	Optional bool
+	// Set for strings.
+	UTF8 bool
+	// Set for int64 columns holding microseconds since the Unix epoch in UTC.
+	Timestamp bool
+}
+
+// A chunk of a column that has been written to the file.
+type parquetChunk struct {
+	offset int64
+	size   int64
+	values int64
+}
+
+// A parquet file being written to w.
+// Values are added a row at a time, kept per column until a row group is full and then written out,
+// so memory is bounded by the row group size however long the file is.
+type parquetWriter struct {
+	w        io.Writer
+	columns  []parquetColumn
+	metadata [][2]string
+	offset   int64
+
+	// The values of the row group being built, plain encoded, and the definition level of each row.
+	values [][]byte
+	levels [][]bool
+	rows   int
+
+	groups [][]parquetChunk
+	sizes  []int
+	total  int64
+	err    error
+}
+
+// This function starts a parquet file with the columns and key value metadata given.
+func newParquetWriter(w io.Writer, columns []parquetColumn, metadata [][2]string) *parquetWriter {
+	return &parquetWriter{
+		w:        w,
+		columns:  columns,
+		metadata: metadata,
+		values:   make([][]byte, len(columns)),
+		levels:   make([][]bool, len(columns)),
+	}
+}
+
+// This function adds a row. Each value must be a string, an int64, a float64 or a *float64 to match
+// the type of its column. A nil *float64 is only allowed in optional columns.
+func (p *parquetWriter) Write(row []interface{}) error {
+	if p.err != nil {
+		return p.err
+	}
+	if len(row) != len(p.columns) {
+		return errors.New("parquet: row does not match the columns")
+	}
+	if p.offset == 0 {
+		if p.err = p.write([]byte(parquetMagic)); p.err != nil {
+			return p.err
+		}
+	}
+
+	for i, value := range row {
+		if number, ok := value.(*float64); ok {
+			if number == nil {
+				p.levels[i] = append(p.levels[i], false)
+				continue
+			}
+			value = *number
+		}
+		p.levels[i] = append(p.levels[i], true)
+
+		switch v := value.(type) {
+		case string:
+			p.values[i] = appendUint32(p.values[i], uint32(len(v)))
+			p.values[i] = append(p.values[i], v...)
+		case int64:
+			p.values[i] = appendUint64(p.values[i], uint64(v))
+		case float64:
+			p.values[i] = appendUint64(p.values[i], math.Float64bits(v))
+		default:
+			p.err = errors.New("parquet: unsupported value type")
+			return p.err
+		}
+	}
+
+	p.rows++
+	if p.rows >= parquetRowGroupSize {
+		p.err = p.flush()
+	}
+	return p.err
+}
+
+// This function writes out the last row group and the footer.
+// It does not close the underlying writer.
+func (p *parquetWriter) Close() error {
+	if p.err != nil {
+		return p.err
+	}
+	if p.offset == 0 {
+		if p.err = p.write([]byte(parquetMagic)); p.err != nil {
+			return p.err
+		}
+	}
+	if p.rows > 0 {
+		if p.err = p.flush(); p.err != nil {
+			return p.err
+		}
+	}
+
+	footer := p.footer()
+	if p.err = p.write(footer); p.err != nil {
+		return p.err
+	}
+	p.err = p.write(append(appendUint32(nil, uint32(len(footer))), parquetMagic...))
+	return p.err
+}
+
+func (p *parquetWriter) write(b []byte) error {
+	n, err := p.w.Write(b)
+	p.offset += int64(n)
+	return err
+}
+
+// This function writes the row group being built as one data page per column.
+func (p *parquetWriter) flush() error {
+	chunks := make([]parquetChunk, len(p.columns))
+	for i, column := range p.columns {
+		var page []byte
+		if column.Optional {
+			levels := encodeLevels(p.levels[i])
+			page = appendUint32(page, uint32(len(levels)))
+			page = append(page, levels...)
+		}
+		page = append(page, p.values[i]...)
+
+		header := thriftWriter{}
+		header.i32(1, 0) // DATA_PAGE
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(page)))
+		header.beginStruct(5)
+		header.i32(1, int32(p.rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.endStruct()
+		header.stop()
+
+		chunks[i] = parquetChunk{offset: p.offset, size: int64(header.buf.Len() + len(page)), values: int64(p.rows)}
+		if err := p.write(header.buf.Bytes()); err != nil {
+			return err
+		}
+		if err := p.write(page); err != nil {
+			return err
+		}
+		p.values[i] = p.values[i][:0]
+		p.levels[i] = p.levels[i][:0]
+	}
+
+	p.groups = append(p.groups, chunks)
+	p.sizes = append(p.sizes, p.rows)
+	p.total += int64(p.rows)
+	p.rows = 0
+	return nil
+}
+
+// This function encodes definition levels of bit width one as runs of the RLE hybrid encoding.
+func encodeLevels(levels []bool) []byte {
+	var out []byte
+	for start := 0; start < len(levels); {
+		end := start + 1
+		for end < len(levels) && levels[end] == levels[start] {
+			end++
+		}
+		out = binary.AppendUvarint(out, uint64(end-start)<<1)
+		if levels[start] {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		start = end
+	}
+	return out
+}
+
+// This function encodes the file metadata.
+func (p *parquetWriter) footer() []byte {
+	t := thriftWriter{}
+	t.i32(1, 1)
+
+	t.beginList(2, thriftStruct, len(p.columns)+1)
+	t.beginElement()
+	t.binary(4, "schema")
+	t.i32(5, int32(len(p.columns)))
+	t.endElement()
+	for _, column := range p.columns {
+		t.beginElement()
+		t.i32(1, column.Type)
+		if column.Optional {
+			t.i32(3, parquetOptional)
+		} else {
+			t.i32(3, parquetRequired)
+		}
+		t.binary(4, column.Name)
+		switch {
+		case column.UTF8:
+			t.i32(6, parquetUTF8)
+			t.beginStruct(10)
+			t.beginStruct(1)
+			t.endStruct()
+			t.endStruct()
+		case column.Timestamp:
+			t.i32(6, parquetTimestampMicros)
+			t.beginStruct(10)
+			t.beginStruct(8)
+			t.boolean(1, true)
+			t.beginStruct(2)
+			t.beginStruct(2)
+			t.endStruct()
+			t.endStruct()
+			t.endStruct()
+			t.endStruct()
+		}
+		t.endElement()
+	}
+
+	t.i64(3, p.total)
+
+	t.beginList(4, thriftStruct, len(p.groups))
+	for g, chunks := range p.groups {
+		t.beginElement()
+		t.beginList(1, thriftStruct, len(chunks))
+		var size int64
+		for i, chunk := range chunks {
+			column := p.columns[i]
+			t.beginElement()
+			t.i64(2, chunk.offset)
+			t.beginStruct(3)
+			t.i32(1, column.Type)
+			t.beginList(2, thriftI32, 2)
+			t.listI32(parquetPlain)
+			t.listI32(parquetRLE)
+			t.beginList(3, thriftBinary, 1)
+			t.listBinary(column.Name)
+			t.i32(4, 0) // UNCOMPRESSED
+			t.i64(5, chunk.values)
+			t.i64(6, chunk.size)
+			t.i64(7, chunk.size)
+			t.i64(9, chunk.offset)
+			t.endStruct()
+			t.endElement()
+			size += chunk.size
+		}
+		t.i64(2, size)
+		t.i64(3, int64(p.sizes[g]))
+		t.endElement()
+	}
+
+	if len(p.metadata) > 0 {
+		t.beginList(5, thriftStruct, len(p.metadata))
+		for _, pair := range p.metadata {
+			t.beginElement()
+			t.binary(1, pair[0])
+			t.binary(2, pair[1])
+			t.endElement()
+		}
+	}
+	t.binary(6, "plantdaddy")
+	t.stop()
+	return t.buf.Bytes()
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(b, v)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return binary.LittleEndian.AppendUint64(b, v)
+}
+
+// Thrift compact protocol types.
+const (
+	thriftBoolTrue  = 1
+	thriftBoolFalse = 2
+	thriftI32       = 5
+	thriftI64       = 6
+	thriftBinary    = 8
+	thriftList      = 9
+	thriftStruct    = 12
+)
+
+// An encoder for the thrift compact protocol that parquet metadata is written in.
+// Only the parts parquet needs are implemented.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// The id of the last field written in each struct being written.
+	last  []int16
+	field int16
+}
+
+func (t *thriftWriter) header(id int16, kind byte) {
+	delta := id - t.field
+	if delta > 0 && delta <= 15 {
+		t.buf.WriteByte(byte(delta)<<4 | kind)
+	} else {
+		t.buf.WriteByte(kind)
+		t.varint(int64(id))
+	}
+	t.field = id
+}
+
+func (t *thriftWriter) varint(v int64) {
+	t.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (t *thriftWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	t.buf.Write(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (t *thriftWriter) i32(id int16, v int32) {
+	t.header(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) i64(id int16, v int64) {
+	t.header(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftWriter) binary(id int16, v string) {
+	t.header(id, thriftBinary)
+	t.listBinary(v)
+}
+
+func (t *thriftWriter) boolean(id int16, v bool) {
+	if v {
+		t.header(id, thriftBoolTrue)
+	} else {
+		t.header(id, thriftBoolFalse)
+	}
+}
+
+func (t *thriftWriter) beginStruct(id int16) {
+	t.header(id, thriftStruct)
+	t.beginElement()
+}
+
+func (t *thriftWriter) endStruct() {
+	t.endElement()
+}
+
+// This function starts a struct that is an element of a list, so it has no field header.
+func (t *thriftWriter) beginElement() {
+	t.last = append(t.last, t.field)
+	t.field = 0
+}
+
+func (t *thriftWriter) endElement() {
+	t.stop()
+	t.field = t.last[len(t.last)-1]
+	t.last = t.last[:len(t.last)-1]
+}
+
+func (t *thriftWriter) stop() {
+	t.buf.WriteByte(0)
+}
+
+func (t *thriftWriter) beginList(id int16, kind byte, size int) {
+	t.header(id, thriftList)
+	if size < 15 {
+		t.buf.WriteByte(byte(size)<<4 | kind)
+	} else {
+		t.buf.WriteByte(0xf0 | kind)
+		t.uvarint(uint64(size))
+	}
+}
+
+func (t *thriftWriter) listI32(v int32) {
+	t.varint(int64(v))
+}
+
+func (t *thriftWriter) listBinary(v string) {
+	t.uvarint(uint64(len(v)))
+	t.buf.WriteString(v)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// thriftReader decodes the thrift compact protocol into maps of field ids to values,
+// so tests can read back what parquetWriter wrote.
+type thriftReader struct {
+	buf *bytes.Reader
+}
+
+func (t thriftReader) uvarint() uint64 {
+	v, _ := binary.ReadUvarint(t.buf)
+	return v
+}
+
+func (t thriftReader) varint() int64 {
+	v := t.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (t thriftReader) value(kind byte) interface{} {
+	switch kind {
+	case thriftBoolTrue:
+		return true
+	case thriftBoolFalse:
+		return false
+	case thriftI32, thriftI64:
+		return t.varint()
+	case thriftBinary:
+		b := make([]byte, t.uvarint())
+		t.buf.Read(b)
+		return string(b)
+	case thriftList:
+		header, _ := t.buf.ReadByte()
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(t.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = t.value(header & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return t.readStruct()
+	}
+	panic("unexpected thrift type")
+}
+
+func (t thriftReader) readStruct() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	var id int16
+	for {
+		header, err := t.buf.ReadByte()
+		if err != nil || header == 0 {
+			return fields
+		}
+		if delta := int16(header >> 4); delta != 0 {
+			id += delta
+		} else {
+			id = int16(t.varint())
+		}
+		fields[id] = t.value(header & 0x0f)
+	}
+}
+
+// A parquet file as read back by readParquet.
+type parquetFile struct {
+	Columns   []string
+	NumRows   int64
+	RowGroups int
+	Metadata  map[string]string
+	// The values of each row, nil for a missing optional value.
+	Rows [][]interface{}
+}
+
+// readParquet reads a file written by parquetWriter, checking the parts of the format it relies on.
+func readParquet(data []byte) (parquetFile, error) {
+	if len(data) < 12 || string(data[:4]) != parquetMagic || string(data[len(data)-4:]) != parquetMagic {
+		return parquetFile{}, errors.New("the file does not start and end with PAR1")
+	}
+	size := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	if size > len(data)-12 {
+		return parquetFile{}, errors.New("the footer is longer than the file")
+	}
+	meta := thriftReader{bytes.NewReader(data[len(data)-8-size : len(data)-8])}.readStruct()
+
+	file := parquetFile{NumRows: meta[3].(int64), Metadata: map[string]string{}}
+	schema := meta[2].([]interface{})
+	var columns []map[int16]interface{}
+	for _, element := range schema[1:] {
+		column := element.(map[int16]interface{})
+		columns = append(columns, column)
+		file.Columns = append(file.Columns, column[4].(string))
+	}
+	if pairs, ok := meta[5].([]interface{}); ok {
+		for _, pair := range pairs {
+			kv := pair.(map[int16]interface{})
+			file.Metadata[kv[1].(string)] = kv[2].(string)
+		}
+	}
+
+	groups, _ := meta[4].([]interface{})
+	file.RowGroups = len(groups)
+	for _, group := range groups {
+		group := group.(map[int16]interface{})
+		rows := int(group[3].(int64))
+		values := make([][]interface{}, rows)
+		for i := range values {
+			values[i] = make([]interface{}, len(columns))
+		}
+
+		for c, chunk := range group[1].([]interface{}) {
+			offset := chunk.(map[int16]interface{})[2].(int64)
+			page := bytes.NewReader(data[offset:])
+			header := thriftReader{page}.readStruct()
+			body := make([]byte, header[2].(int64))
+			page.Read(body)
+
+			present := make([]bool, rows)
+			for i := range present {
+				present[i] = true
+			}
+			if columns[c][3].(int64) == parquetOptional {
+				length := binary.LittleEndian.Uint32(body)
+				levels := bytes.NewReader(body[4 : 4+length])
+				for i := 0; i < rows; {
+					run, _ := binary.ReadUvarint(levels)
+					value, _ := levels.ReadByte()
+					for n := uint64(0); n < run>>1; n++ {
+						present[i] = value == 1
+						i++
+					}
+				}
+				body = body[4+length:]
+			}
+
+			for i := 0; i < rows; i++ {
+				if !present[i] {
+					continue
+				}
+				switch columns[c][1].(int64) {
+				case parquetByteArray:
+					length := binary.LittleEndian.Uint32(body)
+					values[i][c] = string(body[4 : 4+length])
+					body = body[4+length:]
+				case parquetInt64:
+					values[i][c] = int64(binary.LittleEndian.Uint64(body))
+					body = body[8:]
+				case parquetDouble:
+					values[i][c] = math.Float64frombits(binary.LittleEndian.Uint64(body))
+					body = body[8:]
+				}
+			}
+			if len(body) != 0 {
+				return parquetFile{}, errors.New("a page holds more values than its rows")
+			}
+		}
+		file.Rows = append(file.Rows, values...)
+	}
+	return file, nil
+}
+
+var testParquetColumns = []parquetColumn{
+	{Name: "name", Type: parquetByteArray, UTF8: true},
+	{Name: "at", Type: parquetInt64, Timestamp: true},
+	{Name: "value", Type: parquetDouble, Optional: true},
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	one, two := 1.5, -2.25
+	rows := [][]interface{}{
+		{"fern", int64(1622548800000000), &one},
+		{"", int64(0), (*float64)(nil)},
+		{"monstera", int64(-1), (*float64)(nil)},
+		{"ficus", int64(1622548800000001), &two},
+	}
+	var buf bytes.Buffer
+	writer := newParquetWriter(&buf, testParquetColumns, [][2]string{{"timeZone", "UTC"}})
+	for _, row := range rows {
+		if err := writer.Write(row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := readParquet(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{
+		{"fern", int64(1622548800000000), 1.5},
+		{"", int64(0), nil},
+		{"monstera", int64(-1), nil},
+		{"ficus", int64(1622548800000001), -2.25},
+	}
+	if !reflect.DeepEqual(file.Columns, []string{"name", "at", "value"}) || file.NumRows != 4 || file.RowGroups != 1 ||
+		file.Metadata["timeZone"] != "UTC" || !reflect.DeepEqual(file.Rows, want) {
+		t.Errorf("got %+v", file)
+	}
+}
+
+func TestParquetRowGroups(t *testing.T) {
+	tests := []struct {
+		rows   int
+		groups int
+	}{
+		{0, 0},
+		{1, 1},
+		{parquetRowGroupSize, 1},
+		{parquetRowGroupSize + 3, 2},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writer := newParquetWriter(&buf, testParquetColumns, nil)
+		for i := 0; i < test.rows; i++ {
+			value := float64(i)
+			row := []interface{}{"fern", int64(i), &value}
+			if i%3 == 0 {
+				row[2] = (*float64)(nil)
+			}
+			if err := writer.Write(row); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		file, err := readParquet(buf.Bytes())
+		if err != nil {
+			t.Fatalf("%d rows: %s", test.rows, err)
+		}
+		if file.NumRows != int64(test.rows) || file.RowGroups != test.groups || len(file.Rows) != test.rows {
+			t.Errorf("%d rows: got %d rows in %d groups", test.rows, file.NumRows, file.RowGroups)
+			continue
+		}
+		for i, row := range file.Rows {
+			if row[1] != int64(i) || (i%3 == 0) != (row[2] == nil) {
+				t.Errorf("%d rows: row %d came back as %v", test.rows, i, row)
+				break
+			}
+		}
+	}
+}
+
+func TestParquetWriteErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		row  []interface{}
+	}{
+		{"too few values", []interface{}{"fern", int64(0)}},
+		{"unsupported type", []interface{}{"fern", 12, (*float64)(nil)}},
+	}
+
+	for _, test := range tests {
+		writer := newParquetWriter(&bytes.Buffer{}, testParquetColumns, nil)
+		if err := writer.Write(test.row); err == nil {
+			t.Errorf("%s: got no error", test.name)
+		}
+	}
+}
+
+func TestEncodeLevels(t *testing.T) {
+	tests := []struct {
+		levels []bool
+		want   []byte
+	}{
+		{nil, nil},
+		{[]bool{true}, []byte{2, 1}},
+		{[]bool{true, true, false}, []byte{4, 1, 2, 0}},
+		{[]bool{false, true, false}, []byte{2, 0, 2, 1, 2, 0}},
+		// A run of 64 takes two bytes to count
+		{make([]bool, 64), []byte{0x80, 0x01, 0}},
+	}
+
+	for _, test := range tests {
+		if got := encodeLevels(test.levels); !bytes.Equal(got, test.want) {
+			t.Errorf("encodeLevels(%v) = %v, want %v", test.levels, got, test.want)
+		}
+	}
+}
+
+func TestThriftWriter(t *testing.T) {
+	w := thriftWriter{}
+	w.i32(1, -3)
+	w.i64(2, 1<<40)
+	w.binary(20, "fern")
+	w.boolean(21, true)
+	w.beginStruct(22)
+	w.i32(1, 7)
+	w.endStruct()
+	w.beginList(23, thriftI32, 16)
+	for i := 0; i < 16; i++ {
+		w.listI32(int32(i))
+	}
+	w.i32(24, 1)
+	w.stop()
+
+	got := thriftReader{bytes.NewReader(w.buf.Bytes())}.readStruct()
+	list := make([]interface{}, 16)
+	for i := range list {
+		list[i] = int64(i)
+	}
+	want := map[int16]interface{}{
+		1:  int64(-3),
+		2:  int64(1 << 40),
+		20: "fern",
+		21: true,
+		22: map[int16]interface{}{1: int64(7)},
+		23: list,
+		24: int64(1),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
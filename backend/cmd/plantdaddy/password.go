@@ -0,0 +1,169 @@
+package main
+
+// This file handles resetting forgotten passwords with emailed one time links
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const minPasswordLength = 8
+
+var errInvalidResetToken = errors.New("reset link is invalid or has expired")
+var errWeakPassword = fmt.Errorf("password must be at least %d characters", minPasswordLength)
+
+// DB Query to create a reset token for the user with the given email.
+// An empty token is returned if there is no such user.
+func insertPasswordReset(db *pgxpool.Pool, email string, ttl time.Duration) (string, string, error) {
+	row := db.QueryRow(context.Background(), `SELECT id, email FROM auth WHERE LOWER(email) = LOWER($1)`, email)
+
+	var id int64
+	var address string
+	err := row.Scan(&id, &address)
+	if err == pgx.ErrNoRows {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now().UTC()
+	_, err = db.Exec(context.Background(), `INSERT INTO password_reset(user_id, token_hash, created_at, expires_at)
+	VALUES ($1, $2, $3, $4)`, id, hashToken(token), now, now.Add(ttl))
+	if err != nil {
+		return "", "", err
+	}
+	return token, address, nil
+}
+
+// DB Query to use up a reset token and set the new password, returning the user it was for.
+// Every session of the user is revoked since the old password may have been compromised.
+func resetPassword(db *pgxpool.Pool, token string, password string) (int64, error) {
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+	var id, userID int64
+	row := tx.QueryRow(ctx, `SELECT id, user_id FROM password_reset
+	WHERE token_hash = $1 AND used_at IS NULL AND expires_at > $2 FOR UPDATE`, hashToken(token), now)
+
+	err = row.Scan(&id, &userID)
+	if err == pgx.ErrNoRows {
+		return 0, errInvalidResetToken
+	} else if err != nil {
+		return 0, err
+	}
+
+	// A reset link does not verify the email, that is left to the verification link.
+	if _, err := tx.Exec(ctx, `UPDATE auth SET password = $1 WHERE id = $2`, hashed, userID); err != nil {
+		return 0, err
+	}
+	// Any other links that were sent out stop working too
+	if _, err := tx.Exec(ctx, `UPDATE password_reset SET used_at = $1 WHERE user_id = $2 AND used_at IS NULL`, now, userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE refresh_token SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`, now, userID); err != nil {
+		return 0, err
+	}
+	if err := bumpTokenVersion(ctx, tx, userID); err != nil {
+		return 0, err
+	}
+	return userID, tx.Commit(ctx)
+}
+
+// This function creates a link into the app holding a token.
+func (api *API) appLink(path string, token string) string {
+	return fmt.Sprintf("%s/%s?token=%s", strings.TrimRight(api.appURL, "/"), path, url.QueryEscape(token))
+}
+
+// HTTP Call to email a password reset link.
+// It always succeeds so that it cannot be used to find out which emails have accounts.
+func (api *API) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var request ForgotPassword
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+		if request.Email == "" {
+			http.Error(w, "Must provide email", http.StatusBadRequest)
+			return
+		}
+
+		token, address, err := insertPasswordReset(api.db, request.Email, api.passwordResetTTL)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		if token != "" {
+			sendMailAsync(api.mailer, Mail{
+				To:      address,
+				Subject: "Reset your Plant Daddy password",
+				Body: fmt.Sprintf("Someone asked to reset the password for your Plant Daddy account.\n\n"+
+					"Open this link to choose a new password, it expires in %s:\n%s\n\n"+
+					"If this was not you, you can ignore this email.\n",
+					api.passwordResetTTL, api.appLink("reset-password", token)),
+			})
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// HTTP Call to set a new password using the token from a reset link
+func (api *API) resetPassword(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var request ResetPassword
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+		if len(request.Password) < minPasswordLength {
+			http.Error(w, errWeakPassword.Error(), http.StatusBadRequest)
+			return
+		}
+
+		userID, err := resetPassword(api.db, request.Token, request.Password)
+		if errors.Is(err, errInvalidResetToken) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		api.audit(r, AuditEvent{ActorID: userID, Action: auditPasswordReset})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
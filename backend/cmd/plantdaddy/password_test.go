@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSignUpRejectsShortPasswords(t *testing.T) {
+	// The request is turned down before the database is used.
+	api := &API{}
+	for _, password := range []string{"", "short", "1234567"} {
+		w := doJSON(t, api.newUser, "POST", "/api/new-user", UserPass{Username: "fern", Password: password, Email: "fern@example.com"}, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("password %q: got status %d, want %d", password, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestResetPasswordRejectsShortPasswords(t *testing.T) {
+	api := &API{}
+	w := doJSON(t, api.resetPassword, "POST", "/api/password/reset", ResetPassword{Token: "abc", Password: "short"}, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestForgotAndResetPassword(t *testing.T) {
+	api, mailer := testAPI(t)
+	username := uniqueName(t, "reset")
+	email := username + "@example.com"
+	userID := createUser(t, api, username, "old password")
+
+	w := doJSON(t, api.forgotPassword, "POST", "/api/password/forgot", ForgotPassword{Email: email}, nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("forgot password: %d %s", w.Code, w.Body)
+	}
+	token := waitForMail(t, mailer, email, "Reset")
+
+	w = doJSON(t, api.resetPassword, "POST", "/api/password/reset", ResetPassword{Token: "not the token", Password: "new password"}, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("reset with a wrong token: got status %d", w.Code)
+	}
+	w = doJSON(t, api.resetPassword, "POST", "/api/password/reset", ResetPassword{Token: token, Password: "new password"}, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("reset: %d %s", w.Code, w.Body)
+	}
+	w = doJSON(t, api.resetPassword, "POST", "/api/password/reset", ResetPassword{Token: token, Password: "another password"}, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("reusing the reset link: got status %d", w.Code)
+	}
+
+	if _, err := LogIn(api.db, UserPass{Username: username, Password: "old password"}); err == nil {
+		t.Error("the old password still works")
+	}
+	if user, err := LogIn(api.db, UserPass{Username: username, Password: "new password"}); err != nil || user.ID != userID {
+		t.Errorf("logging in with the new password: %v", err)
+	}
+
+	var verified bool
+	if err := api.db.QueryRow(context.Background(), `SELECT email_verified FROM auth WHERE id = $1`, userID).Scan(&verified); err != nil {
+		t.Fatal(err)
+	}
+	if verified {
+		t.Error("resetting the password verified the email")
+	}
+}
+
+func TestForgotPasswordForUnknownEmail(t *testing.T) {
+	api, mailer := testAPI(t)
+	email := uniqueName(t, "nobody") + "@example.com"
+
+	w := doJSON(t, api.forgotPassword, "POST", "/api/password/forgot", ForgotPassword{Email: email}, nil)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusAccepted)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for _, mail := range mailer.Sent() {
+		if mail.To == email {
+			t.Errorf("a mail was sent to an unknown email: %+v", mail)
+		}
+	}
+}
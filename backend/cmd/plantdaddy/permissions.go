@@ -0,0 +1,110 @@
+package main
+
+// This file checks what a user is allowed to do with a device
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var errDeviceNotFound = errors.New("device not found")
+var errForbidden = errors.New("you are not allowed to do this with the device")
+
+type deviceAction int
+
+const (
+	// Reading the device and the plant data it has collected.
+	readDevice deviceAction = iota
+	// Looking after the plant day to day, such as renaming the device.
+	careDevice
+	// Deleting, sharing, transferring or giving the device a new secret.
+	// Only the user who registered the device may do this, whatever their role in the household.
+	manageDevice
+)
+
+const roleOwner = "owner"
+const roleCaretaker = "caretaker"
+const roleViewer = "viewer"
+
+// The actions each role may take on a device.
+var rolePermissions = map[string][]deviceAction{
+	roleOwner:     {readDevice, careDevice},
+	roleCaretaker: {readDevice, careDevice},
+	roleViewer:    {readDevice},
+}
+
+// This function checks if a role may take an action.
+func roleCan(role string, action deviceAction) bool {
+	for _, allowed := range rolePermissions[role] {
+		if allowed == action {
+			return true
+		}
+	}
+	return false
+}
+
+// DB Query to find the role a user has on a device.
+// The user who registered the device is always its owner, everyone else gets the role they have
+// in the household the device is shared with.
+// Devices the user cannot see are reported as not found so their existence is not leaked.
+func deviceRole(db *pgxpool.Pool, userID int64, deviceID string) (string, error) {
+	role, _, err := deviceAccess(db, userID, deviceID)
+	return role, err
+}
+
+// DB Query to find the role a user has on a device and whether they registered it.
+func deviceAccess(db *pgxpool.Pool, userID int64, deviceID string) (string, bool, error) {
+	row := db.QueryRow(context.Background(), `SELECT CASE WHEN r.user_id = $2 THEN 'owner' ELSE m.role END,
+	r.user_id = $2 FROM registered_devices r LEFT JOIN household_member m
+	ON m.household_id = r.household_id AND m.user_id = $2
+	WHERE r.device_id = $1 AND (r.user_id = $2 OR m.user_id IS NOT NULL)`, deviceID, userID)
+
+	var role string
+	var registrant bool
+	err := row.Scan(&role, &registrant)
+	if err == pgx.ErrNoRows {
+		return "", false, errDeviceNotFound
+	} else if err != nil {
+		return "", false, err
+	}
+	return role, registrant, nil
+}
+
+// This function returns nil if the user may take the action on the device.
+func authorizeDevice(db *pgxpool.Pool, userID int64, deviceID string, action deviceAction) error {
+	if deviceID == "" {
+		return errDeviceNotFound
+	}
+
+	role, registrant, err := deviceAccess(db, userID, deviceID)
+	if err != nil {
+		return err
+	}
+
+	if !registrant && !roleCan(role, action) {
+		return errForbidden
+	}
+	return nil
+}
+
+// This function checks that the authenticated user may take the action on the device.
+// If they cannot the error is written to the response and false is returned.
+func (api *API) allowDevice(w http.ResponseWriter, r *http.Request, deviceID string, action deviceAction) bool {
+	err := authorizeDevice(api.db, currentUser(r).ID, deviceID, action)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, errDeviceNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+	return false
+}
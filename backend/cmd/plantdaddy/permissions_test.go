@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestRoleCan(t *testing.T) {
+	tests := []struct {
+		role   string
+		action deviceAction
+		want   bool
+	}{
+		{roleOwner, readDevice, true},
+		{roleOwner, careDevice, true},
+		// Only the user who registered a device may manage it, not a household owner
+		{roleOwner, manageDevice, false},
+		{roleCaretaker, readDevice, true},
+		{roleCaretaker, careDevice, true},
+		{roleCaretaker, manageDevice, false},
+		{roleViewer, readDevice, true},
+		{roleViewer, careDevice, false},
+		{roleViewer, manageDevice, false},
+		{"", readDevice, false},
+		{"admin", manageDevice, false},
+	}
+
+	for _, test := range tests {
+		if got := roleCan(test.role, test.action); got != test.want {
+			t.Errorf("roleCan(%q, %d) = %v, want %v", test.role, test.action, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+// This file throttles repeated failed logins per account and per ip address
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// How attempts for a key are turned into a lockout.
+type LockoutPolicy struct {
+	// Attempts allowed before the key is locked at all.
+	FreeAttempts int
+	// The first lockout, every attempt after that doubles it.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Attempts are forgotten once there has been none for this long.
+	Window time.Duration
+	// Set when a successful attempt forgets every earlier one, otherwise only the successful attempt is taken back.
+	ResetOnSuccess bool
+}
+
+// Accounts are locked quickly, addresses are given more room since many users can share one.
+var accountLockout = LockoutPolicy{FreeAttempts: 5, BaseDelay: 30 * time.Second, MaxDelay: 15 * time.Minute, Window: time.Hour, ResetOnSuccess: true}
+var ipLockout = LockoutPolicy{FreeAttempts: 20, BaseDelay: 30 * time.Second, MaxDelay: time.Hour, Window: time.Hour}
+
+// Keys that have had no attempt for this long are removed, it must be longer than the window of every policy.
+const loginAttemptRetention = 24 * time.Hour
+
+// This function returns how long a key is locked for after the given number of attempts.
+func (p LockoutPolicy) lockout(failures int) time.Duration {
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	delay := float64(p.BaseDelay) * math.Pow(2, float64(failures-p.FreeAttempts-1))
+	if delay > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(delay)
+}
+
+// Keeps track of attempts for keys such as an account or an ip address.
+// Every attempt is counted before it is checked so guesses sent at the same time cannot all get in
+// before the first of them fails. Attempts that succeed are taken back afterwards.
+type LoginLimiter interface {
+	// Attempt counts an attempt for the key and returns zero, or returns how long the key must wait
+	// without counting anything if it is locked.
+	Attempt(ctx context.Context, key string, policy LockoutPolicy, now time.Time) (time.Duration, error)
+	// Undo takes back one attempt that was counted for the key.
+	Undo(ctx context.Context, key string, policy LockoutPolicy) error
+	// Reset forgets every attempt for the key.
+	Reset(ctx context.Context, key string) error
+	// Prune forgets keys that have had no attempt since the given time and are not locked.
+	Prune(ctx context.Context, before time.Time, now time.Time) error
+}
+
+type attempts struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// This function counts an attempt against the state of a key unless the key is locked,
+// and returns how long the key must still wait.
+func (p LockoutPolicy) attempt(a *attempts, now time.Time) time.Duration {
+	if a.lockedUntil.After(now) {
+		return a.lockedUntil.Sub(now)
+	}
+	if now.Sub(a.lastFailure) > p.Window {
+		a.failures = 0
+	}
+	a.failures++
+	a.lastFailure = now
+	a.lockedUntil = now.Add(p.lockout(a.failures))
+	return 0
+}
+
+// This function takes back an attempt from the state of a key.
+func (p LockoutPolicy) undo(a *attempts) {
+	if a.failures > 0 {
+		a.failures--
+	}
+	a.lockedUntil = a.lastFailure.Add(p.lockout(a.failures))
+}
+
+// Keeps attempts in memory, only suitable when a single server is running.
+type MemoryLoginLimiter struct {
+	mu   sync.Mutex
+	keys map[string]*attempts
+}
+
+func NewMemoryLoginLimiter() *MemoryLoginLimiter {
+	return &MemoryLoginLimiter{keys: make(map[string]*attempts)}
+}
+
+func (l *MemoryLoginLimiter) Attempt(ctx context.Context, key string, policy LockoutPolicy, now time.Time) (time.Duration, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.keys[key]
+	if !ok {
+		a = &attempts{}
+		l.keys[key] = a
+	}
+	return policy.attempt(a, now), nil
+}
+
+func (l *MemoryLoginLimiter) Undo(ctx context.Context, key string, policy LockoutPolicy) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if a, ok := l.keys[key]; ok {
+		policy.undo(a)
+		if a.failures == 0 {
+			delete(l.keys, key)
+		}
+	}
+	return nil
+}
+
+func (l *MemoryLoginLimiter) Reset(ctx context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+	return nil
+}
+
+func (l *MemoryLoginLimiter) Prune(ctx context.Context, before time.Time, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, a := range l.keys {
+		if a.lastFailure.Before(before) && !a.lockedUntil.After(now) {
+			delete(l.keys, key)
+		}
+	}
+	return nil
+}
+
+// Keeps attempts in the login_attempt table so every server sees the same lockouts.
+type PostgresLoginLimiter struct {
+	db *pgxpool.Pool
+}
+
+func NewPostgresLoginLimiter(db *pgxpool.Pool) *PostgresLoginLimiter {
+	return &PostgresLoginLimiter{db: db}
+}
+
+// The lockout of a policy worked out in SQL from a number of attempts n, starting at the time from.
+// The free attempts, base delay and max delay of the policy are the parameters starting at $param.
+// The exponent is capped so the power cannot overflow.
+func lockoutSQL(n string, from string, param int) string {
+	free := fmt.Sprintf("$%d::int", param)
+	base := fmt.Sprintf("$%d::float8", param+1)
+	max := fmt.Sprintf("$%d::float8", param+2)
+	return `CASE WHEN ` + n + ` > ` + free + ` THEN ` + from + ` + LEAST(` + max + `, ` + base + ` * power(2, LEAST(` + n + ` - ` + free + ` - 1, 60)))
+		* interval '1 second' END`
+}
+
+func (l *PostgresLoginLimiter) Attempt(ctx context.Context, key string, policy LockoutPolicy, now time.Time) (time.Duration, error) {
+	now = now.UTC()
+	// The count and the lock are changed in one statement, concurrent attempts wait on the row and see the lock
+	failures := `CASE WHEN a.last_failure < $3 THEN 1 ELSE a.failures + 1 END`
+	var counted int
+	err := l.db.QueryRow(ctx, `INSERT INTO login_attempt AS a (key, failures, last_failure, locked_until)
+	VALUES ($1, 1, $2::timestamp, `+lockoutSQL("1", "$2::timestamp", 4)+`)
+	ON CONFLICT (key) DO UPDATE SET
+		failures = `+failures+`,
+		last_failure = $2::timestamp,
+		locked_until = `+lockoutSQL(failures, "$2::timestamp", 4)+`
+	WHERE a.locked_until IS NULL OR a.locked_until <= $2::timestamp
+	RETURNING failures`, key, now, now.Add(-policy.Window), policy.FreeAttempts,
+		policy.BaseDelay.Seconds(), policy.MaxDelay.Seconds()).Scan(&counted)
+	if err != pgx.ErrNoRows {
+		return 0, err
+	}
+
+	// The key is locked, nothing was counted
+	var lockedUntil time.Time
+	if err := l.db.QueryRow(ctx, `SELECT locked_until FROM login_attempt WHERE key = $1`, key).Scan(&lockedUntil); err != nil {
+		return 0, err
+	}
+	if !lockedUntil.After(now) {
+		return time.Second, nil
+	}
+	return lockedUntil.Sub(now), nil
+}
+
+func (l *PostgresLoginLimiter) Undo(ctx context.Context, key string, policy LockoutPolicy) error {
+	_, err := l.db.Exec(ctx, `UPDATE login_attempt SET failures = GREATEST(failures - 1, 0),
+	locked_until = `+lockoutSQL("(failures - 1)", "last_failure", 2)+`
+	WHERE key = $1`, key, policy.FreeAttempts, policy.BaseDelay.Seconds(), policy.MaxDelay.Seconds())
+	return err
+}
+
+func (l *PostgresLoginLimiter) Reset(ctx context.Context, key string) error {
+	_, err := l.db.Exec(ctx, `DELETE FROM login_attempt WHERE key = $1`, key)
+	return err
+}
+
+func (l *PostgresLoginLimiter) Prune(ctx context.Context, before time.Time, now time.Time) error {
+	_, err := l.db.Exec(ctx, `DELETE FROM login_attempt WHERE last_failure < $1
+	AND (locked_until IS NULL OR locked_until <= $2)`, before.UTC(), now.UTC())
+	return err
+}
+
+// This function forgets quiet keys every hour until the context is done.
+func runLoginAttemptCleanup(ctx context.Context, limiter LoginLimiter) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		if err := limiter.Prune(ctx, now.Add(-loginAttemptRetention), now); err != nil {
+			log.Printf("pruning login attempts: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// This function creates the limiter chosen by LOGIN_LIMITER, postgres unless set to memory.
+func loginLimiterFromEnv(db *pgxpool.Pool) LoginLimiter {
+	switch value := stringEnv("LOGIN_LIMITER", "postgres"); value {
+	case "postgres":
+		return NewPostgresLoginLimiter(db)
+	case "memory":
+		return NewMemoryLoginLimiter()
+	default:
+		log.Fatalf("LOGIN_LIMITER must be postgres or memory: %q", value)
+		return nil
+	}
+}
+
+// This function returns the address of the client, taken from X-Forwarded-For if we are behind a proxy.
+func (api *API) clientIP(r *http.Request) string {
+	if api.trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			// The proxy in front of us appends the address it saw last
+			parts := strings.Split(forwarded, ",")
+			return strings.TrimSpace(parts[len(parts)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// The limiter key counting attempts against an account.
+func accountKey(userID int64) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// The limiter keys for attempts against the account of the user and the policy for each.
+func (api *API) accountKeys(r *http.Request, userID int64) map[string]LockoutPolicy {
+	return map[string]LockoutPolicy{
+		accountKey(userID):      accountLockout,
+		"ip:" + api.clientIP(r): ipLockout,
+	}
+}
+
+// The limiter keys for guessing the claim code of a device and the policy for each.
+// Guesses are counted per caller so that nobody can lock the owner out of their own probe,
+// and per address so that making more accounts does not buy more guesses.
+func (api *API) claimKeys(r *http.Request, userID int64, deviceID string) map[string]LockoutPolicy {
+	return map[string]LockoutPolicy{
+		fmt.Sprintf("claim:%d:%s", userID, deviceID): accountLockout,
+		"claim-ip:" + api.clientIP(r):                ipLockout,
+	}
+}
+
+// The limiter keys for a login attempt and the policy for each.
+// Attempts are counted against the account the name belongs to, so guessing through its username and
+// its email share one count. Names without an account are counted by name so they are throttled the same.
+func (api *API) loginKeys(r *http.Request, username string) map[string]LockoutPolicy {
+	if userID := loginAccountID(api.db, username); userID != 0 {
+		return api.accountKeys(r, userID)
+	}
+	return map[string]LockoutPolicy{
+		"name:" + strings.ToLower(username): accountLockout,
+		"ip:" + api.clientIP(r):             ipLockout,
+	}
+}
+
+// This function counts an attempt against every key and checks if it may go ahead.
+// If it may not a 429 with Retry-After is written and false is returned.
+func (api *API) allowLoginAttempt(w http.ResponseWriter, r *http.Request, keys map[string]LockoutPolicy) bool {
+	var wait time.Duration
+	now := time.Now()
+	counted := map[string]LockoutPolicy{}
+	for key, policy := range keys {
+		retry, err := api.loginLimiter.Attempt(r.Context(), key, policy, now)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return false
+		}
+		if retry == 0 {
+			counted[key] = policy
+		} else if retry > wait {
+			wait = retry
+		}
+	}
+
+	if wait > 0 {
+		// An attempt that is turned away counts against none of its keys
+		for key, policy := range counted {
+			if err := api.loginLimiter.Undo(r.Context(), key, policy); err != nil {
+				log.Printf("%s", err)
+			}
+		}
+		w.Header().Set("Retry-After", fmt.Sprint(int64(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Too many failed login attempts, try again later", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// This function takes back the attempt once it has succeeded. The account is cleared while the address
+// only gets this one attempt back, so one good account cannot be used to keep guessing others.
+func (api *API) recordLoginSuccess(r *http.Request, keys map[string]LockoutPolicy) {
+	for key, policy := range keys {
+		var err error
+		if policy.ResetOnSuccess {
+			err = api.loginLimiter.Reset(r.Context(), key)
+		} else {
+			err = api.loginLimiter.Undo(r.Context(), key, policy)
+		}
+		if err != nil {
+			log.Printf("%s", err)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLockout(t *testing.T) {
+	policy := LockoutPolicy{FreeAttempts: 3, BaseDelay: 10 * time.Second, MaxDelay: time.Minute, Window: time.Hour}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, 10 * time.Second},
+		{5, 20 * time.Second},
+		{6, 40 * time.Second},
+		{7, time.Minute},
+		{5000, time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := policy.lockout(test.failures); got != test.want {
+			t.Errorf("lockout(%d) = %s, want %s", test.failures, got, test.want)
+		}
+	}
+}
+
+func TestPolicyAttempt(t *testing.T) {
+	policy := LockoutPolicy{FreeAttempts: 2, BaseDelay: 10 * time.Second, MaxDelay: time.Minute, Window: time.Hour}
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	steps := []struct {
+		name     string
+		at       time.Duration
+		wait     time.Duration
+		failures int
+	}{
+		{"first", 0, 0, 1},
+		{"second", time.Second, 0, 2},
+		{"third is counted and locks", 2 * time.Second, 0, 3},
+		{"locked", 3 * time.Second, 9 * time.Second, 3},
+		{"after the lock", 12 * time.Second, 0, 4},
+		{"locked for longer", 13 * time.Second, 19 * time.Second, 4},
+		{"after the window", 2 * time.Hour, 0, 1},
+	}
+
+	var a attempts
+	for _, step := range steps {
+		wait := policy.attempt(&a, now.Add(step.at))
+		if wait != step.wait || a.failures != step.failures {
+			t.Fatalf("%s: got wait %s and %d failures, want %s and %d", step.name, wait, a.failures, step.wait, step.failures)
+		}
+	}
+}
+
+func TestPolicyUndo(t *testing.T) {
+	policy := LockoutPolicy{FreeAttempts: 2, BaseDelay: 10 * time.Second, MaxDelay: time.Minute, Window: time.Hour}
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		attempts int
+		failures int
+		locked   bool
+	}{
+		{"nothing counted", 0, 0, false},
+		{"free attempt", 1, 0, false},
+		{"the attempt that locked", 3, 2, false},
+		{"still locked after", 4, 3, true},
+	}
+
+	for _, test := range tests {
+		var a attempts
+		for i := 0; i < test.attempts; i++ {
+			a.failures++
+			a.lastFailure = now
+			a.lockedUntil = now.Add(policy.lockout(a.failures))
+		}
+		policy.undo(&a)
+		if a.failures != test.failures || a.lockedUntil.After(now) != test.locked {
+			t.Errorf("%s: got %d failures locked until %s", test.name, a.failures, a.lockedUntil)
+		}
+	}
+}
+
+func TestMemoryLoginLimiterCountsConcurrentAttempts(t *testing.T) {
+	limiter := NewMemoryLoginLimiter()
+	testConcurrentAttempts(t, limiter, "user:1")
+}
+
+func TestPostgresLoginLimiterCountsConcurrentAttempts(t *testing.T) {
+	api, _ := testAPI(t)
+	limiter := NewPostgresLoginLimiter(api.db)
+	key := uniqueName(t, "test:")
+	t.Cleanup(func() { api.db.Exec(context.Background(), `DELETE FROM login_attempt WHERE key = $1`, key) })
+	testConcurrentAttempts(t, limiter, key)
+
+	if err := limiter.Undo(context.Background(), key, accountLockout); err != nil {
+		t.Fatal(err)
+	}
+	var failures int
+	if err := api.db.QueryRow(context.Background(), `SELECT failures FROM login_attempt WHERE key = $1`, key).Scan(&failures); err != nil {
+		t.Fatal(err)
+	}
+	if failures != accountLockout.FreeAttempts {
+		t.Errorf("got %d failures after taking one back, want %d", failures, accountLockout.FreeAttempts)
+	}
+
+	if err := limiter.Prune(context.Background(), time.Now().Add(time.Hour), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if wait, err := limiter.Attempt(context.Background(), key, accountLockout, time.Now()); err != nil || wait != 0 {
+		t.Errorf("a pruned key had to wait %s: %v", wait, err)
+	}
+}
+
+// testConcurrentAttempts sends many attempts for a key at once, only the free attempts and the
+// attempt that locks the key may go ahead.
+func testConcurrentAttempts(t *testing.T, limiter LoginLimiter, key string) {
+	t.Helper()
+	now := time.Now()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := limiter.Attempt(context.Background(), key, accountLockout, now)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != accountLockout.FreeAttempts+1 {
+		t.Errorf("%d of 20 concurrent attempts went ahead, want %d", allowed, accountLockout.FreeAttempts+1)
+	}
+}
+
+func TestMemoryLoginLimiterPrune(t *testing.T) {
+	limiter := NewMemoryLoginLimiter()
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	limiter.Attempt(context.Background(), "quiet", accountLockout, now.Add(-2*loginAttemptRetention))
+	limiter.Attempt(context.Background(), "recent", accountLockout, now)
+
+	if err := limiter.Prune(context.Background(), now.Add(-loginAttemptRetention), now); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := limiter.keys["quiet"]; ok {
+		t.Error("a quiet key was kept")
+	}
+	if _, ok := limiter.keys["recent"]; !ok {
+		t.Error("a recent key was removed")
+	}
+}
+
+func TestAllowLoginAttempt(t *testing.T) {
+	api := &API{loginLimiter: NewMemoryLoginLimiter()}
+	keys := map[string]LockoutPolicy{"user:1": accountLockout, "ip:192.0.2.1": ipLockout}
+
+	for i := 0; i <= accountLockout.FreeAttempts; i++ {
+		w := httptest.NewRecorder()
+		if !api.allowLoginAttempt(w, httptest.NewRequest("POST", "/api/login", nil), keys) {
+			t.Fatalf("attempt %d was turned away", i+1)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	if api.allowLoginAttempt(w, httptest.NewRequest("POST", "/api/login", nil), keys) {
+		t.Fatal("a locked account was let through")
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("got status %d with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// The attempt that was turned away is not counted against the address either
+	if a := api.loginLimiter.(*MemoryLoginLimiter).keys["ip:192.0.2.1"]; a == nil || a.failures != accountLockout.FreeAttempts+1 {
+		t.Errorf("got address attempts %+v", a)
+	}
+
+	// A success clears the account but the address keeps its other attempts
+	api.recordLoginSuccess(httptest.NewRequest("POST", "/api/login", nil), keys)
+	if _, ok := api.loginLimiter.(*MemoryLoginLimiter).keys["user:1"]; ok {
+		t.Error("the account was not cleared")
+	}
+	if a := api.loginLimiter.(*MemoryLoginLimiter).keys["ip:192.0.2.1"]; a == nil || a.failures != accountLockout.FreeAttempts {
+		t.Errorf("got address attempts %+v", a)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trustProxy bool
+		remote     string
+		forwarded  string
+		want       string
+	}{
+		{"remote address", false, "192.0.2.1:1234", "", "192.0.2.1"},
+		{"forwarded header ignored", false, "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"behind a proxy", true, "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+		{"last hop is used", true, "10.0.0.1:1234", "203.0.113.9, 198.51.100.7", "198.51.100.7"},
+		{"proxy without the header", true, "10.0.0.1:1234", "", "10.0.0.1"},
+		{"no port", false, "192.0.2.1", "", "192.0.2.1"},
+	}
+
+	for _, test := range tests {
+		api := &API{trustProxy: test.trustProxy}
+		r := httptest.NewRequest("POST", "/api/login", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if got := api.clientIP(r); got != test.want {
+			t.Errorf("%s: clientIP = %s, want %s", test.name, got, test.want)
+		}
+	}
+}
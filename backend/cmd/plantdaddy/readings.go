@@ -0,0 +1,303 @@
+package main
+
+// This file answers questions about the readings of a device over any range of time
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// The most buckets a single query may return.
+const maxBuckets = 10000
+
+// How often a probe sends a reading, used to tell how much of a bucket was covered.
+const deviceReportInterval = 10 * time.Minute
+
+var errInvalidRange = errors.New("from must be before to")
+var errTooManyBuckets = fmt.Errorf("the range holds more than %d buckets, use a larger bucket", maxBuckets)
+var errInvalidPeriod = errors.New("timePeriod must be a date such as 2021-06-01")
+
+// A size readings can be grouped into.
+type bucketSize struct {
+	Name     string
+	Duration time.Duration
+	// The field the time is truncated to, and the number of those a bucket holds.
+	unit string
+	step int
+}
+
+var bucketSizes = map[string]bucketSize{
+	"1m":  {Name: "1m", Duration: time.Minute, unit: "minute", step: 1},
+	"10m": {Name: "10m", Duration: 10 * time.Minute, unit: "minute", step: 10},
+	"1h":  {Name: "1h", Duration: time.Hour, unit: "hour", step: 1},
+	"1d":  {Name: "1d", Duration: 24 * time.Hour, unit: "day", step: 1},
+	"1w":  {Name: "1w", Duration: 7 * 24 * time.Hour, unit: "week", step: 1},
+}
+
+// This function returns the sql that truncates a time to the bucket it falls in.
+// Weeks start on Monday. The expression is only ever built from bucketSizes.
+func (b bucketSize) truncate(column string) string {
+	if b.step == 1 {
+		return fmt.Sprintf("date_trunc('%s', %s)", b.unit, column)
+	}
+	return fmt.Sprintf("(date_trunc('%[1]s', %[2]s) - (EXTRACT(%[1]s FROM %[2]s)::int %% %[3]d) * interval '1 %[1]s')", b.unit, column, b.step)
+}
+
+// This function returns the sql for the start of the bucket a reading falls in, in UTC.
+// The column holds UTC times and tz is the parameter naming the time zone the buckets follow.
+//
+// Minutes and hours are truncated in local time and moved back by the offset of the reading,
+// so the hour that repeats when the clocks go back stays two buckets and zones that are off
+// by half an hour get their own boundaries. Days and weeks run from local midnight to midnight
+// whatever their length.
+func (b bucketSize) expression(column string, tz string) string {
+	local := fmt.Sprintf("((%s AT TIME ZONE 'UTC') AT TIME ZONE %s)", column, tz)
+	if b.Duration < 24*time.Hour {
+		return fmt.Sprintf("(%s - (%s - %s))", b.truncate(local), local, column)
+	}
+	return fmt.Sprintf("((%s AT TIME ZONE %s) AT TIME ZONE 'UTC')", b.truncate(local), tz)
+}
+
+// This function parses a time as RFC 3339, or a date such as 2021-06-01 which is taken as midnight in loc.
+func parseTimeIn(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", value, loc)
+}
+
+// This function parses the from, to and bucket parameters of a readings query.
+// Dates without a time are midnight in loc and to defaults to now.
+func parseReadingsQuery(r *http.Request, loc *time.Location) (time.Time, time.Time, bucketSize, error) {
+	query := r.URL.Query()
+	bucket, ok := bucketSizes[query.Get("bucket")]
+	if !ok {
+		return time.Time{}, time.Time{}, bucketSize{}, errors.New("bucket must be one of 1m, 10m, 1h, 1d or 1w")
+	}
+
+	from, err := parseTimeIn(query.Get("from"), loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, bucketSize{}, errors.New("from must be a time such as 2021-06-01T00:00:00Z or a date")
+	}
+	to := time.Now()
+	if value := query.Get("to"); value != "" {
+		if to, err = parseTimeIn(value, loc); err != nil {
+			return time.Time{}, time.Time{}, bucketSize{}, errors.New("to must be a time such as 2021-06-02T00:00:00Z or a date")
+		}
+	}
+
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, bucketSize{}, errInvalidRange
+	}
+	if to.Sub(from)/bucket.Duration > maxBuckets {
+		return time.Time{}, time.Time{}, bucketSize{}, errTooManyBuckets
+	}
+	return from.UTC(), to.UTC(), bucket, nil
+}
+
+// DB Query to get the readings of a device between from and to grouped into buckets in loc, oldest first.
+// Buckets with no readings are left out.
+func getReadingsDB(db *pgxpool.Pool, deviceID string, from time.Time, to time.Time, bucket bucketSize, loc *time.Location) ([]ReadingBucket, error) {
+	start := bucket.expression("time", "$4")
+	rows, err := db.Query(context.Background(), `SELECT `+start+` AS bucket, COUNT(*),
+	AVG(temperature), MIN(temperature), MAX(temperature), COUNT(temperature),
+	AVG(humidity), MIN(humidity), MAX(humidity), COUNT(humidity),
+	AVG(soil_moisture), MIN(soil_moisture), MAX(soil_moisture), COUNT(soil_moisture),
+	AVG(light), MIN(light), MAX(light), COUNT(light)
+	FROM plant_data WHERE device_id = $1 AND time >= $2 AND time < $3
+	GROUP BY bucket ORDER BY bucket`, deviceID, from.UTC(), to.UTC(), loc.String())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buckets := []ReadingBucket{}
+	for rows.Next() {
+		var b ReadingBucket
+		err := rows.Scan(&b.Start, &b.Count,
+			&b.Temperature.Avg, &b.Temperature.Min, &b.Temperature.Max, &b.Temperature.Count,
+			&b.Humidity.Avg, &b.Humidity.Min, &b.Humidity.Max, &b.Humidity.Count,
+			&b.SoilMoisture.Avg, &b.SoilMoisture.Min, &b.SoilMoisture.Max, &b.SoilMoisture.Count,
+			&b.Light.Avg, &b.Light.Min, &b.Light.Max, &b.Light.Count)
+		if err != nil {
+			return nil, err
+		}
+		b.Start = b.Start.In(loc)
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// HTTP Call to get the readings of a device between from and to, grouped into buckets
+func (api *API) getReadings(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		deviceID := r.URL.Query().Get("deviceID")
+		if !api.allowDevice(w, r, deviceID, readDevice) {
+			return
+		}
+
+		loc, err := deviceLocation(api.db, currentUser(r).ID, deviceID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		from, to, bucket, err := parseReadingsQuery(r, loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		buckets, err := getReadingsDB(api.db, deviceID, from, to, bucket, loc)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(Readings{DeviceID: deviceID, From: from.In(loc), To: to.In(loc), Bucket: bucket.Name,
+			TimeZone: loc.String(), Buckets: buckets})
+	}
+}
+
+// This function returns the average of the metric, or zero when it has no values.
+func (m MetricStats) average() float64 {
+	if m.Avg == nil {
+		return 0
+	}
+	return *m.Avg
+}
+
+// This function combines two hours of data, such as the hour that repeats when the clocks go back.
+func (d DeviceHourData) merge(other DeviceHourData) DeviceHourData {
+	total := float64(d.DeviceNumber + other.DeviceNumber)
+	if total == 0 {
+		return d
+	}
+	weigh := func(a float64, b float64) float64 {
+		return (a*float64(d.DeviceNumber) + b*float64(other.DeviceNumber)) / total
+	}
+	return DeviceHourData{
+		TimePeriod:   d.TimePeriod,
+		Temperature:  weigh(d.Temperature, other.Temperature),
+		Humidity:     weigh(d.Humidity, other.Humidity),
+		SoilMoisture: weigh(d.SoilMoisture, other.SoilMoisture),
+		Light:        weigh(d.Light, other.Light),
+		DeviceNumber: d.DeviceNumber + other.DeviceNumber,
+	}
+}
+
+// This function lays out every bucket of a size between from and to in order, filling in the readings
+// that were found and marking the rest as empty.
+// Buckets shorter than a day are stepped in real time so a day with a clock change has 23 or 25 hours.
+func fillBuckets(found []ReadingBucket, from time.Time, to time.Time, bucket bucketSize, loc *time.Location) []DailyBucket {
+	byStart := make(map[int64]ReadingBucket, len(found))
+	for _, b := range found {
+		byStart[b.Start.Unix()] = b
+	}
+
+	buckets := []DailyBucket{}
+	for start := from; start.Before(to); {
+		var end time.Time
+		if bucket.Duration < 24*time.Hour {
+			end = start.Add(bucket.Duration)
+		} else {
+			local := start.In(loc)
+			end = time.Date(local.Year(), local.Month(), local.Day()+int(bucket.Duration/(24*time.Hour)), 0, 0, 0, 0, loc)
+		}
+
+		b, ok := byStart[start.Unix()]
+		// A bucket shorter than the report interval is covered by a single reading
+		expected := math.Max(1, float64(end.Sub(start)/deviceReportInterval))
+		daily := DailyBucket{
+			Start:        start.In(loc),
+			End:          end.In(loc),
+			Empty:        !ok || b.Count == 0,
+			SampleCount:  b.Count,
+			Temperature:  b.Temperature,
+			Humidity:     b.Humidity,
+			SoilMoisture: b.SoilMoisture,
+			Light:        b.Light,
+		}
+		daily.Coverage = coverage(b.Count, expected)
+		buckets = append(buckets, daily)
+		start = end
+	}
+	return buckets
+}
+
+// This function returns the percentage of the expected readings that arrived, at most 100.
+func coverage(count int64, expected float64) float64 {
+	percent := float64(count) / expected * 100
+	if percent > 100 {
+		return 100
+	}
+	return math.Round(percent*10) / 10
+}
+
+// HTTP Call to get a day of readings as an ordered list of every bucket in it, including the empty ones
+func (api *API) getDailyDataV2(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		deviceID := r.URL.Query().Get("deviceID")
+		if !api.allowDevice(w, r, deviceID, readDevice) {
+			return
+		}
+
+		bucket := bucketSizes["1h"]
+		if name := r.URL.Query().Get("bucket"); name != "" {
+			var ok bool
+			if bucket, ok = bucketSizes[name]; !ok || bucket.Duration >= 24*time.Hour {
+				http.Error(w, "bucket must be one of 1m, 10m or 1h", http.StatusBadRequest)
+				return
+			}
+		}
+
+		loc, err := deviceLocation(api.db, currentUser(r).ID, deviceID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		date := r.URL.Query().Get("timePeriod")
+		day, err := time.ParseInLocation("2006-01-02", date, loc)
+		if err != nil {
+			http.Error(w, errInvalidPeriod.Error(), http.StatusBadRequest)
+			return
+		}
+		next := day.AddDate(0, 0, 1)
+
+		found, err := getReadingsDB(api.db, deviceID, day, next, bucket, loc)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		data := DailyData{
+			DeviceID: deviceID,
+			Date:     date,
+			TimeZone: loc.String(),
+			Bucket:   bucket.Name,
+			Buckets:  fillBuckets(found, day, next, bucket, loc),
+		}
+		for _, b := range found {
+			data.SampleCount += b.Count
+		}
+		data.Coverage = coverage(data.SampleCount, float64(next.Sub(day)/deviceReportInterval))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(data)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBucketTruncate(t *testing.T) {
+	tests := []struct {
+		bucket string
+		want   string
+	}{
+		{"1m", "date_trunc('minute', time)"},
+		{"1h", "date_trunc('hour', time)"},
+		{"1d", "date_trunc('day', time)"},
+		{"1w", "date_trunc('week', time)"},
+		{"10m", "(date_trunc('minute', time) - (EXTRACT(minute FROM time)::int % 10) * interval '1 minute')"},
+	}
+
+	for _, test := range tests {
+		if got := bucketSizes[test.bucket].truncate("time"); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.bucket, got, test.want)
+		}
+	}
+}
+
+func TestBucketExpression(t *testing.T) {
+	local := "((time AT TIME ZONE 'UTC') AT TIME ZONE $4)"
+	tests := []struct {
+		bucket string
+		want   string
+	}{
+		{"1h", "(date_trunc('hour', " + local + ") - (" + local + " - time))"},
+		{"1d", "((date_trunc('day', " + local + ") AT TIME ZONE $4) AT TIME ZONE 'UTC')"},
+	}
+
+	for _, test := range tests {
+		if got := bucketSizes[test.bucket].expression("time", "$4"); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.bucket, got, test.want)
+		}
+	}
+}
+
+func TestParseReadingsQuery(t *testing.T) {
+	vancouver, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		query  string
+		from   time.Time
+		to     time.Time
+		bucket string
+		err    bool
+	}{
+		{"times", "from=2021-06-01T00:00:00Z&to=2021-06-02T00:00:00Z&bucket=1h",
+			time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 6, 2, 0, 0, 0, 0, time.UTC), "1h", false},
+		{"dates are local midnight", "from=2021-06-01&to=2021-06-08&bucket=1d",
+			time.Date(2021, 6, 1, 7, 0, 0, 0, time.UTC), time.Date(2021, 6, 8, 7, 0, 0, 0, time.UTC), "1d", false},
+		{"offsets", "from=2021-06-01T00:00:00-07:00&to=2021-06-01T01:00:00-07:00&bucket=1m",
+			time.Date(2021, 6, 1, 7, 0, 0, 0, time.UTC), time.Date(2021, 6, 1, 8, 0, 0, 0, time.UTC), "1m", false},
+		{"at the bucket limit", "from=2021-06-01T00:00:00Z&to=2021-06-07T22:40:00Z&bucket=1m",
+			time.Date(2021, 6, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 6, 7, 22, 40, 0, 0, time.UTC), "1m", false},
+		{"too many buckets", "from=2021-06-01T00:00:00Z&to=2021-06-07T22:41:00Z&bucket=1m", time.Time{}, time.Time{}, "", true},
+		{"unknown bucket", "from=2021-06-01&to=2021-06-02&bucket=2h", time.Time{}, time.Time{}, "", true},
+		{"no bucket", "from=2021-06-01&to=2021-06-02", time.Time{}, time.Time{}, "", true},
+		{"no from", "to=2021-06-02&bucket=1h", time.Time{}, time.Time{}, "", true},
+		{"bad to", "from=2021-06-01&to=tomorrow&bucket=1h", time.Time{}, time.Time{}, "", true},
+		{"empty range", "from=2021-06-01&to=2021-06-01&bucket=1h", time.Time{}, time.Time{}, "", true},
+		{"backwards", "from=2021-06-02&to=2021-06-01&bucket=1h", time.Time{}, time.Time{}, "", true},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/readings?"+test.query, nil)
+		from, to, bucket, err := parseReadingsQuery(r, vancouver)
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if !from.Equal(test.from) || !to.Equal(test.to) || bucket.Name != test.bucket {
+			t.Errorf("%s: got %s to %s in %s buckets", test.name, from, to, bucket.Name)
+		}
+	}
+}
+
+func TestParseReadingsQueryDefaultsToNow(t *testing.T) {
+	r := httptest.NewRequest("GET", "/api/readings?from=2021-06-01&bucket=1w", nil)
+	before := time.Now()
+	_, to, _, err := parseReadingsQuery(r, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to.Before(before) || to.After(time.Now()) {
+		t.Errorf("to is %s, not now", to)
+	}
+}
+
+func TestGetReadings(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "reader")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	deviceID := createDevice(t, api, user.ID)
+
+	at := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	addReading(t, api, deviceID, at.Add(3*time.Minute), 20)
+	addReading(t, api, deviceID, at.Add(7*time.Minute), 22)
+	addReading(t, api, deviceID, at.Add(13*time.Minute), 30)
+	// Outside of the range
+	addReading(t, api, deviceID, at.Add(time.Hour), 50)
+
+	w := doJSON(t, asUser(api, user, api.getReadings), "GET",
+		"/api/readings?deviceID="+deviceID+"&from=2021-06-01T12:00:00Z&to=2021-06-01T13:00:00Z&bucket=10m", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("readings: %d %s", w.Code, w.Body)
+	}
+	var readings Readings
+	if err := json.NewDecoder(w.Body).Decode(&readings); err != nil {
+		t.Fatal(err)
+	}
+	if readings.Bucket != "10m" || readings.TimeZone != "UTC" || len(readings.Buckets) != 2 {
+		t.Fatalf("got %+v", readings)
+	}
+
+	tests := []struct {
+		start time.Time
+		count int64
+		avg   float64
+		min   float64
+		max   float64
+	}{
+		{at, 2, 21, 20, 22},
+		{at.Add(10 * time.Minute), 1, 30, 30, 30},
+	}
+	for i, test := range tests {
+		b := readings.Buckets[i]
+		temperature := b.Temperature
+		if !b.Start.Equal(test.start) || b.Count != test.count || temperature.Count != test.count ||
+			*temperature.Avg != test.avg || *temperature.Min != test.min || *temperature.Max != test.max {
+			t.Errorf("bucket %d: got %s %d %v %v %v", i, b.Start, b.Count, *temperature.Avg, *temperature.Min, *temperature.Max)
+		}
+	}
+
+	w = doJSON(t, asUser(api, AuthUser{ID: -1, Username: "nobody"}, api.getReadings), "GET",
+		"/api/readings?deviceID="+deviceID+"&from=2021-06-01&bucket=1h", nil, nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("another user got %d", w.Code)
+	}
+}
+
+func TestGetReadingsAcrossAClockChange(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "reader")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	deviceID := createDevice(t, api, user.ID)
+	vancouver, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The clocks in Vancouver went back from 02:00 to 01:00 on 2021-11-07, at 09:00 UTC
+	addReading(t, api, deviceID, time.Date(2021, 11, 7, 8, 30, 0, 0, time.UTC), 10)
+	addReading(t, api, deviceID, time.Date(2021, 11, 7, 9, 30, 0, 0, time.UTC), 20)
+	addReading(t, api, deviceID, time.Date(2021, 11, 8, 7, 30, 0, 0, time.UTC), 30)
+
+	from := time.Date(2021, 11, 7, 0, 0, 0, 0, vancouver)
+	to := time.Date(2021, 11, 9, 0, 0, 0, 0, vancouver)
+	hours, err := getReadingsDB(api.db, deviceID, from, to, bucketSizes["1h"], vancouver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hours) != 3 || hours[0].Start.Hour() != 1 || hours[1].Start.Hour() != 1 || hours[0].Start.Equal(hours[1].Start) {
+		t.Fatalf("the repeated hour was not kept as two buckets: %+v", hours)
+	}
+
+	// The day the clocks went back is 25 hours long
+	days, err := getReadingsDB(api.db, deviceID, from, to, bucketSizes["1d"], vancouver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(days) != 1 || !days[0].Start.Equal(from) || days[0].Count != 3 {
+		t.Fatalf("got days %+v", days)
+	}
+}
+
+func TestFillBuckets(t *testing.T) {
+	vancouver, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	avg := 21.0
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, vancouver)
+	}
+	tests := []struct {
+		name     string
+		from     time.Time
+		to       time.Time
+		bucket   string
+		found    []ReadingBucket
+		count    int
+		full     int
+		coverage float64
+	}{
+		{"an hour of a day", day(2021, 6, 1), day(2021, 6, 2), "1h",
+			[]ReadingBucket{{Start: day(2021, 6, 1).Add(2 * time.Hour), Count: 3}}, 24, 2, 50},
+		{"the day the clocks went forward", day(2021, 3, 14), day(2021, 3, 15), "1h", nil, 23, -1, 0},
+		{"the day the clocks went back", day(2021, 11, 7), day(2021, 11, 8), "1h", nil, 25, -1, 0},
+		{"a full ten minutes", day(2021, 6, 1), day(2021, 6, 2), "10m",
+			[]ReadingBucket{{Start: day(2021, 6, 1).Add(10 * time.Minute), Count: 1}}, 144, 1, 100},
+		{"a minute is covered by one reading", day(2021, 6, 1), day(2021, 6, 1).Add(time.Hour), "1m",
+			[]ReadingBucket{{Start: day(2021, 6, 1), Count: 1}}, 60, 0, 100},
+		{"too many readings", day(2021, 6, 1), day(2021, 6, 2), "1h",
+			[]ReadingBucket{{Start: day(2021, 6, 1), Count: 9}}, 24, 0, 100},
+		{"days of a week with a clock change", day(2021, 11, 1), day(2021, 11, 8), "1d",
+			[]ReadingBucket{{Start: day(2021, 11, 7), Count: 150}}, 7, 6, 100},
+		{"a bucket with no readings", day(2021, 6, 1), day(2021, 6, 2), "1h",
+			[]ReadingBucket{{Start: day(2021, 6, 1), Count: 0}}, 24, -1, 0},
+	}
+
+	for _, test := range tests {
+		for i := range test.found {
+			if test.found[i].Count > 0 {
+				test.found[i].Temperature.Avg = &avg
+			}
+		}
+		buckets := fillBuckets(test.found, test.from, test.to, bucketSizes[test.bucket], vancouver)
+		if len(buckets) != test.count {
+			t.Errorf("%s: got %d buckets, want %d", test.name, len(buckets), test.count)
+			continue
+		}
+
+		start := test.from
+		for i, b := range buckets {
+			if !b.Start.Equal(start) || !b.End.After(b.Start) || b.Start.Location() != vancouver {
+				t.Errorf("%s: bucket %d runs from %s to %s", test.name, i, b.Start, b.End)
+			}
+			start = b.End
+
+			if i != test.full {
+				if !b.Empty || b.SampleCount != 0 || b.Coverage != 0 || b.Temperature.Avg != nil {
+					t.Errorf("%s: bucket %d is not empty: %+v", test.name, i, b)
+				}
+			} else if b.Empty || b.Coverage != test.coverage || b.Temperature.Avg == nil {
+				t.Errorf("%s: bucket %d got %+v, want coverage %v", test.name, i, b, test.coverage)
+			}
+		}
+		if !start.Equal(test.to) {
+			t.Errorf("%s: the buckets end at %s", test.name, start)
+		}
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	tests := []struct {
+		count    int64
+		expected float64
+		want     float64
+	}{
+		{0, 144, 0},
+		{144, 144, 100},
+		{200, 144, 100},
+		{72, 144, 50},
+		{1, 3, 33.3},
+		{2, 3, 66.7},
+	}
+
+	for _, test := range tests {
+		if got := coverage(test.count, test.expected); got != test.want {
+			t.Errorf("coverage(%d, %v) = %v, want %v", test.count, test.expected, got, test.want)
+		}
+	}
+}
+
+func TestDeviceHourDataMerge(t *testing.T) {
+	tests := []struct {
+		name string
+		a    DeviceHourData
+		b    DeviceHourData
+		want DeviceHourData
+	}{
+		{"weighed by readings", DeviceHourData{TimePeriod: 1, Temperature: 10, Light: 100, DeviceNumber: 1},
+			DeviceHourData{TimePeriod: 1, Temperature: 20, Light: 400, DeviceNumber: 3},
+			DeviceHourData{TimePeriod: 1, Temperature: 17.5, Light: 325, DeviceNumber: 4}},
+		{"nothing to merge", DeviceHourData{TimePeriod: 1}, DeviceHourData{TimePeriod: 1}, DeviceHourData{TimePeriod: 1}},
+	}
+
+	for _, test := range tests {
+		if got := test.a.merge(test.b); got != test.want {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetDailyDataV2(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "reader")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	deviceID := createDevice(t, api, user.ID)
+	if err := setUserTimeZone(api.db, user.ID, "America/Vancouver"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 00:05 and 00:15 on 2021-06-01 in Vancouver, and one from the day before
+	addReading(t, api, deviceID, time.Date(2021, 6, 1, 7, 5, 0, 0, time.UTC), 20)
+	addReading(t, api, deviceID, time.Date(2021, 6, 1, 7, 15, 0, 0, time.UTC), 22)
+	addReading(t, api, deviceID, time.Date(2021, 6, 1, 6, 55, 0, 0, time.UTC), 50)
+
+	tests := []struct {
+		query   string
+		code    int
+		buckets int
+	}{
+		{"timePeriod=2021-06-01", http.StatusOK, 24},
+		{"timePeriod=2021-06-01&bucket=10m", http.StatusOK, 144},
+		{"timePeriod=2021-06-01&bucket=1d", http.StatusBadRequest, 0},
+		{"timePeriod=June", http.StatusBadRequest, 0},
+	}
+	for _, test := range tests {
+		w := doJSON(t, asUser(api, user, api.getDailyDataV2), "GET", "/api/v2/daily-data?deviceID="+deviceID+"&"+test.query, nil, nil)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d %s", test.query, w.Code, w.Body)
+			continue
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+
+		var data DailyData
+		if err := json.NewDecoder(w.Body).Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		if data.TimeZone != "America/Vancouver" || data.SampleCount != 2 || len(data.Buckets) != test.buckets {
+			t.Errorf("%s: got %s with %d samples in %d buckets", test.query, data.TimeZone, data.SampleCount, len(data.Buckets))
+			continue
+		}
+		if first := data.Buckets[0]; first.Empty || first.Start.Hour() != 0 {
+			t.Errorf("%s: got first bucket %+v", test.query, first)
+		}
+		if last := data.Buckets[len(data.Buckets)-1]; !last.Empty {
+			t.Errorf("%s: got last bucket %+v", test.query, last)
+		}
+	}
+}
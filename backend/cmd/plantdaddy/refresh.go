@@ -0,0 +1,233 @@
+package main
+
+// This file handles the long lived refresh tokens that keep the app signed in
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var errInvalidRefreshToken = errors.New("refresh token is invalid or has been revoked")
+
+// DB Query to store a new refresh token for the user. Only the hash of the token is kept.
+func insertRefreshToken(db *pgxpool.Pool, userID int64, userAgent string, ttl time.Duration) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	_, err = db.Exec(context.Background(), `INSERT INTO refresh_token(user_id, token_hash, created_at, expires_at, user_agent)
+	VALUES ($1, $2, $3, $4, $5)`, userID, hashToken(token), now, now.Add(ttl), userAgent)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// DB Query to swap a refresh token for a new one.
+// If a token that was already used is presented again every session of the user is revoked
+// since it means the token has been stolen.
+func rotateRefreshToken(db *pgxpool.Pool, token string, userAgent string, ttl time.Duration) (AuthUser, string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return AuthUser{}, "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var id int64
+	var user AuthUser
+	var expiresAt time.Time
+	var revokedAt *time.Time
+	row := tx.QueryRow(ctx, `SELECT r.id, r.expires_at, r.revoked_at, a.id, a.username, a.token_version
+	FROM refresh_token r INNER JOIN auth a ON r.user_id = a.id
+	WHERE r.token_hash = $1 FOR UPDATE OF r`, hashToken(token))
+
+	err = row.Scan(&id, &expiresAt, &revokedAt, &user.ID, &user.Username, &user.TokenVersion)
+	if err == pgx.ErrNoRows {
+		return AuthUser{}, "", errInvalidRefreshToken
+	} else if err != nil {
+		return AuthUser{}, "", err
+	}
+
+	now := time.Now().UTC()
+	if revokedAt != nil {
+		log.Printf("refresh token reuse for user %d, revoking all sessions", user.ID)
+		if _, err := tx.Exec(ctx, `UPDATE refresh_token SET revoked_at = $1 WHERE user_id = $2 AND revoked_at IS NULL`, now, user.ID); err != nil {
+			return AuthUser{}, "", err
+		}
+		if err := bumpTokenVersion(ctx, tx, user.ID); err != nil {
+			return AuthUser{}, "", err
+		}
+		if err := tx.Commit(ctx); err != nil {
+			return AuthUser{}, "", err
+		}
+		return AuthUser{}, "", errInvalidRefreshToken
+	}
+	if now.After(expiresAt) {
+		return AuthUser{}, "", errInvalidRefreshToken
+	}
+
+	newToken, err := newOpaqueToken()
+	if err != nil {
+		return AuthUser{}, "", err
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE refresh_token SET revoked_at = $1 WHERE id = $2`, now, id); err != nil {
+		return AuthUser{}, "", err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO refresh_token(user_id, token_hash, created_at, expires_at, user_agent)
+	VALUES ($1, $2, $3, $4, $5)`, user.ID, hashToken(newToken), now, now.Add(ttl), userAgent)
+	if err != nil {
+		return AuthUser{}, "", err
+	}
+
+	return user, newToken, tx.Commit(ctx)
+}
+
+// DB Query to revoke a single refresh token.
+func revokeRefreshToken(db *pgxpool.Pool, token string) error {
+	_, err := db.Exec(context.Background(), `UPDATE refresh_token SET revoked_at = $1
+	WHERE token_hash = $2 AND revoked_at IS NULL`, time.Now().UTC(), hashToken(token))
+	return err
+}
+
+// DB Query to revoke every refresh token belonging to a user along with the access tokens they hold.
+func revokeAllRefreshTokens(db *pgxpool.Pool, userID int64) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE refresh_token SET revoked_at = $1
+	WHERE user_id = $2 AND revoked_at IS NULL`, time.Now().UTC(), userID); err != nil {
+		return err
+	}
+	if err := bumpTokenVersion(ctx, tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// This function creates an access and refresh token for the user and writes them to the response.
+func (api *API) issueTokens(w http.ResponseWriter, r *http.Request, user AuthUser) {
+	var err error
+	user.TokenVersion, err = getTokenVersion(r.Context(), api.db, user.ID)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := newAccessToken(api.tokenSecret, user, api.accessTokenTTL)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	token.RefreshToken, err = insertRefreshToken(api.db, user.ID, r.UserAgent(), api.refreshTokenTTL)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	writeTokens(w, token)
+}
+
+// this function writes the tokens to the response so that they are never cached
+func writeTokens(w http.ResponseWriter, token AccessToken) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(token)
+}
+
+// This function decodes the refresh token from the request body.
+func decodeRefreshRequest(w http.ResponseWriter, r *http.Request) (RefreshRequest, bool) {
+	var request RefreshRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+
+	if jsonDecoder(err, w) != nil {
+		return RefreshRequest{}, false
+	}
+	if request.RefreshToken == "" {
+		http.Error(w, "Must provide refreshToken", http.StatusBadRequest)
+		return RefreshRequest{}, false
+	}
+	return request, true
+}
+
+// HTTP Call to swap a refresh token for a new access and refresh token
+func (api *API) refreshToken(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		request, ok := decodeRefreshRequest(w, r)
+		if !ok {
+			return
+		}
+
+		user, refresh, err := rotateRefreshToken(api.db, request.RefreshToken, r.UserAgent(), api.refreshTokenTTL)
+		if errors.Is(err, errInvalidRefreshToken) {
+			unauthorized(w, err.Error())
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		token, err := newAccessToken(api.tokenSecret, user, api.accessTokenTTL)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		token.RefreshToken = refresh
+
+		writeTokens(w, token)
+	}
+}
+
+// HTTP Call to log out of the session the refresh token belongs to
+func (api *API) logOut(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		request, ok := decodeRefreshRequest(w, r)
+		if !ok {
+			return
+		}
+
+		if err := revokeRefreshToken(api.db, request.RefreshToken); err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HTTP Call to log the authenticated user out of every device they are signed in on
+func (api *API) logOutAll(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		if err := revokeAllRefreshTokens(api.db, currentUser(r).ID); err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditLogOutAll})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
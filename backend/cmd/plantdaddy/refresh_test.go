@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDecodeRefreshRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		ok     bool
+		status int
+	}{
+		{"valid", `{"refreshToken":"abc"}`, true, http.StatusOK},
+		{"missing token", `{}`, false, http.StatusBadRequest},
+		{"empty token", `{"refreshToken":""}`, false, http.StatusBadRequest},
+		{"unknown field", `{"refreshToken":"abc","userID":1}`, false, http.StatusBadRequest},
+		{"bad json", `{"refreshToken":`, false, http.StatusBadRequest},
+		{"wrong type", `{"refreshToken":1}`, false, http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("POST", "/refresh", strings.NewReader(test.body))
+			request, ok := decodeRefreshRequest(w, r)
+			if ok != test.ok || w.Code != test.status {
+				t.Fatalf("got ok %v and status %d, want %v and %d", ok, w.Code, test.ok, test.status)
+			}
+			if ok && request.RefreshToken != "abc" {
+				t.Errorf("got token %q", request.RefreshToken)
+			}
+		})
+	}
+}
+
+func TestOpaqueTokens(t *testing.T) {
+	first, err := newOpaqueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newOpaqueToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 64 || first == second {
+		t.Errorf("got tokens %q and %q", first, second)
+	}
+
+	if hashToken(first) != hashToken(first) || hashToken(first) == hashToken(second) || hashToken(first) == first {
+		t.Error("hashToken must be stable, distinct per token and not the token itself")
+	}
+	// The sha256 of the empty string, hex encoded.
+	if got := hashToken(""); got != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("hashToken(\"\") = %s", got)
+	}
+}
@@ -1,22 +1,37 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
 )
 type NewDevice struct {
 	DeviceID string `json:"deviceID"`
 	DeviceName string `json:"deviceName"`
+	// Ignored, the device is always registered to the authenticated user.
 	Username string `json:"username"`
+	// The code printed on the box of the probe.
+	ClaimCode string `json:"claimCode"`
 }
 type Login struct {
 	DeviceID string `json:"deviceID"`
+	// Unix time the request was signed at.
+	Timestamp int64 `json:"timestamp"`
+	Nonce string `json:"nonce"`
+}
+
+type DeviceCredentials struct {
+	DeviceID string `json:"deviceID"`
+	DeviceSecret string `json:"deviceSecret"`
 }
 
 type Device struct {
 	DeviceID string `json:"deviceID"`
 	DeviceName string `json:"deviceName"`
 	DeviceData Data `json:"deviceData"`
-
+	// The role the caller has on the device, owner unless it was shared with them.
+	Role string `json:"role"`
+	// Where the device is, when it is not where its owner is.
+	TimeZone *string `json:"timeZone,omitempty"`
 }
 
 type UserPass struct {
@@ -25,6 +40,60 @@ type UserPass struct {
 	Email string `json:"email"`
 }
 
+type AccessToken struct {
+	AccessToken string `json:"accessToken"`
+	TokenType string `json:"tokenType"`
+	ExpiresIn int64 `json:"expiresIn"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+}
+
+type MFAChallenge struct {
+	MFARequired bool `json:"mfaRequired"`
+	MFAToken string `json:"mfaToken"`
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+type MFALogin struct {
+	MFAToken string `json:"mfaToken"`
+	// Either a code from the authenticator app or a recovery code.
+	Code string `json:"code"`
+}
+
+type TOTPCode struct {
+	Code string `json:"code"`
+}
+
+type DisableTOTP struct {
+	Password string `json:"password"`
+	Code string `json:"code"`
+}
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI string `json:"otpauthURI"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type ForgotPassword struct {
+	Email string `json:"email"`
+}
+
+type ResetPassword struct {
+	Token string `json:"token"`
+	Password string `json:"password"`
+}
+
+type VerifyEmail struct {
+	Token string `json:"token"`
+}
+
 type deviceName struct {
 	DeviceName string `json:"deviceName"`
 	DeviceID string `json:"deviceID"`
@@ -55,6 +124,10 @@ type SessionData struct {
 	SoilMoisture float64 `json:"soilMoisture"`
 	Light float64 `json:"light"`
 	DeviceID string `json:"deviceID"`
+	// Chosen by the device for each reading so a retried request does not store it twice.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// Registered metrics beyond the four above, by name.
+	Metrics map[string]float64 `json:"metrics,omitempty"`
 }
 
 type Data struct {
@@ -63,4 +136,311 @@ type Data struct {
 	Humidity int `json:"humidity"`
 	SoilMoisture float64 `json:"soilMoisture"`
 	Light float64 `json:"light"`
+	// Chosen by the device for each reading so a retried request does not store it twice.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// Registered metrics beyond the four above, by name.
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+}
+
+type Household struct {
+	ID int64 `json:"householdID"`
+	Name string `json:"name"`
+	// The role the caller has in the household.
+	Role string `json:"role"`
+	Members []HouseholdMember `json:"members,omitempty"`
+}
+
+type HouseholdMember struct {
+	UserID int64 `json:"userID"`
+	Username string `json:"username"`
+	Role string `json:"role"`
+}
+
+type NewHousehold struct {
+	Name string `json:"name"`
+}
+
+type NewInvitation struct {
+	HouseholdID int64 `json:"householdID"`
+	Username string `json:"username"`
+	Role string `json:"role"`
+}
+
+type Invitation struct {
+	ID int64 `json:"invitationID"`
+	HouseholdID int64 `json:"householdID"`
+	HouseholdName string `json:"householdName"`
+	Role string `json:"role"`
+	InvitedBy string `json:"invitedBy"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type InvitationAnswer struct {
+	InvitationID int64 `json:"invitationID"`
+}
+
+type ShareDevice struct {
+	DeviceID string `json:"deviceID"`
+	HouseholdID int64 `json:"householdID"`
+}
+
+type NewTransfer struct {
+	DeviceID string `json:"deviceID"`
+	// The user the device is being given to.
+	Username string `json:"username"`
+	// Whether the new owner gets the data the device has already collected.
+	KeepHistory bool `json:"keepHistory"`
+}
+
+type Transfer struct {
+	ID int64 `json:"transferID"`
+	DeviceID string `json:"deviceID"`
+	DeviceName string `json:"deviceName"`
+	From string `json:"from"`
+	KeepHistory bool `json:"keepHistory"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type TransferAnswer struct {
+	TransferID int64 `json:"transferID"`
+}
+
+type ClaimCode struct {
+	DeviceID string `json:"deviceID"`
+	ClaimCode string `json:"claimCode"`
+	ExpiresIn int64 `json:"expiresIn"`
+}
+
+type ClaimDevice struct {
+	DeviceID string `json:"deviceID"`
+	ClaimCode string `json:"claimCode"`
+	DeviceName string `json:"deviceName"`
+}
+
+type NewAPIKey struct {
+	Name string `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type APIKey struct {
+	ID int64 `json:"keyID"`
+	Name string `json:"name"`
+	// The first part of the key so it can be recognised in the list.
+	Prefix string `json:"prefix"`
+	Scopes []string `json:"scopes"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt"`
+	// Only set when the key is created.
+	Key string `json:"key,omitempty"`
+}
+
+type AuditEntry struct {
+	ID int64 `json:"entryID"`
+	Action string `json:"action"`
+	// The username of who did it, empty for failed logins and deleted users.
+	Actor *string `json:"actor"`
+	// Set when it was done with an api key.
+	APIKeyID *int64 `json:"apiKeyID,omitempty"`
+	DeviceID *string `json:"deviceID,omitempty"`
+	IP *string `json:"ip"`
+	UserAgent *string `json:"userAgent"`
+	Before json.RawMessage `json:"before"`
+	After json.RawMessage `json:"after"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type OIDCStart struct {
+	Provider string `json:"provider"`
+	CodeChallenge string `json:"codeChallenge"`
+}
+
+type OIDCAuthorization struct {
+	URL string `json:"url"`
+}
+
+type OIDCExchange struct {
+	Code string `json:"code"`
+	CodeVerifier string `json:"codeVerifier"`
+}
+
+type Identity struct {
+	ID int64 `json:"identityID"`
+	Provider string `json:"provider"`
+	Email *string `json:"email"`
+	CreatedAt time.Time `json:"createdAt"`
+	LastLoginAt *time.Time `json:"lastLoginAt"`
+}
+
+type Account struct {
+	ID int64 `json:"userID"`
+	Username string `json:"username"`
+	Email *string `json:"email"`
+	EmailVerified bool `json:"emailVerified"`
+	TwoFactorEnabled bool `json:"twoFactorEnabled"`
+	// False for accounts made by signing in with a provider until a password is set.
+	HasPassword bool `json:"hasPassword"`
+	// The IANA time zone days and hours are counted in.
+	TimeZone string `json:"timeZone"`
+	// Set while the account is waiting to be deleted.
+	DeleteAfter *time.Time `json:"deleteAfter"`
+}
+
+type AccountExport struct {
+	Account
+	Households []Household `json:"households"`
+	Identities []Identity `json:"identities"`
+	APIKeys []APIKey `json:"apiKeys"`
+}
+
+type DeleteAccount struct {
+	Password string `json:"password"`
+}
+
+type MetricStats struct {
+	// Nil when the bucket has no values for the metric.
+	Avg *float64 `json:"avg"`
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+	Count int64 `json:"count"`
+}
+
+type ReadingBucket struct {
+	Start time.Time `json:"start"`
+	// The number of readings in the bucket.
+	Count int64 `json:"count"`
+	Temperature MetricStats `json:"temperature"`
+	Humidity MetricStats `json:"humidity"`
+	SoilMoisture MetricStats `json:"soilMoisture"`
+	Light MetricStats `json:"light"`
+}
+
+type Readings struct {
+	DeviceID string `json:"deviceID"`
+	From time.Time `json:"from"`
+	To time.Time `json:"to"`
+	Bucket string `json:"bucket"`
+	// The IANA time zone the buckets follow.
+	TimeZone string `json:"timeZone"`
+	Buckets []ReadingBucket `json:"buckets"`
+}
+
+type TimeZone struct {
+	// Only used when changing the time zone of a device.
+	DeviceID string `json:"deviceID,omitempty"`
+	// An IANA time zone such as America/Vancouver.
+	TimeZone string `json:"timeZone"`
+}
+
+type DailyBucket struct {
+	Start time.Time `json:"start"`
+	End time.Time `json:"end"`
+	// True when the device sent nothing during the bucket.
+	Empty bool `json:"empty"`
+	SampleCount int64 `json:"sampleCount"`
+	// The percentage of the readings the device should have sent that arrived.
+	Coverage float64 `json:"coverage"`
+	Temperature MetricStats `json:"temperature"`
+	Humidity MetricStats `json:"humidity"`
+	SoilMoisture MetricStats `json:"soilMoisture"`
+	Light MetricStats `json:"light"`
+}
+
+type DailyData struct {
+	DeviceID string `json:"deviceID"`
+	Date string `json:"date"`
+	TimeZone string `json:"timeZone"`
+	Bucket string `json:"bucket"`
+	SampleCount int64 `json:"sampleCount"`
+	Coverage float64 `json:"coverage"`
+	// Every bucket of the day in order.
+	Buckets []DailyBucket `json:"buckets"`
+}
+
+type RawReading struct {
+	ID int64 `json:"id"`
+	Time time.Time `json:"time"`
+	// The metrics that were asked for, null when the device did not send one.
+	Metrics map[string]*float64 `json:"metrics"`
+}
+
+type RawReadings struct {
+	DeviceID string `json:"deviceID"`
+	TimeZone string `json:"timeZone"`
+	Order string `json:"order"`
+	Readings []RawReading `json:"readings"`
+	// Pass as cursor to get the next page, left out on the last page.
+	NextCursor string `json:"nextCursor,omitempty"`
+}
+
+type ExportedReading struct {
+	DeviceID string `json:"deviceID"`
+	// Null for the readings of old probes that did not send a time.
+	Time *time.Time `json:"time"`
+	Temperature *float64 `json:"temperature"`
+	Humidity *float64 `json:"humidity"`
+	SoilMoisture *float64 `json:"soilMoisture"`
+	Light *float64 `json:"light"`
+	Metrics map[string]float64 `json:"metrics,omitempty"`
+}
+
+type ImportError struct {
+	// The line of the file the row starts on.
+	Line int `json:"line"`
+	Error string `json:"error"`
+}
+
+type ImportResult struct {
+	DryRun bool `json:"dryRun"`
+	// Every row of the file apart from the header.
+	Rows int64 `json:"rows"`
+	Imported int64 `json:"imported"`
+	// Rows at a time the device already had a reading.
+	Duplicates int64 `json:"duplicates"`
+	Failed int64 `json:"failed"`
+	// The first rows that could not be imported.
+	Errors []ImportError `json:"errors"`
+	// Columns of the file that were not imported.
+	IgnoredColumns []string `json:"ignoredColumns,omitempty"`
+}
+
+type SessionBatch struct {
+	SessionID string `json:"sessionID"`
+	UsageCounter int `json:"usageCounter"`
+	// The clock of the device when it sent the batch, used to correct the times of the readings.
+	Timestamp time.Time `json:"timestamp"`
+	DeviceID string `json:"deviceID"`
+	// Each with the time it was taken by the clock of the device.
+	Readings []Data `json:"readings"`
+}
+
+type BatchReadingResult struct {
+	// The position of the reading in the batch.
+	Index int `json:"index"`
+	// stored, duplicate or rejected.
+	Status string `json:"status"`
+	// The time the reading was stored at, after correcting the clock of the device.
+	Time *time.Time `json:"time,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+type BatchResult struct {
+	// The session to send next, as /new-data returns it.
+	Session
+	// Seconds the clock of the device was behind the server, zero when it was close enough to trust.
+	ClockOffset float64 `json:"clockOffset"`
+	Stored int `json:"stored"`
+	Results []BatchReadingResult `json:"results"`
+}
+
+// A kind of value probes can measure. The four every probe has are legacy metrics,
+// sent and stored in their own fields.
+type Metric struct {
+	ID int64 `json:"-"`
+	Name string `json:"name"`
+	Unit string `json:"unit"`
+	Type string `json:"type"`
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+	Description string `json:"description,omitempty"`
+	Legacy bool `json:"legacy"`
 }
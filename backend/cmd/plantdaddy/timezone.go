@@ -0,0 +1,158 @@
+package main
+
+// This file handles the time zones days and hours are counted in
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	// The zones are built in so every server accepts the same names
+	_ "time/tzdata"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var errInvalidTimeZone = errors.New("timeZone must be an IANA time zone such as America/Vancouver")
+
+// This function loads an IANA time zone, refusing names that only mean something to this server.
+func loadTimeZone(name string) (*time.Location, error) {
+	if name == "" || name == "Local" {
+		return nil, errInvalidTimeZone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, errInvalidTimeZone
+	}
+	return loc, nil
+}
+
+// DB Query to find the time zone to count the days of a device in.
+// The zone of the device is used if it has one, otherwise the zone of the user asking, otherwise UTC.
+// Zones are checked when they are set, so one that no longer loads is logged and the next one is used.
+func deviceLocation(db *pgxpool.Pool, userID int64, deviceID string) (*time.Location, error) {
+	var deviceZone, userZone *string
+	err := db.QueryRow(context.Background(), `SELECT
+		(SELECT time_zone FROM registered_devices WHERE device_id = $1),
+		(SELECT time_zone FROM auth WHERE id = $2)`, deviceID, userID).Scan(&deviceZone, &userZone)
+	if err != nil {
+		return nil, err
+	}
+	return pickLocation(deviceID, deviceZone, userZone), nil
+}
+
+// This function returns the first of the zones that is set and loads, or UTC.
+func pickLocation(deviceID string, zones ...*string) *time.Location {
+	for _, name := range zones {
+		if name == nil {
+			continue
+		}
+		loc, err := loadTimeZone(*name)
+		if err != nil {
+			log.Printf("time zone %q used by device %s: %s", *name, deviceID, err)
+			continue
+		}
+		return loc
+	}
+	return time.UTC
+}
+
+// DB Query to set the time zone of a user.
+// The database has to know the zone as well since it counts the days.
+func setUserTimeZone(db *pgxpool.Pool, userID int64, timeZone string) error {
+	tag, err := db.Exec(context.Background(), `UPDATE auth SET time_zone = $1 WHERE id = $2
+	AND EXISTS (SELECT 1 FROM pg_timezone_names WHERE name = $1)`, timeZone, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errInvalidTimeZone
+	}
+	return nil
+}
+
+// DB Query to set the time zone of a device, or go back to the zone of the user when it is nil.
+func setDeviceTimeZone(db *pgxpool.Pool, deviceID string, timeZone *string) error {
+	tag, err := db.Exec(context.Background(), `UPDATE registered_devices SET time_zone = $1 WHERE device_id = $2
+	AND ($1::text IS NULL OR EXISTS (SELECT 1 FROM pg_timezone_names WHERE name = $1))`, timeZone, deviceID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errInvalidTimeZone
+	}
+	return nil
+}
+
+// This function decodes a time zone request and checks the zone.
+func decodeTimeZone(w http.ResponseWriter, r *http.Request, allowEmpty bool) (TimeZone, bool) {
+	var request TimeZone
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+
+	if jsonDecoder(err, w) != nil {
+		return TimeZone{}, false
+	}
+	if request.TimeZone == "" && allowEmpty {
+		return request, true
+	}
+	if _, err := loadTimeZone(request.TimeZone); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return TimeZone{}, false
+	}
+	return request, true
+}
+
+// HTTP Call to set the time zone of the user
+func (api *API) changeTimeZone(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		request, ok := decodeTimeZone(w, r, false)
+		if !ok {
+			return
+		}
+
+		err := setUserTimeZone(api.db, currentUser(r).ID, request.TimeZone)
+		if err == errInvalidTimeZone {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HTTP Call to set the time zone of a device that is not where its owner is, an empty zone clears it
+func (api *API) changeDeviceTimeZone(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		request, ok := decodeTimeZone(w, r, true)
+		if !ok {
+			return
+		}
+		if !api.allowDevice(w, r, request.DeviceID, careDevice) {
+			return
+		}
+
+		var timeZone *string
+		if request.TimeZone != "" {
+			timeZone = &request.TimeZone
+		}
+		err := setDeviceTimeZone(api.db, request.DeviceID, timeZone)
+		if err == errInvalidTimeZone {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLoadTimeZone(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"America/Vancouver", true},
+		{"Asia/Kolkata", true},
+		{"UTC", true},
+		{"", false},
+		{"Local", false},
+		{"Mars/Olympus_Mons", false},
+		{"../../etc/passwd", false},
+	}
+
+	for _, test := range tests {
+		loc, err := loadTimeZone(test.name)
+		if test.ok && (err != nil || loc.String() != test.name) {
+			t.Errorf("%q: got %v %v", test.name, loc, err)
+		} else if !test.ok && err != errInvalidTimeZone {
+			t.Errorf("%q: got error %v, want %v", test.name, err, errInvalidTimeZone)
+		}
+	}
+}
+
+func TestPickLocation(t *testing.T) {
+	zone := func(name string) *string { return &name }
+	tests := []struct {
+		name  string
+		zones []*string
+		want  string
+	}{
+		{"device zone", []*string{zone("Europe/Paris"), zone("America/Vancouver")}, "Europe/Paris"},
+		{"user zone", []*string{nil, zone("America/Vancouver")}, "America/Vancouver"},
+		{"bad device zone", []*string{zone("Nowhere/Special"), zone("America/Vancouver")}, "America/Vancouver"},
+		{"nothing set", []*string{nil, nil}, "UTC"},
+		{"nothing loads", []*string{zone("Local"), zone("")}, "UTC"},
+	}
+
+	for _, test := range tests {
+		if got := pickLocation("probe", test.zones...); got.String() != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseTimeIn(t *testing.T) {
+	vancouver, err := time.LoadLocation("America/Vancouver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		value string
+		want  time.Time
+		err   bool
+	}{
+		{"2021-06-01", time.Date(2021, 6, 1, 7, 0, 0, 0, time.UTC), false},
+		// Midnight is an hour later in UTC once the clocks have gone back
+		{"2021-11-08", time.Date(2021, 11, 8, 8, 0, 0, 0, time.UTC), false},
+		{"2021-06-01T12:00:00Z", time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC), false},
+		{"2021-06-01T12:00:00+02:00", time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC), false},
+		{"2021-06-01 12:00", time.Time{}, true},
+		{"", time.Time{}, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseTimeIn(test.value, vancouver)
+		if (err != nil) != test.err || !got.Equal(test.want) {
+			t.Errorf("%q: got %s %v", test.value, got, err)
+		}
+	}
+}
+
+func TestChangeTimeZone(t *testing.T) {
+	api, _ := testAPI(t)
+	user := AuthUser{Username: uniqueName(t, "zoned")}
+	user.ID = createUser(t, api, user.Username, "correct horse battery")
+	deviceID := createDevice(t, api, user.ID)
+
+	location := func() string {
+		t.Helper()
+		loc, err := deviceLocation(api.db, user.ID, deviceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return loc.String()
+	}
+	if got := location(); got != "UTC" {
+		t.Errorf("with no zone set got %s", got)
+	}
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		request TimeZone
+		code    int
+		want    string
+	}{
+		{"user zone", api.changeTimeZone, TimeZone{TimeZone: "America/Vancouver"}, http.StatusNoContent, "America/Vancouver"},
+		{"unknown user zone", api.changeTimeZone, TimeZone{TimeZone: "Mars/Olympus_Mons"}, http.StatusBadRequest, "America/Vancouver"},
+		{"empty user zone", api.changeTimeZone, TimeZone{}, http.StatusBadRequest, "America/Vancouver"},
+		{"device zone", api.changeDeviceTimeZone, TimeZone{DeviceID: deviceID, TimeZone: "Europe/Paris"}, http.StatusNoContent, "Europe/Paris"},
+		{"unknown device zone", api.changeDeviceTimeZone, TimeZone{DeviceID: deviceID, TimeZone: "Local"}, http.StatusBadRequest, "Europe/Paris"},
+		{"cleared device zone", api.changeDeviceTimeZone, TimeZone{DeviceID: deviceID}, http.StatusNoContent, "America/Vancouver"},
+	}
+	for _, test := range tests {
+		w := doJSON(t, asUser(api, user, test.handler), "POST", "/api/account/time-zone", test.request, nil)
+		if w.Code != test.code {
+			t.Errorf("%s: got %d %s", test.name, w.Code, w.Body)
+		}
+		if got := location(); got != test.want {
+			t.Errorf("%s: days are counted in %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	// A zone that stopped loading after it was stored is passed over
+	_, err := api.db.Exec(context.Background(), `UPDATE registered_devices SET time_zone = 'Gone/Away' WHERE device_id = $1`, deviceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := location(); got != "America/Vancouver" {
+		t.Errorf("with a bad device zone got %s", got)
+	}
+}
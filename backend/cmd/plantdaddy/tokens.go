@@ -0,0 +1,110 @@
+package main
+
+// This file is used for signing and verifying the access tokens handed to the app
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var errInvalidToken = errors.New("invalid access token")
+var errExpiredToken = errors.New("access token has expired")
+var errRevokedToken = errors.New("access token has been revoked")
+
+// The header is always the same since we only ever sign with HS256.
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// The claims carried inside of an access token.
+type AccessClaims struct {
+	UserID    int64  `json:"uid"`
+	Username  string `json:"usr"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// Bumped on the user whenever every session is revoked, older tokens stop working straight away.
+	Version int64 `json:"ver"`
+	// Set on tokens that are only good for one step such as entering a two factor code.
+	// These are never accepted as access tokens.
+	Purpose string `json:"pur,omitempty"`
+}
+
+// This function signs the claims with the secret and returns a JWT compatible token.
+func signAccessToken(secret []byte, claims AccessClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// This function checks an access token and returns the claims inside of it.
+func verifyAccessToken(secret []byte, token string, now time.Time) (AccessClaims, error) {
+	return verifyPurposeToken(secret, token, "", now)
+}
+
+// This function checks the signature, expiry and purpose of a token and returns the claims inside of it.
+func verifyPurposeToken(secret []byte, token string, purpose string, now time.Time) (AccessClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return AccessClaims{}, errInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return AccessClaims{}, errInvalidToken
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return AccessClaims{}, errInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return AccessClaims{}, errInvalidToken
+	}
+
+	var claims AccessClaims
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&claims); err != nil || claims.UserID == 0 || claims.Purpose != purpose {
+		return AccessClaims{}, errInvalidToken
+	}
+
+	if now.Unix() >= claims.ExpiresAt {
+		return AccessClaims{}, errExpiredToken
+	}
+
+	return claims, nil
+}
+
+// This function creates a new access token for the user that expires after the given ttl.
+func newAccessToken(secret []byte, user AuthUser, ttl time.Duration) (AccessToken, error) {
+	now := time.Now().UTC()
+	token, err := signAccessToken(secret, AccessClaims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+		Version:   user.TokenVersion,
+	})
+	if err != nil {
+		return AccessToken{}, err
+	}
+
+	return AccessToken{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(ttl.Seconds()),
+	}, nil
+}
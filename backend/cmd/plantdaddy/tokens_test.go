@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyAccessToken(t *testing.T) {
+	secret := []byte("test secret")
+	now := time.Unix(1600000000, 0)
+	claims := AccessClaims{UserID: 7, Username: "fern", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Minute).Unix(), Version: 3}
+
+	valid, err := signAccessToken(secret, claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	purpose, err := signAccessToken(secret, AccessClaims{UserID: 7, ExpiresAt: claims.ExpiresAt, Purpose: "totp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noUser, err := signAccessToken(secret, AccessClaims{ExpiresAt: claims.ExpiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ".")
+	unknownField := tokenHeader + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"uid":7,"exp":1600000060,"admin":true}`))
+
+	tests := []struct {
+		name  string
+		token string
+		now   time.Time
+		err   error
+	}{
+		{"valid", valid, now, nil},
+		{"expired", valid, now.Add(time.Minute), errExpiredToken},
+		{"signed with another secret", resign([]byte("other"), parts[0]+"."+parts[1]), now, errInvalidToken},
+		{"tampered payload", parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"uid":1,"exp":1600000060}`)) + "." + parts[2], now, errInvalidToken},
+		{"other header", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "." + parts[2], now, errInvalidToken},
+		{"missing signature", parts[0] + "." + parts[1], now, errInvalidToken},
+		{"bad signature encoding", parts[0] + "." + parts[1] + ".!!", now, errInvalidToken},
+		{"purpose token", purpose, now, errInvalidToken},
+		{"no user", noUser, now, errInvalidToken},
+		{"unknown claim", resign(secret, unknownField), now, errInvalidToken},
+		{"empty", "", now, errInvalidToken},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := verifyAccessToken(secret, test.token, test.now)
+			if err != test.err {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if err == nil && got != claims {
+				t.Errorf("got claims %+v, want %+v", got, claims)
+			}
+		})
+	}
+}
+
+func TestVerifyPurposeToken(t *testing.T) {
+	secret := []byte("test secret")
+	now := time.Unix(1600000000, 0)
+	token, err := signAccessToken(secret, AccessClaims{UserID: 7, ExpiresAt: now.Add(time.Minute).Unix(), Purpose: "totp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := verifyPurposeToken(secret, token, "totp", now); err != nil {
+		t.Errorf("got error %v for the right purpose", err)
+	}
+	if _, err := verifyPurposeToken(secret, token, "reset", now); err != errInvalidToken {
+		t.Errorf("got error %v for another purpose, want %v", err, errInvalidToken)
+	}
+}
+
+func TestNewAccessTokenCarriesVersion(t *testing.T) {
+	secret := []byte("test secret")
+	token, err := newAccessToken(secret, AuthUser{ID: 7, Username: "fern", TokenVersion: 5}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token.TokenType != "Bearer" || token.ExpiresIn != 60 {
+		t.Errorf("got %s token expiring in %d", token.TokenType, token.ExpiresIn)
+	}
+
+	claims, err := verifyAccessToken(secret, token.AccessToken, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != 7 || claims.Username != "fern" || claims.Version != 5 {
+		t.Errorf("got claims %+v", claims)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"Bearer abc.def.ghi", "abc.def.ghi"},
+		{"bearer abc", "abc"},
+		{"Bearer   abc  ", "abc"},
+		{"Basic abc", ""},
+		{"Bearer", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/api/devices", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		if got := bearerToken(r); got != test.want {
+			t.Errorf("bearerToken(%q) = %q, want %q", test.header, got, test.want)
+		}
+	}
+}
+
+// resign signs the header and payload of a token with the secret.
+func resign(secret []byte, unsigned string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,452 @@
+package main
+
+// This file handles two factor logins with time based one time passwords (RFC 6238)
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const totpIssuer = "Plant Daddy"
+const totpPeriod = 30
+const totpDigits = 6
+
+// How many steps either side of now a code is still accepted for, to allow for clock drift.
+const totpSkew = 1
+
+const recoveryCodeCount = 10
+
+// How long the user has to enter their code after their password was accepted.
+const mfaTokenTTL = 5 * time.Minute
+
+const mfaPurpose = "mfa"
+
+var errTOTPEnabled = errors.New("two factor authentication is already enabled")
+var errTOTPNotEnrolled = errors.New("two factor authentication has not been set up")
+var errInvalidCode = errors.New("code is invalid")
+var errWrongPassword = errors.New("password is incorrect")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// This function creates a new random base32 encoded secret.
+func generateTOTPSecret() (string, error) {
+	b, err := generateRandomBytes(20)
+	if err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// This function calculates the code for the secret at a given time step.
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// This function returns the time step the code matches, only steps after lastStep are accepted
+// so that a code cannot be used twice.
+func matchTOTP(secret string, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// This function builds the uri authenticator apps read from a QR code.
+func otpauthURI(username string, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// This function creates recovery codes in the form xxxxx-xxxxx.
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b, err := generateRandomBytes(7)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+// This function puts a recovery code in the form it was hashed in.
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	if len(code) != 10 {
+		return code
+	}
+	return code[:5] + "-" + code[5:]
+}
+
+// DB Query to check if the user has to enter a code when logging in.
+func totpEnabled(db *pgxpool.Pool, userID int64) (bool, error) {
+	var enabled bool
+	err := db.QueryRow(context.Background(), `SELECT totp_enabled FROM auth WHERE id = $1`, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// DB Query to store a new secret that is not used until it is confirmed.
+func enrollTOTP(db *pgxpool.Pool, userID int64) (string, error) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	tag, err := db.Exec(context.Background(), `UPDATE auth SET totp_secret = $1, totp_last_step = NULL
+	WHERE id = $2 AND NOT totp_enabled`, secret, userID)
+	if err != nil {
+		return "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return "", errTOTPEnabled
+	}
+	return secret, nil
+}
+
+// DB Query to check a code or recovery code for the user.
+// A code can only be used once, as can each recovery code.
+func checkSecondFactor(ctx context.Context, tx pgx.Tx, userID int64, code string, allowRecovery bool) error {
+	var secret *string
+	var lastStep *int64
+	row := tx.QueryRow(ctx, `SELECT totp_secret, totp_last_step FROM auth WHERE id = $1 FOR UPDATE`, userID)
+	if err := row.Scan(&secret, &lastStep); err != nil {
+		return err
+	}
+	if secret == nil {
+		return errTOTPNotEnrolled
+	}
+
+	last := int64(-1)
+	if lastStep != nil {
+		last = *lastStep
+	}
+	if step, ok := matchTOTP(*secret, strings.TrimSpace(code), last, time.Now()); ok {
+		_, err := tx.Exec(ctx, `UPDATE auth SET totp_last_step = $1 WHERE id = $2`, step, userID)
+		return err
+	}
+
+	if allowRecovery {
+		tag, err := tx.Exec(ctx, `UPDATE recovery_code SET used_at = $1
+		WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL`, time.Now().UTC(), userID, hashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 1 {
+			return nil
+		}
+	}
+	return errInvalidCode
+}
+
+// DB Query to turn on two factor authentication once the user has shown they can create codes.
+// The recovery codes are returned in plain text, only their hashes are stored.
+func confirmTOTP(db *pgxpool.Pool, userID int64, code string) ([]string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var enabled bool
+	if err := tx.QueryRow(ctx, `SELECT totp_enabled FROM auth WHERE id = $1`, userID).Scan(&enabled); err != nil {
+		return nil, err
+	}
+	if enabled {
+		return nil, errTOTPEnabled
+	}
+	if err := checkSecondFactor(ctx, tx, userID, code, false); err != nil {
+		return nil, err
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_code WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(ctx, `INSERT INTO recovery_code(user_id, code_hash) VALUES ($1, $2)`, userID, hashToken(code)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(ctx, `UPDATE auth SET totp_enabled = true WHERE id = $1`, userID); err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit(ctx)
+}
+
+// DB Query to turn off two factor authentication after checking the password and a code.
+func disableTOTP(db *pgxpool.Pool, userID int64, password string, code string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var hashed string
+	if err := tx.QueryRow(ctx, `SELECT password FROM auth WHERE id = $1 FOR UPDATE`, userID).Scan(&hashed); err != nil {
+		return err
+	}
+	if !CheckPasswordHash(password, hashed) {
+		return errWrongPassword
+	}
+	if err := checkSecondFactor(ctx, tx, userID, code, true); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE auth SET totp_enabled = false, totp_secret = NULL, totp_last_step = NULL WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM recovery_code WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	if err := bumpTokenVersion(ctx, tx, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DB Query to check the code entered during login.
+func verifyLoginCode(db *pgxpool.Pool, userID int64, code string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := checkSecondFactor(ctx, tx, userID, code, true); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// This function either hands out tokens or, if the user has two factor authentication turned on,
+// a short lived token that must be sent back to /api/login/2fa with a code.
+// The factor is how the user proved who they are so far, such as "password".
+func (api *API) completeLogin(w http.ResponseWriter, r *http.Request, user AuthUser, factor string) {
+	enabled, err := totpEnabled(api.db, user.ID)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if !enabled {
+		api.audit(r, AuditEvent{ActorID: user.ID, Action: auditLogin, After: map[string]string{"factor": factor}})
+		api.issueTokens(w, r, user)
+		return
+	}
+
+	now := time.Now().UTC()
+	token, err := signAccessToken(api.tokenSecret, AccessClaims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(mfaTokenTTL).Unix(),
+		Purpose:   mfaPurpose,
+	})
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(MFAChallenge{MFARequired: true, MFAToken: token, ExpiresIn: int64(mfaTokenTTL.Seconds())})
+}
+
+// This function decodes the code sent to the two factor endpoints.
+func decodeTOTPCode(w http.ResponseWriter, r *http.Request) (TOTPCode, bool) {
+	var request TOTPCode
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&request)
+
+	if jsonDecoder(err, w) != nil {
+		return TOTPCode{}, false
+	}
+	if request.Code == "" {
+		http.Error(w, "Must provide code", http.StatusBadRequest)
+		return TOTPCode{}, false
+	}
+	return request, true
+}
+
+// this function writes the error from a two factor query
+func totpError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTOTPEnabled):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errTOTPNotEnrolled):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errInvalidCode), errors.Is(err, errWrongPassword):
+		unauthorized(w, err.Error())
+	default:
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// The limiter keys for guessing the codes of an account. Logging in, turning two factor authentication
+// on and turning it off share one count so none of them can be used to keep guessing.
+func mfaKeys(userID int64) map[string]LockoutPolicy {
+	return map[string]LockoutPolicy{fmt.Sprintf("mfa:%d", userID): accountLockout}
+}
+
+// HTTP Call to finish logging in with the token from /api/login and a code or recovery code
+func (api *API) logInSecondFactor(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var request MFALogin
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+
+		claims, err := verifyPurposeToken(api.tokenSecret, request.MFAToken, mfaPurpose, time.Now())
+		if err != nil {
+			unauthorized(w, err.Error())
+			return
+		}
+
+		keys := mfaKeys(claims.UserID)
+		if !api.allowLoginAttempt(w, r, keys) {
+			return
+		}
+
+		if err := verifyLoginCode(api.db, claims.UserID, request.Code); err != nil {
+			if errors.Is(err, errInvalidCode) {
+				api.audit(r, AuditEvent{UserID: claims.UserID, Action: auditLoginFailed, After: map[string]string{"factor": "totp"}})
+			}
+			totpError(w, err)
+			return
+		}
+
+		api.recordLoginSuccess(r, keys)
+		api.audit(r, AuditEvent{ActorID: claims.UserID, Action: auditLogin, After: map[string]string{"factor": "totp"}})
+		api.issueTokens(w, r, AuthUser{ID: claims.UserID, Username: claims.Username})
+	}
+}
+
+// HTTP Call to start setting up two factor authentication
+func (api *API) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		user := currentUser(r)
+		secret, err := enrollTOTP(api.db, user.ID)
+		if err != nil {
+			totpError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(TOTPEnrollment{Secret: secret, URI: otpauthURI(user.Username, secret)})
+	}
+}
+
+// HTTP Call to turn on two factor authentication with a code from the authenticator app
+func (api *API) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		request, ok := decodeTOTPCode(w, r)
+		if !ok {
+			return
+		}
+
+		user := currentUser(r)
+		keys := mfaKeys(user.ID)
+		if !api.allowLoginAttempt(w, r, keys) {
+			return
+		}
+
+		codes, err := confirmTOTP(api.db, user.ID, request.Code)
+		if err != nil {
+			totpError(w, err)
+			return
+		}
+		api.recordLoginSuccess(r, keys)
+		api.audit(r, AuditEvent{Action: auditTOTPEnabled})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(RecoveryCodes{RecoveryCodes: codes})
+	}
+}
+
+// HTTP Call to turn off two factor authentication with the password and a code or recovery code
+func (api *API) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var request DisableTOTP
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+		if request.Password == "" || request.Code == "" {
+			http.Error(w, "Must provide password and code", http.StatusBadRequest)
+			return
+		}
+
+		user := currentUser(r)
+		keys := mfaKeys(user.ID)
+		if !api.allowLoginAttempt(w, r, keys) {
+			return
+		}
+
+		if err := disableTOTP(api.db, user.ID, request.Password, request.Code); err != nil {
+			totpError(w, err)
+			return
+		}
+		api.recordLoginSuccess(r, keys)
+		api.audit(r, AuditEvent{Action: auditTOTPDisabled})
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors of RFC 6238, cut to six digits.
+func TestTOTPCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, test := range tests {
+		if got := totpCode(secret, test.unix/totpPeriod); got != test.want {
+			t.Errorf("code at %d = %s, want %s", test.unix, got, test.want)
+		}
+	}
+}
+
+func TestMatchTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+	key := []byte("12345678901234567890")
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		step     int64
+		ok       bool
+	}{
+		{"current code", secret, totpCode(key, step), -1, step, true},
+		{"lower case secret", strings.ToLower(secret), totpCode(key, step), -1, step, true},
+		{"previous step", secret, totpCode(key, step-1), -1, step - 1, true},
+		{"next step", secret, totpCode(key, step+1), -1, step + 1, true},
+		{"too old", secret, totpCode(key, step-2), -1, 0, false},
+		{"too new", secret, totpCode(key, step+2), -1, 0, false},
+		{"already used", secret, totpCode(key, step), step, 0, false},
+		{"newer than the last used", secret, totpCode(key, step+1), step, step + 1, true},
+		{"wrong code", secret, "000000", -1, 0, false},
+		{"short code", secret, totpCode(key, step)[:5], -1, 0, false},
+		{"bad secret", "not base32!", totpCode(key, step), -1, 0, false},
+	}
+
+	for _, test := range tests {
+		got, ok := matchTOTP(test.secret, test.code, test.lastStep, now)
+		if ok != test.ok || got != test.step {
+			t.Errorf("%s: got step %d %t, want %d %t", test.name, got, ok, test.step, test.ok)
+		}
+	}
+}
+
+func TestOtpauthURI(t *testing.T) {
+	uri, err := url.Parse(otpauthURI("fern lover", "ABCDEF"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Plant Daddy:fern lover" {
+		t.Errorf("got uri %s", uri)
+	}
+	query := uri.Query()
+	if query.Get("secret") != "ABCDEF" || query.Get("issuer") != totpIssuer || query.Get("digits") != "6" || query.Get("period") != "30" {
+		t.Errorf("got query %s", uri.RawQuery)
+	}
+}
+
+var recoveryCodePattern = regexp.MustCompile(`^[a-z2-7]{5}-[a-z2-7]{5}$`)
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if !recoveryCodePattern.MatchString(code) {
+			t.Errorf("code %q is not in the form xxxxx-xxxxx", code)
+		}
+		if seen[code] {
+			t.Errorf("code %q was handed out twice", code)
+		}
+		seen[code] = true
+		if normalizeRecoveryCode(code) != code {
+			t.Errorf("code %q changes when normalized", code)
+		}
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"abcde-fghij", "abcde-fghij"},
+		{"ABCDE-FGHIJ", "abcde-fghij"},
+		{"abcdefghij", "abcde-fghij"},
+		{" abcde-fghij\n", "abcde-fghij"},
+		{"ab-cde-fg-hij", "abcde-fghij"},
+		{"abcde", "abcde"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeRecoveryCode(test.code); got != test.want {
+			t.Errorf("normalizeRecoveryCode(%q) = %q, want %q", test.code, got, test.want)
+		}
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	api, _ := testAPI(t)
+	username := uniqueName(t, "totp")
+	password := "correct horse battery"
+	user := AuthUser{ID: createUser(t, api, username, password), Username: username}
+
+	w := doJSON(t, asUser(api, user, api.enrollTOTP), "POST", "/api/account/2fa/enroll", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("enroll: %d %s", w.Code, w.Body)
+	}
+	var enrollment TOTPEnrollment
+	if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil {
+		t.Fatal(err)
+	}
+	key, err := totpEncoding.DecodeString(enrollment.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+
+	w = doJSON(t, asUser(api, user, api.confirmTOTP), "POST", "/api/account/2fa/confirm", TOTPCode{Code: code}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("confirm: %d %s", w.Code, w.Body)
+	}
+	var recovery RecoveryCodes
+	if err := json.NewDecoder(w.Body).Decode(&recovery); err != nil {
+		t.Fatal(err)
+	}
+
+	w = doJSON(t, api.logInApp, "POST", "/api/login", UserPass{Username: username, Password: password}, nil)
+	var challenge MFAChallenge
+	if err := json.NewDecoder(w.Body).Decode(&challenge); err != nil || !challenge.MFARequired {
+		t.Fatalf("login did not ask for a code: %d %v", w.Code, err)
+	}
+
+	// The code used to confirm cannot be used again
+	w = doJSON(t, api.logInSecondFactor, "POST", "/api/login/2fa", MFALogin{MFAToken: challenge.MFAToken, Code: code}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a used code got %d", w.Code)
+	}
+
+	w = doJSON(t, api.logInSecondFactor, "POST", "/api/login/2fa", MFALogin{MFAToken: challenge.MFAToken, Code: strings.ToUpper(recovery.RecoveryCodes[0])}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("recovery code: %d %s", w.Code, w.Body)
+	}
+	w = doJSON(t, api.logInSecondFactor, "POST", "/api/login/2fa", MFALogin{MFAToken: challenge.MFAToken, Code: recovery.RecoveryCodes[0]}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("a used recovery code got %d", w.Code)
+	}
+
+	// Turning it off takes the password as well as a code
+	disable := asUser(api, user, api.disableTOTP)
+	w = doJSON(t, disable, "POST", "/api/account/2fa/disable", DisableTOTP{Code: recovery.RecoveryCodes[1]}, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("disabling without the password got %d", w.Code)
+	}
+	w = doJSON(t, disable, "POST", "/api/account/2fa/disable", DisableTOTP{Password: "wrong", Code: recovery.RecoveryCodes[1]}, nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("disabling with the wrong password got %d", w.Code)
+	}
+	w = doJSON(t, disable, "POST", "/api/account/2fa/disable", DisableTOTP{Password: password, Code: recovery.RecoveryCodes[1]}, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("disable: %d %s", w.Code, w.Body)
+	}
+	if enabled, err := totpEnabled(api.db, user.ID); err != nil || enabled {
+		t.Errorf("two factor authentication is still on: %v", err)
+	}
+}
+
+func TestTwoFactorCodeGuessing(t *testing.T) {
+	api, _ := testAPI(t)
+	username := uniqueName(t, "totp")
+	password := "correct horse battery"
+	user := AuthUser{ID: createUser(t, api, username, password), Username: username}
+	if w := doJSON(t, asUser(api, user, api.enrollTOTP), "POST", "/api/account/2fa/enroll", nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("enroll: %d %s", w.Code, w.Body)
+	}
+
+	// Turning two factor authentication on and off share the count of wrong codes with logging in
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    interface{}
+	}{
+		{"confirm", asUser(api, user, api.confirmTOTP), TOTPCode{Code: "000000"}},
+		{"disable", asUser(api, user, api.disableTOTP), DisableTOTP{Password: password, Code: "000000"}},
+	}
+	for _, test := range tests {
+		api.loginLimiter = NewMemoryLoginLimiter()
+		for i := 0; i <= accountLockout.FreeAttempts; i++ {
+			doJSON(t, test.handler, "POST", "/api/account/2fa/"+test.name, test.body, nil)
+		}
+		w := doJSON(t, test.handler, "POST", "/api/account/2fa/"+test.name, test.body, nil)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("%s: a guess after %d wrong codes got %d", test.name, accountLockout.FreeAttempts+1, w.Code)
+		}
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+// This file handles handing a device over to another user
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// How long the new owner has to accept a transfer.
+const transferTTL = 7 * 24 * time.Hour
+
+// How long the code a probe shows after a factory reset can be used for.
+const resetClaimTTL = time.Hour
+
+var errTransferNotFound = errors.New("transfer not found or has expired")
+var errTransferToSelf = errors.New("cannot transfer a device to yourself")
+var errInvalidClaimCode = errors.New("claim code is invalid or has expired")
+
+// DB Query to move a device to a new owner inside of a transaction.
+// The device is taken out of its household, given a new secret and its session is dropped
+// so that whoever held it before cannot keep sending data as it.
+func moveDevice(ctx context.Context, tx pgx.Tx, deviceID string, userID int64, keepHistory bool) (string, error) {
+	secret, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(ctx, `UPDATE registered_devices SET user_id = $1, household_id = NULL, device_secret = $2, register_date = $3
+	WHERE device_id = $4`, userID, secret, time.Now().UTC(), deviceID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM session WHERE device_id = $1`, deviceID); err != nil {
+		return "", err
+	}
+	if !keepHistory {
+		if _, err := tx.Exec(ctx, `DELETE FROM plant_data WHERE device_id = $1`, deviceID); err != nil {
+			return "", err
+		}
+	}
+	return secret, nil
+}
+
+// DB Query to offer a device to another user.
+// Only the user who registered the device can offer it, since only they can accept on its behalf.
+func insertTransfer(db *pgxpool.Pool, userID int64, transfer NewTransfer) error {
+	ctx := context.Background()
+	var toUserID int64
+	err := db.QueryRow(ctx, `SELECT id FROM auth WHERE LOWER(username) = LOWER($1)`, transfer.Username).Scan(&toUserID)
+	if err == pgx.ErrNoRows {
+		return errUserNotFound
+	} else if err != nil {
+		return err
+	}
+	if toUserID == userID {
+		return errTransferToSelf
+	}
+
+	now := time.Now().UTC()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Only one transfer can be waiting for a device at a time
+	_, err = tx.Exec(ctx, `UPDATE device_transfer SET cancelled_at = $1
+	WHERE device_id = $2 AND accepted_at IS NULL AND cancelled_at IS NULL`, now, transfer.DeviceID)
+	if err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, `INSERT INTO device_transfer(device_id, from_user_id, to_user_id, keep_history, created_at, expires_at)
+	SELECT r.device_id, r.user_id, $3, $4, $5, $6 FROM registered_devices r WHERE r.device_id = $1 AND r.user_id = $2`,
+		transfer.DeviceID, userID, toUserID, transfer.KeepHistory, now, now.Add(transferTTL))
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errForbidden
+	}
+	return tx.Commit(ctx)
+}
+
+// DB Query to get the transfers waiting for the user to accept.
+func getTransfersDB(db *pgxpool.Pool, userID int64) ([]Transfer, error) {
+	rows, err := db.Query(context.Background(), `SELECT t.id, t.device_id, r.device_name, a.username, t.keep_history, t.expires_at
+	FROM device_transfer t
+	INNER JOIN registered_devices r ON r.device_id = t.device_id
+	INNER JOIN auth a ON a.id = t.from_user_id
+	WHERE t.to_user_id = $1 AND t.accepted_at IS NULL AND t.cancelled_at IS NULL AND t.expires_at > $2
+	ORDER BY t.created_at`, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []Transfer{}
+	for rows.Next() {
+		var transfer Transfer
+		err := rows.Scan(&transfer.ID, &transfer.DeviceID, &transfer.DeviceName, &transfer.From,
+			&transfer.KeepHistory, &transfer.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, transfer)
+	}
+	return transfers, rows.Err()
+}
+
+// DB Query to accept or decline a transfer offered to the user.
+// On accepting the new device secret is returned so that the probe can be provisioned again.
+func answerTransfer(db *pgxpool.Pool, userID int64, transferID int64, accept bool) (DeviceCredentials, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return DeviceCredentials{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+	var deviceID string
+	var keepHistory bool
+	// The transfer only counts if the person who offered it still owns the device
+	err = tx.QueryRow(ctx, `SELECT t.device_id, t.keep_history FROM device_transfer t
+	INNER JOIN registered_devices r ON r.device_id = t.device_id AND r.user_id = t.from_user_id
+	WHERE t.id = $1 AND t.to_user_id = $2 AND t.accepted_at IS NULL AND t.cancelled_at IS NULL AND t.expires_at > $3
+	FOR UPDATE OF t, r`, transferID, userID, now).Scan(&deviceID, &keepHistory)
+	if err == pgx.ErrNoRows {
+		return DeviceCredentials{}, errTransferNotFound
+	} else if err != nil {
+		return DeviceCredentials{}, err
+	}
+
+	if !accept {
+		if _, err := tx.Exec(ctx, `UPDATE device_transfer SET cancelled_at = $1 WHERE id = $2`, now, transferID); err != nil {
+			return DeviceCredentials{}, err
+		}
+		return DeviceCredentials{}, tx.Commit(ctx)
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE device_transfer SET accepted_at = $1 WHERE id = $2`, now, transferID); err != nil {
+		return DeviceCredentials{}, err
+	}
+	secret, err := moveDevice(ctx, tx, deviceID, userID, keepHistory)
+	if err != nil {
+		return DeviceCredentials{}, err
+	}
+	return DeviceCredentials{DeviceID: deviceID, DeviceSecret: secret}, tx.Commit(ctx)
+}
+
+// DB Query to create the claim code a probe shows after it has been factory reset.
+func insertResetClaim(db *pgxpool.Pool, deviceID string) (string, error) {
+	code, err := newClaimCode()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	// Older reset codes stop working once a new one is made
+	_, err = tx.Exec(ctx, `UPDATE device_claim SET used_at = $1
+	WHERE device_id = $2 AND source = 'reset' AND used_at IS NULL`, now, deviceID)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(ctx, `INSERT INTO device_claim(device_id, code_hash, source, created_at, expires_at)
+	VALUES ($1, $2, 'reset', $3, $4)`, deviceID, hashToken(normalizeClaimCode(code)), now, now.Add(resetClaimTTL))
+	if err != nil {
+		return "", err
+	}
+	return code, tx.Commit(ctx)
+}
+
+// DB Query to claim a device that was factory reset using the code it showed.
+// History is only kept if the device is being claimed back by the same user.
+func claimResetDevice(db *pgxpool.Pool, userID int64, claim ClaimDevice) (DeviceCredentials, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return DeviceCredentials{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+	var claimID int64
+	var ownerID *int64
+	err = tx.QueryRow(ctx, `SELECT c.id, r.user_id FROM device_claim c
+	INNER JOIN registered_devices r ON r.device_id = c.device_id
+	WHERE c.device_id = $1 AND c.code_hash = $2 AND c.source = 'reset' AND c.used_at IS NULL AND c.expires_at > $3
+	FOR UPDATE OF c, r`, claim.DeviceID, hashToken(normalizeClaimCode(claim.ClaimCode)), now).Scan(&claimID, &ownerID)
+	if err == pgx.ErrNoRows {
+		return DeviceCredentials{}, errInvalidClaimCode
+	} else if err != nil {
+		return DeviceCredentials{}, err
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE device_claim SET used_at = $1 WHERE id = $2`, now, claimID); err != nil {
+		return DeviceCredentials{}, err
+	}
+	sameOwner := ownerID != nil && *ownerID == userID
+	secret, err := moveDevice(ctx, tx, claim.DeviceID, userID, sameOwner)
+	if err != nil {
+		return DeviceCredentials{}, err
+	}
+	if claim.DeviceName != "" {
+		if _, err := tx.Exec(ctx, `UPDATE registered_devices SET device_name = $1 WHERE device_id = $2`, claim.DeviceName, claim.DeviceID); err != nil {
+			return DeviceCredentials{}, err
+		}
+	}
+	return DeviceCredentials{DeviceID: claim.DeviceID, DeviceSecret: secret}, tx.Commit(ctx)
+}
+
+// This function creates a short code that is easy to read off a screen or type in, in the form XXXX-XXXX.
+func newClaimCode() (string, error) {
+	b, err := generateRandomBytes(5)
+	if err != nil {
+		return "", err
+	}
+	code := totpEncoding.EncodeToString(b)
+	return code[:4] + "-" + code[4:], nil
+}
+
+// This function puts a claim code in the form it was hashed in.
+func normalizeClaimCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// this function writes the error from a transfer query
+func transferError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUserNotFound), errors.Is(err, errTransferNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errTransferToSelf), errors.Is(err, errInvalidClaimCode):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errForbidden):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		log.Printf("%s", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	}
+}
+
+// HTTP Call to offer a device to another user
+func (api *API) transferDevice(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var request NewTransfer
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+		if !api.allowDevice(w, r, request.DeviceID, manageDevice) {
+			return
+		}
+
+		if err := insertTransfer(api.db, currentUser(r).ID, request); err != nil {
+			transferError(w, err)
+			return
+		}
+		api.audit(r, AuditEvent{Action: auditDeviceTransfer, DeviceID: request.DeviceID, After: request})
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// HTTP Call to list the transfers waiting for the user
+func (api *API) getTransfers(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "GET" {
+		transfers, err := getTransfersDB(api.db, currentUser(r).ID)
+		if err != nil {
+			transferError(w, err)
+			return
+		}
+		json.NewEncoder(w).Encode(transfers)
+	}
+}
+
+// This function returns a handler that accepts or declines a transfer
+func (api *API) answerTransfer(accept bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		if r.Method == "POST" {
+			var request TransferAnswer
+			decoder := json.NewDecoder(r.Body)
+			decoder.DisallowUnknownFields()
+			err := decoder.Decode(&request)
+
+			if jsonDecoder(err, w) != nil {
+				return
+			}
+
+			credentials, err := answerTransfer(api.db, currentUser(r).ID, request.TransferID, accept)
+			if err != nil {
+				transferError(w, err)
+				return
+			}
+			if !accept {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			api.audit(r, AuditEvent{Action: auditDeviceAccepted, DeviceID: credentials.DeviceID, After: request})
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			json.NewEncoder(w).Encode(credentials)
+		}
+	}
+}
+
+// HTTP call for a probe that is being factory reset, it returns the code the next owner claims it with.
+// The body must be signed with the device secret.
+func (api *API) resetDevice(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var login Login
+		if !api.decodeSignedDeviceRequest(w, r, &login, func() string { return login.DeviceID }) {
+			return
+		}
+
+		if err := useDeviceNonce(api.db, login); errors.Is(err, errStaleRequest) {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		code, err := insertResetClaim(api.db, login.DeviceID)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(ClaimCode{DeviceID: login.DeviceID, ClaimCode: code, ExpiresIn: int64(resetClaimTTL.Seconds())})
+	}
+}
+
+// HTTP Call to claim a factory reset probe with the code it showed
+func (api *API) claimDevice(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var request ClaimDevice
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+
+		// Claim codes are short so guesses are throttled like passwords
+		keys := api.claimKeys(r, currentUser(r).ID, request.DeviceID)
+		if !api.allowLoginAttempt(w, r, keys) {
+			return
+		}
+
+		credentials, err := claimResetDevice(api.db, currentUser(r).ID, request)
+		if err != nil {
+			transferError(w, err)
+			return
+		}
+		api.recordLoginSuccess(r, keys)
+		api.audit(r, AuditEvent{Action: auditDeviceClaim, DeviceID: request.DeviceID,
+			After: map[string]string{"deviceName": request.DeviceName}})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(credentials)
+	}
+}
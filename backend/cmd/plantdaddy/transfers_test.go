@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeClaimCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"ABCD-EFGH", "ABCDEFGH"},
+		{"abcd-efgh", "ABCDEFGH"},
+		{" abcdefgh\n", "ABCDEFGH"},
+		{"ab-cd-ef-gh", "ABCDEFGH"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeClaimCode(test.code); got != test.want {
+			t.Errorf("normalizeClaimCode(%q) = %q, want %q", test.code, got, test.want)
+		}
+	}
+}
+
+func TestNewClaimCode(t *testing.T) {
+	code, err := newClaimCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 9 || code[4] != '-' {
+		t.Errorf("got claim code %q", code)
+	}
+	if normalizeClaimCode(code) != code[:4]+code[5:] {
+		t.Errorf("claim code %q is not normalized", code)
+	}
+}
+
+// Someone guessing the claim code of a device must not lock its owner out of claiming it.
+func TestClaimGuessesDoNotLockOutOthers(t *testing.T) {
+	api := &API{loginLimiter: NewMemoryLoginLimiter()}
+	guess := func(userID int64, remote string) int {
+		r := httptest.NewRequest("POST", "/api/devices/claim", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		api.allowLoginAttempt(w, r, api.claimKeys(r, userID, "device-1"))
+		return w.Code
+	}
+
+	for i := 0; i <= accountLockout.FreeAttempts; i++ {
+		guess(1, "192.0.2.1:1234")
+	}
+	if code := guess(1, "192.0.2.1:1234"); code != http.StatusTooManyRequests {
+		t.Errorf("the guesser got %d, want %d", code, http.StatusTooManyRequests)
+	}
+	if code := guess(2, "198.51.100.7:1234"); code != http.StatusOK {
+		t.Errorf("the owner got %d after someone else guessed", code)
+	}
+}
+
+func TestTransferDevice(t *testing.T) {
+	api, _ := testAPI(t)
+	registrant := AuthUser{Username: uniqueName(t, "registrant")}
+	registrant.ID = createUser(t, api, registrant.Username, "correct horse battery")
+	coOwner := AuthUser{Username: uniqueName(t, "coowner")}
+	coOwner.ID = createUser(t, api, coOwner.Username, "correct horse battery")
+	buyer := AuthUser{Username: uniqueName(t, "buyer")}
+	buyer.ID = createUser(t, api, buyer.Username, "correct horse battery")
+
+	setUpHousehold(t, api, registrant, coOwner, roleOwner)
+	deviceID := createDevice(t, api, registrant.ID)
+
+	// A transfer offered by anyone but the registrant could never be accepted
+	err := insertTransfer(api.db, coOwner.ID, NewTransfer{DeviceID: deviceID, Username: buyer.Username})
+	if err != errForbidden {
+		t.Errorf("a transfer from a household owner got %v, want %v", err, errForbidden)
+	}
+
+	w := doJSON(t, asUser(api, registrant, api.transferDevice), "POST", "/api/devices/transfer",
+		NewTransfer{DeviceID: deviceID, Username: buyer.Username}, nil)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("transfer: %d %s", w.Code, w.Body)
+	}
+	transfers, err := getTransfersDB(api.db, buyer.ID)
+	if err != nil || len(transfers) != 1 || transfers[0].From != registrant.Username {
+		t.Fatalf("got transfers %+v: %v", transfers, err)
+	}
+
+	w = doJSON(t, asUser(api, buyer, api.answerTransfer(true)), "POST", "/api/devices/transfer/accept",
+		TransferAnswer{TransferID: transfers[0].ID}, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("accept: %d %s", w.Code, w.Body)
+	}
+	var credentials DeviceCredentials
+	if err := json.NewDecoder(w.Body).Decode(&credentials); err != nil || credentials.DeviceSecret == "" {
+		t.Fatalf("got credentials %+v: %v", credentials, err)
+	}
+	if ownerID, _, err := getDeviceState(api.db, deviceID); err != nil || ownerID != buyer.ID {
+		t.Errorf("the device belongs to %d: %v", ownerID, err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+// This file handles verifying the email addresses users sign up with
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+var errInvalidVerificationToken = errors.New("verification link is invalid or has expired")
+var errAlreadyVerified = errors.New("email has already been verified")
+var errInvalidEmail = errors.New("email must be an address such as fern@example.com")
+
+// This function checks the email a user signs up with is a bare address and returns it without surrounding spaces.
+// Addresses with a name or angle brackets are turned down, so the address stored is the one mail is sent to
+// and the one the user logs in with.
+func parseEmail(input string) (string, error) {
+	addr, err := mail.ParseAddress(input)
+	if err != nil || addr.Name != "" || addr.Address != strings.TrimSpace(input) {
+		return "", errInvalidEmail
+	}
+	return addr.Address, nil
+}
+
+// DB Query to create a verification token for the current email of the user.
+func insertEmailVerification(ctx context.Context, tx pgx.Tx, userID int64, email string, ttl time.Duration) (string, error) {
+	token, err := newOpaqueToken()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(ctx, `INSERT INTO email_verification(user_id, email, token_hash, created_at, expires_at)
+	VALUES ($1, $2, $3, $4, $5)`, userID, email, hashToken(token), now, now.Add(ttl))
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// DB Query to create a new verification token for a user that has not verified their email yet.
+func resendEmailVerification(db *pgxpool.Pool, userID int64, ttl time.Duration) (string, string, error) {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	defer tx.Rollback(ctx)
+
+	var email string
+	var verified bool
+	row := tx.QueryRow(ctx, `SELECT email, email_verified FROM auth WHERE id = $1 AND email IS NOT NULL`, userID)
+	if err := row.Scan(&email, &verified); err != nil {
+		return "", "", err
+	}
+	if verified {
+		return "", "", errAlreadyVerified
+	}
+
+	token, err := insertEmailVerification(ctx, tx, userID, email, ttl)
+	if err != nil {
+		return "", "", err
+	}
+	return token, email, tx.Commit(ctx)
+}
+
+// DB Query to use up a verification token and mark the email as verified.
+// The token only counts if the user still has the email it was sent to.
+func verifyEmail(db *pgxpool.Pool, token string) error {
+	ctx := context.Background()
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	now := time.Now().UTC()
+	var id, userID int64
+	row := tx.QueryRow(ctx, `SELECT v.id, v.user_id FROM email_verification v
+	INNER JOIN auth a ON a.id = v.user_id AND LOWER(a.email) = LOWER(v.email)
+	WHERE v.token_hash = $1 AND v.used_at IS NULL AND v.expires_at > $2 FOR UPDATE OF v`, hashToken(token), now)
+
+	err = row.Scan(&id, &userID)
+	if err == pgx.ErrNoRows {
+		return errInvalidVerificationToken
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `UPDATE auth SET email_verified = true WHERE id = $1`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE email_verification SET used_at = $1 WHERE user_id = $2 AND used_at IS NULL`, now, userID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// This function emails a verification link to the user.
+func (api *API) sendVerificationEmail(email string, token string) {
+	sendMailAsync(api.mailer, Mail{
+		To:      email,
+		Subject: "Verify your Plant Daddy email",
+		Body: fmt.Sprintf("Welcome to Plant Daddy!\n\n"+
+			"Open this link to verify your email, it expires in %s:\n%s\n\n"+
+			"Until then you can only sign in with your username.\n",
+			api.emailVerificationTTL, api.appLink("verify-email", token)),
+	})
+}
+
+// HTTP Call to verify an email with the token from a verification link
+func (api *API) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		var request VerifyEmail
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&request)
+
+		if jsonDecoder(err, w) != nil {
+			return
+		}
+
+		err = verifyEmail(api.db, request.Token)
+		if errors.Is(err, errInvalidVerificationToken) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HTTP Call to send the authenticated user a new verification link
+func (api *API) resendVerification(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method == "POST" {
+		token, email, err := resendEmailVerification(api.db, currentUser(r).ID, api.emailVerificationTTL)
+		switch {
+		case errors.Is(err, errAlreadyVerified):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err == pgx.ErrNoRows:
+			http.Error(w, "Account does not have an email", http.StatusBadRequest)
+			return
+		case err != nil:
+			log.Printf("%s", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		api.sendVerificationEmail(email, token)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestVerifyEmailFromSignUp(t *testing.T) {
+	api, mailer := testAPI(t)
+	username := uniqueName(t, "verify")
+	email := username + "@example.com"
+	userID := createUser(t, api, username, "a password")
+
+	// Until the email is verified it cannot be used to log in
+	if _, err := LogIn(api.db, UserPass{Username: email, Password: "a password"}); err == nil {
+		t.Error("logged in with an unverified email")
+	}
+
+	token := waitForMail(t, mailer, email, "Verify")
+	w := doJSON(t, api.verifyEmail, "POST", "/api/email/verify", VerifyEmail{Token: token}, nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("verify: %d %s", w.Code, w.Body)
+	}
+	w = doJSON(t, api.verifyEmail, "POST", "/api/email/verify", VerifyEmail{Token: token}, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("reusing the verification link: got status %d", w.Code)
+	}
+
+	if user, err := LogIn(api.db, UserPass{Username: email, Password: "a password"}); err != nil || user.ID != userID {
+		t.Errorf("logging in with the verified email: %v", err)
+	}
+
+	user := AuthUser{ID: userID, Username: username}
+	w = doJSON(t, asUser(api, user, api.resendVerification), "POST", "/api/email/resend", nil, nil)
+	if w.Code != http.StatusConflict {
+		t.Errorf("resending to a verified email: got status %d", w.Code)
+	}
+}
+
+func TestVerificationLinkForOldEmail(t *testing.T) {
+	api, mailer := testAPI(t)
+	username := uniqueName(t, "moved")
+	email := username + "@example.com"
+	userID := createUser(t, api, username, "a password")
+	token := waitForMail(t, mailer, email, "Verify")
+
+	if _, err := api.db.Exec(context.Background(), `UPDATE auth SET email = $1 WHERE id = $2`, "new-"+email, userID); err != nil {
+		t.Fatal(err)
+	}
+	w := doJSON(t, api.verifyEmail, "POST", "/api/email/verify", VerifyEmail{Token: token}, nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a link sent to an old email", w.Code)
+	}
+}
+
+func TestSignUpRequiresAValidEmail(t *testing.T) {
+	// The request is turned down before the database is used.
+	api := &API{}
+	for _, email := range []string{"", "fern", "fern@", "@example.com", "fern example.com", "Fern <fern@example.com>"} {
+		w := doJSON(t, api.newUser, "POST", "/api/new-user", UserPass{Username: "fern", Password: "a password", Email: email}, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("email %q: got status %d, want %d", email, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestParseEmail(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		err   bool
+	}{
+		{"fern@example.com", "fern@example.com", false},
+		{" Fern@Example.com ", "Fern@Example.com", false},
+		{"fern+plants@example.com", "fern+plants@example.com", false},
+		{"Fern <fern@example.com>", "", true},
+		{"<fern@example.com>", "", true},
+		{"fern@example.com (Fern)", "", true},
+		{"\"fern\"@example.com", "", true},
+		{"fern@example.com, moss@example.com", "", true},
+		{"fern", "", true},
+		{"", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := parseEmail(test.input)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("%q: got %q %v, want %q", test.input, got, err, test.want)
+		}
+	}
+}
@@ -16,6 +16,21 @@ SET xmloption = content;
 SET client_min_messages = warning;
 SET row_security = off;
 
+--
+-- Name: audit_log_append_only(); Type: FUNCTION; Schema: public; Owner: plantdaddy
+--
+
+CREATE FUNCTION public.audit_log_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$;
+
+
+ALTER FUNCTION public.audit_log_append_only() OWNER TO plantdaddy;
+
 SET default_tablespace = '';
 
 SET default_table_access_method = heap;
@@ -28,7 +43,14 @@ CREATE TABLE public.auth (
     id integer NOT NULL,
     username character varying(50) NOT NULL,
     password text NOT NULL,
-    email character varying(100)
+    email character varying(100),
+    email_verified boolean DEFAULT false NOT NULL,
+    totp_secret text,
+    totp_enabled boolean DEFAULT false NOT NULL,
+    totp_last_step bigint,
+    delete_after timestamp without time zone,
+    time_zone text,
+    token_version integer DEFAULT 0 NOT NULL
 );
 
 
@@ -67,7 +89,12 @@ CREATE TABLE public.plant_data (
     humidity double precision,
     soil_moisture double precision,
     light double precision,
-    "time" timestamp without time zone
+    "time" timestamp without time zone,
+    idempotency_key text,
+    device_time timestamp without time zone,
+    session_id text,
+    usage_counter integer,
+    response jsonb
 );
 
 
@@ -104,7 +131,10 @@ CREATE TABLE public.registered_devices (
     device_id text NOT NULL,
     register_date date NOT NULL,
     user_id integer,
-    device_name text
+    device_name text,
+    device_secret text,
+    household_id integer,
+    time_zone text
 );
 
 
@@ -141,7 +171,8 @@ CREATE TABLE public.session (
     usage integer,
     usage_time timestamp without time zone,
     id integer NOT NULL,
-    device_id text
+    device_id text,
+    issued_at timestamp without time zone
 );
 
 
@@ -170,103 +201,1336 @@ ALTER SEQUENCE public.session_id_seq OWNED BY public.session.id;
 
 
 --
--- Name: auth id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+-- Name: refresh_token; Type: TABLE; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.auth ALTER COLUMN id SET DEFAULT nextval('public.auth_id_seq'::regclass);
+CREATE TABLE public.refresh_token (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    token_hash text NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    revoked_at timestamp without time zone,
+    user_agent text
+);
 
 
+ALTER TABLE public.refresh_token OWNER TO plantdaddy;
+
 --
--- Name: plant_data id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+-- Name: refresh_token_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.plant_data ALTER COLUMN id SET DEFAULT nextval('public.plant_data_id_seq'::regclass);
+CREATE SEQUENCE public.refresh_token_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
 
+ALTER TABLE public.refresh_token_id_seq OWNER TO plantdaddy;
 
 --
--- Name: registered_devices id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+-- Name: refresh_token_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.registered_devices ALTER COLUMN id SET DEFAULT nextval('public.registered_devices_id_seq'::regclass);
+ALTER SEQUENCE public.refresh_token_id_seq OWNED BY public.refresh_token.id;
 
 
 --
--- Name: session id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+-- Name: password_reset; Type: TABLE; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.session ALTER COLUMN id SET DEFAULT nextval('public.session_id_seq'::regclass);
+CREATE TABLE public.password_reset (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    token_hash text NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone
+);
 
 
+ALTER TABLE public.password_reset OWNER TO plantdaddy;
+
 --
--- Name: auth auth_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+-- Name: password_reset_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.auth
-    ADD CONSTRAINT auth_pkey PRIMARY KEY (id);
+CREATE SEQUENCE public.password_reset_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
 
 
+ALTER TABLE public.password_reset_id_seq OWNER TO plantdaddy;
+
 --
--- Name: plant_data plant_data_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+-- Name: password_reset_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.plant_data
-    ADD CONSTRAINT plant_data_pkey PRIMARY KEY (id);
+ALTER SEQUENCE public.password_reset_id_seq OWNED BY public.password_reset.id;
 
 
 --
--- Name: registered_devices registered_devices_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+-- Name: email_verification; Type: TABLE; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.registered_devices
-    ADD CONSTRAINT registered_devices_pkey PRIMARY KEY (device_id);
+CREATE TABLE public.email_verification (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    email character varying(100) NOT NULL,
+    token_hash text NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone
+);
+
 
+ALTER TABLE public.email_verification OWNER TO plantdaddy;
 
 --
--- Name: session session_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+-- Name: email_verification_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.session
-    ADD CONSTRAINT session_pkey PRIMARY KEY (id);
+CREATE SEQUENCE public.email_verification_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
 
+ALTER TABLE public.email_verification_id_seq OWNER TO plantdaddy;
 
 --
--- Name: session unique_device_id; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+-- Name: email_verification_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.session
-    ADD CONSTRAINT unique_device_id UNIQUE (device_id);
+ALTER SEQUENCE public.email_verification_id_seq OWNED BY public.email_verification.id;
 
 
 --
--- Name: auth user_unique; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+-- Name: login_attempt; Type: TABLE; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.auth
-    ADD CONSTRAINT user_unique UNIQUE (username);
+CREATE TABLE public.login_attempt (
+    key text NOT NULL,
+    failures integer NOT NULL,
+    last_failure timestamp without time zone NOT NULL,
+    locked_until timestamp without time zone
+);
+
 
+ALTER TABLE public.login_attempt OWNER TO plantdaddy;
 
 --
--- Name: session fk_device; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+-- Name: recovery_code; Type: TABLE; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.session
-    ADD CONSTRAINT fk_device FOREIGN KEY (device_id) REFERENCES public.registered_devices(device_id) ON DELETE CASCADE;
+CREATE TABLE public.recovery_code (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    code_hash text NOT NULL,
+    used_at timestamp without time zone
+);
+
 
+ALTER TABLE public.recovery_code OWNER TO plantdaddy;
 
 --
--- Name: plant_data fk_device; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+-- Name: recovery_code_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.plant_data
-    ADD CONSTRAINT fk_device FOREIGN KEY (device_id) REFERENCES public.registered_devices(device_id) ON DELETE CASCADE;
+CREATE SEQUENCE public.recovery_code_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
 
+ALTER TABLE public.recovery_code_id_seq OWNER TO plantdaddy;
 
 --
--- Name: registered_devices fk_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+-- Name: recovery_code_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
 --
 
-ALTER TABLE ONLY public.registered_devices
-    ADD CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+ALTER SEQUENCE public.recovery_code_id_seq OWNED BY public.recovery_code.id;
+
+
+--
+-- Name: household; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.household (
+    id integer NOT NULL,
+    name text NOT NULL,
+    created_by integer,
+    created_at timestamp without time zone NOT NULL
+);
+
+
+ALTER TABLE public.household OWNER TO plantdaddy;
+
+--
+-- Name: household_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
+--
+
+CREATE SEQUENCE public.household_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.household_id_seq OWNER TO plantdaddy;
+
+--
+-- Name: household_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
+--
+
+ALTER SEQUENCE public.household_id_seq OWNED BY public.household.id;
+
+
+--
+-- Name: household_member; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.household_member (
+    household_id integer NOT NULL,
+    user_id integer NOT NULL,
+    role text NOT NULL
+);
+
+
+ALTER TABLE public.household_member OWNER TO plantdaddy;
+
+--
+-- Name: household_invitation; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.household_invitation (
+    id integer NOT NULL,
+    household_id integer NOT NULL,
+    user_id integer NOT NULL,
+    role text NOT NULL,
+    invited_by integer,
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    accepted_at timestamp without time zone,
+    declined_at timestamp without time zone
+);
+
+
+ALTER TABLE public.household_invitation OWNER TO plantdaddy;
+
+--
+-- Name: household_invitation_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
+--
+
+CREATE SEQUENCE public.household_invitation_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.household_invitation_id_seq OWNER TO plantdaddy;
+
+--
+-- Name: household_invitation_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
+--
+
+ALTER SEQUENCE public.household_invitation_id_seq OWNED BY public.household_invitation.id;
+
+
+--
+-- Name: device_nonce; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.device_nonce (
+    device_id text NOT NULL,
+    nonce text NOT NULL,
+    expires_at timestamp without time zone NOT NULL
+);
+
+
+ALTER TABLE public.device_nonce OWNER TO plantdaddy;
+
+--
+-- Name: device_transfer; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.device_transfer (
+    id integer NOT NULL,
+    device_id text NOT NULL,
+    from_user_id integer NOT NULL,
+    to_user_id integer NOT NULL,
+    keep_history boolean DEFAULT false NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    accepted_at timestamp without time zone,
+    cancelled_at timestamp without time zone
+);
+
+
+ALTER TABLE public.device_transfer OWNER TO plantdaddy;
+
+--
+-- Name: device_transfer_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
+--
+
+CREATE SEQUENCE public.device_transfer_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.device_transfer_id_seq OWNER TO plantdaddy;
+
+--
+-- Name: device_transfer_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
+--
+
+ALTER SEQUENCE public.device_transfer_id_seq OWNED BY public.device_transfer.id;
+
+
+--
+-- Name: device_claim; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.device_claim (
+    id integer NOT NULL,
+    device_id text NOT NULL,
+    code_hash text NOT NULL,
+    source text NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone,
+    used_at timestamp without time zone
+);
+
+
+ALTER TABLE public.device_claim OWNER TO plantdaddy;
+
+--
+-- Name: device_claim_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
+--
+
+CREATE SEQUENCE public.device_claim_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.device_claim_id_seq OWNER TO plantdaddy;
+
+--
+-- Name: device_claim_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
+--
+
+ALTER SEQUENCE public.device_claim_id_seq OWNED BY public.device_claim.id;
+
+
+--
+-- Name: manufactured_device; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.manufactured_device (
+    device_id text NOT NULL,
+    batch text NOT NULL,
+    manufactured_at timestamp without time zone NOT NULL,
+    claim_code_hash text NOT NULL,
+    claimed_at timestamp without time zone
+);
+
+
+ALTER TABLE public.manufactured_device OWNER TO plantdaddy;
+
+--
+-- Name: api_key; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.api_key (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    name text NOT NULL,
+    prefix text NOT NULL,
+    key_hash text NOT NULL,
+    scopes text[] NOT NULL,
+    created_at timestamp without time zone NOT NULL,
+    last_used_at timestamp without time zone,
+    revoked_at timestamp without time zone
+);
+
+
+ALTER TABLE public.api_key OWNER TO plantdaddy;
+
+--
+-- Name: api_key_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
+--
+
+CREATE SEQUENCE public.api_key_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.api_key_id_seq OWNER TO plantdaddy;
+
+--
+-- Name: api_key_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
+--
+
+ALTER SEQUENCE public.api_key_id_seq OWNED BY public.api_key.id;
+
+
+--
+-- Name: audit_log; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.audit_log (
+    id integer NOT NULL,
+    user_id integer,
+    actor_id integer,
+    api_key_id integer,
+    action text NOT NULL,
+    device_id text,
+    ip text,
+    user_agent text,
+    before jsonb,
+    after jsonb,
+    created_at timestamp without time zone NOT NULL
+);
+
+
+ALTER TABLE public.audit_log OWNER TO plantdaddy;
+
+--
+-- Name: audit_log_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
+--
+
+CREATE SEQUENCE public.audit_log_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.audit_log_id_seq OWNER TO plantdaddy;
+
+--
+-- Name: audit_log_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
+--
+
+ALTER SEQUENCE public.audit_log_id_seq OWNED BY public.audit_log.id;
+
+
+--
+-- Name: external_identity; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.external_identity (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    provider text NOT NULL,
+    issuer text NOT NULL,
+    subject text NOT NULL,
+    email text,
+    created_at timestamp without time zone NOT NULL,
+    last_login_at timestamp without time zone
+);
+
+
+ALTER TABLE public.external_identity OWNER TO plantdaddy;
+
+--
+-- Name: external_identity_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
+--
+
+CREATE SEQUENCE public.external_identity_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.external_identity_id_seq OWNER TO plantdaddy;
+
+--
+-- Name: external_identity_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
+--
+
+ALTER SEQUENCE public.external_identity_id_seq OWNED BY public.external_identity.id;
+
+
+--
+-- Name: oidc_login; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.oidc_login (
+    id integer NOT NULL,
+    state_hash text NOT NULL,
+    provider text NOT NULL,
+    nonce text NOT NULL,
+    code_verifier text NOT NULL,
+    link_user_id integer,
+    app_challenge text NOT NULL,
+    claims jsonb,
+    exchange_hash text,
+    created_at timestamp without time zone NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone,
+    exchange_expires_at timestamp without time zone,
+    exchanged_at timestamp without time zone
+);
+
+
+ALTER TABLE public.oidc_login OWNER TO plantdaddy;
+
+--
+-- Name: oidc_login_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
+--
+
+CREATE SEQUENCE public.oidc_login_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.oidc_login_id_seq OWNER TO plantdaddy;
+
+--
+-- Name: oidc_login_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
+--
+
+ALTER SEQUENCE public.oidc_login_id_seq OWNED BY public.oidc_login.id;
+
+
+--
+-- Name: metric; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.metric (
+    id integer NOT NULL,
+    name text NOT NULL,
+    unit text DEFAULT ''::text NOT NULL,
+    value_type text DEFAULT 'float'::text NOT NULL,
+    min_value double precision,
+    max_value double precision,
+    description text,
+    legacy_column text
+);
+
+
+ALTER TABLE public.metric OWNER TO plantdaddy;
+
+--
+-- Name: metric_id_seq; Type: SEQUENCE; Schema: public; Owner: plantdaddy
+--
+
+CREATE SEQUENCE public.metric_id_seq
+    AS integer
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1;
+
+
+ALTER TABLE public.metric_id_seq OWNER TO plantdaddy;
+
+--
+-- Name: metric_id_seq; Type: SEQUENCE OWNED BY; Schema: public; Owner: plantdaddy
+--
+
+ALTER SEQUENCE public.metric_id_seq OWNED BY public.metric.id;
+
+
+--
+-- Name: plant_data_metric; Type: TABLE; Schema: public; Owner: plantdaddy
+--
+
+CREATE TABLE public.plant_data_metric (
+    plant_data_id integer NOT NULL,
+    metric_id integer NOT NULL,
+    value double precision NOT NULL
+);
+
+
+ALTER TABLE public.plant_data_metric OWNER TO plantdaddy;
+
+--
+-- Name: auth id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.auth ALTER COLUMN id SET DEFAULT nextval('public.auth_id_seq'::regclass);
+
+
+--
+-- Name: plant_data id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.plant_data ALTER COLUMN id SET DEFAULT nextval('public.plant_data_id_seq'::regclass);
+
+
+--
+-- Name: registered_devices id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.registered_devices ALTER COLUMN id SET DEFAULT nextval('public.registered_devices_id_seq'::regclass);
+
+
+--
+-- Name: session id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.session ALTER COLUMN id SET DEFAULT nextval('public.session_id_seq'::regclass);
+
+
+--
+-- Name: refresh_token id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.refresh_token ALTER COLUMN id SET DEFAULT nextval('public.refresh_token_id_seq'::regclass);
+
+
+--
+-- Name: password_reset id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.password_reset ALTER COLUMN id SET DEFAULT nextval('public.password_reset_id_seq'::regclass);
+
+
+--
+-- Name: email_verification id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.email_verification ALTER COLUMN id SET DEFAULT nextval('public.email_verification_id_seq'::regclass);
+
+
+--
+-- Name: recovery_code id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.recovery_code ALTER COLUMN id SET DEFAULT nextval('public.recovery_code_id_seq'::regclass);
+
+
+--
+-- Name: household id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household ALTER COLUMN id SET DEFAULT nextval('public.household_id_seq'::regclass);
+
+
+--
+-- Name: household_invitation id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household_invitation ALTER COLUMN id SET DEFAULT nextval('public.household_invitation_id_seq'::regclass);
+
+
+--
+-- Name: device_transfer id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.device_transfer ALTER COLUMN id SET DEFAULT nextval('public.device_transfer_id_seq'::regclass);
+
+
+--
+-- Name: device_claim id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.device_claim ALTER COLUMN id SET DEFAULT nextval('public.device_claim_id_seq'::regclass);
+
+
+--
+-- Name: api_key id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.api_key ALTER COLUMN id SET DEFAULT nextval('public.api_key_id_seq'::regclass);
+
+
+--
+-- Name: audit_log id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.audit_log ALTER COLUMN id SET DEFAULT nextval('public.audit_log_id_seq'::regclass);
+
+
+--
+-- Name: external_identity id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.external_identity ALTER COLUMN id SET DEFAULT nextval('public.external_identity_id_seq'::regclass);
+
+
+--
+-- Name: oidc_login id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.oidc_login ALTER COLUMN id SET DEFAULT nextval('public.oidc_login_id_seq'::regclass);
+
+
+--
+-- Name: metric id; Type: DEFAULT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.metric ALTER COLUMN id SET DEFAULT nextval('public.metric_id_seq'::regclass);
+
+
+--
+-- Data for Name: metric; Type: TABLE DATA; Schema: public; Owner: plantdaddy
+--
+
+COPY public.metric (id, name, unit, value_type, min_value, max_value, description, legacy_column) FROM stdin;
+1	temperature	°C	float	-50	100	Air temperature	temperature
+2	humidity	%	float	0	100	Relative humidity of the air	humidity
+3	soilMoisture	%	float	0	100	Soil moisture between the dry and wet calibration of the probe	soil_moisture
+4	light	%	float	0	100	Light level	light
+\.
+
+
+--
+-- Name: metric_id_seq; Type: SEQUENCE SET; Schema: public; Owner: plantdaddy
+--
+
+SELECT pg_catalog.setval('public.metric_id_seq', 4, true);
+
+
+--
+-- Name: auth auth_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.auth
+    ADD CONSTRAINT auth_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: plant_data plant_data_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.plant_data
+    ADD CONSTRAINT plant_data_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: registered_devices registered_devices_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.registered_devices
+    ADD CONSTRAINT registered_devices_pkey PRIMARY KEY (device_id);
+
+
+--
+-- Name: session session_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.session
+    ADD CONSTRAINT session_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: session unique_device_id; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.session
+    ADD CONSTRAINT unique_device_id UNIQUE (device_id);
+
+
+--
+-- Name: auth user_unique; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.auth
+    ADD CONSTRAINT user_unique UNIQUE (username);
+
+
+--
+-- Name: refresh_token refresh_token_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.refresh_token
+    ADD CONSTRAINT refresh_token_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: refresh_token unique_token_hash; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.refresh_token
+    ADD CONSTRAINT unique_token_hash UNIQUE (token_hash);
+
+
+--
+-- Name: refresh_token_user_id_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX refresh_token_user_id_idx ON public.refresh_token USING btree (user_id);
+
+
+--
+-- Name: password_reset password_reset_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.password_reset
+    ADD CONSTRAINT password_reset_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: password_reset unique_reset_token_hash; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.password_reset
+    ADD CONSTRAINT unique_reset_token_hash UNIQUE (token_hash);
+
+
+--
+-- Name: auth_email_lower_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE UNIQUE INDEX auth_email_lower_idx ON public.auth USING btree (lower((email)::text));
+
+
+--
+-- Name: email_verification email_verification_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.email_verification
+    ADD CONSTRAINT email_verification_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: email_verification unique_verification_token_hash; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.email_verification
+    ADD CONSTRAINT unique_verification_token_hash UNIQUE (token_hash);
+
+
+--
+-- Name: login_attempt login_attempt_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.login_attempt
+    ADD CONSTRAINT login_attempt_pkey PRIMARY KEY (key);
+
+
+--
+-- Name: recovery_code recovery_code_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.recovery_code
+    ADD CONSTRAINT recovery_code_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: recovery_code unique_user_code_hash; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.recovery_code
+    ADD CONSTRAINT unique_user_code_hash UNIQUE (user_id, code_hash);
+
+
+--
+-- Name: household household_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household
+    ADD CONSTRAINT household_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: household_member household_member_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household_member
+    ADD CONSTRAINT household_member_pkey PRIMARY KEY (household_id, user_id);
+
+
+--
+-- Name: household_member valid_member_role; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household_member
+    ADD CONSTRAINT valid_member_role CHECK (role = ANY (ARRAY['viewer'::text, 'caretaker'::text, 'owner'::text]));
+
+
+--
+-- Name: household_member_user_id_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX household_member_user_id_idx ON public.household_member USING btree (user_id);
+
+
+--
+-- Name: household_invitation household_invitation_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household_invitation
+    ADD CONSTRAINT household_invitation_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: household_invitation valid_invitation_role; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household_invitation
+    ADD CONSTRAINT valid_invitation_role CHECK (role = ANY (ARRAY['viewer'::text, 'caretaker'::text, 'owner'::text]));
+
+
+--
+-- Name: device_nonce device_nonce_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.device_nonce
+    ADD CONSTRAINT device_nonce_pkey PRIMARY KEY (device_id, nonce);
+
+
+--
+-- Name: device_nonce_expires_at_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX device_nonce_expires_at_idx ON public.device_nonce USING btree (expires_at);
+
+
+--
+-- Name: device_transfer device_transfer_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.device_transfer
+    ADD CONSTRAINT device_transfer_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: device_claim device_claim_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.device_claim
+    ADD CONSTRAINT device_claim_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: device_claim_device_id_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX device_claim_device_id_idx ON public.device_claim USING btree (device_id);
+
+
+--
+-- Name: manufactured_device manufactured_device_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.manufactured_device
+    ADD CONSTRAINT manufactured_device_pkey PRIMARY KEY (device_id);
+
+
+--
+-- Name: manufactured_device_batch_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX manufactured_device_batch_idx ON public.manufactured_device USING btree (batch);
+
+
+--
+-- Name: api_key api_key_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.api_key
+    ADD CONSTRAINT api_key_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: api_key api_key_prefix_key; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.api_key
+    ADD CONSTRAINT api_key_prefix_key UNIQUE (prefix);
+
+
+--
+-- Name: api_key api_key_key_hash_key; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.api_key
+    ADD CONSTRAINT api_key_key_hash_key UNIQUE (key_hash);
+
+
+--
+-- Name: audit_log audit_log_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.audit_log
+    ADD CONSTRAINT audit_log_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: audit_log_user_id_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX audit_log_user_id_idx ON public.audit_log USING btree (user_id, id);
+
+
+--
+-- Name: audit_log_actor_id_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX audit_log_actor_id_idx ON public.audit_log USING btree (actor_id, id);
+
+
+--
+-- Name: external_identity external_identity_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.external_identity
+    ADD CONSTRAINT external_identity_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: external_identity unique_issuer_subject; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.external_identity
+    ADD CONSTRAINT unique_issuer_subject UNIQUE (issuer, subject);
+
+
+--
+-- Name: external_identity_user_id_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX external_identity_user_id_idx ON public.external_identity USING btree (user_id);
+
+
+--
+-- Name: oidc_login oidc_login_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.oidc_login
+    ADD CONSTRAINT oidc_login_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: oidc_login unique_state_hash; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.oidc_login
+    ADD CONSTRAINT unique_state_hash UNIQUE (state_hash);
+
+
+--
+-- Name: oidc_login unique_exchange_hash; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.oidc_login
+    ADD CONSTRAINT unique_exchange_hash UNIQUE (exchange_hash);
+
+
+--
+-- Name: auth_delete_after_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX auth_delete_after_idx ON public.auth USING btree (delete_after) WHERE (delete_after IS NOT NULL);
+
+
+--
+-- Name: plant_data_device_id_time_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX plant_data_device_id_time_idx ON public.plant_data USING btree (device_id, "time", id);
+
+
+--
+-- Name: plant_data unique_device_idempotency_key; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.plant_data
+    ADD CONSTRAINT unique_device_idempotency_key UNIQUE (device_id, idempotency_key);
+
+
+--
+-- Name: metric metric_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.metric
+    ADD CONSTRAINT metric_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: metric unique_metric_name; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.metric
+    ADD CONSTRAINT unique_metric_name UNIQUE (name);
+
+
+--
+-- Name: metric metric_value_type_check; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.metric
+    ADD CONSTRAINT metric_value_type_check CHECK (value_type = ANY (ARRAY['float'::text, 'integer'::text]));
+
+
+--
+-- Name: plant_data_metric plant_data_metric_pkey; Type: CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.plant_data_metric
+    ADD CONSTRAINT plant_data_metric_pkey PRIMARY KEY (plant_data_id, metric_id);
+
+
+--
+-- Name: plant_data_metric_metric_id_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE INDEX plant_data_metric_metric_id_idx ON public.plant_data_metric USING btree (metric_id);
+
+
+--
+-- Name: household_invitation_pending_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE UNIQUE INDEX household_invitation_pending_idx ON public.household_invitation USING btree (household_id, user_id) WHERE ((accepted_at IS NULL) AND (declined_at IS NULL));
+
+
+--
+-- Name: plant_data_device_time_idx; Type: INDEX; Schema: public; Owner: plantdaddy
+--
+
+CREATE UNIQUE INDEX plant_data_device_time_idx ON public.plant_data USING btree (device_id, device_time) WHERE (device_time IS NOT NULL);
+
+
+--
+-- Name: audit_log audit_log_append_only; Type: TRIGGER; Schema: public; Owner: plantdaddy
+--
+
+CREATE TRIGGER audit_log_append_only BEFORE DELETE OR UPDATE ON public.audit_log FOR EACH ROW EXECUTE FUNCTION public.audit_log_append_only();
+
+
+--
+-- Name: audit_log audit_log_no_truncate; Type: TRIGGER; Schema: public; Owner: plantdaddy
+--
+
+CREATE TRIGGER audit_log_no_truncate BEFORE TRUNCATE ON public.audit_log FOR EACH STATEMENT EXECUTE FUNCTION public.audit_log_append_only();
+
+
+--
+-- Name: session fk_device; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.session
+    ADD CONSTRAINT fk_device FOREIGN KEY (device_id) REFERENCES public.registered_devices(device_id) ON DELETE CASCADE;
+
+
+--
+-- Name: plant_data fk_device; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.plant_data
+    ADD CONSTRAINT fk_device FOREIGN KEY (device_id) REFERENCES public.registered_devices(device_id) ON DELETE CASCADE;
+
+
+--
+-- Name: registered_devices fk_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.registered_devices
+    ADD CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: refresh_token fk_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.refresh_token
+    ADD CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: password_reset fk_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.password_reset
+    ADD CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: email_verification fk_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.email_verification
+    ADD CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: recovery_code fk_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.recovery_code
+    ADD CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: household fk_created_by; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household
+    ADD CONSTRAINT fk_created_by FOREIGN KEY (created_by) REFERENCES public.auth(id) ON DELETE SET NULL;
+
+
+--
+-- Name: household_member fk_household; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household_member
+    ADD CONSTRAINT fk_household FOREIGN KEY (household_id) REFERENCES public.household(id) ON DELETE CASCADE;
+
+
+--
+-- Name: household_member fk_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household_member
+    ADD CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: household_invitation fk_household; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household_invitation
+    ADD CONSTRAINT fk_household FOREIGN KEY (household_id) REFERENCES public.household(id) ON DELETE CASCADE;
+
+
+--
+-- Name: household_invitation fk_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household_invitation
+    ADD CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: household_invitation fk_invited_by; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.household_invitation
+    ADD CONSTRAINT fk_invited_by FOREIGN KEY (invited_by) REFERENCES public.auth(id) ON DELETE SET NULL;
+
+
+--
+-- Name: registered_devices fk_household; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.registered_devices
+    ADD CONSTRAINT fk_household FOREIGN KEY (household_id) REFERENCES public.household(id) ON DELETE SET NULL;
+
+
+--
+-- Name: device_nonce fk_device; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.device_nonce
+    ADD CONSTRAINT fk_device FOREIGN KEY (device_id) REFERENCES public.registered_devices(device_id) ON DELETE CASCADE;
+
+
+--
+-- Name: device_transfer fk_device; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.device_transfer
+    ADD CONSTRAINT fk_device FOREIGN KEY (device_id) REFERENCES public.registered_devices(device_id) ON DELETE CASCADE;
+
+
+--
+-- Name: device_transfer fk_from_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.device_transfer
+    ADD CONSTRAINT fk_from_user FOREIGN KEY (from_user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: device_transfer fk_to_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.device_transfer
+    ADD CONSTRAINT fk_to_user FOREIGN KEY (to_user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: device_claim fk_device; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.device_claim
+    ADD CONSTRAINT fk_device FOREIGN KEY (device_id) REFERENCES public.registered_devices(device_id) ON DELETE CASCADE;
+
+
+--
+-- Name: api_key fk_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.api_key
+    ADD CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: external_identity fk_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.external_identity
+    ADD CONSTRAINT fk_user FOREIGN KEY (user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: oidc_login fk_link_user; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.oidc_login
+    ADD CONSTRAINT fk_link_user FOREIGN KEY (link_user_id) REFERENCES public.auth(id) ON DELETE CASCADE;
+
+
+--
+-- Name: plant_data_metric fk_plant_data; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.plant_data_metric
+    ADD CONSTRAINT fk_plant_data FOREIGN KEY (plant_data_id) REFERENCES public.plant_data(id) ON DELETE CASCADE;
+
+
+--
+-- Name: plant_data_metric fk_metric; Type: FK CONSTRAINT; Schema: public; Owner: plantdaddy
+--
+
+ALTER TABLE ONLY public.plant_data_metric
+    ADD CONSTRAINT fk_metric FOREIGN KEY (metric_id) REFERENCES public.metric(id);
 
 
 --
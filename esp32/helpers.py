@@ -1,5 +1,10 @@
 import ujson
 import utime
+import uhashlib
+import ubinascii
+
+# MicroPython on the esp32 counts seconds from 2000-01-01 instead of 1970-01-01
+EPOCH_OFFSET = 946684800 if utime.gmtime(0)[0] == 2000 else 0
 
 def get_configs():
     """Gets the configurations for the module.
@@ -32,3 +37,48 @@ def do_connect(ssid: str, password: str) -> bool:
     print('network config:', sta_if.ifconfig())
     return True
 
+
+
+def sync_time():
+    """
+    Sets the clock from NTP so that signed requests carry the right time.
+    """
+    import ntptime
+    try:
+        ntptime.settime()
+    except OSError as e:
+        print("Could not sync time", e)
+
+
+def unix_time() -> int:
+    """
+    Returns the current unix time in seconds.
+    """
+    return utime.time() + EPOCH_OFFSET
+
+
+def iso_time() -> str:
+    """
+    Returns the current UTC time formatted as RFC 3339.
+    """
+    t = utime.gmtime()
+    return "{:04d}-{:02d}-{:02d}T{:02d}:{:02d}:{:02d}Z".format(t[0], t[1], t[2], t[3], t[4], t[5])
+
+
+def hmac_sha256(key: str, msg: bytes) -> str:
+    """
+    Signs the message with the key and returns the hex encoded HMAC-SHA256.
+
+    Args:
+        key (str): The device secret.
+        msg (bytes): The request body.
+    """
+    block_size = 64
+    key = key.encode("utf-8")
+    if len(key) > block_size:
+        key = uhashlib.sha256(key).digest()
+    key = key + b"\x00" * (block_size - len(key))
+    outer = bytes(b ^ 0x5C for b in key)
+    inner = bytes(b ^ 0x36 for b in key)
+    inner_hash = uhashlib.sha256(inner + msg).digest()
+    return ubinascii.hexlify(uhashlib.sha256(outer + inner_hash).digest()).decode()
@@ -2,15 +2,23 @@
 ### This is the script to run the majority of the microcontrollers code. This
 ### It has three components: The dht, light and moisture sensor parts.
 
-from helpers import get_configs
+from helpers import get_configs, hmac_sha256, iso_time, sync_time, unix_time
 import machine
 from machine import ADC, Pin
 import dht
 import time
 import urequests
 import ujson
+import ubinascii
+import uos
 
 MS_TO_SECS = 1000
+# Readings that could not be sent are kept here and sent together once the server can be reached
+PENDING_FILE = "pending.json"
+# The most readings the server takes in one batch, a day of readings
+MAX_BATCH = 144
+# The readings kept while offline, one less than a batch so the next reading still fits
+MAX_PENDING = MAX_BATCH - 1
 
 CONFIGURATIONS = get_configs()
 
@@ -89,15 +97,38 @@ def get_session_id():
 	device_id = CONFIGURATIONS.get("deviceID")
 	url:str = CONFIGURATIONS.get("url")
 
-	device_obj = ujson.dumps({"deviceID": device_id})
+	nonce = ubinascii.hexlify(uos.urandom(16)).decode()
+	device_obj = ujson.dumps({"deviceID": device_id, "timestamp": unix_time(), "nonce": nonce})
 	res = post_data("/auth-device", device_obj)
 	for key, val in res.json().items():
 		CONFIGURATIONS[key] = val
 	write_to_config()
 
+def factory_reset() -> str:
+	"""
+	Asks the server for the code the next owner claims the probe with, then forgets
+	the wifi, session and secret of the current owner.
+
+	Returns:
+		str: The claim code to show to the next owner.
+	"""
+	global CONFIGURATIONS
+
+	nonce = ubinascii.hexlify(uos.urandom(16)).decode()
+	device_obj = ujson.dumps({"deviceID": CONFIGURATIONS.get("deviceID"), "timestamp": unix_time(), "nonce": nonce})
+	res = post_data("/reset-device", device_obj)
+	if res.status_code != 200:
+		raise OSError("reset failed with status {}".format(res.status_code))
+	code = res.json().get("claimCode")
+
+	for key in ("ssid", "password", "sessionID", "usageCounter", "timestamp", "deviceSecret"):
+		CONFIGURATIONS.pop(key, None)
+	write_to_config()
+	return code
+
 def post_data(path: str, data: str) -> urequests.Response:
 	"""
-	Encloses the data for simple post requests.
+	Encloses the data for simple post requests. The body is signed with the device secret.
 
 	Args:
 		path (str): The path to the data.
@@ -108,14 +139,44 @@ def post_data(path: str, data: str) -> urequests.Response:
 	"""
 	global CONFIGURATIONS
 	url = CONFIGURATIONS.get("url")
+	signature = hmac_sha256(CONFIGURATIONS.get("deviceSecret"), data.encode("utf-8"))
 	res = urequests.post(url + path, 
-	headers={'content-type':'application/json'},
+	headers={'content-type':'application/json', 'x-signature': signature},
 	data=data)
 	return res
 
 
+def load_pending() -> list:
+	"""
+	Returns the readings that have not been sent yet, oldest first.
+	"""
+	try:
+		with open(PENDING_FILE) as f:
+			return ujson.load(f)[-MAX_PENDING:]
+	except (OSError, ValueError):
+		return []
+
+
+def save_pending(readings: list):
+	"""
+	Keeps the readings that could not be sent, dropping the oldest once there are too many.
+
+	Args:
+		readings (list): The readings to send later.
+	"""
+	if not readings:
+		try:
+			uos.remove(PENDING_FILE)
+		except OSError:
+			pass
+		return
+	with open(PENDING_FILE, "w") as f:
+		ujson.dump(readings[-MAX_PENDING:], f)
+
+
 def send_plant_data(temperature: int, humidity: int, soil_moisture: float, light: int):
-	"""Send the plant data to the server
+	"""Send the plant data to the server. If earlier readings could not be sent they are
+	sent along with this one, and if this one cannot be sent it is kept for next time.
 
 	Args:
 		temperature (int)
@@ -124,24 +185,57 @@ def send_plant_data(temperature: int, humidity: int, soil_moisture: float, light
 		light (int)
 	"""
 	global CONFIGURATIONS
-	url = CONFIGURATIONS.get("url")
-	session_id = CONFIGURATIONS.get("sessionID")
-	usage_counter = CONFIGURATIONS.get("usageCounter")
-	timestamp = CONFIGURATIONS.get("timestamp")
 	device_id = CONFIGURATIONS.get("deviceID")
-	data = {"sessionID":session_id,
-	"usageCounter":usage_counter,
-	"timestamp": timestamp,
+
+	# The key lets the server recognise the reading if it is sent again after a timeout
+	reading = {"timestamp": iso_time(),
+	"idempotencyKey": ubinascii.hexlify(uos.urandom(16)).decode(),
 	"temperature":temperature,
 	"humidity":humidity,
 	"soilMoisture":soil_moisture,
-	"light":light, 
-	"deviceID": device_id}
-
-	json_data = ujson.dumps(data)
+	"light":light}
+	pending = load_pending()
+
+	def post_reading():
+		data = {"sessionID":CONFIGURATIONS.get("sessionID"),
+		"usageCounter":CONFIGURATIONS.get("usageCounter"),
+		"timestamp": iso_time(),
+		"deviceID": device_id}
+		if pending:
+			data["readings"] = pending + [reading]
+			return post_data("/new-data/batch", ujson.dumps(data))
+		data.update(reading)
+		return post_data("/new-data", ujson.dumps(data))
 
-	res = post_data("/new-data", json_data)
-	for key, value in res.json().items():
+	try:
+		res = post_reading()
+		# The session has expired or is out of sync, log in again and retry once
+		if res.status_code == 401:
+			get_session_id()
+			res = post_reading()
+		# The server takes fewer readings at once than are pending, drop the oldest half and try again
+		while res.status_code == 413 and pending:
+			pending = pending[(len(pending) + 1) // 2:]
+			res = post_reading()
+	except OSError as e:
+		print("Could not reach the server, keeping the reading", e)
+		save_pending(pending + [reading])
+		return
+	if res.status_code != 200:
+		print("Could not send plant data", res.status_code, res.text)
+		# Server errors, rate limits and sessions that could not be renewed may pass,
+		# anything else would be refused again so the readings are dropped
+		if res.status_code >= 500 or res.status_code in (401, 429):
+			save_pending(pending + [reading])
+		else:
+			save_pending([])
+		return
+
+	# Every reading of a batch has been stored, refused or found to be a duplicate
+	save_pending([])
+	body = res.json()
+	for key in ("sessionID", "usageCounter", "timestamp"):
+		value = body.get(key)
 		if key == "sessionID" and value == "":
 			CONFIGURATIONS.pop("ssid")
 			CONFIGURATIONS.pop("password")
@@ -157,6 +251,7 @@ def main():
 
 	# Assume it is not none
 	global CONFIGURATIONS
+	sync_time()
 	sessionID = CONFIGURATIONS.get("sessionID")
 
 	# If is is none now we send our request to get one.
@@ -1,4 +1,4 @@
-from main import write_to_config, CONFIGURATIONS
+from main import write_to_config, factory_reset, sync_time, CONFIGURATIONS
 import ubluetooth as bluetooth
 from micropython import const
 import utime as time
@@ -139,7 +139,7 @@ class BlePeripheral:
             # Start advertising again to allow a new connection.
 			self._advertise()
 		elif event == _IRQ_GATTS_WRITE:
-			# Sample format ssid=name&password=123456789
+			# Sample format {"ssid": "name", "password": "123456789", "deviceSecret": "..."}
 			conn_handle, value_handle = data
 			value = self._ble.gatts_read(value_handle)
 			data = value.decode("utf-8")
@@ -154,6 +154,9 @@ class BlePeripheral:
 		else:
 			# Try to connect to the wifi
 			self.data = ""
+			if writeable_data.get("command") == "factory-reset":
+				self.reset_device()
+				return
 			if "ssid" not in writeable_data or "password" not in writeable_data:
 				return
 			try:
@@ -164,6 +167,10 @@ class BlePeripheral:
 					self.send(yes)
 					CONFIGURATIONS["ssid"] = writeable_data.get("ssid")
 					CONFIGURATIONS["password"] = writeable_data.get("password")
+					if "deviceSecret" in writeable_data:
+						CONFIGURATIONS["deviceSecret"] = writeable_data.get("deviceSecret")
+						# A new secret invalidates the old session
+						CONFIGURATIONS.pop("sessionID", None)
 					write_to_config()
 					machine.reset()
 				else:
@@ -175,6 +182,21 @@ class BlePeripheral:
 				print(os)
 				self.send(os)
 			
+	def reset_device(self):
+		"""
+		Factory resets the probe and sends the claim code for the next owner back over bluetooth.
+		"""
+		try:
+			if not do_connect(CONFIGURATIONS.get("ssid"), CONFIGURATIONS.get("password")):
+				self.send("NO CONNECT".encode("utf-8"))
+				return
+			sync_time()
+			code = factory_reset()
+			self.send("CLAIM {}".format(code).encode("utf-8"))
+		except OSError as e:
+			print(e)
+			self.send("OS ERROR".encode("utf-8"))
+
 	def is_connected(self):
 		return len(self._connections) > 0
 